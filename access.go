@@ -0,0 +1,112 @@
+package cavee
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyAccess counts the reads and writes made to a key through the API. It
+// is part of the response of the meta endpoint when -access-counters is set.
+type KeyAccess struct {
+	Reads         uint64     `json:"reads"`
+	Writes        uint64     `json:"writes"`
+	LastReadAt    *time.Time `json:"last_read_at,omitempty"`
+	LastWrittenAt *time.Time `json:"last_written_at,omitempty"`
+	// Since is when counting started: when the server started, or when
+	// the store was last restored from a snapshot.
+	Since time.Time `json:"since"`
+}
+
+type accessKey struct {
+	namespace string
+	key       string
+}
+
+// accessCounters keeps a KeyAccess for each key read or written since
+// counting started. The counters are held in memory only, so a key with none
+// has not been used since then rather than never. Deleting a key drops its
+// counters.
+type accessCounters struct {
+	sync.Mutex
+	since time.Time
+	keys  map[accessKey]*KeyAccess
+}
+
+func newAccessCounters() *accessCounters {
+	return &accessCounters{since: time.Now().UTC(), keys: make(map[accessKey]*KeyAccess)}
+}
+
+// counter returns the counters of a key, adding them if needed. The caller
+// must hold the lock.
+func (c *accessCounters) counter(ns, key string) *KeyAccess {
+	k := accessKey{namespace: ns, key: key}
+	a, ok := c.keys[k]
+	if !ok {
+		a = &KeyAccess{Since: c.since}
+		c.keys[k] = a
+	}
+
+	return a
+}
+
+func (c *accessCounters) read(ns, key string, at time.Time) {
+	at = at.UTC()
+
+	c.Lock()
+	defer c.Unlock()
+
+	a := c.counter(ns, key)
+	a.Reads++
+	a.LastReadAt = &at
+}
+
+func (c *accessCounters) write(ns, key string, at time.Time) {
+	at = at.UTC()
+
+	c.Lock()
+	defer c.Unlock()
+
+	a := c.counter(ns, key)
+	a.Writes++
+	a.LastWrittenAt = &at
+}
+
+func (c *accessCounters) forget(ns, key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.keys, accessKey{namespace: ns, key: key})
+}
+
+func (c *accessCounters) forgetNamespace(ns string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k := range c.keys {
+		if k.namespace == ns {
+			delete(c.keys, k)
+		}
+	}
+}
+
+// reset drops every counter and starts counting afresh.
+func (c *accessCounters) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.since = time.Now().UTC()
+	clear(c.keys)
+}
+
+// get returns a copy of the counters of a key, which are zero if it has not
+// been used since counting started.
+func (c *accessCounters) get(ns, key string) KeyAccess {
+	c.Lock()
+	defer c.Unlock()
+
+	if a, ok := c.keys[accessKey{namespace: ns, key: key}]; ok {
+		return *a
+	}
+
+	return KeyAccess{Since: c.since}
+}
@@ -0,0 +1,186 @@
+package cavee
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable identifier sent in the "code" field of
+// every error response. Clients should branch on the code rather than on the
+// human-readable message, which may change between releases.
+type ErrorCode string
+
+const (
+	// ErrorCodeNoSuchKey is returned with 404 when the requested key does
+	// not exist in the store.
+	ErrorCodeNoSuchKey ErrorCode = "no_such_key"
+	// ErrorCodeNoSuchNamespace is returned with 404 when the namespace in
+	// the request path has not been created.
+	ErrorCodeNoSuchNamespace ErrorCode = "no_such_namespace"
+	// ErrorCodeNamespaceExists is returned with 409 when creating a
+	// namespace that already exists.
+	ErrorCodeNamespaceExists ErrorCode = "namespace_exists"
+	// ErrorCodeNoSuchVersion is returned with 404 when the requested version
+	// of a key is not, or no longer, held by the store.
+	ErrorCodeNoSuchVersion ErrorCode = "no_such_version"
+	// ErrorCodeSnapshotTooOld is returned with 410 for reads as of a
+	// sequence whose values may no longer be held.
+	ErrorCodeSnapshotTooOld ErrorCode = "snapshot_too_old"
+	// ErrorCodeHistoryUnavailable is returned with 410 for watches resuming
+	// from a sequence whose events the transaction log no longer holds.
+	ErrorCodeHistoryUnavailable ErrorCode = "history_unavailable"
+	// ErrorCodeNoSuchSession is returned with 404 for a transaction session
+	// that has been committed, aborted or dropped for being idle.
+	ErrorCodeNoSuchSession ErrorCode = "no_such_session"
+	// ErrorCodeSessionConflict is returned with 409 when a key a transaction
+	// session read has changed since, so the session cannot commit.
+	ErrorCodeSessionConflict ErrorCode = "session_conflict"
+	// ErrorCodeLockHeld is returned with 409 when taking a lock somebody
+	// else holds.
+	ErrorCodeLockHeld ErrorCode = "lock_held"
+	// ErrorCodeLockNotHeld is returned with 409 when renewing or releasing a
+	// lock with a fencing token that is not the current holder's.
+	ErrorCodeLockNotHeld ErrorCode = "lock_not_held"
+	// ErrorCodeNoSuchLock is returned with 404 for a lock nobody holds.
+	ErrorCodeNoSuchLock ErrorCode = "no_such_lock"
+	// ErrorCodeKeyExists is returned with 409 when a PUT with
+	// If-None-Match: * finds the key already set.
+	ErrorCodeKeyExists ErrorCode = "key_exists"
+	// ErrorCodePreconditionFailed is returned with 412 when a conditional
+	// write names a revision the key no longer has.
+	ErrorCodePreconditionFailed ErrorCode = "precondition_failed"
+	// ErrorCodeValueTooLarge is returned with 413 when a request body is
+	// larger than -max-value-size.
+	ErrorCodeValueTooLarge ErrorCode = "value_too_large"
+	// ErrorCodeKeyTooLong is returned with 414 when a key is longer than
+	// -max-key-length.
+	ErrorCodeKeyTooLong ErrorCode = "key_too_long"
+	// ErrorCodeRateLimited is returned with 429, along with Retry-After,
+	// when a client has used up its request rate.
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// ErrorCodeInvalidRequest is returned with 400 when the request body or
+	// parameters are malformed or fail validation.
+	ErrorCodeInvalidRequest ErrorCode = "invalid_request"
+	// ErrorCodeNoSuchPath is returned with 404 when a JSON path does not
+	// address a fragment of the key's document.
+	ErrorCodeNoSuchPath ErrorCode = "no_such_path"
+	// ErrorCodeNotJSON is returned with 422 when a JSON path is used on a
+	// key whose value is not a JSON document.
+	ErrorCodeNotJSON ErrorCode = "not_json"
+	// ErrorCodeWrongType is returned with 422 when an operation of a data
+	// type, such as a set, is used on a key holding a value of another.
+	ErrorCodeWrongType ErrorCode = "wrong_type"
+	// ErrorCodeNoSuchMember is returned with 404 when a set does not hold
+	// the member asked for.
+	ErrorCodeNoSuchMember ErrorCode = "no_such_member"
+	// ErrorCodeNoSuchField is returned with 404 when a hash does not hold
+	// the field asked for.
+	ErrorCodeNoSuchField ErrorCode = "no_such_field"
+	// ErrorCodeNoSuchScript is returned with 404 when running a script
+	// that is not in -scripts-dir.
+	ErrorCodeNoSuchScript ErrorCode = "no_such_script"
+	// ErrorCodeScriptFailed is returned with 422 when a script raises an
+	// error, calls fail or runs for too long. Nothing it wrote is kept.
+	ErrorCodeScriptFailed ErrorCode = "script_failed"
+	// ErrorCodeValueRejected is returned with 422 when a value transform
+	// rejects the value written or read.
+	ErrorCodeValueRejected ErrorCode = "value_rejected"
+	// ErrorCodeSchemaViolation is returned with 422 when a value written
+	// does not match the JSON Schema of its namespace. The response lists
+	// the violations.
+	ErrorCodeSchemaViolation ErrorCode = "schema_violation"
+	// ErrorCodeNoSchema is returned with 404 when the schema of a namespace
+	// without one is asked for.
+	ErrorCodeNoSchema ErrorCode = "no_schema"
+	// ErrorCodeWriteOnce is returned with 409 when a write would change or
+	// delete a write-once key before its retention has passed.
+	ErrorCodeWriteOnce ErrorCode = "write_once"
+	// ErrorCodeQuotaExceeded is returned when a write would take its
+	// namespace over its quota: with 429 for the key limit and with 507 for
+	// the byte limit.
+	ErrorCodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// ErrorCodeNotEncrypted is returned with 404 when the data keys of a
+	// namespace whose values are not encrypted are asked for.
+	ErrorCodeNotEncrypted ErrorCode = "not_encrypted"
+	// ErrorCodeUnsupportedMediaType is returned with 415 when a request body
+	// is not of a media type the endpoint accepts.
+	ErrorCodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	// ErrorCodeUnknownClient is returned with 400 when a read names a
+	// tracking client ID that is not connected to the watch stream.
+	ErrorCodeUnknownClient ErrorCode = "unknown_client"
+	// ErrorCodeUnauthenticated is returned with 401 when authentication is
+	// enabled and the request has no valid credentials.
+	ErrorCodeUnauthenticated ErrorCode = "unauthenticated"
+	// ErrorCodePermissionDenied is returned with 403 when the caller is
+	// authenticated but lacks the permission the request needs.
+	ErrorCodePermissionDenied ErrorCode = "permission_denied"
+	// ErrorCodeProposalPending is returned with 409 when a cluster config
+	// change is proposed while another one is still pending.
+	ErrorCodeProposalPending ErrorCode = "proposal_pending"
+	// ErrorCodeNoSuchProposal is returned with 404 when committing or
+	// aborting a cluster config proposal that is not the pending one.
+	ErrorCodeNoSuchProposal ErrorCode = "no_such_proposal"
+	// ErrorCodeNotReady is returned with 503 while the transaction log is
+	// being replayed, and by /readyz once shutdown has begun.
+	ErrorCodeNotReady ErrorCode = "not_ready"
+	// ErrorCodeReadOnly is returned with 503 for writes while the server is
+	// in read-only mode.
+	ErrorCodeReadOnly ErrorCode = "read_only"
+	// ErrorCodeLogFailed is returned with 503 for writes once the
+	// transaction log has failed, until the server is restarted.
+	ErrorCodeLogFailed ErrorCode = "log_failed"
+	// ErrorCodeOverloaded is returned with 503, along with Retry-After, when
+	// the transaction log queue is full and writes are being rejected.
+	ErrorCodeOverloaded ErrorCode = "overloaded"
+	// ErrorCodeNotSupported is returned with 501 when the request needs a
+	// feature the configured transaction log backend lacks, or one that is
+	// switched off.
+	ErrorCodeNotSupported ErrorCode = "not_supported"
+	// ErrorCodeNotClustered is returned with 404 for cluster endpoints of a
+	// node that is not part of a cluster.
+	ErrorCodeNotClustered ErrorCode = "not_clustered"
+	// ErrorCodeNodeUnavailable is returned with 502 when a request cannot be
+	// forwarded to the node that serves it: the owner of its key, or the
+	// replication leader for writes sent to a follower.
+	ErrorCodeNodeUnavailable ErrorCode = "node_unavailable"
+	// ErrorCodeReplicaLagging is returned with 503, along with Retry-After,
+	// for stale reads of a follower lagging behind the leader by more than
+	// the replication lag allowed.
+	ErrorCodeReplicaLagging ErrorCode = "replica_lagging"
+	// ErrorCodeReplicationTimeout is returned with 504 when a write is not
+	// applied by as many replicas as its consistency asks for in time. The
+	// write has been made on the leader and is not undone.
+	ErrorCodeReplicationTimeout ErrorCode = "replication_timeout"
+	// ErrorCodeInternal is returned with 500 for failures that are not the
+	// client's fault. Retrying may succeed.
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+type ErrorResponse struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Key       string    `json:"key,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// writeError replaces http.Error for API responses, writing the JSON error
+// envelope with the given status code.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	resp := ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Key:       r.PathValue("key"),
+		RequestID: r.Header.Get(requestIDHeader),
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write error response", slog.String("error", err.Error()))
+	}
+}
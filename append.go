@@ -0,0 +1,81 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+type appendResponse struct {
+	// Length is the length of the value in bytes once the body is appended.
+	Length int `json:"length"`
+}
+
+// AppendHandler appends the body to the value of a key, creating the key
+// with the request's Content-Type if it does not exist. Only the appended
+// bytes are logged, as an append event, rather than the whole value. The key
+// keeps its content type, tags and TTL. Keys holding data types such as sets
+// cannot be appended to, since the result would no longer decode.
+func (s *Server) AppendHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		if _, _, err = mime.ParseMediaType(contentType); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid Content-Type: "+err.Error())
+			return
+		}
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	// Only a missing key is appended to as empty. Anything else, such as a
+	// missing namespace, must fail before the append is logged, since
+	// replaying it would create the namespace.
+	current, err := s.store.Get(r.Context(), ns, key)
+	if err != nil && !errors.Is(err, ErrNoSuchKey) {
+		writeStoreError(w, r, err)
+		return
+	}
+	if isDataType(current.ContentType) {
+		writeStoreError(w, r, fmt.Errorf("%w: %s", ErrWrongType, current.ContentType))
+		return
+	}
+
+	if maxSize := s.config.MaxValueSize; maxSize > 0 && int64(len(current.Value)+len(value)) > maxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge,
+			fmt.Sprintf("value would be %d bytes, more than the limit of %d", len(current.Value)+len(value), maxSize))
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeAppend, Namespace: ns, Key: key, Value: string(value), ContentType: contentType, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	entry, err := s.store.Append(r.Context(), e)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(Event{Sequence: e.Sequence, Type: EventTypePut, Namespace: ns, Key: key, Value: entry.Value, ContentType: entry.ContentType, Tags: entry.Tags, Time: e.Time})
+
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, appendResponse{Length: len(entry.Value)})
+}
@@ -0,0 +1,25 @@
+package cavee_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+func TestAppend(t *testing.T) {
+	inst := restarted(t, func(inst *caveetest.Instance) {
+		mustRequest(t, inst, http.MethodPost, "/v1/key/k/append", "ab", http.StatusOK)
+		mustRequest(t, inst, http.MethodPost, "/v1/key/k/append", "c", http.StatusOK)
+
+		// An append into a missing namespace must fail without being
+		// logged, or replaying it would create the namespace.
+		mustFail(t, inst, http.MethodPost, "/v1/ns/nope/key/k/append", "x", http.StatusNotFound, cavee.ErrorCodeNoSuchNamespace)
+	})
+
+	if b := mustRequest(t, inst, http.MethodGet, "/v1/key/k", "", http.StatusOK); string(b) != "abc" {
+		t.Errorf("k reads as %q after a restart, want abc", b)
+	}
+	mustFail(t, inst, http.MethodGet, "/v1/ns/nope/key/k", "", http.StatusNotFound, cavee.ErrorCodeNoSuchNamespace)
+}
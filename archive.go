@@ -0,0 +1,138 @@
+package cavee
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// SegmentArchiver copies closed transaction log segments to long-term
+// storage. Names are segment file names; archivers are free to store them
+// under a prefix of their own.
+type SegmentArchiver interface {
+	Upload(ctx context.Context, name string, file *os.File) error
+	Download(ctx context.Context, name string, w io.Writer) error
+	List(ctx context.Context) ([]string, error)
+}
+
+// archiveTimeout bounds a single segment upload or download.
+const archiveTimeout = 10 * time.Minute
+
+// restoreSegments downloads the archived segments that are older than the
+// oldest local one, so a node whose disk was lost or pruned replays the full
+// history. It returns the names of the segments that were already archived.
+func (l *FileTransactionLogger) restoreSegments(local []string) (archived []string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+
+	names, err := l.opts.Archiver.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived segments: %w", err)
+	}
+
+	for _, name := range names {
+		if filepath.Ext(name) != segmentExt || filepath.Base(name) != name {
+			continue
+		}
+		archived = append(archived, name)
+
+		// Segments from before the base snapshot are covered by it.
+		if len(local) > 0 && name >= local[0] || name < segmentName(l.baseSequence+1) {
+			continue
+		}
+
+		if err = l.downloadSegment(name); err != nil {
+			return nil, err
+		}
+		slog.Info("restored transaction log segment from archive", slog.String("segment", name))
+	}
+
+	return archived, nil
+}
+
+func (l *FileTransactionLogger) downloadSegment(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+
+	// Download next to the segment and rename it into place, so an
+	// interrupted restore does not leave a partial segment behind.
+	tmp, err := os.CreateTemp(l.dir, name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to restore segment %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = l.opts.Archiver.Download(ctx, name, tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(l.dir, name))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore segment %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// archiveSegments uploads the segments sent on names until the channel is
+// closed. Failed uploads are only logged: the segment stays on disk and is
+// retried the next time the logger starts.
+func (l *FileTransactionLogger) archiveSegments(names <-chan string) {
+	for name := range names {
+		start := time.Now()
+
+		if err := l.uploadSegment(name); err != nil {
+			slog.Error("failed to archive transaction log segment",
+				slog.String("segment", name),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+
+		slog.Info("archived transaction log segment",
+			slog.String("segment", name),
+			slog.String("duration", time.Since(start).String()),
+		)
+	}
+}
+
+func (l *FileTransactionLogger) uploadSegment(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+	defer cancel()
+
+	file, err := os.Open(filepath.Join(l.dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return l.opts.Archiver.Upload(ctx, name, file)
+}
+
+// unarchivedSegments returns the closed local segments missing from the
+// archive.
+func (l *FileTransactionLogger) unarchivedSegments(archived []string) (names []string, err error) {
+	local, err := listSegments(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	active := filepath.Base(l.active.Name())
+	for _, name := range local {
+		if name != active && !slices.Contains(archived, name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,218 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnauthenticated  = errors.New("missing or invalid credentials")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+type Permissions uint8
+
+const (
+	PermissionRead Permissions = 1 << iota
+	PermissionWrite
+	PermissionAdmin
+)
+
+var permissionNames = map[string]Permissions{
+	"read":  PermissionRead,
+	"write": PermissionWrite,
+	"admin": PermissionAdmin,
+}
+
+func ParsePermissions(names []string) (perms Permissions, err error) {
+	for _, name := range names {
+		p, ok := permissionNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perms |= p
+	}
+
+	return perms, nil
+}
+
+func (p Permissions) Has(required Permissions) bool {
+	return p&required == required
+}
+
+// Identity is an authenticated caller. Attributes carries whatever else the
+// provider learned while validating the credentials, such as token claims,
+// for use when resolving permissions.
+type Identity struct {
+	Principal  string
+	Attributes map[string]any
+}
+
+// AuthProvider authenticates requests and decides what the caller may do.
+// ValidateCredentials returns ErrUnauthenticated when the request carries no
+// usable credentials.
+type AuthProvider interface {
+	ValidateCredentials(r *http.Request) (Identity, error)
+	ResolvePermissions(id Identity) (Permissions, error)
+}
+
+// AuthProviderFactory builds a provider from the server configuration.
+type AuthProviderFactory func(config *Config) (AuthProvider, error)
+
+var (
+	authProvidersMu sync.RWMutex
+	authProviders   = map[string]AuthProviderFactory{
+		"static": NewStaticKeyAuthProviderFromConfig,
+		"jwt":    NewJWTAuthProviderFromConfig,
+		"mtls":   NewMTLSAuthProviderFromConfig,
+	}
+)
+
+// RegisterAuthProvider makes a custom provider selectable by name through the
+// -auth flag, so embedders can plug in mechanisms such as LDAP or OIDC token
+// introspection without changing Cavee.
+func RegisterAuthProvider(name string, factory AuthProviderFactory) {
+	authProvidersMu.Lock()
+	defer authProvidersMu.Unlock()
+
+	authProviders[name] = factory
+}
+
+// NewAuthProvider returns the provider registered under name, or nil when
+// authentication is disabled.
+func NewAuthProvider(name string, config *Config) (AuthProvider, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	authProvidersMu.RLock()
+	factory, ok := authProviders[name]
+	authProvidersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown auth provider %q", name)
+	}
+
+	return factory(config)
+}
+
+// AuthFile is the on-disk format shared by the built-in providers. Keys maps
+// static API keys to the identity they authenticate as, and Principals
+// grants permissions to identities established by other means, such as a
+// client certificate.
+type AuthFile struct {
+	Keys map[string]struct {
+		Principal   string   `yaml:"principal"`
+		Permissions []string `yaml:"permissions"`
+	} `yaml:"keys"`
+	Principals map[string][]string `yaml:"principals"`
+}
+
+func LoadAuthFile(filename string) (*AuthFile, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("an auth file is required")
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth file: %w", err)
+	}
+
+	var f AuthFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse auth file: %w", err)
+	}
+
+	return &f, nil
+}
+
+type identityContextKey struct{}
+
+// IdentityFromContext returns the identity of the caller that made the
+// request, if authentication is enabled.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(Identity)
+	return id, ok
+}
+
+// principal returns the principal of the caller that made the request, or
+// an empty string if authentication is disabled.
+func principal(ctx context.Context) string {
+	id, _ := IdentityFromContext(ctx)
+	return id.Principal
+}
+
+// requiredPermissions returns the permissions needed to serve r. Anything
+// outside the API, etcd gateway and admin trees, such as the health check,
+// is public.
+func requiredPermissions(r *http.Request) (perms Permissions, protected bool) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return PermissionAdmin, true
+	case strings.HasPrefix(r.URL.Path, "/v1/"):
+		if isReadMethod(r.Method) {
+			return PermissionRead, true
+		}
+		return PermissionWrite, true
+	case strings.HasPrefix(r.URL.Path, "/v3/"):
+		if isEtcdRead(r.URL.Path) {
+			return PermissionRead, true
+		}
+		return PermissionWrite, true
+	default:
+		return 0, false
+	}
+}
+
+// isReadMethod reports whether requests with method leave the store as it
+// is.
+func isReadMethod(method string) bool {
+	return slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodOptions}, method)
+}
+
+func AuthMiddleware(provider AuthProvider, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required, protected := requiredPermissions(r)
+		if !protected {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := provider.ValidateCredentials(r)
+		if err != nil {
+			if !errors.Is(err, ErrUnauthenticated) {
+				slog.WarnContext(r.Context(), "credential validation failed", slog.String("error", err.Error()))
+			}
+			writeError(w, r, http.StatusUnauthorized, ErrorCodeUnauthenticated, ErrUnauthenticated.Error())
+			return
+		}
+
+		perms, err := provider.ResolvePermissions(id)
+		if err != nil {
+			slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+			return
+		}
+		if !perms.Has(required) {
+			writeError(w, r, http.StatusForbidden, ErrorCodePermissionDenied, ErrPermissionDenied.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id)))
+	})
+}
+
+// bearerToken returns the credential from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok && strings.TrimSpace(token) != ""
+}
@@ -0,0 +1,99 @@
+package cavee
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTAuthProvider authenticates requests carrying an HS256-signed JSON Web
+// Token as a bearer token. The "sub" claim is the principal and the
+// "permissions" claim lists what it may do.
+type JWTAuthProvider struct {
+	secret []byte
+}
+
+func NewJWTAuthProviderFromConfig(config *Config) (AuthProvider, error) {
+	secret := config.JWTSecret
+	if secret == "" {
+		secret = os.Getenv("CAVEE_JWT_SECRET")
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("jwt auth requires -jwt-secret or CAVEE_JWT_SECRET")
+	}
+
+	return &JWTAuthProvider{secret: []byte(secret)}, nil
+}
+
+type jwtClaims struct {
+	Subject     string   `json:"sub"`
+	ExpiresAt   int64    `json:"exp"`
+	NotBefore   int64    `json:"nbf"`
+	Permissions []string `json:"permissions"`
+}
+
+func (p *JWTAuthProvider) ValidateCredentials(r *http.Request) (Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	now := time.Now().Unix()
+	if claims.Subject == "" || (claims.ExpiresAt != 0 && now >= claims.ExpiresAt) || (claims.NotBefore != 0 && now < claims.NotBefore) {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	return Identity{Principal: claims.Subject, Attributes: map[string]any{"permissions": claims.Permissions}}, nil
+}
+
+func (p *JWTAuthProvider) ResolvePermissions(id Identity) (Permissions, error) {
+	names, _ := id.Attributes["permissions"].([]string)
+
+	perms, err := ParsePermissions(names)
+	if err != nil {
+		// A token naming permissions this server does not know grants
+		// nothing rather than failing the request outright.
+		return 0, nil
+	}
+
+	return perms, nil
+}
+
+func decodeJWTSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,54 @@
+package cavee
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MTLSAuthProvider authenticates requests by their verified client
+// certificate. The certificate's common name is the principal, and its
+// permissions come from the principals section of the auth file.
+type MTLSAuthProvider struct {
+	principals map[string]Permissions
+}
+
+func NewMTLSAuthProviderFromConfig(config *Config) (AuthProvider, error) {
+	if config.TLSClientCA == "" {
+		return nil, fmt.Errorf("mtls auth requires -tls-client-ca")
+	}
+
+	f, err := LoadAuthFile(config.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &MTLSAuthProvider{principals: make(map[string]Permissions)}
+	for principal, names := range f.Principals {
+		perms, err := ParsePermissions(names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permissions for principal %q: %w", principal, err)
+		}
+		p.principals[principal] = perms
+	}
+
+	return p, nil
+}
+
+func (p *MTLSAuthProvider) ValidateCredentials(r *http.Request) (Identity, error) {
+	// The TLS handshake has already verified the chain against the client
+	// CA, so only the presence of a certificate needs checking here.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	return Identity{Principal: cert.Subject.CommonName}, nil
+}
+
+func (p *MTLSAuthProvider) ResolvePermissions(id Identity) (Permissions, error) {
+	return p.principals[id.Principal], nil
+}
@@ -0,0 +1,63 @@
+package cavee
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+)
+
+type staticKey struct {
+	principal   string
+	permissions Permissions
+}
+
+// StaticKeyAuthProvider authenticates requests carrying one of a fixed set of
+// API keys, either as a bearer token or in the X-Api-Key header.
+type StaticKeyAuthProvider struct {
+	keys map[[sha256.Size]byte]staticKey
+}
+
+func NewStaticKeyAuthProviderFromConfig(config *Config) (AuthProvider, error) {
+	f, err := LoadAuthFile(config.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &StaticKeyAuthProvider{keys: make(map[[sha256.Size]byte]staticKey)}
+	for key, entry := range f.Keys {
+		perms, err := ParsePermissions(entry.Permissions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid permissions for principal %q: %w", entry.Principal, err)
+		}
+
+		// Keys are looked up by hash so that comparing a presented key does
+		// not leak how much of it matched.
+		p.keys[sha256.Sum256([]byte(key))] = staticKey{principal: entry.Principal, permissions: perms}
+	}
+
+	return p, nil
+}
+
+func (p *StaticKeyAuthProvider) ValidateCredentials(r *http.Request) (Identity, error) {
+	key, ok := bearerToken(r)
+	if !ok {
+		key = r.Header.Get("X-Api-Key")
+	}
+	if key == "" {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	entry, ok := p.keys[sum]
+	if !ok {
+		return Identity{}, ErrUnauthenticated
+	}
+
+	return Identity{Principal: entry.principal, Attributes: map[string]any{"key_hash": sum}}, nil
+}
+
+func (p *StaticKeyAuthProvider) ResolvePermissions(id Identity) (Permissions, error) {
+	sum, _ := id.Attributes["key_hash"].([sha256.Size]byte)
+
+	return p.keys[sum].permissions, nil
+}
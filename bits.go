@@ -0,0 +1,189 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bit operations treat a value as a bitmap, as Redis does: bit 0 is the most
+// significant bit of the first byte, and bits past the end of the value, or
+// of a key that does not exist, are 0.
+
+// maxBitOffset is the highest bit that can be set, which bounds a bitmap to
+// 512 MiB as in Redis.
+const maxBitOffset = 1<<32 - 1
+
+type bitResponse struct {
+	Bit int `json:"bit"`
+}
+
+type bitCountResponse struct {
+	Count int `json:"count"`
+}
+
+// getBitmap returns the entry of a key to be used as a bitmap, which is
+// empty if the key does not exist. Keys holding data types are not bitmaps.
+// As in getTyped, a read sees the value through the read transforms of ns.
+func (s *Server) getBitmap(r *http.Request, ns, key string) (Entry, error) {
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if errors.Is(err, ErrNoSuchKey) {
+		return Entry{}, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	if isDataType(entry.ContentType) {
+		return Entry{}, fmt.Errorf("%w: %s", ErrWrongType, entry.ContentType)
+	}
+	if isReadMethod(r.Method) {
+		if entry.Value, err = s.readValue(r.Context(), ns, entry.Value); err != nil {
+			return Entry{}, err
+		}
+	}
+
+	return entry, nil
+}
+
+func getBit(value string, offset uint64) int {
+	i := offset / 8
+	if i >= uint64(len(value)) {
+		return 0
+	}
+	return int(value[i]>>(7-offset%8)) & 1
+}
+
+// parseBitOffset parses the offset in the path, writing the error response
+// if it is invalid.
+func parseBitOffset(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	offset, err := strconv.ParseUint(r.PathValue("offset"), 10, 64)
+	if err != nil || offset > maxBitOffset {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Sprintf("offset must be a number from 0 to %d", maxBitOffset))
+		return 0, false
+	}
+	return offset, true
+}
+
+// GetBitHandler sends the bit at an offset of the value of a key.
+func (s *Server) GetBitHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	offset, ok := parseBitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err := s.getBitmap(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, bitResponse{Bit: getBit(entry.Value, offset)})
+}
+
+// SetBitHandler sets the bit at an offset of the value of a key to the 0 or
+// 1 in the body, growing the value with zero bytes, or creating the key, as
+// needed, and sends the bit it replaced. Setting a bit to what it already is
+// writes nothing.
+func (s *Server) SetBitHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	offset, ok := parseBitOffset(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var bit int
+	switch strings.TrimSpace(string(body)) {
+	case "0":
+	case "1":
+		bit = 1
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "body must be 0 or 1")
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	current, err := s.getBitmap(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	previous := getBit(current.Value, offset)
+	if previous != bit {
+		value := []byte(current.Value)
+		if n := int(offset/8) + 1; n > len(value) {
+			value = append(value, make([]byte, n-len(value))...)
+		}
+		value[offset/8] ^= 1 << (7 - offset%8)
+
+		if _, ok := s.writeTyped(w, r, ns, key, current, string(value), current.ContentType); !ok {
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, bitResponse{Bit: previous})
+}
+
+// BitCountHandler sends how many bits of the value of a key are set,
+// counting only the bytes from ?start= to ?end=, inclusive, if given. As in
+// Redis, negative positions count back from the end of the value.
+func (s *Server) BitCountHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	start, end := 0, -1
+	for name, pos := range map[string]*int{"start": &start, "end": &end} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			var err error
+			if *pos, err = strconv.Atoi(raw); err != nil {
+				writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, name+" must be a number")
+				return
+			}
+		}
+	}
+
+	entry, err := s.getBitmap(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	n := len(entry.Value)
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = n + end
+	}
+	end = min(end, n-1)
+
+	var count int
+	for i := start; i <= end; i++ {
+		count += bits.OnesCount8(entry.Value[i])
+	}
+
+	writeJSON(w, http.StatusOK, bitCountResponse{Count: count})
+}
@@ -0,0 +1,263 @@
+package cavee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedHeaders are replaced in captures so that credentials never end up
+// in a capture file.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+type CapturedRequest struct {
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URI            string      `json:"uri"`
+	Namespace      string      `json:"namespace,omitempty"`
+	Key            string      `json:"key"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    []byte      `json:"request_body,omitempty"`
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   []byte      `json:"response_body,omitempty"`
+}
+
+// Capturer records full requests and responses for keys under a prefix into
+// a size-rotated JSONL file, so that a client issue can be replayed locally.
+// It starts disabled and is switched on and off through the admin API.
+type Capturer struct {
+	sync.Mutex
+	enabled bool
+	prefix  string
+
+	filename string
+	maxSize  int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+func NewCapturer(filename string, maxSize int64, backups int) *Capturer {
+	return &Capturer{filename: filename, maxSize: maxSize, backups: backups}
+}
+
+func (c *Capturer) Enable(prefix string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.enabled = true
+	c.prefix = prefix
+
+	slog.Info("request capture enabled", slog.String("prefix", prefix), slog.String("file", c.filename))
+}
+
+func (c *Capturer) Disable() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.enabled = false
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+
+	slog.Info("request capture disabled")
+}
+
+func (c *Capturer) matches(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.enabled && strings.HasPrefix(key, c.prefix)
+}
+
+func (c *Capturer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns, key, ok := keyFromPath(r.URL.Path)
+		if !ok || !c.matches(key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := bufferBody(r)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		c.record(CapturedRequest{
+			Time:           time.Now(),
+			Method:         r.Method,
+			URI:            r.URL.RequestURI(),
+			Namespace:      ns,
+			Key:            key,
+			RequestHeader:  redactHeader(r.Header),
+			RequestBody:    body,
+			Status:         rec.status,
+			ResponseHeader: redactHeader(w.Header()),
+			ResponseBody:   rec.body.Bytes(),
+		})
+	})
+}
+
+func (c *Capturer) record(req CapturedRequest) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		slog.Warn("failed to encode captured request", slog.String("error", err.Error()))
+		return
+	}
+	line = append(line, '\n')
+
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.enabled {
+		return
+	}
+
+	if err := c.rotate(int64(len(line))); err != nil {
+		slog.Warn("failed to rotate capture file", slog.String("error", err.Error()))
+		return
+	}
+
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		slog.Warn("failed to write captured request", slog.String("error", err.Error()))
+	}
+}
+
+// rotate makes sure there is an open capture file with room for n more bytes,
+// shifting full files to numbered backups. It must be called with the lock
+// held.
+func (c *Capturer) rotate(n int64) error {
+	if c.file != nil && (c.maxSize <= 0 || c.size+n <= c.maxSize || c.size == 0) {
+		return nil
+	}
+
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+
+		for i := c.backups; i > 0; i-- {
+			from := c.filename
+			if i > 1 {
+				from = fmt.Sprintf("%s.%d", c.filename, i-1)
+			}
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", c.filename, i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if c.backups == 0 {
+			if err := os.Remove(c.filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	file, err := os.OpenFile(c.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	c.file = file
+	c.size = info.Size()
+
+	return nil
+}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "REDACTED")
+		}
+	}
+
+	return h
+}
+
+// keyFromPath extracts the namespace and key from a /v1/key/{key} or
+// /v1/ns/{ns}/key/{key} path before the router has matched the request.
+func keyFromPath(path string) (ns, key string, ok bool) {
+	if rest, found := strings.CutPrefix(path, "/v1/ns/"); found {
+		ns, path, _ = strings.Cut(rest, "/")
+		path = "/v1/" + path
+	}
+
+	key, ok = strings.CutPrefix(path, "/v1/key/")
+	if !ok {
+		return "", "", false
+	}
+	key, _, _ = strings.Cut(key, "/")
+
+	return ns, key, key != ""
+}
+
+// bufferBody reads the whole request body and replaces it with an in-memory
+// copy, so middleware can inspect it without consuming it.
+func bufferBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+type captureStatus struct {
+	Enabled bool   `json:"enabled"`
+	Prefix  string `json:"prefix"`
+	File    string `json:"file"`
+}
+
+func (s *Server) GetCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	s.capturer.Lock()
+	status := captureStatus{Enabled: s.capturer.enabled, Prefix: s.capturer.prefix, File: s.capturer.filename}
+	s.capturer.Unlock()
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) EnableCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	s.capturer.Enable(req.Prefix)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) DisableCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	s.capturer.Disable()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,239 @@
+// Package caveetest runs real Cavee servers in-process for integration tests,
+// so code built on Cavee can be tested without Docker or an external
+// instance. Each server listens on a random local port and keeps its
+// transaction log in a temporary directory that is removed with the test.
+package caveetest
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+)
+
+// Instance is a running test server.
+type Instance struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:41234.
+	URL string
+	// Dir is the temporary directory holding the server's files.
+	Dir string
+
+	Server *cavee.Server
+
+	httpServer *httptest.Server
+	faults     *faults
+}
+
+// Start starts a server and stops it when the test finishes. The configure
+// functions can adjust the configuration before the server is created; it
+// starts out with the same defaults as the cavee command.
+func Start(t testing.TB, configure ...func(*cavee.Config)) *Instance {
+	t.Helper()
+
+	return StartWithOptions(t, nil, configure...)
+}
+
+// StartWithOptions is Start for a server created with opts as well, such as
+// the hooks of an application embedding Cavee.
+func StartWithOptions(t testing.TB, opts []cavee.ServerOption, configure ...func(*cavee.Config)) *Instance {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	config, err := cavee.ParseConfig(nil)
+	if err != nil {
+		t.Fatalf("caveetest: %v", err)
+	}
+	config.Addr = ""
+	config.TransactionLogDir = filepath.Join(dir, "tlog")
+	config.CaptureFile = filepath.Join(dir, "capture.jsonl")
+
+	for _, fn := range configure {
+		fn(config)
+	}
+
+	logger, err := cavee.NewTransactionLoggerFromConfig(config)
+	if err != nil {
+		t.Fatalf("caveetest: %v", err)
+	}
+
+	f := &faults{}
+
+	opts = append([]cavee.ServerOption{cavee.WithTransactionLogger(&faultyLogger{TransactionLogger: logger, faults: f})}, opts...)
+	server, err := cavee.NewServer(config, opts...)
+	if err != nil {
+		t.Fatalf("caveetest: %v", err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatalf("caveetest: %v", err)
+	}
+
+	ts := httptest.NewServer(f.middleware(server.Handler()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := server.Close(ctx); err != nil {
+			t.Errorf("caveetest: %v", err)
+		}
+		ts.Close()
+	})
+
+	return &Instance{
+		URL:        ts.URL,
+		Dir:        dir,
+		Server:     server,
+		httpServer: ts,
+		faults:     f,
+	}
+}
+
+// Client returns an HTTP client configured for the server.
+func (i *Instance) Client() *http.Client {
+	return i.httpServer.Client()
+}
+
+// SetLatency delays every request by d before it is handled.
+func (i *Instance) SetLatency(d time.Duration) {
+	i.faults.Lock()
+	defer i.faults.Unlock()
+
+	i.faults.latency = d
+}
+
+// SetErrorRate makes the given fraction of requests, between 0 and 1, fail
+// with 503 Service Unavailable without reaching the server.
+func (i *Instance) SetErrorRate(rate float64) {
+	i.faults.Lock()
+	defer i.faults.Unlock()
+
+	i.faults.errorRate = rate
+}
+
+// FailLogWrites makes every transaction log write fail with err until it is
+// called again with nil, simulating a full or broken disk.
+func (i *Instance) FailLogWrites(err error) {
+	i.faults.Lock()
+	defer i.faults.Unlock()
+
+	i.faults.logErr = err
+}
+
+type faults struct {
+	sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	logErr    error
+}
+
+func (f *faults) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		latency, errorRate := f.latency, f.errorRate
+		f.Unlock()
+
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if errorRate > 0 && rand.Float64() < errorRate {
+			http.Error(w, "injected fault", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (f *faults) logError() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.logErr
+}
+
+type faultyLogger struct {
+	cavee.TransactionLogger
+	faults *faults
+}
+
+func (l *faultyLogger) WritePut(key, value string) <-chan cavee.WriteResult {
+	return l.WriteEvent(cavee.Event{Type: cavee.EventTypePut, Key: key, Value: value})
+}
+
+func (l *faultyLogger) WriteDelete(key string) <-chan cavee.WriteResult {
+	return l.WriteEvent(cavee.Event{Type: cavee.EventTypeDelete, Key: key})
+}
+
+func (l *faultyLogger) WriteEvent(e cavee.Event) <-chan cavee.WriteResult {
+	if err := l.faults.logError(); err != nil {
+		result := make(chan cavee.WriteResult, 1)
+		result <- cavee.WriteResult{Err: err}
+		return result
+	}
+
+	return l.TransactionLogger.WriteEvent(e)
+}
+
+func (l *faultyLogger) LoggerStats() cavee.LoggerStats {
+	if reporter, ok := l.TransactionLogger.(cavee.LoggerStatsReporter); ok {
+		return reporter.LoggerStats()
+	}
+
+	return cavee.LoggerStats{}
+}
+
+func (l *faultyLogger) Flush(ctx context.Context) error {
+	if flusher, ok := l.TransactionLogger.(cavee.Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+
+	return nil
+}
+
+func (l *faultyLogger) RestoreSnapshot(ctx context.Context, r io.Reader, sequence uint64) error {
+	if restorer, ok := l.TransactionLogger.(cavee.SnapshotRestorer); ok {
+		return restorer.RestoreSnapshot(ctx, r, sequence)
+	}
+
+	return cavee.ErrSnapshotsUnsupported
+}
+
+func (l *faultyLogger) OpenSnapshot() (io.ReadCloser, error) {
+	if restorer, ok := l.TransactionLogger.(cavee.SnapshotRestorer); ok {
+		return restorer.OpenSnapshot()
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+func (l *faultyLogger) HealthChecks(ctx context.Context) []cavee.HealthCheck {
+	if checker, ok := l.TransactionLogger.(cavee.HealthChecker); ok {
+		return checker.HealthChecks(ctx)
+	}
+
+	return nil
+}
+
+func (l *faultyLogger) ReadEventsBetween(ctx context.Context, from, to uint64, fn func(cavee.Event) error) error {
+	if history, ok := l.TransactionLogger.(cavee.HistoryReader); ok {
+		return history.ReadEventsBetween(ctx, from, to, fn)
+	}
+
+	return cavee.ErrEventUnsupported
+}
+
+func (l *faultyLogger) ReplayProgress() (bytesRead, bytesTotal int64) {
+	if reporter, ok := l.TransactionLogger.(cavee.ReplayProgressReporter); ok {
+		return reporter.ReplayProgress()
+	}
+
+	return 0, 0
+}
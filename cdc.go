@@ -0,0 +1,237 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// cdcQueueSize is the number of events publishing can fall behind by
+	// before further events are dropped.
+	cdcQueueSize = 4096
+	// cdcBatchSize is the most events published at once.
+	cdcBatchSize = 256
+	// Failed publishes are retried after cdcMinBackoff, doubling up to
+	// cdcMaxBackoff, until they succeed or the server shuts down.
+	cdcMinBackoff     = 100 * time.Millisecond
+	cdcMaxBackoff     = 10 * time.Second
+	cdcPublishTimeout = 10 * time.Second
+)
+
+// ChangeEvent is a committed transaction log event as published by change
+// data capture.
+type ChangeEvent struct {
+	Sequence    uint64    `json:"sequence"`
+	Type        string    `json:"type"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Value       string    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Time        time.Time `json:"time"`
+	Origin      string    `json:"origin,omitempty"`
+	Principal   string    `json:"principal,omitempty"`
+}
+
+// ChangePublisher sends change events to a message broker.
+type ChangePublisher interface {
+	Publish(ctx context.Context, events []ChangeEvent) error
+	Close() error
+}
+
+// NewChangePublisherFromConfig returns the publisher selected by -cdc, or
+// nil if change data capture is disabled.
+func NewChangePublisherFromConfig(config *Config) (ChangePublisher, error) {
+	switch config.CDC {
+	case "", "none":
+		return nil, nil
+	case "kafka":
+		return NewKafkaChangePublisher(strings.Split(config.CDCURL, ","), config.CDCTopic)
+	case "nats":
+		return NewNATSChangePublisher(config.CDCURL, config.CDCTopic)
+	default:
+		return nil, fmt.Errorf("unknown cdc publisher %q", config.CDC)
+	}
+}
+
+// KafkaChangePublisher publishes change events to a Kafka topic, keyed by
+// namespace and key, so events for a key stay in order within a partition.
+type KafkaChangePublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaChangePublisher(brokers []string, topic string) (*KafkaChangePublisher, error) {
+	if len(brokers) == 0 || brokers[0] == "" {
+		return nil, fmt.Errorf("no cdc kafka brokers configured")
+	}
+
+	return &KafkaChangePublisher{writer: &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		BatchTimeout:           time.Millisecond,
+		AllowAutoTopicCreation: true,
+	}}, nil
+}
+
+func (p *KafkaChangePublisher) Publish(ctx context.Context, events []ChangeEvent) error {
+	messages := make([]kafka.Message, len(events))
+	for i, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		messages[i] = kafka.Message{Key: []byte(e.Namespace + "\x00" + e.Key), Value: value}
+	}
+
+	return p.writer.WriteMessages(ctx, messages...)
+}
+
+func (p *KafkaChangePublisher) Close() error {
+	return p.writer.Close()
+}
+
+// NATSChangePublisher publishes change events to a NATS subject. A stream
+// capturing the subject has to be set up for them to be kept.
+type NATSChangePublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func NewNATSChangePublisher(url, subject string) (*NATSChangePublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("cavee-cdc"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to cdc nats: %w", err)
+	}
+
+	return &NATSChangePublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *NATSChangePublisher) Publish(ctx context.Context, events []ChangeEvent) error {
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err = p.conn.Publish(p.subject, data); err != nil {
+			return err
+		}
+	}
+
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *NATSChangePublisher) Close() error {
+	return p.conn.Drain()
+}
+
+// changeCapture publishes committed events in the background, so that a
+// slow or unreachable broker never holds up writes. Events are published in
+// the order they were committed in, which is sequence order for any one
+// key; consumers that need a total order can sort by sequence.
+type changeCapture struct {
+	publisher ChangePublisher
+	events    chan ChangeEvent
+	done      chan struct{}
+	stop      chan struct{}
+}
+
+func newChangeCapture(publisher ChangePublisher) *changeCapture {
+	c := &changeCapture{
+		publisher: publisher,
+		events:    make(chan ChangeEvent, cdcQueueSize),
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	go c.run()
+
+	return c
+}
+
+// capture queues a committed event for publishing.
+func (c *changeCapture) capture(e Event) {
+	select {
+	case c.events <- ChangeEvent{
+		Sequence:    e.Sequence,
+		Type:        e.Type.String(),
+		Namespace:   e.Namespace,
+		Key:         e.Key,
+		Value:       e.Value,
+		ContentType: e.ContentType,
+		Tags:        e.Tags,
+		Time:        e.Time,
+		Origin:      e.Origin,
+		Principal:   e.Principal,
+	}:
+	default:
+		slog.Warn("dropping cdc event, publishing is falling behind", slog.Uint64("sequence", e.Sequence))
+	}
+}
+
+func (c *changeCapture) run() {
+	defer close(c.done)
+
+	batch := make([]ChangeEvent, 0, cdcBatchSize)
+	for e := range c.events {
+		batch = append(batch[:0], e)
+	collect:
+		for len(batch) < cap(batch) {
+			select {
+			case e, ok := <-c.events:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, e)
+			default:
+				break collect
+			}
+		}
+
+		backoff := cdcMinBackoff
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), cdcPublishTimeout)
+			err := c.publisher.Publish(ctx, batch)
+			cancel()
+			if err == nil {
+				break
+			}
+
+			slog.Warn("failed to publish cdc events, retrying",
+				slog.Uint64("first_sequence", batch[0].Sequence),
+				slog.Int("events", len(batch)),
+				slog.String("error", err.Error()),
+			)
+			select {
+			case <-time.After(backoff):
+			case <-c.stop:
+				return
+			}
+			backoff = min(2*backoff, cdcMaxBackoff)
+		}
+	}
+}
+
+// close publishes the queued events, until ctx is done, and closes the
+// publisher.
+func (c *changeCapture) close(ctx context.Context) error {
+	close(c.events)
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		close(c.stop)
+		<-c.done
+		c.publisher.Close()
+		return fmt.Errorf("failed to publish queued cdc events: %w", ctx.Err())
+	}
+
+	return c.publisher.Close()
+}
@@ -0,0 +1,236 @@
+package cavee
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrProposalPending = errors.New("a cluster config change is already pending")
+	ErrNoSuchProposal  = errors.New("no such cluster config proposal")
+)
+
+// ClusterSettings are the settings every node of a cluster must agree on.
+type ClusterSettings struct {
+	ReplicationFactor int        `json:"replication_factor"`
+	MaxKeys           int64      `json:"max_keys"`
+	MaxBytes          int64      `json:"max_bytes"`
+	Durability        SyncPolicy `json:"durability"`
+}
+
+func (s ClusterSettings) Validate() error {
+	if s.ReplicationFactor < 1 {
+		return fmt.Errorf("replication_factor must be at least 1, got %d", s.ReplicationFactor)
+	}
+	if s.MaxKeys < 0 {
+		return fmt.Errorf("max_keys must not be negative, got %d", s.MaxKeys)
+	}
+	if s.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative, got %d", s.MaxBytes)
+	}
+	if _, err := ParseSyncPolicy(string(s.Durability)); err != nil {
+		return fmt.Errorf("invalid durability: %w", err)
+	}
+
+	return nil
+}
+
+type ConfigProposal struct {
+	ID          string          `json:"id"`
+	BaseVersion uint64          `json:"base_version"`
+	Settings    ClusterSettings `json:"settings"`
+}
+
+// ClusterConfig holds the cluster settings, which only change through a
+// two-phase protocol: a change is first proposed and only takes effect once
+// it is committed. Both steps are recorded in the transaction log, so every
+// node replaying the log arrives at the same committed settings and never
+// acts on a proposal that was aborted or not yet committed.
+type ClusterConfig struct {
+	sync.Mutex
+	transact TransactionLogger
+	// origin is the node ID the events are logged with.
+	origin   string
+	version  uint64
+	settings ClusterSettings
+	pending  *ConfigProposal
+}
+
+func NewClusterConfig(transact TransactionLogger, origin string, defaults ClusterSettings) *ClusterConfig {
+	return &ClusterConfig{transact: transact, origin: origin, settings: defaults}
+}
+
+// Settings returns the committed settings and their version.
+func (c *ClusterConfig) Settings() (settings ClusterSettings, version uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.settings, c.version
+}
+
+func (c *ClusterConfig) Propose(settings ClusterSettings) (proposal ConfigProposal, err error) {
+	if err = settings.Validate(); err != nil {
+		return ConfigProposal{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return ConfigProposal{}, fmt.Errorf("failed to generate proposal id: %w", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.pending != nil {
+		return ConfigProposal{}, ErrProposalPending
+	}
+
+	proposal = ConfigProposal{ID: hex.EncodeToString(id), BaseVersion: c.version, Settings: settings}
+
+	value, err := json.Marshal(proposal)
+	if err != nil {
+		return ConfigProposal{}, fmt.Errorf("failed to encode proposal: %w", err)
+	}
+
+	e := Event{Type: EventTypeConfigPropose, Key: proposal.ID, Value: string(value), Time: time.Now(), Origin: c.origin}
+	if err = (<-c.transact.WriteEvent(e)).Err; err != nil {
+		return ConfigProposal{}, err
+	}
+
+	c.pending = &proposal
+
+	return proposal, nil
+}
+
+func (c *ClusterConfig) Commit(id string) (err error) {
+	return c.resolve(Event{Type: EventTypeConfigCommit, Key: id})
+}
+
+func (c *ClusterConfig) Abort(id string) (err error) {
+	return c.resolve(Event{Type: EventTypeConfigAbort, Key: id})
+}
+
+func (c *ClusterConfig) resolve(e Event) (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.pending == nil || c.pending.ID != e.Key {
+		return ErrNoSuchProposal
+	}
+	e.Time, e.Origin = time.Now(), c.origin
+
+	if err = (<-c.transact.WriteEvent(e)).Err; err != nil {
+		return err
+	}
+
+	return c.apply(e)
+}
+
+// Apply replays a config event read from the transaction log.
+func (c *ClusterConfig) Apply(e Event) (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.apply(e)
+}
+
+// apply must be called with the lock held.
+func (c *ClusterConfig) apply(e Event) (err error) {
+	switch e.Type {
+	case EventTypeConfigPropose:
+		var proposal ConfigProposal
+		if err = json.Unmarshal([]byte(e.Value), &proposal); err != nil {
+			return fmt.Errorf("failed to decode cluster config proposal: %w", err)
+		}
+		c.pending = &proposal
+
+	case EventTypeConfigCommit:
+		if c.pending == nil || c.pending.ID != e.Key {
+			return fmt.Errorf("commit of unknown cluster config proposal %q", e.Key)
+		}
+		c.settings = c.pending.Settings
+		c.version++
+		c.pending = nil
+
+		slog.Info("cluster config committed",
+			slog.String("proposal", e.Key),
+			slog.Uint64("version", c.version),
+		)
+
+	case EventTypeConfigAbort:
+		if c.pending == nil || c.pending.ID != e.Key {
+			return fmt.Errorf("abort of unknown cluster config proposal %q", e.Key)
+		}
+		c.pending = nil
+	}
+
+	return nil
+}
+
+type clusterConfigResponse struct {
+	Version  uint64          `json:"version"`
+	Settings ClusterSettings `json:"settings"`
+	Pending  *ConfigProposal `json:"pending,omitempty"`
+}
+
+func (s *Server) GetClusterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s.clusterConfig.Lock()
+	resp := clusterConfigResponse{
+		Version:  s.clusterConfig.version,
+		Settings: s.clusterConfig.settings,
+		Pending:  s.clusterConfig.pending,
+	}
+	s.clusterConfig.Unlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) ProposeClusterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var settings ClusterSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	proposal, err := s.clusterConfig.Propose(settings)
+	if errors.Is(err, ErrProposalPending) {
+		writeError(w, r, http.StatusConflict, ErrorCodeProposalPending, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, proposal)
+}
+
+func (s *Server) CommitClusterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	resolveClusterConfig(w, r, s.clusterConfig.Commit)
+}
+
+func (s *Server) AbortClusterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	resolveClusterConfig(w, r, s.clusterConfig.Abort)
+}
+
+func resolveClusterConfig(w http.ResponseWriter, r *http.Request, resolve func(id string) error) {
+	err := resolve(r.PathValue("id"))
+	if errors.Is(err, ErrNoSuchProposal) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchProposal, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nayyara-airlangga/cavee"
+)
+
+func main() {
+	logLevel := new(slog.LevelVar)
+	logOpts := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+	logHandler := cavee.NewContextLogHandler(slog.NewJSONHandler(os.Stdout, logOpts))
+	logger := slog.New(logHandler)
+	slog.SetDefault(logger)
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate-log" {
+		if err := migrateLog(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := cavee.ParseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevel.Set(config.LogLevel)
+
+	server, err := cavee.NewServer(config, cavee.WithLogLevel(logLevel))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !config.RecoverTo.IsZero() {
+		if err := recoverTo(server, config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// SIGUSR1 cycles the log level through debug, info and warn.
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			logLevel.Set(cavee.NextLogLevel(logLevel.Level()))
+			slog.Warn("log level changed", slog.String("level", logLevel.Level().String()))
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Starting up Cavee")
+
+	// The server listens while the transaction log is replayed, so that
+	// probes can tell a slow start from a dead process.
+	errs := make(chan error, 2)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	go func() {
+		if err := server.Start(); err != nil {
+			errs <- err
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	case <-server.ExitRequested():
+	}
+
+	slog.Info("Shutting down Cavee")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrateLog copies the transaction log from one backend to another.
+func migrateLog(args []string) error {
+	fromConfig, toConfig, err := cavee.ParseMigrateLogConfig(args)
+	if err != nil {
+		return err
+	}
+
+	from, err := cavee.NewTransactionLoggerFromConfig(fromConfig)
+	if err != nil {
+		return err
+	}
+	defer from.Close(context.Background())
+
+	to, err := cavee.NewTransactionLoggerFromConfig(toConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	_, err = cavee.MigrateTransactionLog(ctx, from, to)
+
+	// Closing waits for the events written so far to become durable.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), fromConfig.ShutdownTimeout)
+	defer cancel()
+	if closeErr := to.Close(shutdownCtx); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// recoverTo writes the state recovered with -recover-to to -recover-output.
+func recoverTo(server *cavee.Server, config *cavee.Config) error {
+	defer server.Close(context.Background())
+
+	file, err := os.OpenFile(config.RecoverOutput, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	sequence, err := server.RecoverTo(config.RecoverTo, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(config.RecoverOutput)
+		return err
+	}
+
+	slog.Info("recovered state written",
+		slog.String("file", config.RecoverOutput),
+		slog.Uint64("sequence", sequence),
+	)
+
+	return nil
+}
@@ -0,0 +1,549 @@
+package cavee
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Addr string
+	// EtcdGRPCAddr is where the etcd v3 KV and Watch services are served
+	// over gRPC, or empty to serve them only through the JSON gateway.
+	EtcdGRPCAddr    string
+	LogLevel        slog.Level
+	ShutdownTimeout time.Duration
+	ShutdownDelay   time.Duration
+	ReadOnly        bool
+	// NodeID identifies the server in the Origin of the events it logs.
+	NodeID string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// Vault is the client secrets given as vault:<path>#<field> are read
+	// with, or nil if no Vault server is configured.
+	Vault              *VaultClient
+	VaultTLSPath       string
+	VaultTLSCommonName string
+	VaultMySQLCreds    string
+	VaultRefresh       time.Duration
+
+	Auth      string
+	AuthFile  string
+	JWTSecret string
+
+	TransactionLog    string
+	TransactionLogDir string
+	MaxSegmentSize    int64
+	FsyncPolicy       SyncPolicy
+	FsyncInterval     time.Duration
+	BatchDelay        time.Duration
+	QueueCapacity     int
+	QueuePolicy       BackpressurePolicy
+	QueueTimeout      time.Duration
+	ExpireInterval    time.Duration
+	WebhooksFile      string
+	ScriptsDir        string
+	TransformsFile    string
+	SchemasFile       string
+	QuotasFile        string
+	WriteOnceFile     string
+	CDC               string
+	CDCURL            string
+	CDCTopic          string
+
+	MaxVersions  int
+	MaxValueSize int64
+	MaxKeyLength int
+	// NamespaceQuota is the quota of the namespaces not given their own
+	// in QuotasFile.
+	NamespaceQuota Quota
+	// MVCCRetention is how many sequences back reads as of a sequence can
+	// go, or 0 to turn them off.
+	MVCCRetention uint64
+	// TxnSessionTimeout is how long a transaction session may go unused
+	// before it is dropped.
+	TxnSessionTimeout time.Duration
+
+	TransactionLogKey        string
+	TransactionLogKeyCommand string
+
+	// ValueEncryption selects what wraps the data keys values are encrypted
+	// with: none, local, aws-kms or command.
+	ValueEncryption           string
+	ValueKEK                  string
+	ValueKMSRegion            string
+	ValueKMSEndpoint          string
+	ValueKEKWrapCommand       string
+	ValueKEKUnwrapCommand     string
+	ValueKeyring              string
+	ValueEncryptionNamespaces []string
+
+	// RestoreFile is a snapshot to reset the store and transaction log to
+	// on startup.
+	RestoreFile string
+	// RecoverTo, when set, makes cavee write the state the transaction log
+	// had at that point to RecoverOutput and exit instead of serving.
+	RecoverTo     RecoveryTarget
+	RecoverOutput string
+
+	SQLitePath string
+	MySQLDSN   string
+
+	ArchiveEndpoint string
+	ArchiveRegion   string
+	ArchiveBucket   string
+	ArchivePrefix   string
+
+	KafkaBrokers           []string
+	KafkaTopic             string
+	KafkaReplicationFactor int
+
+	NATSURL      string
+	NATSStream   string
+	NATSReplicas int
+
+	LogPlugin string
+
+	SeedFile string
+
+	CaptureFile    string
+	CaptureMaxSize int64
+	CaptureBackups int
+
+	ShadowURL     string
+	ShadowPercent float64
+	ShadowWrites  bool
+	ShadowTimeout time.Duration
+
+	GzipMinSize int
+
+	AccessCounters bool
+	SearchIndex    bool
+	// KeyHistory is how many events of each key's history are kept, or 0
+	// to keep none.
+	KeyHistory int
+
+	RateLimit float64
+	RateBurst int
+
+	// ClusterPeers are the nodes of the hash ring keys are sharded over,
+	// this one included, or empty to serve every key locally.
+	ClusterPeers   []RingNode
+	ClusterRouting string
+	RingVnodes     int
+	// GossipAddr is where the node gossips with the other members of the
+	// cluster, or empty to not gossip. GossipAdvertise is the address the
+	// others reach it at, when it differs, and GossipJoin the gossip
+	// addresses of members to join through. AdvertiseURL is the base URL of
+	// the node's HTTP API, which members share through gossip.
+	GossipAddr      string
+	GossipAdvertise string
+	GossipJoin      []string
+	AdvertiseURL    string
+	// ClusterDNS is the DNS name the nodes of the cluster are discovered
+	// from, looked up every ClusterDNSInterval, or empty to not discover
+	// them.
+	ClusterDNS         string
+	ClusterDNSInterval time.Duration
+
+	// ReplicationAddr is where a leader serves its events to followers.
+	// ReplicateFrom is the replication address of the leader a follower
+	// streams from, and LeaderURL the base URL of the leader's HTTP API
+	// that the follower forwards writes to.
+	ReplicationAddr string
+	ReplicateFrom   string
+	LeaderURL       string
+	// MaxReplicationLag is how long ago a follower may have last been
+	// caught up with the leader and still serve stale reads, or 0 for no
+	// bound.
+	MaxReplicationLag time.Duration
+	// ReadConsistency and WriteConsistency are the consistency of the
+	// requests of a replicated cluster that do not ask for their own, and
+	// ReplicationTimeout how long requests wait for replicas to reach it.
+	ReadConsistency    ReadConsistency
+	WriteConsistency   WriteConsistency
+	ReplicationTimeout time.Duration
+}
+
+func ParseConfig(args []string) (config *Config, err error) {
+	return parseConfig("cavee", args, nil)
+}
+
+// ParseMigrateLogConfig parses the arguments of the migrate-log command,
+// which takes the server flags describing both backends along with -from and
+// -to naming them. It returns a config for each side.
+func ParseMigrateLogConfig(args []string) (from, to *Config, err error) {
+	var fromLog, toLog string
+	config, err := parseConfig("cavee migrate-log", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&fromLog, "from", "file", "transaction log backend to read events from")
+		fs.StringVar(&toLog, "to", "", "transaction log backend to write events to; it must be empty")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if toLog == "" {
+		return nil, nil, fmt.Errorf("migrate-log requires to")
+	}
+	if fromLog == toLog {
+		return nil, nil, fmt.Errorf("from and to must be different backends, since they share their flags")
+	}
+
+	fromConfig, toConfig := *config, *config
+	fromConfig.TransactionLog, toConfig.TransactionLog = fromLog, toLog
+	for _, c := range []*Config{&fromConfig, &toConfig} {
+		if err = c.checkTransactionLog(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &fromConfig, &toConfig, nil
+}
+
+// parseConfig parses the server flags, and the ones extra adds, from args.
+func parseConfig(name string, args []string, extra func(*flag.FlagSet)) (config *Config, err error) {
+	config = &Config{}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.StringVar(&config.Addr, "addr", "0.0.0.0:8080", "address the HTTP server listens on")
+	fs.StringVar(&config.EtcdGRPCAddr, "etcd-grpc-addr", "", "address to serve the etcd v3 KV and Watch services on over gRPC, for clientv3 and etcdctl; calls are authenticated and limited as those of the /v3 gateway, but the listener is plaintext")
+	hostname, _ := os.Hostname()
+	fs.StringVar(&config.NodeID, "node-id", hostname, "ID of this node, recorded as the origin of every event it logs (defaults to the hostname)")
+	var logLevel string
+	fs.StringVar(&logLevel, "log-level", "info", "initial log level: debug, info or warn; it can be changed at runtime through the admin API or with SIGUSR1")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for requests and queued writes to finish on shutdown")
+	fs.BoolVar(&config.ReadOnly, "read-only", false, "start in read-only mode, rejecting writes with 503 until it is switched off through /admin/readonly")
+	fs.DurationVar(&config.ShutdownDelay, "shutdown-delay", 0, "how long to keep serving with /readyz failing before shutting down, so load balancers can stop routing first; counts towards -shutdown-timeout")
+
+	fs.StringVar(&config.TLSCert, "tls-cert", "", "TLS certificate file; enables HTTPS together with -tls-key")
+	fs.StringVar(&config.TLSKey, "tls-key", "", "TLS private key file")
+
+	var vaultAddr, vaultToken, vaultTokenFile string
+	fs.StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "HashiCorp Vault address; -tlog-key, -value-kek and -mysql-dsn may then be given as vault:<path>#<field> (defaults to $VAULT_ADDR)")
+	fs.StringVar(&vaultToken, "vault-token", os.Getenv("VAULT_TOKEN"), "Vault token, renewed while cavee runs (defaults to $VAULT_TOKEN)")
+	fs.StringVar(&vaultTokenFile, "vault-token-file", "", "file holding the Vault token, e.g. a Vault Agent sink, read again for every request")
+	fs.StringVar(&config.VaultTLSPath, "vault-tls-path", "", "Vault path of the TLS certificate and key to serve HTTPS with: a KV secret with certificate and private_key fields, or a PKI issue endpoint with -vault-tls-common-name")
+	fs.StringVar(&config.VaultTLSCommonName, "vault-tls-common-name", "", "common name to have the Vault PKI engine at -vault-tls-path issue certificates for")
+	fs.StringVar(&config.VaultMySQLCreds, "vault-mysql-creds", "", "Vault database secrets engine path, e.g. database/creds/cavee, issuing the credentials for -tlog=mysql; -mysql-dsn then needs no user or password")
+	fs.DurationVar(&config.VaultRefresh, "vault-refresh", time.Hour, "how often the TLS certificate is read again from a KV secret; issued certificates are renewed before they expire")
+	fs.StringVar(&config.TLSClientCA, "tls-client-ca", "", "CA bundle used to verify client certificates")
+
+	fs.StringVar(&config.Auth, "auth", "none", "authentication provider: none, static, jwt, mtls or a registered custom provider")
+	fs.StringVar(&config.AuthFile, "auth-file", "", "YAML file with API keys and principal permissions")
+	fs.StringVar(&config.JWTSecret, "jwt-secret", "", "HS256 secret for jwt auth (defaults to $CAVEE_JWT_SECRET)")
+
+	var fsync string
+	fs.StringVar(&config.TransactionLog, "tlog", "file", "transaction log backend: file, sqlite, mysql, kafka, nats or plugin")
+	fs.StringVar(&config.TransactionLogDir, "tlog-dir", "tlog", "directory holding the transaction log segments")
+	fs.Int64Var(&config.MaxSegmentSize, "segment-size", 64<<20, "size in bytes after which a new transaction log segment is started")
+	fs.StringVar(&fsync, "fsync", string(SyncNone), "when to fsync the transaction log: always, interval or none")
+	fs.DurationVar(&config.FsyncInterval, "fsync-interval", 10*time.Millisecond, "how often to fsync the transaction log when -fsync=interval")
+	fs.DurationVar(&config.BatchDelay, "tlog-batch-delay", 0, "how long the file transaction log waits for more events before writing a batch; events queued during a write are always batched")
+	var queuePolicy string
+	fs.IntVar(&config.QueueCapacity, "tlog-queue-size", 16, "number of writes that can wait for the transaction log")
+	fs.StringVar(&queuePolicy, "tlog-queue-policy", string(BackpressureBlock), "what writes do when the transaction log queue is full: block, for up to -tlog-queue-timeout, or reject with 503")
+	fs.DurationVar(&config.QueueTimeout, "tlog-queue-timeout", 0, "how long a write waits for room in a full queue before failing with 503 under -tlog-queue-policy=block; 0 waits indefinitely")
+	fs.StringVar(&config.CDC, "cdc", "none", "change data capture publisher every committed event is sent to: none, kafka or nats")
+	fs.StringVar(&config.CDCURL, "cdc-url", "", "comma-separated Kafka brokers, or the NATS server URL, for -cdc")
+	fs.StringVar(&config.CDCTopic, "cdc-topic", "cavee-cdc", "Kafka topic or NATS subject change events are published to")
+	fs.StringVar(&config.WebhooksFile, "webhooks-file", "", "YAML file of webhooks that key changes are POSTed to")
+	fs.StringVar(&config.ScriptsDir, "scripts-dir", "", "directory of Starlark scripts, *.star, that POST /v1/scripts/{name} runs")
+	fs.StringVar(&config.SchemasFile, "schemas-file", "", "YAML file attaching JSON Schemas to namespaces; writes of values that do not match are rejected with 422")
+	fs.StringVar(&config.WriteOnceFile, "write-once-file", "", "YAML file of keys and prefixes that are write-once: once written they cannot be written again or deleted, ever or until their retention passes")
+	fs.StringVar(&config.TransformsFile, "transforms-file", "", "YAML file of WebAssembly modules that values are passed through when keys are written or read")
+	fs.DurationVar(&config.ExpireInterval, "expire-interval", time.Second, "how often keys past their TTL are deleted; expired keys are hidden from reads in between; 0 disables deletion")
+	fs.IntVar(&config.MaxVersions, "max-versions", 10, "number of versions kept for each key, including the current one")
+	fs.Uint64Var(&config.MVCCRetention, "mvcc-retention", 0, "number of sequences past values are kept for, for reads with ?as_of= and consistent exports (0 turns them off)")
+	fs.DurationVar(&config.TxnSessionTimeout, "txn-session-timeout", 30*time.Second, "how long a transaction session may go unused before it is dropped along with its pending writes")
+	fs.Int64Var(&config.MaxValueSize, "max-value-size", 16<<20, "largest request body, and so value, accepted in bytes; 0 means no limit")
+	fs.IntVar(&config.MaxKeyLength, "max-key-length", 1024, "longest key accepted in bytes; 0 means no limit")
+	fs.StringVar(&config.QuotasFile, "quotas-file", "", "YAML file of per-namespace limits on key count and bytes; writes over them are rejected with 429 or 507")
+	fs.IntVar(&config.NamespaceQuota.MaxKeys, "namespace-max-keys", 0, "most keys a namespace not in -quotas-file may hold; 0 means no limit")
+	fs.Int64Var(&config.NamespaceQuota.MaxBytes, "namespace-max-bytes", 0, "most bytes of keys and values a namespace not in -quotas-file may hold; 0 means no limit")
+	fs.StringVar(&config.TransactionLogKey, "tlog-key", "", "hex or base64 AES key for encrypting the transaction log (defaults to $CAVEE_TLOG_KEY)")
+	fs.StringVar(&config.TransactionLogKeyCommand, "tlog-key-command", "", "shell command printing the transaction log key, e.g. a KMS decrypt call")
+
+	var valueNamespaces string
+	fs.StringVar(&config.ValueEncryption, "value-encryption", "none", "what wraps the per-namespace data keys values are encrypted with: none, local, aws-kms or command")
+	fs.StringVar(&config.ValueKEK, "value-kek", "", "hex or base64 AES key for -value-encryption=local (defaults to $CAVEE_VALUE_KEK), or the KMS key ID or ARN for aws-kms")
+	fs.StringVar(&config.ValueKMSRegion, "value-kms-region", "us-east-1", "AWS region of the KMS key for -value-encryption=aws-kms; credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&config.ValueKMSEndpoint, "value-kms-endpoint", "", "KMS endpoint URL for -value-encryption=aws-kms (defaults to the region's)")
+	fs.StringVar(&config.ValueKEKWrapCommand, "value-kek-wrap-command", "", "shell command wrapping a data key read on stdin for -value-encryption=command, e.g. gcloud kms encrypt or age -e")
+	fs.StringVar(&config.ValueKEKUnwrapCommand, "value-kek-unwrap-command", "", "shell command unwrapping a data key read on stdin for -value-encryption=command")
+	fs.StringVar(&config.ValueKeyring, "value-keyring", "keyring.json", "file holding the wrapped data keys of each namespace")
+	fs.StringVar(&valueNamespaces, "value-encryption-namespaces", "", "comma-separated namespaces whose values are encrypted; empty encrypts all of them")
+
+	fs.StringVar(&config.RestoreFile, "restore", "", "snapshot file, as downloaded from /admin/backup, to reset the store and transaction log to on startup; the replaced log is kept aside in the log directory")
+
+	var recoverTo string
+	fs.StringVar(&recoverTo, "recover-to", "", "sequence number or RFC 3339 time to replay the transaction log up to; writes the recovered state to -recover-output as a snapshot and exits")
+	fs.StringVar(&config.RecoverOutput, "recover-output", "", "file the snapshot recovered with -recover-to is written to")
+
+	fs.StringVar(&config.SQLitePath, "sqlite-path", "tlog.db", "SQLite database file holding the transaction log for -tlog=sqlite")
+
+	fs.StringVar(&config.MySQLDSN, "mysql-dsn", "", "MySQL or MariaDB DSN for -tlog=mysql, e.g. user:pass@tcp(host:3306)/cavee (defaults to $CAVEE_MYSQL_DSN)")
+
+	fs.StringVar(&config.ArchiveBucket, "archive-bucket", "", "S3 bucket closed transaction log segments are archived to and restored from")
+	fs.StringVar(&config.ArchivePrefix, "archive-prefix", "", "prefix for archived segment object names, e.g. prod/node-1/")
+	fs.StringVar(&config.ArchiveEndpoint, "archive-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint URL; credentials are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&config.ArchiveRegion, "archive-region", "us-east-1", "region used to sign archive requests")
+
+	var kafkaBrokers string
+	fs.StringVar(&kafkaBrokers, "kafka-brokers", "", "comma-separated Kafka broker addresses for -tlog=kafka")
+	fs.StringVar(&config.KafkaTopic, "kafka-topic", "cavee-tlog", "Kafka topic holding the transaction log")
+	fs.IntVar(&config.KafkaReplicationFactor, "kafka-replication-factor", 1, "replication factor used when creating the Kafka topic")
+
+	fs.StringVar(&config.NATSURL, "nats-url", "nats://127.0.0.1:4222", "NATS server URL for -tlog=nats")
+	fs.StringVar(&config.NATSStream, "nats-stream", "CAVEE", "JetStream stream holding the transaction log; use one per instance")
+	fs.IntVar(&config.NATSReplicas, "nats-replicas", 1, "number of replicas used when creating the JetStream stream")
+
+	fs.StringVar(&config.LogPlugin, "tlog-plugin", "", "plugin binary that keeps the transaction log for -tlog=plugin")
+
+	fs.StringVar(&config.SeedFile, "seed-file", "", "JSON or YAML file of keys and values applied at startup")
+
+	fs.StringVar(&config.CaptureFile, "capture-file", "capture.jsonl", "file that captured requests are written to when capture is enabled")
+	fs.Int64Var(&config.CaptureMaxSize, "capture-max-size", 16<<20, "size in bytes after which the capture file is rotated")
+	fs.IntVar(&config.CaptureBackups, "capture-backups", 3, "number of rotated capture files to keep")
+
+	fs.StringVar(&config.ShadowURL, "shadow-url", "", "base URL of a second Cavee instance to mirror traffic to")
+	fs.Float64Var(&config.ShadowPercent, "shadow-percent", 100, "percentage of eligible requests mirrored to the shadow instance")
+	fs.BoolVar(&config.ShadowWrites, "shadow-writes", false, "also mirror PUT and DELETE requests to the shadow instance")
+	fs.DurationVar(&config.ShadowTimeout, "shadow-timeout", 2*time.Second, "timeout for a single shadow request")
+
+	fs.IntVar(&config.GzipMinSize, "gzip-min-size", 1024, "smallest GET response in bytes that is gzipped for clients accepting it; negative disables compression")
+
+	fs.BoolVar(&config.AccessCounters, "access-counters", false, "count reads and writes of each key since startup and report them in the key's metadata")
+	fs.BoolVar(&config.SearchIndex, "search-index", false, "keep a full-text index of values for /v1/search")
+	fs.IntVar(&config.KeyHistory, "key-history", 0, "number of transaction log events kept in the history of each key for /v1/key/{key}/history; 0 turns the history off")
+
+	fs.Float64Var(&config.RateLimit, "rate-limit", 0, "requests per second allowed for each client, by principal or IP address; 0 disables rate limiting")
+	fs.IntVar(&config.RateBurst, "rate-burst", 20, "number of requests a client may make at once before -rate-limit applies")
+
+	var clusterPeers string
+	fs.StringVar(&clusterPeers, "cluster-peers", "", "comma-separated id=url nodes of the hash ring keys are sharded over, including this one by its -node-id")
+	fs.StringVar(&config.ClusterRouting, "cluster-routing", clusterRoutingForward, "what to do with requests for keys owned by another node: forward them to it, or redirect the client there with 307")
+	fs.IntVar(&config.RingVnodes, "ring-vnodes", 128, "number of points each node has on the hash ring")
+	fs.StringVar(&config.GossipAddr, "gossip-addr", "", "host:port to gossip with the other members of the cluster on, finding them and detecting their failures; without replication, keys are sharded over the live members instead of -cluster-peers")
+	fs.StringVar(&config.GossipAdvertise, "gossip-advertise", "", "host:port the other members reach this node's -gossip-addr at, when it differs")
+	var gossipJoin string
+	fs.StringVar(&gossipJoin, "gossip-join", "", "comma-separated -gossip-addr of members to join the cluster through")
+	fs.StringVar(&config.AdvertiseURL, "advertise-url", "", "base URL the other members reach this node's HTTP API at, shared through gossip")
+	fs.StringVar(&config.ClusterDNS, "cluster-dns", "", "DNS name to discover the nodes of the cluster from, such as a headless Kubernetes service: SRV records for names starting with _, A and AAAA records otherwise; with -gossip-addr they are joined through gossip, and without it they make up the hash ring")
+	fs.DurationVar(&config.ClusterDNSInterval, "cluster-dns-interval", 30*time.Second, "how often -cluster-dns is looked up again to follow the cluster as it scales")
+
+	fs.StringVar(&config.ReplicationAddr, "replication-addr", "", "address to serve committed events to followers on over gRPC, making this node a replication leader; plaintext, so keep it on a private network")
+	fs.StringVar(&config.ReplicateFrom, "replicate-from", "", "-replication-addr of the leader to stream events from, making this node a follower that serves stale reads and forwards writes and other reads to -leader-url")
+	fs.StringVar(&config.LeaderURL, "leader-url", "", "base URL of the leader's HTTP API that a follower forwards writes to")
+	fs.DurationVar(&config.MaxReplicationLag, "max-replication-lag", 5*time.Second, "how far behind the leader a follower may be and still serve reads with consistency any, which it otherwise rejects with 503; 0 means no bound")
+	var readConsistency, writeConsistency string
+	fs.StringVar(&readConsistency, "read-consistency", string(ReadLeader), "consistency of reads without an X-Consistency header: leader, forwarding reads sent to followers to the leader; quorum, serving them once the follower has applied what a quorum of replicas has; or any, serving them from the follower within -max-replication-lag")
+	fs.StringVar(&writeConsistency, "write-consistency", string(WriteOne), "consistency of writes without an X-Consistency header: how many of the cluster's replication_factor replicas must apply them before they are acknowledged, one, quorum or all")
+	fs.DurationVar(&config.ReplicationTimeout, "replication-timeout", 5*time.Second, "how long writes wait for replicas to apply them, and quorum reads for the follower to catch up, before failing with 504 or being forwarded to the leader")
+
+	if extra != nil {
+		extra(fs)
+	}
+
+	if err = fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if config.TLSClientCA != "" && config.TLSCert == "" && config.VaultTLSPath == "" {
+		return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key or vault-tls-path")
+	}
+	if config.VaultTLSPath != "" && config.TLSCert != "" {
+		return nil, fmt.Errorf("vault-tls-path and tls-cert cannot be set together")
+	}
+	if vaultAddr != "" {
+		if config.Vault, err = NewVaultClient(vaultAddr, vaultToken, vaultTokenFile); err != nil {
+			return nil, err
+		}
+	} else if config.VaultTLSPath != "" || config.VaultMySQLCreds != "" {
+		return nil, fmt.Errorf("vault-tls-path and vault-mysql-creds require vault-addr")
+	}
+
+	if config.FsyncPolicy, err = ParseSyncPolicy(fsync); err != nil {
+		return nil, err
+	}
+	if config.LogLevel, err = ParseLogLevel(logLevel); err != nil {
+		return nil, err
+	}
+	if config.QueuePolicy, err = ParseBackpressurePolicy(queuePolicy); err != nil {
+		return nil, err
+	}
+	if config.QueueCapacity < 1 {
+		return nil, fmt.Errorf("tlog-queue-size must be at least 1, got %d", config.QueueCapacity)
+	}
+	if recoverTo != "" {
+		if config.RecoverTo, err = ParseRecoveryTarget(recoverTo); err != nil {
+			return nil, err
+		}
+		if config.RecoverOutput == "" {
+			return nil, fmt.Errorf("recover-to requires recover-output")
+		}
+	}
+
+	if kafkaBrokers != "" {
+		config.KafkaBrokers = strings.Split(kafkaBrokers, ",")
+	}
+	if valueNamespaces != "" {
+		config.ValueEncryptionNamespaces = strings.Split(valueNamespaces, ",")
+	}
+	if err = config.checkTransactionLog(); err != nil {
+		return nil, err
+	}
+
+	if config.KeyHistory < 0 {
+		return nil, fmt.Errorf("key-history must not be negative, got %d", config.KeyHistory)
+	}
+	if config.NamespaceQuota.MaxKeys < 0 || config.NamespaceQuota.MaxBytes < 0 {
+		return nil, fmt.Errorf("namespace-max-keys and namespace-max-bytes must not be negative")
+	}
+	if config.ShadowPercent < 0 || config.ShadowPercent > 100 {
+		return nil, fmt.Errorf("shadow-percent must be between 0 and 100, got %v", config.ShadowPercent)
+	}
+
+	if clusterPeers != "" {
+		if config.ClusterPeers, err = ParseRingNodes(clusterPeers); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(config.ClusterPeers, func(node RingNode) bool { return node.ID == config.NodeID }) {
+			return nil, fmt.Errorf("cluster-peers must include this node, %q", config.NodeID)
+		}
+	}
+	if config.ClusterRouting != clusterRoutingForward && config.ClusterRouting != clusterRoutingRedirect {
+		return nil, fmt.Errorf("cluster-routing must be forward or redirect, got %q", config.ClusterRouting)
+	}
+	if config.RingVnodes < 1 {
+		return nil, fmt.Errorf("ring-vnodes must be at least 1, got %d", config.RingVnodes)
+	}
+	if gossipJoin != "" {
+		for _, addr := range strings.Split(gossipJoin, ",") {
+			config.GossipJoin = append(config.GossipJoin, strings.TrimSpace(addr))
+		}
+	}
+	if err = config.checkGossip(); err != nil {
+		return nil, err
+	}
+	if config.ClusterDNS != "" {
+		switch {
+		case len(config.ClusterPeers) > 0:
+			return nil, fmt.Errorf("cluster-dns and cluster-peers cannot be set together")
+		case config.GossipAddr == "" && (config.ReplicationAddr != "" || config.ReplicateFrom != ""):
+			return nil, fmt.Errorf("cluster-dns requires gossip-addr with replication")
+		case config.ClusterDNSInterval <= 0:
+			return nil, fmt.Errorf("cluster-dns-interval must be positive, got %s", config.ClusterDNSInterval)
+		}
+	}
+	if err = config.checkReplication(); err != nil {
+		return nil, err
+	}
+	if config.MaxReplicationLag < 0 {
+		return nil, fmt.Errorf("max-replication-lag must not be negative, got %s", config.MaxReplicationLag)
+	}
+	if config.ReadConsistency, err = ParseReadConsistency(readConsistency); err != nil {
+		return nil, err
+	}
+	if config.WriteConsistency, err = ParseWriteConsistency(writeConsistency); err != nil {
+		return nil, err
+	}
+	if config.ReplicationTimeout <= 0 {
+		return nil, fmt.Errorf("replication-timeout must be positive, got %s", config.ReplicationTimeout)
+	}
+
+	return config, nil
+}
+
+func (c *Config) checkReplication() error {
+	if c.ReplicationAddr == "" && c.ReplicateFrom == "" {
+		return nil
+	}
+
+	switch {
+	case c.ReplicationAddr != "" && c.ReplicateFrom != "":
+		return fmt.Errorf("replication-addr and replicate-from cannot be set together")
+	case len(c.ClusterPeers) > 0:
+		return fmt.Errorf("cluster-peers cannot be set together with replication")
+	case c.ReplicateFrom == "":
+		return nil
+	case c.LeaderURL == "":
+		return fmt.Errorf("replicate-from requires leader-url")
+	case c.SeedFile != "":
+		// Followers only log the leader's events, so that they keep its
+		// sequence numbers.
+		return fmt.Errorf("seed-file cannot be set on a follower")
+	}
+
+	u, err := url.Parse(c.LeaderURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("leader-url must be an absolute URL, got %q", c.LeaderURL)
+	}
+	c.LeaderURL = strings.TrimSuffix(c.LeaderURL, "/")
+
+	return nil
+}
+
+func (c *Config) checkGossip() error {
+	if c.GossipAddr == "" {
+		if len(c.GossipJoin) > 0 || c.GossipAdvertise != "" {
+			return fmt.Errorf("gossip-join and gossip-advertise require gossip-addr")
+		}
+		return nil
+	}
+
+	switch {
+	case len(c.ClusterPeers) > 0:
+		return fmt.Errorf("cluster-peers cannot be set together with gossip-addr: the hash ring is made of the live members")
+	case c.AdvertiseURL == "" && c.ReplicationAddr == "" && c.ReplicateFrom == "":
+		return fmt.Errorf("gossip-addr requires advertise-url for the other members to route keys to")
+	case c.AdvertiseURL == "":
+		return nil
+	}
+
+	u, err := url.Parse(c.AdvertiseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("advertise-url must be an absolute URL, got %q", c.AdvertiseURL)
+	}
+	c.AdvertiseURL = strings.TrimSuffix(c.AdvertiseURL, "/")
+
+	return nil
+}
+
+// QueueOptions returns the write queue options for the transaction logger.
+func (c *Config) QueueOptions() QueueOptions {
+	return QueueOptions{
+		Capacity: c.QueueCapacity,
+		Policy:   c.QueuePolicy,
+		Timeout:  c.QueueTimeout,
+	}
+}
+
+func (c *Config) checkTransactionLog() error {
+	switch c.TransactionLog {
+	case "file", "sqlite", "mysql", "nats":
+	case "kafka":
+		if len(c.KafkaBrokers) == 0 {
+			return fmt.Errorf("tlog=kafka requires kafka-brokers")
+		}
+	case "plugin":
+		if c.LogPlugin == "" {
+			return fmt.Errorf("tlog=plugin requires tlog-plugin")
+		}
+	default:
+		return fmt.Errorf("unknown transaction log backend %q", c.TransactionLog)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package cavee
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// consistencyHeader is how a client of a replicated cluster picks the
+// consistency of a request, overriding -read-consistency or
+// -write-consistency.
+const consistencyHeader = "X-Consistency"
+
+// ReadConsistency decides which nodes of a replicated cluster may serve a
+// read.
+type ReadConsistency string
+
+const (
+	// ReadLeader forwards reads sent to a follower to the leader, so they
+	// see every acknowledged write.
+	ReadLeader ReadConsistency = "leader"
+	// ReadQuorum lets a follower serve a read once it has applied every
+	// event a quorum of replicas had applied when the read arrived, so it
+	// sees every write acknowledged with WriteQuorum or WriteAll.
+	ReadQuorum ReadConsistency = "quorum"
+	// ReadAny lets a follower serve a read from its own store, as long as
+	// it lags behind the leader by no more than -max-replication-lag.
+	ReadAny ReadConsistency = "any"
+	// readStale is the name ReadAny had before the other levels existed.
+	readStale ReadConsistency = "stale"
+)
+
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch c := ReadConsistency(s); c {
+	case ReadLeader, ReadQuorum, ReadAny:
+		return c, nil
+	case readStale:
+		return ReadAny, nil
+	default:
+		return "", fmt.Errorf("unknown read consistency %q: must be leader, quorum or any", s)
+	}
+}
+
+// WriteConsistency decides how many replicas must have applied a write
+// before the leader acknowledges it.
+type WriteConsistency string
+
+const (
+	// WriteOne acknowledges writes once the leader has logged them.
+	WriteOne WriteConsistency = "one"
+	// WriteQuorum waits for a majority of the replicas, the leader
+	// included.
+	WriteQuorum WriteConsistency = "quorum"
+	// WriteAll waits for every replica.
+	WriteAll WriteConsistency = "all"
+)
+
+func ParseWriteConsistency(s string) (WriteConsistency, error) {
+	switch c := WriteConsistency(s); c {
+	case WriteOne, WriteQuorum, WriteAll:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown write consistency %q: must be one, quorum or all", s)
+	}
+}
+
+// readConsistency returns the consistency a read asks for, defaulting to
+// -read-consistency.
+func (s *Server) readConsistency(r *http.Request) (ReadConsistency, error) {
+	if v := r.Header.Get(consistencyHeader); v != "" {
+		return ParseReadConsistency(v)
+	}
+	return s.config.ReadConsistency, nil
+}
+
+// writeConsistency returns the consistency a write asks for, defaulting to
+// -write-consistency.
+func (s *Server) writeConsistency(r *http.Request) (WriteConsistency, error) {
+	if v := r.Header.Get(consistencyHeader); v != "" {
+		return ParseWriteConsistency(v)
+	}
+	return s.config.WriteConsistency, nil
+}
+
+// replicas returns how many copies of the data the cluster keeps, the
+// leader's included, as set by the replication factor of the cluster
+// config, and how many of them make a quorum.
+func (s *Server) replicas() (all, quorum int) {
+	settings, _ := s.clusterConfig.Settings()
+	return settings.ReplicationFactor, settings.ReplicationFactor/2 + 1
+}
+
+// errReplicationTimeout is returned when a write is not applied by as many
+// replicas as its consistency asks for in time. The write is not undone.
+var errReplicationTimeout = errors.New("write not replicated in time")
+
+// replicatedBy returns the last sequence applied by at least n replicas,
+// the leader included. The caller must hold the lock.
+func (l *replicationLeader) replicatedBy(n int) uint64 {
+	applied := []uint64{l.server.lastSequence()}
+	for _, f := range l.followers {
+		applied = append(applied, f.Applied)
+	}
+	if n > len(applied) {
+		return 0
+	}
+
+	slices.SortFunc(applied, func(a, b uint64) int {
+		return cmpUint64(b, a)
+	})
+	return applied[max(n, 1)-1]
+}
+
+// awaitReplicas waits until n replicas, the leader included, have applied
+// the event of a sequence, for up to -replication-timeout.
+func (l *replicationLeader) awaitReplicas(ctx context.Context, sequence uint64, n int) error {
+	timer := time.NewTimer(l.server.config.ReplicationTimeout)
+	defer timer.Stop()
+
+	for {
+		l.mu.Lock()
+		acked, done := l.acked, l.replicatedBy(n) >= sequence
+		l.mu.Unlock()
+
+		if done {
+			return nil
+		}
+		select {
+		case <-acked:
+		case <-timer.C:
+			return errReplicationTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readIndex returns the last sequence a quorum of replicas has applied.
+// It never goes back, so that a quorum read sees the writes acknowledged
+// with WriteQuorum even after some of the replicas that applied them have
+// gone away.
+func (l *replicationLeader) readIndex() uint64 {
+	_, quorum := l.server.replicas()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.quorumSequence = max(l.quorumSequence, l.replicatedBy(quorum))
+	return l.quorumSequence
+}
+
+// readIndexResponse answers a follower asking for the read index.
+type readIndexResponse struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+const replicationReadIndexMethod = "/cavee.Replication/ReadIndex"
+
+func readIndexHandler(srv any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+	var req followerMessage
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return &readIndexResponse{Sequence: srv.(*replicationLeader).readIndex()}, nil
+}
+
+// awaitReadIndex asks the leader for the read index and waits until the
+// follower has applied it, for up to -replication-timeout.
+func (f *replicationFollower) awaitReadIndex(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, f.server.config.ReplicationTimeout)
+	defer cancel()
+
+	var resp readIndexResponse
+	if err := f.conn.Invoke(ctx, replicationReadIndexMethod, &followerMessage{NodeID: f.server.config.NodeID}, &resp); err != nil {
+		return err
+	}
+
+	for {
+		f.mu.Lock()
+		applied, changed := f.progress.Applied, f.applied
+		f.mu.Unlock()
+
+		if applied >= resp.Sequence {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serveRead serves a read sent to a follower at the consistency it asks
+// for: from the follower's own store if it is recent enough, and from the
+// leader otherwise.
+func (s *Server) serveRead(w http.ResponseWriter, r *http.Request, next http.Handler, leader RingNode) {
+	consistency, err := s.readConsistency(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	switch consistency {
+	case ReadLeader:
+		s.forward(w, r, leader)
+	case ReadQuorum:
+		if err = s.follower.awaitReadIndex(r.Context()); err != nil {
+			slog.DebugContext(r.Context(), "forwarding quorum read to leader", slog.String("error", err.Error()))
+			s.forward(w, r, leader)
+			return
+		}
+		next.ServeHTTP(w, r)
+	case ReadAny:
+		if s.checkReplicaLag(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// heldResponse buffers a response until the write it answers has been
+// replicated. Its header is that of the response it is sent with.
+type heldResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (h *heldResponse) Header() http.Header {
+	return h.header
+}
+
+func (h *heldResponse) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *heldResponse) Write(b []byte) (int, error) {
+	h.WriteHeader(http.StatusOK)
+	return h.body.Write(b)
+}
+
+func (h *heldResponse) send(w http.ResponseWriter) {
+	w.WriteHeader(cmp.Or(h.status, http.StatusOK))
+	w.Write(h.body.Bytes())
+}
+
+// replicateWrites holds back the response to a successful write sent to the
+// leader until as many replicas as its consistency asks for have applied
+// it: the sequence in its X-Cavee-Sequence, or the last one logged for
+// writes that do not send one. Writes not replicated within
+// -replication-timeout are answered with 504; they are not undone.
+func (s *Server) replicateWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLoggedWrite(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		consistency, err := s.writeConsistency(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		if consistency == WriteOne {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		held := &heldResponse{header: w.Header()}
+		next.ServeHTTP(held, r)
+		if held.status >= http.StatusMultipleChoices {
+			held.send(w)
+			return
+		}
+
+		sequence := s.lastSequence()
+		if v := held.header.Get("X-Cavee-Sequence"); v != "" {
+			sequence, _ = strconv.ParseUint(v, 10, 64)
+		}
+		all, quorum := s.replicas()
+		n := quorum
+		if consistency == WriteAll {
+			n = all
+		}
+
+		if err = s.leader.awaitReplicas(r.Context(), sequence, n); err != nil {
+			slog.WarnContext(r.Context(), "write not replicated",
+				slog.Uint64("sequence", sequence),
+				slog.String("consistency", string(consistency)),
+				slog.String("error", err.Error()),
+			)
+			writeError(w, r, http.StatusGatewayTimeout, ErrorCodeReplicationTimeout,
+				fmt.Sprintf("write was logged as sequence %d but not applied by %d replicas within %s", sequence, n, s.config.ReplicationTimeout))
+			return
+		}
+		held.send(w)
+	})
+}
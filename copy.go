@@ -0,0 +1,47 @@
+package cavee
+
+import (
+	"net/http"
+	"time"
+)
+
+// CopyHandler writes the value, content type and tags of a key to the
+// destination key, without the client downloading and uploading the value.
+// It is logged as an ordinary put of the destination, so the copy does not
+// depend on the source surviving in the log. The destination must not exist
+// unless overwrite is set.
+func (s *Server) CopyHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	req, ok := s.readKeyDestination(w, r, key)
+	if !ok {
+		return
+	}
+
+	unlock := s.store.LockKeys(ns, key, req.Destination)
+	defer unlock()
+
+	current, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if _, err = s.store.Get(r.Context(), ns, req.Destination); err == nil && !req.Overwrite {
+		writeError(w, r, http.StatusConflict, ErrorCodeKeyExists, "destination already exists")
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePut, Namespace: ns, Key: req.Destination, Value: current.Value, ContentType: current.ContentType, Tags: current.Tags, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Put(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusCreated)
+}
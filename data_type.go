@@ -0,0 +1,199 @@
+package cavee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Data types such as sets are kept as ordinary values, encoded as JSON and
+// written with a content type of their own, which tells their keys apart
+// from those holding anything else. Their operations read the value, change
+// it and log the result as a put, so every logger, replica and export
+// handles them like any other key.
+
+var ErrWrongType = errors.New("key holds a value of another type")
+
+// ErrInvalidDataType is returned for a write of a value that does not decode
+// as the data type its content type names.
+var ErrInvalidDataType = errors.New("invalid data type value")
+
+// isDataType reports whether contentType is that of a data type, whose
+// values are checked and normalized by normalizeEvent however they are
+// written.
+func isDataType(contentType string) bool {
+	switch contentType {
+	case setContentType, hashContentType, sortedSetContentType:
+		return true
+	default:
+		return false
+	}
+}
+
+// normalizeDataType checks a value written with the content type of a data
+// type and returns it in the form the type's operations keep it in: the
+// members of a set sorted and listed once, the fields of a hash in order and
+// the members of a sorted set listed once, in score order, the last listing
+// of a member winning. The operations search values relying on that form. An
+// empty data type is kept as no key at all, so it cannot be written.
+func normalizeDataType(contentType, value string) (string, error) {
+	var (
+		normalized string
+		err        error
+	)
+	entry := Entry{Value: value}
+	switch contentType {
+	case setContentType:
+		var members set
+		if members, err = decodeSet(entry); err == nil {
+			slices.Sort(members)
+			normalized, err = slices.Compact(members).encode()
+		}
+	case hashContentType:
+		var fields hash
+		if fields, err = decodeHash(entry); err == nil {
+			normalized, err = fields.encode()
+		}
+	case sortedSetContentType:
+		var members sortedSet
+		if members, err = decodeSortedSet(entry); err == nil {
+			seen := make(map[string]bool, len(members))
+			var listed sortedSet
+			for _, m := range slices.Backward(members) {
+				if !seen[m.Member] {
+					seen[m.Member] = true
+					listed = append(listed, m)
+				}
+			}
+			slices.SortFunc(listed, compareScored)
+			normalized, err = listed.encode()
+		}
+	default:
+		return value, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidDataType, err)
+	}
+	if normalized == "" {
+		return "", fmt.Errorf("%w: an empty %s is kept as no key at all", ErrInvalidDataType, contentType)
+	}
+	return normalized, nil
+}
+
+// normalizeEvent normalizes the values an event writes with the content type
+// of a data type, those of a put or of the puts of a transaction. Every
+// logged write goes through it, so no route can store a value the type's
+// operations would fail to decode. Appends with such a content type are
+// refused, since appending to a valid value never leaves one.
+func normalizeEvent(e *Event) error {
+	var err error
+	switch e.Type {
+	case EventTypePut:
+		e.Value, err = normalizeDataType(e.ContentType, e.Value)
+	case EventTypeAppend:
+		if isDataType(e.ContentType) {
+			err = fmt.Errorf("%w: values of %s cannot be appended to", ErrInvalidDataType, e.ContentType)
+		}
+	case EventTypeTxn:
+		var writes []txnOp
+		if writes, err = decodeTxnWrites(e.Value); err != nil {
+			return err
+		}
+		normalized := false
+		for i := range writes {
+			if writes[i].Op == txnOpPut && isDataType(writes[i].ContentType) {
+				if writes[i].Value, err = normalizeDataType(writes[i].ContentType, writes[i].Value); err != nil {
+					return err
+				}
+				normalized = true
+			}
+		}
+		if normalized {
+			var value []byte
+			if value, err = json.Marshal(writes); err == nil {
+				e.Value = string(value)
+			}
+		}
+	}
+
+	return err
+}
+
+// writeDataTypeError reports a value that does not decode as its data type,
+// if err is one, and reports whether it was.
+func writeDataTypeError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, ErrInvalidDataType) {
+		return false
+	}
+	writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+	return true
+}
+
+// getTyped returns the entry of a key holding a value of the data type with
+// contentType, reporting whether it exists. A key holding anything else
+// fails with ErrWrongType. For a read, the value is passed through the read
+// transforms of ns, as it would be for a GET of the key.
+func (s *Server) getTyped(r *http.Request, ns, key, contentType string) (Entry, bool, error) {
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if errors.Is(err, ErrNoSuchKey) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if entry.ContentType != contentType {
+		return Entry{}, false, fmt.Errorf("%w than %s", ErrWrongType, contentType)
+	}
+	if isReadMethod(r.Method) {
+		if entry.Value, err = s.readValue(r.Context(), ns, entry.Value); err != nil {
+			return Entry{}, false, err
+		}
+	}
+
+	return entry, true, nil
+}
+
+// writeTyped logs and applies the new value of a key holding a data type,
+// keeping its tags, or deletes the key if value is empty. Like any PUT, a
+// write clears the key's TTL. It writes the error response if it fails.
+// The caller holds the key's lock.
+func (s *Server) writeTyped(w http.ResponseWriter, r *http.Request, ns, key string, current Entry, value, contentType string) (Event, bool) {
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+		return Event{}, false
+	}
+	if maxSize := s.config.MaxValueSize; maxSize > 0 && int64(len(value)) > maxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge,
+			fmt.Sprintf("value would be %d bytes, more than the limit of %d", len(value), maxSize))
+		return Event{}, false
+	}
+
+	e := Event{Type: EventTypePut, Namespace: ns, Key: key, Value: value, ContentType: contentType, Tags: current.Tags, Time: time.Now()}
+	if value == "" {
+		e = Event{Type: EventTypeDelete, Namespace: ns, Key: key, Time: e.Time}
+	}
+
+	e, err := s.writeEvent(r.Context(), e)
+	if err != nil {
+		writeLogError(w, r, err)
+		return Event{}, false
+	}
+	if e.Type == EventTypeDelete {
+		err = s.store.Delete(r.Context(), e)
+	} else {
+		err = s.store.Put(r.Context(), e)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return Event{}, false
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	return e, true
+}
@@ -0,0 +1,93 @@
+package cavee_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// jsonEqual reports whether b holds the same JSON value as want.
+func jsonEqual(b []byte, want string) bool {
+	var got, w any
+	return json.Unmarshal(b, &got) == nil && json.Unmarshal([]byte(want), &w) == nil && reflect.DeepEqual(got, w)
+}
+
+// Values written with the content type of a data type by the generic routes
+// must decode as that type, and are kept in the form its operations rely
+// on.
+func TestDataTypeValues(t *testing.T) {
+	inst := caveetest.Start(t)
+
+	for _, tc := range []struct {
+		name, key, contentType string
+		// value is a valid value, not in normal form, which then reads as
+		// want through path.
+		value, path, want string
+		invalid           string
+		// member is found, once the value is written, through member.
+		member string
+	}{
+		{
+			name: "set", key: "s", contentType: "application/vnd.cavee.set+json",
+			value: `["c","a","c","b"]`, path: "/members", want: `{"members":["a","b","c"],"cardinality":3}`,
+			invalid: `{"a":1}`, member: "/members/a",
+		},
+		{
+			name: "hash", key: "h", contentType: "application/vnd.cavee.hash+json",
+			value: `{"b":"2","a":"1"}`, path: "/fields", want: `{"fields":{"a":"1","b":"2"},"count":2}`,
+			invalid: `["a"]`, member: "/fields/a",
+		},
+		{
+			name: "sorted set", key: "z", contentType: "application/vnd.cavee.sorted-set+json",
+			value: `[{"member":"b","score":2},{"member":"a","score":3},{"member":"a","score":1}]`, path: "/scores",
+			want:    `{"members":[{"member":"a","score":1},{"member":"b","score":2}],"cardinality":2}`,
+			invalid: `[{"member":"a","score":"high"}]`, member: "/scores/a",
+		},
+	} {
+		header := http.Header{"Content-Type": {tc.contentType}}
+		key := "/v1/key/" + tc.key
+
+		if resp, b := doRequest(t, inst, http.MethodPut, key, tc.value, header); resp.StatusCode != http.StatusCreated {
+			t.Errorf("PUT of a %s answered %d, want 201: %s", tc.name, resp.StatusCode, b)
+			continue
+		}
+		if b := mustRequest(t, inst, http.MethodGet, key+tc.path, "", http.StatusOK); !jsonEqual(b, tc.want) {
+			t.Errorf("%s reads as %s, want %s", tc.name, b, tc.want)
+		}
+		if resp, b := doRequest(t, inst, http.MethodGet, key+tc.member, "", nil); resp.StatusCode/100 != 2 {
+			t.Errorf("%s does not hold a, answering %d: %s", tc.name, resp.StatusCode, b)
+		}
+
+		for _, write := range []struct {
+			method, path, body string
+		}{
+			{http.MethodPut, key, tc.invalid},
+			{http.MethodPut, key, "[]"},
+			{http.MethodPost, "/v1/txn", `{"then":[{"op":"put","key":"t","content_type":"` + tc.contentType + `","value":` + strconv.Quote(tc.invalid) + `}]}`},
+			{http.MethodPost, "/v1/import", `{"key":"i","content_type":"` + tc.contentType + `","value":` + strconv.Quote(tc.invalid) + `}`},
+		} {
+			resp, b := doRequest(t, inst, write.method, write.path, write.body, header)
+			var e cavee.ErrorResponse
+			if resp.StatusCode != http.StatusBadRequest || json.Unmarshal(b, &e) != nil || e.Code != cavee.ErrorCodeInvalidRequest {
+				t.Errorf("invalid %s written with %s %s answered %d, want 400: %s", tc.name, write.method, write.path, resp.StatusCode, b)
+			}
+		}
+		if b := mustRequest(t, inst, http.MethodGet, key+tc.path, "", http.StatusOK); !jsonEqual(b, tc.want) {
+			t.Errorf("%s reads as %s after invalid writes, want %s", tc.name, b, tc.want)
+		}
+
+		// Appending could never leave a valid value.
+		if resp, b := doRequest(t, inst, http.MethodPost, "/v1/key/a/append", tc.value, header); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("append creating a %s answered %d, want 400: %s", tc.name, resp.StatusCode, b)
+		}
+	}
+
+	mustFail(t, inst, http.MethodGet, "/v1/key/t", "", http.StatusNotFound, cavee.ErrorCodeNoSuchKey)
+	mustFail(t, inst, http.MethodGet, "/v1/key/i", "", http.StatusNotFound, cavee.ErrorCodeNoSuchKey)
+	mustFail(t, inst, http.MethodGet, "/v1/key/a", "", http.StatusNotFound, cavee.ErrorCodeNoSuchKey)
+}
@@ -0,0 +1,147 @@
+package cavee
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS discovery finds the nodes of the cluster from the records of a DNS
+// name, such as that of a headless Kubernetes service, and looks them up
+// again every -cluster-dns-interval to follow the cluster as it scales.
+// Names starting with an underscore, as _gossip._tcp.cavee.default.svc, are
+// looked up as SRV records, which carry the port of each node; others as
+// A and AAAA records, whose nodes listen on the port of this node.
+//
+// With gossip, the nodes found are joined through their gossip address,
+// and gossip takes care of those that go away. Without it, they make up
+// the hash ring, with their HTTP address: a node found by SRV has the ID of
+// the first label of its target, the pod name in a StatefulSet, and one
+// found by address has the address as ID.
+
+// dnsLookupTimeout bounds one lookup of the cluster's DNS name.
+const dnsLookupTimeout = 5 * time.Second
+
+// dnsPeer is a node found in the cluster's DNS records.
+type dnsPeer struct {
+	id   string
+	host string
+	port int
+}
+
+// lookupPeers looks up the nodes of the cluster's DNS name, giving those
+// found by address defaultPort.
+func lookupPeers(ctx context.Context, name string, defaultPort int) ([]dnsPeer, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	var peers []dnsPeer
+	if strings.HasPrefix(name, "_") {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			id, _, _ := strings.Cut(host, ".")
+			peers = append(peers, dnsPeer{id: id, host: host, port: int(srv.Port)})
+		}
+	} else {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			peers = append(peers, dnsPeer{id: addr, host: addr, port: defaultPort})
+		}
+	}
+
+	slices.SortFunc(peers, func(a, b dnsPeer) int {
+		return strings.Compare(a.id, b.id)
+	})
+	return peers, nil
+}
+
+// addrPort returns the port of a host:port address.
+func addrPort(addr string) (int, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(p)
+}
+
+// discoverPeers looks up the cluster's DNS name now and every
+// -cluster-dns-interval until the server closes. Failed lookups keep the
+// nodes found before.
+func (s *Server) discoverPeers() {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(s.config.ClusterDNSInterval)
+	defer ticker.Stop()
+
+	for {
+		s.discoverPeersOnce()
+
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *Server) discoverPeersOnce() {
+	// Nodes found by address are reached on the port this node uses.
+	addr := s.config.Addr
+	if s.gossip != nil {
+		addr = cmp.Or(s.config.GossipAdvertise, s.config.GossipAddr)
+	}
+	port, err := addrPort(addr)
+	if err != nil {
+		slog.Error("invalid address for cluster DNS discovery", slog.String("addr", addr), slog.String("error", err.Error()))
+		return
+	}
+
+	peers, err := lookupPeers(context.Background(), s.config.ClusterDNS, port)
+	if err != nil {
+		slog.Warn("failed to look up cluster peers", slog.String("name", s.config.ClusterDNS), slog.String("error", err.Error()))
+		return
+	}
+
+	if s.gossip != nil {
+		var addrs []string
+		for _, peer := range peers {
+			if peer.id != s.config.NodeID {
+				addrs = append(addrs, net.JoinHostPort(peer.host, strconv.Itoa(peer.port)))
+			}
+		}
+		s.gossip.joinNew(addrs)
+		return
+	}
+
+	scheme := "http"
+	if s.config.TLSCert != "" || s.config.VaultTLSPath != "" {
+		scheme = "https"
+	}
+	nodes := []RingNode{{ID: s.config.NodeID, URL: s.config.AdvertiseURL}}
+	for _, peer := range peers {
+		if peer.id != s.config.NodeID {
+			nodes = append(nodes, RingNode{ID: peer.id, URL: fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(peer.host, strconv.Itoa(peer.port)))})
+		}
+	}
+	slices.SortFunc(nodes, func(a, b RingNode) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	if !slices.Equal(nodes, s.ring.Nodes()) {
+		s.ring.SetNodes(nodes)
+		slog.Info("cluster peers changed", slog.String("name", s.config.ClusterDNS), slog.Int("nodes", len(nodes)))
+	}
+}
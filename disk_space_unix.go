@@ -0,0 +1,16 @@
+//go:build unix
+
+package cavee
+
+import "syscall"
+
+// diskSpace returns the free and total bytes of the file system holding
+// path.
+func diskSpace(path string) (free, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
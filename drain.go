@@ -0,0 +1,100 @@
+package cavee
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type drainResponse struct {
+	// Drained is set if every other request finished before the timeout.
+	Drained  bool  `json:"drained"`
+	InFlight int64 `json:"in_flight"`
+	Exiting  bool  `json:"exiting"`
+}
+
+// DrainHandler takes the server out of rotation: readiness starts failing,
+// the requests already being served are waited for, up to ?timeout or the
+// shutdown timeout, and the transaction log is flushed. With ?exit=true the
+// server then shuts down, which ExitRequested tells the process about.
+func (s *Server) DrainHandler(w http.ResponseWriter, r *http.Request) {
+	timeout := s.config.ShutdownTimeout
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		var err error
+		if timeout, err = time.ParseDuration(raw); err != nil || timeout < 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "timeout must be a non-negative duration")
+			return
+		}
+	}
+	exit, _ := strconv.ParseBool(r.URL.Query().Get("exit"))
+
+	s.draining.Store(true)
+	slog.InfoContext(r.Context(), "draining", slog.Duration("timeout", timeout), slog.Bool("exit", exit))
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	resp := drainResponse{Drained: s.waitForRequests(ctx), Exiting: exit}
+	// The drain request itself is in flight.
+	resp.InFlight = s.requests.inFlight.Load() - 1
+
+	if flusher, ok := s.transact.(Flusher); ok {
+		if err := flusher.Flush(context.WithoutCancel(ctx)); err != nil {
+			slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "drained", slog.Bool("drained", resp.Drained), slog.Int64("in_flight", resp.InFlight))
+
+	if exit {
+		s.exitOnce.Do(func() { close(s.exit) })
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UndrainHandler puts a drained server back into rotation, unless it is
+// shutting down.
+func (s *Server) UndrainHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.exit:
+		writeError(w, r, http.StatusConflict, ErrorCodeNotReady, "server is shutting down")
+		return
+	case <-s.closing:
+		writeError(w, r, http.StatusConflict, ErrorCodeNotReady, "server is shutting down")
+		return
+	default:
+	}
+
+	if s.draining.Swap(false) {
+		slog.InfoContext(r.Context(), "undrained")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// waitForRequests waits until the only request in flight is the caller's
+// own, and reports whether that happened before ctx was done.
+func (s *Server) waitForRequests(ctx context.Context) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for s.requests.inFlight.Load() > 1 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// ExitRequested is closed once a drain has asked for the server to exit.
+func (s *Server) ExitRequested() <-chan struct{} {
+	return s.exit
+}
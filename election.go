@@ -0,0 +1,185 @@
+package cavee
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// electionRecheck is how often a campaign or observer looks at the lock
+// again even if it has not been told it changed.
+const electionRecheck = time.Second
+
+// electionLock returns the name of the lock whose holder leads an
+// election. Elections can be inspected and managed through the lock
+// endpoints under that name too.
+func electionLock(name string) string {
+	return "election/" + name
+}
+
+// waitForLock waits until the lock may have changed hands: it has been
+// written or deleted, or the current holder's lease has run out. It
+// returns false if the request or the server is going away first, or the
+// deadline, if any, passes.
+func (s *Server) waitForLock(r *http.Request, sub *watchSubscriber, holder lockResponse, deadline <-chan time.Time) bool {
+	expiry := time.NewTimer(time.Until(holder.ExpiresAt))
+	defer expiry.Stop()
+	recheck := time.NewTimer(electionRecheck)
+	defer recheck.Stop()
+
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-s.closing:
+		return false
+	case <-deadline:
+		return false
+	case _, ok := <-sub.messages:
+		// A subscriber that fell behind is dropped, which only costs it
+		// the wait: the lock is looked at again either way.
+		if !ok {
+			<-recheck.C
+		}
+	case <-expiry.C:
+	case <-recheck.C:
+	}
+
+	return true
+}
+
+// CampaignHandler waits until the caller leads the election, that is holds
+// its lock, for up to ?timeout= seconds or, without one, for as long as the
+// request lasts. The body is that of taking a lock, and the leader keeps
+// leading by renewing the lease with the keepalive endpoint, passing the
+// fencing token it was elected with. A campaign that times out fails with
+// 409 and the current leader.
+func (s *Server) CampaignHandler(w http.ResponseWriter, r *http.Request) {
+	ns, name := r.PathValue("ns"), electionLock(r.PathValue("name"))
+	if !s.checkLockName(w, r, name) {
+		return
+	}
+
+	var deadline <-chan time.Time
+	if raw := r.URL.Query().Get("timeout"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds < 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "timeout must be a number of seconds")
+			return
+		}
+		timer := time.NewTimer(time.Duration(seconds) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	req, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Subscribing before the first attempt means no release can be missed
+	// between an attempt and the wait after it.
+	sub, err := s.watchHub.subscribe(ns, lockKey(name), false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+	defer s.watchHub.unsubscribe(sub)
+
+	for {
+		lock, held, ok := s.takeLock(w, r, ns, name, req)
+		if !ok {
+			return
+		}
+		if !held {
+			setSequenceHeader(w, lock.Token)
+			writeJSON(w, http.StatusOK, lock)
+			return
+		}
+
+		if !s.waitForLock(r, sub, lock, deadline) {
+			if r.Context().Err() == nil {
+				writeError(w, r, http.StatusConflict, ErrorCodeLockHeld, "election is led by "+strconv.Quote(lock.Holder))
+			}
+			return
+		}
+	}
+}
+
+// GetLeaderHandler reports who leads an election, with their fencing token
+// and when their lease runs out.
+func (s *Server) GetLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLock(w, r, r.PathValue("ns"), electionLock(r.PathValue("name")))
+}
+
+// ObserveHandler streams the leaders of an election as server-sent events:
+// a leader event each time somebody is elected, and a vacant event when
+// the leader resigns or its lease runs out with nobody taking over.
+func (s *Server) ObserveHandler(w http.ResponseWriter, r *http.Request) {
+	ns, name := r.PathValue("ns"), electionLock(r.PathValue("name"))
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	sub, err := s.watchHub.subscribe(ns, lockKey(name), false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+	defer s.watchHub.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	// last is the token of the leader last sent, or 0 once the election
+	// has been reported vacant; sent tells whether anything has been.
+	var last uint64
+	sent := false
+	for {
+		leader := lockResponse{Name: name}
+		holder, entry, err := s.getLock(r, ns, name)
+		if err == nil {
+			leader = lockResponse{Name: name, Holder: holder.Holder, Token: entry.Version, ExpiresAt: entry.ExpiresAt.UTC()}
+		}
+
+		if !sent || leader.Token != last {
+			if leader.Token == 0 {
+				err = writeSSE(w, "vacant", map[string]any{"name": name})
+			} else {
+				err = writeSSE(w, "leader", leader)
+			}
+			if err != nil {
+				return
+			}
+			if err = rc.Flush(); err != nil {
+				return
+			}
+			last, sent = leader.Token, true
+		}
+
+		if leader.Token == 0 {
+			leader.ExpiresAt = time.Now().Add(electionRecheck)
+		}
+		if !s.waitForLock(r, sub, leader, nil) {
+			return
+		}
+	}
+}
+
+// ResignHandler gives up the leadership held with the fencing token in
+// ?token=, so that another candidate can be elected straight away.
+func (s *Server) ResignHandler(w http.ResponseWriter, r *http.Request) {
+	s.releaseLock(w, r, r.PathValue("ns"), electionLock(r.PathValue("name")))
+}
+
+// KeepAliveLeaderHandler renews the lease of the leader with the fencing
+// token in ?token=.
+func (s *Server) KeepAliveLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	s.keepAliveLock(w, r, r.PathValue("ns"), electionLock(r.PathValue("name")))
+}
@@ -0,0 +1,65 @@
+package cavee
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// LoadEncryptionKey returns the transaction log encryption key, or nil when
+// encryption is not configured. The key is taken from the first of these
+// that is set:
+//
+//   - the output of -tlog-key-command, run through the shell, which lets the
+//     key be unwrapped by an external KMS (e.g. "aws kms decrypt ...")
+//   - the -tlog-key flag
+//   - the CAVEE_TLOG_KEY environment variable
+//
+// Keys are hex or base64 encoded AES keys of 16, 24 or 32 bytes. The flag and
+// variable may also name a Vault secret holding the key.
+func LoadEncryptionKey(config *Config) (key []byte, err error) {
+	encoded := config.TransactionLogKey
+	if encoded == "" {
+		encoded = os.Getenv("CAVEE_TLOG_KEY")
+	}
+	if encoded, err = resolveSecret(config, encoded); err != nil {
+		return nil, err
+	}
+
+	if config.TransactionLogKeyCommand != "" {
+		out, err := exec.Command("sh", "-c", config.TransactionLogKeyCommand).Output()
+		if err != nil {
+			return nil, fmt.Errorf("transaction log key command failed: %w", err)
+		}
+		encoded = string(out)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	if key, err = decodeAESKey(encoded); err != nil {
+		return nil, fmt.Errorf("transaction log %w", err)
+	}
+	return key, nil
+}
+
+// decodeAESKey decodes a hex or base64 encoded AES key of 16, 24 or 32 bytes.
+func decodeAESKey(encoded string) (key []byte, err error) {
+	if key, err = hex.DecodeString(encoded); err != nil {
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("key is neither hex nor base64")
+		}
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+}
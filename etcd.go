@@ -0,0 +1,990 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The etcd gateway serves the KV and watch calls of the etcd v3 API in the
+// JSON form of etcd's own gRPC gateway: every call is a POST of the request
+// message to /v3/<service>/<method>, keys and values are base64 encoded, and
+// 64-bit integers are written as strings. With -etcd-grpc-addr, the same
+// calls are served over gRPC as well, for clientv3 and etcdctl.
+// Revisions are sequence numbers and keys are those of the default
+// namespace. Leases, nested transactions and compares over key ranges are
+// not supported.
+
+// etcdNamespace is the namespace the etcd gateway serves, etcd having none.
+const etcdNamespace = ""
+
+// etcd error codes, which are gRPC's.
+const (
+	etcdCodeInvalidArgument  = 3
+	etcdCodePermissionDenied = 7
+	etcdCodeOutOfRange       = 11
+	etcdCodeUnimplemented    = 12
+	etcdCodeInternal         = 13
+	etcdCodeUnavailable      = 14
+)
+
+var (
+	errEtcdInvalid        = errors.New("etcdserver: invalid request")
+	errEtcdEmptyKey       = errors.New("etcdserver: key is not provided")
+	errEtcdDuplicateKey   = errors.New("etcdserver: duplicate key given in txn request")
+	errEtcdUnsupported    = errors.New("etcdserver: not supported by cavee")
+	errEtcdFutureRevision = errors.New("etcdserver: mvcc: required revision is a future revision")
+	errEtcdCompacted      = errors.New("etcdserver: mvcc: required revision has been compacted")
+)
+
+// isEtcdRead reports whether path is an etcd gateway call that leaves the
+// store as it is. Unlike the rest of the API, the gateway takes every call
+// as a POST, reads included.
+func isEtcdRead(path string) bool {
+	return path == "/v3/kv/range" || path == "/v3/watch"
+}
+
+// etcdInt is a 64-bit integer as the gateway writes it, quoted. Both quoted
+// and bare numbers are read.
+type etcdInt int64
+
+func (n etcdInt) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(n), 10) + `"`), nil
+}
+
+func (n *etcdInt) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", b)
+	}
+	*n = etcdInt(v)
+
+	return nil
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision,omitempty"`
+}
+
+type etcdKeyValue struct {
+	Key            []byte  `json:"key,omitempty"`
+	CreateRevision etcdInt `json:"create_revision,omitempty"`
+	ModRevision    etcdInt `json:"mod_revision,omitempty"`
+	Version        etcdInt `json:"version,omitempty"`
+	Value          []byte  `json:"value,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key        []byte  `json:"key"`
+	RangeEnd   []byte  `json:"range_end"`
+	Limit      etcdInt `json:"limit"`
+	Revision   etcdInt `json:"revision"`
+	SortOrder  string  `json:"sort_order"`
+	SortTarget string  `json:"sort_target"`
+	KeysOnly   bool    `json:"keys_only"`
+	CountOnly  bool    `json:"count_only"`
+}
+
+type etcdRangeResponse struct {
+	Header *etcdHeader     `json:"header,omitempty"`
+	Kvs    []*etcdKeyValue `json:"kvs,omitempty"`
+	More   bool            `json:"more,omitempty"`
+	Count  etcdInt         `json:"count,omitempty"`
+}
+
+type etcdPutRequest struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	Lease       etcdInt `json:"lease"`
+	PrevKv      bool    `json:"prev_kv"`
+	IgnoreValue bool    `json:"ignore_value"`
+	IgnoreLease bool    `json:"ignore_lease"`
+}
+
+type etcdPutResponse struct {
+	Header *etcdHeader   `json:"header,omitempty"`
+	PrevKv *etcdKeyValue `json:"prev_kv,omitempty"`
+}
+
+type etcdDeleteRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+	PrevKv   bool   `json:"prev_kv"`
+}
+
+type etcdDeleteRangeResponse struct {
+	Header  *etcdHeader     `json:"header,omitempty"`
+	Deleted etcdInt         `json:"deleted,omitempty"`
+	PrevKvs []*etcdKeyValue `json:"prev_kvs,omitempty"`
+}
+
+// etcdCompare is a condition of a transaction. Result defaults to EQUAL and
+// Target to VERSION, as in etcd.
+type etcdCompare struct {
+	Result         string  `json:"result"`
+	Target         string  `json:"target"`
+	Key            []byte  `json:"key"`
+	RangeEnd       []byte  `json:"range_end"`
+	Version        etcdInt `json:"version"`
+	CreateRevision etcdInt `json:"create_revision"`
+	ModRevision    etcdInt `json:"mod_revision"`
+	Value          []byte  `json:"value"`
+	Lease          etcdInt `json:"lease"`
+}
+
+type etcdRequestOp struct {
+	RequestRange       *etcdRangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *etcdPutRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRangeRequest `json:"request_delete_range,omitempty"`
+	RequestTxn         json.RawMessage         `json:"request_txn,omitempty"`
+}
+
+type etcdResponseOp struct {
+	ResponseRange       *etcdRangeResponse       `json:"response_range,omitempty"`
+	ResponsePut         *etcdPutResponse         `json:"response_put,omitempty"`
+	ResponseDeleteRange *etcdDeleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+	Failure []etcdRequestOp `json:"failure"`
+}
+
+type etcdTxnResponse struct {
+	Header    *etcdHeader      `json:"header,omitempty"`
+	Succeeded bool             `json:"succeeded,omitempty"`
+	Responses []etcdResponseOp `json:"responses,omitempty"`
+}
+
+type etcdError struct {
+	Error   string `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeEtcdError writes an error the way the etcd gateway does.
+func writeEtcdError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := http.StatusInternalServerError, etcdCodeInternal
+	switch {
+	case errors.Is(err, errEtcdInvalid), errors.Is(err, errEtcdEmptyKey), errors.Is(err, errEtcdDuplicateKey), errors.Is(err, ErrKeyTooLong):
+		status, code = http.StatusBadRequest, etcdCodeInvalidArgument
+	case errors.Is(err, errEtcdFutureRevision), errors.Is(err, errEtcdCompacted):
+		status, code = http.StatusBadRequest, etcdCodeOutOfRange
+	case errors.Is(err, ErrSnapshotTooOld):
+		status, code, err = http.StatusBadRequest, etcdCodeOutOfRange, errEtcdCompacted
+	case errors.Is(err, errEtcdUnsupported), errors.Is(err, ErrEventUnsupported):
+		status, code = http.StatusNotImplemented, etcdCodeUnimplemented
+	case errors.Is(err, ErrLogQueueFull):
+		slog.WarnContext(r.Context(), "rejected write", slog.String("error", err.Error()))
+		w.Header().Set("Retry-After", "1")
+		status, code = http.StatusServiceUnavailable, etcdCodeUnavailable
+	case errors.As(err, new(*errRejectedByHook)):
+		status, code = http.StatusForbidden, etcdCodePermissionDenied
+	case errors.As(err, new(*SchemaError)), errors.Is(err, ErrValueRejected), errors.Is(err, errTransformedTooLarge):
+		status, code = http.StatusBadRequest, etcdCodeInvalidArgument
+	default:
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		err = ErrInternalServerError
+	}
+
+	writeJSON(w, status, etcdError{Error: err.Error(), Code: code, Message: err.Error()})
+}
+
+// readEtcdRequest decodes the request message of a gateway call, writing the
+// error response if it is invalid.
+func readEtcdRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeBodyError(w, r, err)
+			return false
+		}
+		writeEtcdError(w, r, fmt.Errorf("%w: %w", errEtcdInvalid, err))
+		return false
+	}
+
+	return true
+}
+
+// etcdKeyRange is the keys a request names: key alone if end is empty, the
+// keys from key up to but not including end otherwise, or every key from
+// key on if end is a single zero byte.
+type etcdKeyRange struct {
+	key, end string
+}
+
+func newEtcdKeyRange(key, end []byte) (etcdKeyRange, error) {
+	if len(key) == 0 {
+		return etcdKeyRange{}, errEtcdEmptyKey
+	}
+
+	return etcdKeyRange{key: string(key), end: string(end)}, nil
+}
+
+func (kr etcdKeyRange) single() bool {
+	return kr.end == ""
+}
+
+func (kr etcdKeyRange) contains(key string) bool {
+	if kr.single() {
+		return key == kr.key
+	}
+
+	return key >= kr.key && (kr.end == "\x00" || key < kr.end)
+}
+
+// etcdRevisions returns the create revision and version etcd reports for an
+// entry. Keys restored from snapshots taken before creations were tracked
+// report their last write as their creation.
+func etcdRevisions(entry Entry) (create, version uint64) {
+	create = entry.CreatedVersion
+	if create == 0 {
+		create = entry.Version
+	}
+
+	return create, max(entry.Writes, 1)
+}
+
+// etcdTxnState is what the operations of a transaction see: the store as of
+// revision, with the writes made earlier in the transaction on top.
+type etcdTxnState struct {
+	s        *Server
+	ctx      context.Context
+	revision uint64
+
+	writes []txnOp
+	// overlay holds the entry each written key will have, or nil for the
+	// deleted ones. Their revisions are only known once the writes are
+	// logged, so they have a Version of 0 until then, and so do the key
+	// values made from them, which pending holds.
+	overlay map[string]*Entry
+	pending []*etcdKeyValue
+}
+
+func (s *Server) newEtcdTxnState(ctx context.Context) *etcdTxnState {
+	return &etcdTxnState{s: s, ctx: ctx, revision: s.lastSequence(), overlay: make(map[string]*Entry)}
+}
+
+func (st *etcdTxnState) header() *etcdHeader {
+	return &etcdHeader{Revision: etcdInt(st.revision)}
+}
+
+// kv returns the key value etcd reports for an entry, once the pre-read
+// hooks have allowed it, with its value as read transforms leave it.
+func (st *etcdTxnState) kv(key string, entry Entry, keysOnly bool) (*etcdKeyValue, error) {
+	if err := st.s.runPreReadHooks(st.ctx, etcdNamespace, key); err != nil {
+		return nil, err
+	}
+	create, version := etcdRevisions(entry)
+	kv := &etcdKeyValue{Key: []byte(key), CreateRevision: etcdInt(create), ModRevision: etcdInt(entry.Version), Version: etcdInt(version)}
+	if !keysOnly {
+		value, err := st.s.readValue(st.ctx, etcdNamespace, entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		kv.Value = []byte(value)
+	}
+	if entry.Version == 0 {
+		st.pending = append(st.pending, kv)
+	}
+
+	return kv, nil
+}
+
+// get returns the current entry of a key, if it exists.
+func (st *etcdTxnState) get(key string) (Entry, bool, error) {
+	if entry, ok := st.overlay[key]; ok {
+		if entry == nil {
+			return Entry{}, false, nil
+		}
+		return *entry, true, nil
+	}
+
+	entry, err := st.s.store.Get(st.ctx, etcdNamespace, key)
+	if errors.Is(err, ErrNoSuchKey) {
+		return Entry{}, false, nil
+	}
+
+	return entry, err == nil, err
+}
+
+// entries returns, sorted, the keys in a range that exist as of revision, or
+// now if it is 0, along with their entries.
+func (st *etcdTxnState) entries(kr etcdKeyRange, revision uint64) ([]string, map[string]Entry, error) {
+	if revision > st.revision {
+		return nil, nil, errEtcdFutureRevision
+	}
+
+	if revision > 0 && revision < st.revision {
+		if st.s.config.MVCCRetention == 0 {
+			return nil, nil, fmt.Errorf("%w: reads at a past revision need -mvcc-retention", errEtcdUnsupported)
+		}
+		keys, err := st.s.store.KeysAsOf(st.ctx, etcdNamespace, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = slices.DeleteFunc(keys, func(key string) bool { return !kr.contains(key) })
+		entries, err := st.s.store.EntriesAsOf(st.ctx, etcdNamespace, keys, revision)
+		if err != nil {
+			return nil, nil, err
+		}
+		return slices.Sorted(maps.Keys(entries)), entries, nil
+	}
+
+	entries := make(map[string]Entry)
+	if kr.single() {
+		entry, exists, err := st.get(kr.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			entries[kr.key] = entry
+		}
+		return slices.Sorted(maps.Keys(entries)), entries, nil
+	}
+
+	all, err := st.s.store.Entries(st.ctx, etcdNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, entry := range all {
+		if kr.contains(key) {
+			entries[key] = entry
+		}
+	}
+	for key, entry := range st.overlay {
+		if !kr.contains(key) {
+			continue
+		}
+		if entry == nil {
+			delete(entries, key)
+		} else {
+			entries[key] = *entry
+		}
+	}
+
+	return slices.Sorted(maps.Keys(entries)), entries, nil
+}
+
+func (st *etcdTxnState) rangeOp(req *etcdRangeRequest) (*etcdRangeResponse, error) {
+	kr, err := newEtcdKeyRange(req.Key, req.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	if (req.SortOrder != "" && req.SortOrder != "NONE" && req.SortOrder != "ASCEND") || (req.SortTarget != "" && req.SortTarget != "KEY") {
+		return nil, fmt.Errorf("%w: ranges are sorted by key only", errEtcdUnsupported)
+	}
+	if req.Limit < 0 || req.Revision < 0 {
+		return nil, fmt.Errorf("%w: limit and revision must not be negative", errEtcdInvalid)
+	}
+
+	keys, entries, err := st.entries(kr, uint64(req.Revision))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdRangeResponse{Header: st.header(), Count: etcdInt(len(keys))}
+	if req.CountOnly {
+		return resp, nil
+	}
+	if req.Limit > 0 && len(keys) > int(req.Limit) {
+		keys, resp.More = keys[:req.Limit], true
+	}
+	for _, key := range keys {
+		kv, err := st.kv(key, entries[key], req.KeysOnly)
+		if err != nil {
+			return nil, err
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+
+	return resp, nil
+}
+
+// write records a pending write of a key, which etcd allows once per
+// transaction.
+func (st *etcdTxnState) write(op txnOp, entry *Entry) error {
+	if _, ok := st.overlay[op.Key]; ok {
+		return errEtcdDuplicateKey
+	}
+
+	st.writes = append(st.writes, op)
+	st.overlay[op.Key] = entry
+
+	return nil
+}
+
+func (st *etcdTxnState) putOp(req *etcdPutRequest) (*etcdPutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, errEtcdEmptyKey
+	}
+	if req.Lease != 0 || req.IgnoreValue || req.IgnoreLease {
+		return nil, fmt.Errorf("%w: leases", errEtcdUnsupported)
+	}
+	key := string(req.Key)
+	if maxLength := st.s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		return nil, fmt.Errorf("%w: key is %d bytes long, more than the limit of %d", errEtcdInvalid, len(key), maxLength)
+	}
+
+	prev, exists, err := st.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{Value: string(req.Value), Writes: 1}
+	if exists {
+		entry.CreatedVersion, entry.Writes = prev.CreatedVersion, prev.Writes+1
+	}
+	if err = st.write(txnOp{Op: txnOpPut, Key: key, Value: string(req.Value)}, entry); err != nil {
+		return nil, err
+	}
+
+	resp := &etcdPutResponse{Header: st.header()}
+	if req.PrevKv && exists {
+		if resp.PrevKv, err = st.kv(key, prev, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+func (st *etcdTxnState) deleteRangeOp(req *etcdDeleteRangeRequest) (*etcdDeleteRangeResponse, error) {
+	kr, err := newEtcdKeyRange(req.Key, req.RangeEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, entries, err := st.entries(kr, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdDeleteRangeResponse{Header: st.header(), Deleted: etcdInt(len(keys))}
+	for _, key := range keys {
+		if err = st.write(txnOp{Op: txnOpDelete, Key: key}, nil); err != nil {
+			return nil, err
+		}
+		if req.PrevKv {
+			kv, err := st.kv(key, entries[key], false)
+			if err != nil {
+				return nil, err
+			}
+			resp.PrevKvs = append(resp.PrevKvs, kv)
+		}
+	}
+
+	return resp, nil
+}
+
+// holds reports whether a condition holds. Like etcd, a condition on the
+// value of a key that does not exist never does.
+func (st *etcdTxnState) holds(c etcdCompare) (bool, error) {
+	if len(c.Key) == 0 {
+		return false, errEtcdEmptyKey
+	}
+	if len(c.RangeEnd) > 0 {
+		return false, fmt.Errorf("%w: compares over key ranges", errEtcdUnsupported)
+	}
+	if err := st.s.runPreReadHooks(st.ctx, etcdNamespace, string(c.Key)); err != nil {
+		return false, err
+	}
+
+	entry, exists, err := st.get(string(c.Key))
+	if err != nil {
+		return false, err
+	}
+	var create, version uint64
+	if exists {
+		create, version = etcdRevisions(entry)
+	}
+
+	var cmp int
+	switch c.Target {
+	case "", "VERSION":
+		cmp = compareInts(int64(version), int64(c.Version))
+	case "CREATE":
+		cmp = compareInts(int64(create), int64(c.CreateRevision))
+	case "MOD":
+		cmp = compareInts(int64(entry.Version), int64(c.ModRevision))
+	case "VALUE":
+		if !exists {
+			return false, nil
+		}
+		cmp = strings.Compare(entry.Value, string(c.Value))
+	case "LEASE":
+		cmp = compareInts(0, int64(c.Lease))
+	default:
+		return false, fmt.Errorf("%w: unknown compare target %q", errEtcdInvalid, c.Target)
+	}
+
+	switch c.Result {
+	case "", "EQUAL":
+		return cmp == 0, nil
+	case "NOT_EQUAL":
+		return cmp != 0, nil
+	case "GREATER":
+		return cmp > 0, nil
+	case "LESS":
+		return cmp < 0, nil
+	default:
+		return false, fmt.Errorf("%w: unknown compare result %q", errEtcdInvalid, c.Result)
+	}
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// commit logs and applies the pending writes, if there are any, and gives
+// the key values made from them the revision they were written at.
+func (st *etcdTxnState) commit() error {
+	if len(st.writes) == 0 {
+		return nil
+	}
+
+	e, err := st.s.applyWrites(st.ctx, etcdNamespace, st.writes)
+	if err != nil {
+		return err
+	}
+
+	st.revision = e.Sequence
+	for _, kv := range st.pending {
+		kv.ModRevision = etcdInt(e.Sequence)
+		if kv.CreateRevision == 0 {
+			kv.CreateRevision = etcdInt(e.Sequence)
+		}
+	}
+
+	return nil
+}
+
+// lockEtcdTxn locks the keys a transaction names, or every key if it names
+// a range.
+func (s *Server) lockEtcdTxn(req *etcdTxnRequest) (unlock func()) {
+	var keys []string
+	for _, c := range req.Compare {
+		keys = append(keys, string(c.Key))
+	}
+	for _, op := range slices.Concat(req.Success, req.Failure) {
+		switch {
+		case op.RequestRange != nil:
+			if len(op.RequestRange.RangeEnd) > 0 {
+				return s.store.LockAllKeys()
+			}
+			keys = append(keys, string(op.RequestRange.Key))
+		case op.RequestPut != nil:
+			keys = append(keys, string(op.RequestPut.Key))
+		case op.RequestDeleteRange != nil:
+			if len(op.RequestDeleteRange.RangeEnd) > 0 {
+				return s.store.LockAllKeys()
+			}
+			keys = append(keys, string(op.RequestDeleteRange.Key))
+		}
+	}
+
+	return s.store.LockKeys(etcdNamespace, keys...)
+}
+
+// runEtcdTxn runs a transaction: if every condition holds, the operations
+// in success are carried out, and otherwise those in failure, all of them
+// logged as a single txn event.
+func (s *Server) runEtcdTxn(ctx context.Context, req *etcdTxnRequest) (*etcdTxnResponse, error) {
+	unlock := s.lockEtcdTxn(req)
+	defer unlock()
+
+	st := s.newEtcdTxnState(ctx)
+
+	resp := &etcdTxnResponse{Succeeded: true}
+	for _, c := range req.Compare {
+		holds, err := st.holds(c)
+		if err != nil {
+			return nil, err
+		}
+		if !holds {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := req.Success
+	if !resp.Succeeded {
+		ops = req.Failure
+	}
+
+	for _, op := range ops {
+		var result etcdResponseOp
+		var err error
+		switch {
+		case op.RequestRange != nil:
+			result.ResponseRange, err = st.rangeOp(op.RequestRange)
+		case op.RequestPut != nil:
+			result.ResponsePut, err = st.putOp(op.RequestPut)
+		case op.RequestDeleteRange != nil:
+			result.ResponseDeleteRange, err = st.deleteRangeOp(op.RequestDeleteRange)
+		case op.RequestTxn != nil:
+			err = fmt.Errorf("%w: nested transactions", errEtcdUnsupported)
+		default:
+			err = fmt.Errorf("%w: empty operation", errEtcdInvalid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Responses = append(resp.Responses, result)
+	}
+
+	if err := st.commit(); err != nil {
+		return nil, err
+	}
+
+	resp.Header = st.header()
+	for _, result := range resp.Responses {
+		switch {
+		case result.ResponseRange != nil:
+			result.ResponseRange.Header = resp.Header
+		case result.ResponsePut != nil:
+			result.ResponsePut.Header = resp.Header
+		case result.ResponseDeleteRange != nil:
+			result.ResponseDeleteRange.Header = resp.Header
+		}
+	}
+
+	return resp, nil
+}
+
+// EtcdRangeHandler serves KV.Range: the keys in a range, or a single key,
+// now or, with -mvcc-retention, as of an earlier revision.
+func (s *Server) EtcdRangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req etcdRangeRequest
+	if !readEtcdRequest(w, r, &req) {
+		return
+	}
+
+	resp, err := s.newEtcdTxnState(r.Context()).rangeOp(&req)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// EtcdPutHandler serves KV.Put. The key is written as a plain put, like a
+// PUT of the key through the API.
+func (s *Server) EtcdPutHandler(w http.ResponseWriter, r *http.Request) {
+	var req etcdPutRequest
+	if !readEtcdRequest(w, r, &req) {
+		return
+	}
+
+	unlock := s.store.LockKey(etcdNamespace, string(req.Key))
+	defer unlock()
+
+	st := s.newEtcdTxnState(r.Context())
+	resp, err := st.putOp(&req)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePut, Namespace: etcdNamespace, Key: string(req.Key), Value: string(req.Value), Time: time.Now()})
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	if err = s.store.Put(r.Context(), e); err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	resp.Header.Revision = etcdInt(e.Sequence)
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// EtcdDeleteRangeHandler serves KV.DeleteRange. A single key is deleted as a
+// plain delete; the keys of a range are deleted together as a txn event.
+func (s *Server) EtcdDeleteRangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req etcdDeleteRangeRequest
+	if !readEtcdRequest(w, r, &req) {
+		return
+	}
+
+	if len(req.RangeEnd) > 0 {
+		resp, err := s.runEtcdTxn(r.Context(), &etcdTxnRequest{Success: []etcdRequestOp{{RequestDeleteRange: &req}}})
+		if err != nil {
+			writeEtcdError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp.Responses[0].ResponseDeleteRange)
+		return
+	}
+
+	unlock := s.store.LockKey(etcdNamespace, string(req.Key))
+	defer unlock()
+
+	st := s.newEtcdTxnState(r.Context())
+	resp, err := st.deleteRangeOp(&req)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	if resp.Deleted == 0 {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeDelete, Namespace: etcdNamespace, Key: string(req.Key), Time: time.Now()})
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	if err = s.store.Delete(r.Context(), e); err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	resp.Header.Revision = etcdInt(e.Sequence)
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// EtcdTxnHandler serves KV.Txn. Every key the transaction names is locked
+// while it runs, or every key in the store if it names a range.
+func (s *Server) EtcdTxnHandler(w http.ResponseWriter, r *http.Request) {
+	var req etcdTxnRequest
+	if !readEtcdRequest(w, r, &req) {
+		return
+	}
+	if n := len(req.Compare) + len(req.Success) + len(req.Failure); n > maxTxnOps {
+		writeEtcdError(w, r, fmt.Errorf("%w: %d compares and operations, more than the limit of %d", errEtcdInvalid, n, maxTxnOps))
+		return
+	}
+
+	resp, err := s.runEtcdTxn(r.Context(), &req)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+
+	if resp.Header.Revision > 0 {
+		setSequenceHeader(w, uint64(resp.Header.Revision))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type etcdWatchCreateRequest struct {
+	Key            []byte  `json:"key"`
+	RangeEnd       []byte  `json:"range_end"`
+	StartRevision  etcdInt `json:"start_revision"`
+	ProgressNotify bool    `json:"progress_notify"`
+	PrevKv         bool    `json:"prev_kv"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest *etcdWatchCreateRequest `json:"create_request"`
+}
+
+type etcdEvent struct {
+	// Type is DELETE for deletes and left out for puts, as etcd does.
+	Type string        `json:"type,omitempty"`
+	Kv   *etcdKeyValue `json:"kv"`
+}
+
+type etcdWatchResponse struct {
+	Header       *etcdHeader `json:"header"`
+	Created      bool        `json:"created,omitempty"`
+	Canceled     bool        `json:"canceled,omitempty"`
+	CancelReason string      `json:"cancel_reason,omitempty"`
+	Events       []etcdEvent `json:"events,omitempty"`
+}
+
+// etcdWatchEvent turns a watch message into an etcd event. Only puts and
+// deletes have one.
+func etcdWatchEvent(msg WatchMessage) (etcdEvent, bool) {
+	kv := &etcdKeyValue{Key: []byte(msg.Key), ModRevision: etcdInt(msg.Revision)}
+	switch msg.Type {
+	case WatchMessagePut:
+		kv.Value = []byte(msg.Value)
+		return etcdEvent{Kv: kv}, true
+	case WatchMessageDelete, WatchMessageExpire:
+		return etcdEvent{Type: "DELETE", Kv: kv}, true
+	default:
+		return etcdEvent{}, false
+	}
+}
+
+// EtcdWatchHandler serves Watch for a single watch, streaming a result line
+// for each change to the keys in its range. Since the gateway runs over
+// plain HTTP, the stream only reads the create request at its start; a
+// client cancels by closing it. A start revision replays the changes logged
+// since, as ?since= does for watches of the API, though changes made with
+// Cavee's own rename, prefix and tag deletes, which the log does not record
+// key by key, are not replayed.
+func (s *Server) EtcdWatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req etcdWatchRequest
+	if !readEtcdRequest(w, r, &req) {
+		return
+	}
+	create := req.CreateRequest
+	if create == nil {
+		writeEtcdError(w, r, fmt.Errorf("%w: only create requests are supported", errEtcdUnsupported))
+		return
+	}
+	kr, err := newEtcdKeyRange(create.Key, create.RangeEnd)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	if create.PrevKv {
+		writeEtcdError(w, r, fmt.Errorf("%w: previous key values in watches", errEtcdUnsupported))
+		return
+	}
+
+	var history HistoryReader
+	if create.StartRevision > 0 {
+		var ok bool
+		if history, ok = s.transact.(HistoryReader); !ok {
+			writeEtcdError(w, r, fmt.Errorf("%w: the transaction log cannot be read back to watch from a revision", errEtcdUnsupported))
+			return
+		}
+	}
+
+	prefix := ""
+	if kr.single() {
+		prefix = kr.key
+	}
+	sub, err := s.watchHub.subscribe(etcdNamespace, prefix, false)
+	if err != nil {
+		writeEtcdError(w, r, err)
+		return
+	}
+	defer s.watchHub.unsubscribe(sub)
+
+	// As for watches of the API, the changes up to until are replayed from
+	// the log and only the later ones sent live.
+	until := s.lastSequence()
+	since := uint64(max(create.StartRevision-1, 0))
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	send := func(resp etcdWatchResponse) error {
+		if err := enc.Encode(map[string]etcdWatchResponse{"result": resp}); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err = send(etcdWatchResponse{Header: &etcdHeader{Revision: etcdInt(until)}, Created: true}); err != nil {
+		return
+	}
+
+	if history != nil && since < until {
+		next := since + 1
+		err = history.ReadEventsBetween(r.Context(), since, until, func(e Event) error {
+			if e.Sequence != next {
+				return errEtcdCompacted
+			}
+			next++
+
+			if e.Namespace != etcdNamespace {
+				return nil
+			}
+			msgs, err := replayMessages(e, prefix)
+			if err == nil {
+				err = s.openMessages(msgs)
+			}
+			if err != nil {
+				return err
+			}
+			var events []etcdEvent
+			for _, msg := range msgs {
+				if !kr.contains(msg.Key) {
+					continue
+				}
+				var readable bool
+				if msg, readable, err = s.readMessage(r.Context(), etcdNamespace, msg); err != nil {
+					return err
+				}
+				if ev, ok := etcdWatchEvent(msg); ok && readable {
+					events = append(events, ev)
+				}
+			}
+			if len(events) == 0 {
+				return nil
+			}
+			return send(etcdWatchResponse{Header: &etcdHeader{Revision: etcdInt(until)}, Events: events})
+		})
+		if err == nil && next <= until {
+			err = errEtcdCompacted
+		}
+		if err != nil {
+			if errors.Is(err, errEtcdCompacted) {
+				send(etcdWatchResponse{Header: &etcdHeader{Revision: etcdInt(until)}, Canceled: true, CancelReason: err.Error()})
+			} else if r.Context().Err() == nil {
+				slog.WarnContext(r.Context(), "failed to replay etcd watch", slog.Uint64("start_revision", since+1), slog.String("error", err.Error()))
+			}
+			return
+		}
+	}
+	skip := max(since, until)
+
+	progress := time.NewTicker(30 * time.Second)
+	defer progress.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-progress.C:
+			if create.ProgressNotify {
+				if err = send(etcdWatchResponse{Header: &etcdHeader{Revision: etcdInt(s.lastSequence())}}); err != nil {
+					return
+				}
+			}
+		case msg, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			if msg.Revision <= skip || !kr.contains(msg.Key) {
+				continue
+			}
+			var readable bool
+			if msg, readable, err = s.readMessage(r.Context(), etcdNamespace, msg); err != nil {
+				return
+			}
+			ev, ok := etcdWatchEvent(msg)
+			if !ok || !readable {
+				continue
+			}
+			if err = send(etcdWatchResponse{Header: &etcdHeader{Revision: etcdInt(msg.Revision)}, Events: []etcdEvent{ev}}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package cavee
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The etcd gRPC services serve the KV and Watch services of the etcd v3 API
+// on -etcd-grpc-addr, for clientv3 and etcdctl. Each call is turned into the
+// matching call of the etcd gateway and served by the server's own handler,
+// so it goes through the same authentication, read-only mode, forwarding to
+// the leader and limits as a call to /v3/, and behaves the same way. The
+// metadata of a call is passed on as the headers of the gateway call, and
+// etcd's token as a bearer token. Like -replication-addr, the listener is
+// plaintext.
+
+// etcdGRPCServer serves the KV and Watch services. Compaction is left
+// unimplemented, as the log is compacted on its own schedule.
+type etcdGRPCServer struct {
+	etcdserverpb.UnimplementedKVServer
+	etcdserverpb.UnimplementedWatchServer
+
+	server *Server
+}
+
+func newEtcdGRPC(s *Server) *grpc.Server {
+	srv := grpc.NewServer()
+	e := &etcdGRPCServer{server: s}
+	etcdserverpb.RegisterKVServer(srv, e)
+	etcdserverpb.RegisterWatchServer(srv, e)
+
+	return srv
+}
+
+// serveEtcdGRPC listens for etcd clients on addr until the server closes.
+func (s *Server) serveEtcdGRPC(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for etcd clients: %w", err)
+	}
+
+	slog.Info("serving etcd gRPC", slog.String("addr", lis.Addr().String()))
+	go func() {
+		if err := s.etcdGRPC.Serve(lis); err != nil {
+			slog.Error("etcd gRPC server stopped", slog.String("error", err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+// etcdGatewayWriter is the response writer of a gateway call made for a
+// gRPC call, which hands the body on as it is written.
+type etcdGatewayWriter struct {
+	header http.Header
+	body   io.Writer
+	once   sync.Once
+	status int
+	// wrote is closed once the status is written.
+	wrote chan struct{}
+}
+
+func newEtcdGatewayWriter(body io.Writer) *etcdGatewayWriter {
+	return &etcdGatewayWriter{header: make(http.Header), body: body, wrote: make(chan struct{})}
+}
+
+func (w *etcdGatewayWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *etcdGatewayWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		close(w.wrote)
+	})
+}
+
+func (w *etcdGatewayWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// Flush does nothing, as nothing is buffered.
+func (w *etcdGatewayWriter) Flush() {}
+
+// etcdGatewayRequest returns the gateway call at path that a gRPC call
+// with ctx stands for.
+func etcdGatewayRequest(ctx context.Context, path string, body []byte) *http.Request {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		// Pseudo-headers, binary values and those of the gRPC transport
+		// itself are not headers of the gateway call.
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") || strings.HasSuffix(key, "-bin") ||
+			key == "content-type" || key == "te" || key == "accept-encoding" {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if token := md.Get("token"); len(token) > 0 && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+token[0])
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	return r
+}
+
+// etcdGatewayError turns the error response of a gateway call into the
+// status of a gRPC call. Errors of the etcd API carry their gRPC code, and
+// those of the middleware in front of it are given the code closest to
+// their HTTP status.
+func etcdGatewayError(httpStatus int, body []byte) error {
+	var resp struct {
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+	}
+	_ = json.Unmarshal(body, &resp)
+	msg := cmp.Or(resp.Message, http.StatusText(httpStatus))
+
+	var code int
+	if json.Unmarshal(resp.Code, &code) == nil && code > 0 {
+		return status.Error(codes.Code(code), msg)
+	}
+
+	switch {
+	case httpStatus == http.StatusUnauthorized:
+		return status.Error(codes.Unauthenticated, msg)
+	case httpStatus == http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, msg)
+	case httpStatus == http.StatusNotFound:
+		return status.Error(codes.NotFound, msg)
+	case httpStatus == http.StatusConflict, httpStatus == http.StatusPreconditionFailed:
+		return status.Error(codes.FailedPrecondition, msg)
+	case httpStatus == http.StatusTooManyRequests:
+		return status.Error(codes.ResourceExhausted, msg)
+	case httpStatus == http.StatusNotImplemented:
+		return status.Error(codes.Unimplemented, msg)
+	case httpStatus == http.StatusGatewayTimeout:
+		return status.Error(codes.DeadlineExceeded, msg)
+	case httpStatus >= 300 && httpStatus < 400, httpStatus == http.StatusBadGateway, httpStatus == http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, msg)
+	case httpStatus >= 400 && httpStatus < 500:
+		return status.Error(codes.InvalidArgument, msg)
+	default:
+		return status.Error(codes.Internal, msg)
+	}
+}
+
+// call serves a unary gRPC call as the gateway call at path, decoding its
+// response into resp.
+func (e *etcdGRPCServer) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	var buf bytes.Buffer
+	w := newEtcdGatewayWriter(&buf)
+	e.server.handler.ServeHTTP(w, etcdGatewayRequest(ctx, path, body))
+	w.WriteHeader(http.StatusOK)
+	if w.status != http.StatusOK {
+		return etcdGatewayError(w.status, buf.Bytes())
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), resp); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("invalid gateway response: %s", err))
+	}
+	return nil
+}
+
+func (h *etcdHeader) proto() *etcdserverpb.ResponseHeader {
+	if h == nil {
+		return &etcdserverpb.ResponseHeader{}
+	}
+	return &etcdserverpb.ResponseHeader{Revision: int64(h.Revision)}
+}
+
+func (kv *etcdKeyValue) proto() *mvccpb.KeyValue {
+	if kv == nil {
+		return nil
+	}
+	return &mvccpb.KeyValue{
+		Key:            kv.Key,
+		CreateRevision: int64(kv.CreateRevision),
+		ModRevision:    int64(kv.ModRevision),
+		Version:        int64(kv.Version),
+		Value:          kv.Value,
+	}
+}
+
+func etcdKeyValuesProto(kvs []*etcdKeyValue) []*mvccpb.KeyValue {
+	var out []*mvccpb.KeyValue
+	for _, kv := range kvs {
+		out = append(out, kv.proto())
+	}
+	return out
+}
+
+func etcdRangeRequestOf(req *etcdserverpb.RangeRequest) (*etcdRangeRequest, error) {
+	if req.MinModRevision != 0 || req.MaxModRevision != 0 || req.MinCreateRevision != 0 || req.MaxCreateRevision != 0 {
+		return nil, status.Error(codes.Unimplemented, fmt.Sprintf("%s: revision filters", errEtcdUnsupported))
+	}
+
+	return &etcdRangeRequest{
+		Key:        req.Key,
+		RangeEnd:   req.RangeEnd,
+		Limit:      etcdInt(req.Limit),
+		Revision:   etcdInt(req.Revision),
+		SortOrder:  req.SortOrder.String(),
+		SortTarget: req.SortTarget.String(),
+		KeysOnly:   req.KeysOnly,
+		CountOnly:  req.CountOnly,
+	}, nil
+}
+
+func (resp *etcdRangeResponse) proto() *etcdserverpb.RangeResponse {
+	return &etcdserverpb.RangeResponse{
+		Header: resp.Header.proto(),
+		Kvs:    etcdKeyValuesProto(resp.Kvs),
+		More:   resp.More,
+		Count:  int64(resp.Count),
+	}
+}
+
+func etcdPutRequestOf(req *etcdserverpb.PutRequest) *etcdPutRequest {
+	return &etcdPutRequest{
+		Key:         req.Key,
+		Value:       req.Value,
+		Lease:       etcdInt(req.Lease),
+		PrevKv:      req.PrevKv,
+		IgnoreValue: req.IgnoreValue,
+		IgnoreLease: req.IgnoreLease,
+	}
+}
+
+func (resp *etcdPutResponse) proto() *etcdserverpb.PutResponse {
+	return &etcdserverpb.PutResponse{Header: resp.Header.proto(), PrevKv: resp.PrevKv.proto()}
+}
+
+func etcdDeleteRangeRequestOf(req *etcdserverpb.DeleteRangeRequest) *etcdDeleteRangeRequest {
+	return &etcdDeleteRangeRequest{Key: req.Key, RangeEnd: req.RangeEnd, PrevKv: req.PrevKv}
+}
+
+func (resp *etcdDeleteRangeResponse) proto() *etcdserverpb.DeleteRangeResponse {
+	return &etcdserverpb.DeleteRangeResponse{
+		Header:  resp.Header.proto(),
+		Deleted: int64(resp.Deleted),
+		PrevKvs: etcdKeyValuesProto(resp.PrevKvs),
+	}
+}
+
+func etcdTxnRequestOf(req *etcdserverpb.TxnRequest) (*etcdTxnRequest, error) {
+	txn := &etcdTxnRequest{}
+	for _, c := range req.Compare {
+		txn.Compare = append(txn.Compare, etcdCompare{
+			Result:         c.Result.String(),
+			Target:         c.Target.String(),
+			Key:            c.Key,
+			RangeEnd:       c.RangeEnd,
+			Version:        etcdInt(c.GetVersion()),
+			CreateRevision: etcdInt(c.GetCreateRevision()),
+			ModRevision:    etcdInt(c.GetModRevision()),
+			Value:          c.GetValue(),
+			Lease:          etcdInt(c.GetLease()),
+		})
+	}
+
+	ops := func(reqs []*etcdserverpb.RequestOp) ([]etcdRequestOp, error) {
+		var ops []etcdRequestOp
+		for _, op := range reqs {
+			switch {
+			case op.GetRequestRange() != nil:
+				r, err := etcdRangeRequestOf(op.GetRequestRange())
+				if err != nil {
+					return nil, err
+				}
+				ops = append(ops, etcdRequestOp{RequestRange: r})
+			case op.GetRequestPut() != nil:
+				ops = append(ops, etcdRequestOp{RequestPut: etcdPutRequestOf(op.GetRequestPut())})
+			case op.GetRequestDeleteRange() != nil:
+				ops = append(ops, etcdRequestOp{RequestDeleteRange: etcdDeleteRangeRequestOf(op.GetRequestDeleteRange())})
+			case op.GetRequestTxn() != nil:
+				// The gateway turns nested transactions down.
+				ops = append(ops, etcdRequestOp{RequestTxn: json.RawMessage("{}")})
+			default:
+				ops = append(ops, etcdRequestOp{})
+			}
+		}
+		return ops, nil
+	}
+
+	var err error
+	if txn.Success, err = ops(req.Success); err != nil {
+		return nil, err
+	}
+	if txn.Failure, err = ops(req.Failure); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (resp *etcdTxnResponse) proto() *etcdserverpb.TxnResponse {
+	txn := &etcdserverpb.TxnResponse{Header: resp.Header.proto(), Succeeded: resp.Succeeded}
+	for _, result := range resp.Responses {
+		op := &etcdserverpb.ResponseOp{}
+		switch {
+		case result.ResponseRange != nil:
+			op.Response = &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: result.ResponseRange.proto()}
+		case result.ResponsePut != nil:
+			op.Response = &etcdserverpb.ResponseOp_ResponsePut{ResponsePut: result.ResponsePut.proto()}
+		case result.ResponseDeleteRange != nil:
+			op.Response = &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: result.ResponseDeleteRange.proto()}
+		}
+		txn.Responses = append(txn.Responses, op)
+	}
+	return txn
+}
+
+func (e *etcdGRPCServer) Range(ctx context.Context, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	r, err := etcdRangeRequestOf(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp etcdRangeResponse
+	if err = e.call(ctx, "/v3/kv/range", r, &resp); err != nil {
+		return nil, err
+	}
+	return resp.proto(), nil
+}
+
+func (e *etcdGRPCServer) Put(ctx context.Context, req *etcdserverpb.PutRequest) (*etcdserverpb.PutResponse, error) {
+	var resp etcdPutResponse
+	if err := e.call(ctx, "/v3/kv/put", etcdPutRequestOf(req), &resp); err != nil {
+		return nil, err
+	}
+	return resp.proto(), nil
+}
+
+func (e *etcdGRPCServer) DeleteRange(ctx context.Context, req *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.DeleteRangeResponse, error) {
+	var resp etcdDeleteRangeResponse
+	if err := e.call(ctx, "/v3/kv/deleterange", etcdDeleteRangeRequestOf(req), &resp); err != nil {
+		return nil, err
+	}
+	return resp.proto(), nil
+}
+
+func (e *etcdGRPCServer) Txn(ctx context.Context, req *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	txn, err := etcdTxnRequestOf(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp etcdTxnResponse
+	if err = e.call(ctx, "/v3/kv/txn", txn, &resp); err != nil {
+		return nil, err
+	}
+	return resp.proto(), nil
+}
+
+func (resp *etcdWatchResponse) proto(id int64) *etcdserverpb.WatchResponse {
+	watch := &etcdserverpb.WatchResponse{
+		Header:       resp.Header.proto(),
+		WatchId:      id,
+		Created:      resp.Created,
+		Canceled:     resp.Canceled,
+		CancelReason: resp.CancelReason,
+	}
+	for _, ev := range resp.Events {
+		event := &mvccpb.Event{Type: mvccpb.PUT, Kv: ev.Kv.proto()}
+		if ev.Type == "DELETE" {
+			event.Type = mvccpb.DELETE
+		}
+		watch.Events = append(watch.Events, event)
+	}
+	return watch
+}
+
+// etcdProgressWatchID is the watch ID of the responses to progress
+// requests, which are about the whole stream.
+const etcdProgressWatchID = -1
+
+// etcdGRPCWatchStream is a Watch call, over which a client creates and
+// cancels any number of watches. Each watch is a watch of the gateway,
+// whose results are sent on the stream as they are written.
+type etcdGRPCWatchStream struct {
+	server *Server
+	stream etcdserverpb.Watch_WatchServer
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int64
+	watches map[int64]*etcdGRPCWatch
+	running sync.WaitGroup
+}
+
+type etcdGRPCWatch struct {
+	cancel context.CancelFunc
+}
+
+func (e *etcdGRPCServer) Watch(stream etcdserverpb.Watch_WatchServer) error {
+	ws := &etcdGRPCWatchStream{server: e.server, stream: stream, watches: make(map[int64]*etcdGRPCWatch)}
+	defer ws.close()
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case req.GetCreateRequest() != nil:
+			ws.create(req.GetCreateRequest())
+		case req.GetCancelRequest() != nil:
+			ws.cancel(req.GetCancelRequest().WatchId)
+		case req.GetProgressRequest() != nil:
+			ws.send(&etcdserverpb.WatchResponse{
+				Header:  &etcdserverpb.ResponseHeader{Revision: int64(e.server.lastSequence())},
+				WatchId: etcdProgressWatchID,
+			})
+		}
+	}
+}
+
+// send sends a response on the stream, which watches share.
+func (ws *etcdGRPCWatchStream) send(resp *etcdserverpb.WatchResponse) error {
+	ws.sendMu.Lock()
+	defer ws.sendMu.Unlock()
+
+	return ws.stream.Send(resp)
+}
+
+// create starts a watch, with the ID the client asked for or, as etcd
+// does, the lowest one free from the last handed out.
+func (ws *etcdGRPCWatchStream) create(create *etcdserverpb.WatchCreateRequest) {
+	id := create.WatchId
+	refuse := func(reason string) {
+		ws.send(&etcdserverpb.WatchResponse{
+			Header:       &etcdserverpb.ResponseHeader{Revision: int64(ws.server.lastSequence())},
+			WatchId:      id,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: reason,
+		})
+	}
+	if len(create.Filters) > 0 {
+		refuse(fmt.Sprintf("%s: watch filters", errEtcdUnsupported))
+		return
+	}
+
+	ws.mu.Lock()
+	if id == 0 {
+		for ws.watches[ws.nextID] != nil {
+			ws.nextID++
+		}
+		id = ws.nextID
+		ws.nextID++
+	} else if ws.watches[id] != nil {
+		ws.mu.Unlock()
+		refuse("etcdserver: duplicate watch ID")
+		return
+	}
+	ctx, cancel := context.WithCancel(ws.stream.Context())
+	watch := &etcdGRPCWatch{cancel: cancel}
+	ws.watches[id] = watch
+	ws.mu.Unlock()
+
+	ws.running.Add(1)
+	go ws.run(ctx, id, watch, create)
+}
+
+// cancel stops a watch at the client's request.
+func (ws *etcdGRPCWatchStream) cancel(id int64) {
+	ws.mu.Lock()
+	watch := ws.watches[id]
+	delete(ws.watches, id)
+	ws.mu.Unlock()
+
+	if watch != nil {
+		watch.cancel()
+		ws.send(&etcdserverpb.WatchResponse{
+			Header:   &etcdserverpb.ResponseHeader{Revision: int64(ws.server.lastSequence())},
+			WatchId:  id,
+			Canceled: true,
+		})
+	}
+}
+
+// run serves a watch as a watch of the gateway, until the client cancels
+// it, the stream ends or the gateway ends it.
+func (ws *etcdGRPCWatchStream) run(ctx context.Context, id int64, watch *etcdGRPCWatch, create *etcdserverpb.WatchCreateRequest) {
+	defer ws.running.Done()
+
+	body, err := json.Marshal(etcdWatchRequest{CreateRequest: &etcdWatchCreateRequest{
+		Key:            create.Key,
+		RangeEnd:       create.RangeEnd,
+		StartRevision:  etcdInt(create.StartRevision),
+		ProgressNotify: create.ProgressNotify,
+		PrevKv:         create.PrevKv,
+	}})
+	if err != nil {
+		return
+	}
+
+	pr, pw := io.Pipe()
+	w := newEtcdGatewayWriter(pw)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		ws.server.handler.ServeHTTP(w, etcdGatewayRequest(ctx, "/v3/watch", body))
+		w.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+	defer func() {
+		ws.mu.Lock()
+		if ws.watches[id] == watch {
+			delete(ws.watches, id)
+		}
+		ws.mu.Unlock()
+		watch.cancel()
+		pr.Close()
+		<-served
+	}()
+
+	<-w.wrote
+	if w.status != http.StatusOK {
+		b, _ := io.ReadAll(pr)
+		ws.send(&etcdserverpb.WatchResponse{
+			Header:       &etcdserverpb.ResponseHeader{Revision: int64(ws.server.lastSequence())},
+			WatchId:      id,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: status.Convert(etcdGatewayError(w.status, b)).Message(),
+		})
+		return
+	}
+
+	dec := json.NewDecoder(pr)
+	for {
+		var line struct {
+			Result etcdWatchResponse `json:"result"`
+		}
+		if err = dec.Decode(&line); err != nil {
+			break
+		}
+		if err = ws.send(line.Result.proto(id)); err != nil || line.Result.Canceled {
+			return
+		}
+	}
+
+	// The gateway ended the watch without the client cancelling it, as it
+	// does when the server closes.
+	if ctx.Err() == nil {
+		ws.send(&etcdserverpb.WatchResponse{
+			Header:       &etcdserverpb.ResponseHeader{Revision: int64(ws.server.lastSequence())},
+			WatchId:      id,
+			Canceled:     true,
+			CancelReason: "etcdserver: watch ended",
+		})
+	}
+}
+
+// close stops the watches of a stream that ended.
+func (ws *etcdGRPCWatchStream) close() {
+	ws.mu.Lock()
+	for _, watch := range ws.watches {
+		watch.cancel()
+	}
+	ws.mu.Unlock()
+
+	ws.running.Wait()
+}
@@ -0,0 +1,81 @@
+package cavee_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+func TestEtcdGRPC(t *testing.T) {
+	addr := freeAddr(t)
+	caveetest.Start(t, func(c *cavee.Config) {
+		c.EtcdGRPCAddr = addr
+	})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	kv, watch := etcdserverpb.NewKVClient(conn), etcdserverpb.NewWatchClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, key := range []string{"a/1", "a/2", "b"} {
+		if _, err = kv.Put(ctx, &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("v")}); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	rng, err := kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("a/"), RangeEnd: []byte("a0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng.Count != 2 || len(rng.Kvs) != 2 || string(rng.Kvs[0].Key) != "a/1" || rng.Header.Revision != 3 {
+		t.Errorf("range of a/ returned %v, want a/1 and a/2 at revision 3", rng)
+	}
+
+	if _, err = kv.Put(ctx, &etcdserverpb.PutRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("put of an empty key returned %v, want InvalidArgument", err)
+	}
+
+	// A watch from a past revision replays the changes from it, then the
+	// live ones.
+	stream, err := watch.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := &etcdserverpb.WatchCreateRequest{Key: []byte("a/"), RangeEnd: []byte("a0"), StartRevision: 2}
+	if err = stream.Send(&etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{CreateRequest: create}}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.Created {
+		t.Fatalf("watch answered %v, %v; want it created", resp, err)
+	}
+	if _, err = kv.DeleteRange(ctx, &etcdserverpb.DeleteRangeRequest{Key: []byte("a/1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*mvccpb.Event
+	for len(got) < 2 {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp.Events...)
+	}
+	if len(got) != 2 || got[0].Type != mvccpb.PUT || string(got[0].Kv.Key) != "a/2" ||
+		got[1].Type != mvccpb.DELETE || string(got[1].Kv.Key) != "a/1" || got[1].Kv.ModRevision != 4 {
+		t.Errorf("watch sent %v, want the put of a/2 and the delete of a/1", got)
+	}
+}
@@ -0,0 +1,230 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLoggerNotRunning = errors.New("transaction logger is not running")
+	ErrLogQueueFull     = errors.New("transaction log queue is full")
+)
+
+// defaultQueueCapacity is the number of events a logger queues when its
+// options leave the capacity unset.
+const defaultQueueCapacity = 16
+
+// BackpressurePolicy decides what happens to a write when the logger queue
+// is full.
+type BackpressurePolicy string
+
+const (
+	// BackpressureBlock makes writers wait for room in the queue, for up
+	// to the queue timeout if one is set.
+	BackpressureBlock BackpressurePolicy = "block"
+	// BackpressureReject fails writes with ErrLogQueueFull at once, so that
+	// clients are told to back off instead of piling up.
+	BackpressureReject BackpressurePolicy = "reject"
+)
+
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch p := BackpressurePolicy(s); p {
+	case BackpressureBlock, BackpressureReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown queue policy %q", s)
+	}
+}
+
+// QueueOptions configure the write queue of a transaction logger.
+type QueueOptions struct {
+	// Capacity is the number of events that can wait to be written. It
+	// defaults to 16.
+	Capacity int
+	Policy   BackpressurePolicy
+	// Timeout bounds how long BackpressureBlock waits for room before
+	// failing the write with ErrLogQueueFull. Zero waits indefinitely.
+	Timeout time.Duration
+}
+
+// pendingEvent is an event waiting in the logger queue together with the
+// channel its writer is waiting on.
+type pendingEvent struct {
+	Event
+	result chan<- WriteResult
+	queue  *eventQueue
+}
+
+// done reports the outcome of appending the event to its writer.
+func (p pendingEvent) done(err error) {
+	p.queue.record(p.Sequence, err)
+
+	if err != nil {
+		p.result <- WriteResult{Err: err}
+		return
+	}
+	p.result <- WriteResult{Sequence: p.Sequence}
+}
+
+// eventQueue is the write path shared by the TransactionLogger
+// implementations: writers push events onto a buffered channel that a single
+// goroutine started by Run drains in order.
+type eventQueue struct {
+	opts QueueOptions
+
+	// mu guards closing the events channel against concurrent sends.
+	mu      sync.RWMutex
+	closed  bool
+	events  chan pendingEvent
+	stopped chan struct{}
+	err     error
+
+	// statsMu guards the outcome of the most recent writes, kept for health
+	// checks.
+	statsMu      sync.Mutex
+	lastWrite    time.Time
+	lastSequence uint64
+	lastErr      error
+	lastErrAt    time.Time
+	rejected     uint64
+}
+
+// start creates the channel the logger goroutine reads from. The goroutine
+// must call finish once the channel has been closed and drained.
+func (q *eventQueue) start() <-chan pendingEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	capacity := q.opts.Capacity
+	if capacity <= 0 {
+		capacity = defaultQueueCapacity
+	}
+	q.events = make(chan pendingEvent, capacity)
+	q.stopped = make(chan struct{})
+
+	return q.events
+}
+
+func (q *eventQueue) push(e Event) <-chan WriteResult {
+	result := make(chan WriteResult, 1)
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	switch {
+	case q.closed:
+		result <- WriteResult{Err: ErrLoggerClosed}
+	case q.events == nil:
+		result <- WriteResult{Err: ErrLoggerNotRunning}
+	default:
+		if !q.send(pendingEvent{Event: e, result: result, queue: q}) {
+			q.statsMu.Lock()
+			q.rejected++
+			q.statsMu.Unlock()
+
+			result <- WriteResult{Err: ErrLogQueueFull}
+		}
+	}
+
+	return result
+}
+
+// send queues p as the backpressure policy allows, and reports whether it
+// was queued. It must be called with mu read locked.
+func (q *eventQueue) send(p pendingEvent) bool {
+	switch {
+	case q.opts.Policy == BackpressureReject:
+		select {
+		case q.events <- p:
+			return true
+		default:
+			return false
+		}
+	case q.opts.Timeout > 0:
+		select {
+		case q.events <- p:
+			return true
+		default:
+		}
+
+		timer := time.NewTimer(q.opts.Timeout)
+		defer timer.Stop()
+
+		select {
+		case q.events <- p:
+			return true
+		case <-timer.C:
+			return false
+		}
+	default:
+		q.events <- p
+		return true
+	}
+}
+
+func (q *eventQueue) record(sequence uint64, err error) {
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+
+	if err != nil {
+		q.lastErr, q.lastErrAt = err, time.Now()
+	} else {
+		q.lastWrite, q.lastSequence = time.Now(), max(q.lastSequence, sequence)
+	}
+}
+
+// resetSequence makes the queue report sequence as the last one written, for
+// loggers that have been restored to an earlier point.
+func (q *eventQueue) resetSequence(sequence uint64) {
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+
+	q.lastSequence = sequence
+}
+
+func (q *eventQueue) stats() LoggerStats {
+	q.mu.RLock()
+	pending, capacity := len(q.events), cap(q.events)
+	q.mu.RUnlock()
+
+	q.statsMu.Lock()
+	defer q.statsMu.Unlock()
+
+	return LoggerStats{LastSequence: q.lastSequence, Pending: pending, Capacity: capacity, Rejected: q.rejected}
+}
+
+// finish reports that the logger goroutine has stopped, with the error
+// encountered while flushing and releasing its resources, if any.
+func (q *eventQueue) finish(err error) {
+	q.err = err
+	close(q.stopped)
+}
+
+// close stops accepting events and waits for the logger goroutine to drain
+// the queue. started reports whether the goroutine was ever started; if it
+// was not, the caller is responsible for releasing resources itself.
+func (q *eventQueue) close(ctx context.Context) (started bool, err error) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false, ErrLoggerClosed
+	}
+	q.closed = true
+
+	if q.events == nil {
+		q.mu.Unlock()
+		return false, nil
+	}
+	close(q.events)
+	q.mu.Unlock()
+
+	select {
+	case <-q.stopped:
+		return true, q.err
+	case <-ctx.Done():
+		return true, fmt.Errorf("failed to drain transaction log: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,177 @@
+package cavee
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// expiryItem records that a key was set to expire at a time. Items are not
+// removed when the key is written, deleted or given another expiry; they are
+// recognised as stale when they reach the top of the heap instead.
+type expiryItem struct {
+	at      time.Time
+	ns, key string
+	// retry is when the key is tried again after its deletion failed, and
+	// backoff how long was waited for it, which doubles with each failure.
+	retry   time.Time
+	backoff time.Duration
+}
+
+// due returns when the key should next be deleted.
+func (i expiryItem) due() time.Time {
+	if i.retry.IsZero() {
+		return i.at
+	}
+	return i.retry
+}
+
+// expiryHeap orders expiry items by when they are due, soonest first.
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].due().Before(h[j].due()) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiryItem)) }
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// trackExpiry adds a key with an expiry to the index. It must be called with
+// the lock held.
+func (s *Store) trackExpiry(ns, key string, at time.Time) {
+	if !at.IsZero() {
+		heap.Push(&s.expiries, expiryItem{at: at, ns: ns, key: key})
+	}
+}
+
+// Expired takes up to limit keys that are due to be deleted by now out of
+// the index, soonest first, dropping the stale items it comes across on the
+// way. Keys that fail to be deleted must be put back with retryExpiry.
+func (s *Store) Expired(now time.Time, limit int) []expiryItem {
+	s.Lock()
+	defer s.Unlock()
+
+	var expired []expiryItem
+	for len(s.expiries) > 0 && len(expired) < limit && !s.expiries[0].due().After(now) {
+		item := heap.Pop(&s.expiries).(expiryItem)
+
+		entry, exists := s.namespaces[item.ns][item.key]
+		if exists && entry.ExpiresAt.Equal(item.at) {
+			expired = append(expired, item)
+		}
+	}
+
+	return expired
+}
+
+// retryExpiry puts a key that failed to be deleted back into the index, to
+// be deleted again at its retry time.
+func (s *Store) retryExpiry(item expiryItem) {
+	s.Lock()
+	defer s.Unlock()
+
+	heap.Push(&s.expiries, item)
+}
+
+const (
+	// sweepBatch is the number of expired keys deleted between checks for
+	// shutdown.
+	sweepBatch = 1000
+	// maxSweepBackoff bounds how long a key whose deletion keeps failing
+	// waits before it is tried again.
+	maxSweepBackoff = 5 * time.Minute
+)
+
+// sweepExpired deletes expired keys every interval, so that keys nobody
+// reads again do not hold on to memory. Each deletion is logged like a
+// DELETE request, so replicas and replays see it too.
+func (s *Server) sweepExpired(interval time.Duration) {
+	defer s.background.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+
+		// Writes are turned away in both cases; expired keys stay hidden
+		// until they can be deleted.
+		if s.readOnly.Load() || s.logFailure.Load() != nil {
+			continue
+		}
+
+		// A key that fails to be deleted, such as one a hook rejects the
+		// deletion of, is retried later so that it does not hold up the
+		// keys expiring after it.
+		for {
+			expired := s.store.Expired(time.Now(), sweepBatch)
+			for _, item := range expired {
+				if err := s.deleteExpired(item); err != nil {
+					item.backoff = min(max(2*item.backoff, interval), maxSweepBackoff)
+					item.retry = time.Now().Add(item.backoff)
+					s.store.retryExpiry(item)
+					slog.Warn("failed to delete expired key",
+						slog.String("namespace", item.ns),
+						slog.String("key", item.key),
+						slog.String("retry_in", item.backoff.String()),
+						slog.String("error", err.Error()),
+					)
+				}
+			}
+
+			if len(expired) < sweepBatch {
+				break
+			}
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// deleteExpired deletes a key if it still expires at the time it was found
+// to, once it is locked.
+func (s *Server) deleteExpired(item expiryItem) error {
+	unlock := s.store.LockKey(item.ns, item.key)
+	defer unlock()
+
+	// The key may have been written or given another expiry since it was
+	// found.
+	if !s.store.expiresAt(item.ns, item.key, item.at) {
+		return nil
+	}
+
+	ctx := context.Background()
+	e, err := s.writeEvent(ctx, Event{Type: EventTypeDelete, Namespace: item.ns, Key: item.key, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err = s.store.Delete(ctx, e); err != nil {
+		return err
+	}
+	s.notifyExpired(e)
+
+	return nil
+}
+
+// expiresAt reports whether a key, expired or not, expires at the given
+// time.
+func (s *Store) expiresAt(ns, key string, at time.Time) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	entry, exists := s.namespaces[ns][key]
+	return exists && entry.ExpiresAt.Equal(at)
+}
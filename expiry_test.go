@@ -0,0 +1,44 @@
+package cavee_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// A key that cannot be deleted once it expires must not hold up the keys
+// expiring after it.
+func TestExpirySweepSkipsFailures(t *testing.T) {
+	stuck := cavee.WithPreWriteHook(func(ctx context.Context, e *cavee.Event) error {
+		if e.Type == cavee.EventTypeDelete && e.Key == "stuck" {
+			return errors.New("stuck may not be deleted")
+		}
+		return nil
+	})
+	inst := caveetest.StartWithOptions(t, []cavee.ServerOption{stuck}, func(c *cavee.Config) {
+		c.ExpireInterval = 20 * time.Millisecond
+	})
+
+	w := openWatch(t, inst, "prefix=")
+	first, later := time.Now().Add(100*time.Millisecond), time.Now().Add(200*time.Millisecond)
+	mustRequest(t, inst, http.MethodPost, "/v1/txn", `{"then":[
+		{"op":"put","key":"stuck","value":"v","expires_at":"`+first.Format(time.RFC3339Nano)+`"},
+		{"op":"put","key":"a","value":"v","expires_at":"`+later.Format(time.RFC3339Nano)+`"},
+		{"op":"put","key":"b","value":"v","expires_at":"`+later.Format(time.RFC3339Nano)+`"}
+	]}`, http.StatusOK)
+
+	expired := map[string]bool{}
+	for len(expired) < 2 {
+		if msg := w.next(t); msg.Type == cavee.WatchMessageExpire {
+			expired[msg.Key] = true
+		}
+	}
+	if !expired["a"] || !expired["b"] {
+		t.Errorf("expired %v, want a and b", expired)
+	}
+}
@@ -0,0 +1,306 @@
+package cavee
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ExportEntry is one line of an export or import. Values that are not valid
+// UTF-8 are carried base64 encoded in ValueBase64 instead of Value.
+type ExportEntry struct {
+	Key         string   `json:"key"`
+	Value       string   `json:"value"`
+	ValueBase64 []byte   `json:"value_base64,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func (e ExportEntry) value() string {
+	if e.ValueBase64 != nil {
+		return string(e.ValueBase64)
+	}
+	return e.Value
+}
+
+// Import modes. Merge writes the imported keys and leaves the others alone;
+// replace also deletes the keys of the namespace the import does not have.
+const (
+	importModeMerge   = "merge"
+	importModeReplace = "replace"
+)
+
+type importResponse struct {
+	Namespace string `json:"namespace"`
+	Imported  int    `json:"imported"`
+	Unchanged int    `json:"unchanged"`
+	Deleted   int    `json:"deleted"`
+	// Sequence is that of the last event the import wrote, if any.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// ExportHandler streams every key of a namespace as JSON lines, ordered by
+// key, in the format ImportHandler accepts. With -mvcc-retention, the
+// export is of the namespace as of a single sequence, ?as_of= or the latest
+// one, and does not hold up writes; see exportAsOf.
+func (s *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	if s.config.MVCCRetention > 0 || r.URL.Query().Has("as_of") {
+		s.exportAsOf(w, r, ns)
+		return
+	}
+
+	entries, err := s.store.Entries(r.Context(), ns)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	keys := slices.Sorted(maps.Keys(entries))
+	if err = s.runPreReadHooksEach(r.Context(), ns, keys); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	lines := make([]ExportEntry, 0, len(entries))
+	for _, key := range keys {
+		line, err := s.exportEntry(r.Context(), ns, key, entries[key])
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		lines = append(lines, line)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, line := range lines {
+		if err = enc.Encode(line); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to write export", slog.String("error", err.Error()))
+	}
+}
+
+// ImportHandler writes the keys of an export into a namespace. The whole
+// body is checked before anything is written, and every write is logged
+// like a PUT or DELETE. Other writes wait while an import runs.
+func (s *Server) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = importModeMerge
+	case importModeMerge, importModeReplace:
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest,
+			fmt.Sprintf("invalid mode %q: must be merge or replace", mode))
+		return
+	}
+
+	lines, err := s.readImport(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || !errors.Is(err, errInvalidImport) {
+			writeBodyError(w, r, err)
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	current, err := s.store.Entries(r.Context(), ns)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	resp := importResponse{Namespace: ns}
+
+	var events []Event
+	for _, line := range lines {
+		value := line.value()
+		if entry, exists := current[line.Key]; exists && entry.Value == value && entry.ContentType == line.ContentType && slices.Equal(entry.Tags, line.Tags) {
+			resp.Unchanged++
+		} else {
+			events = append(events, Event{Type: EventTypePut, Namespace: ns, Key: line.Key, Value: value, ContentType: line.ContentType, Tags: line.Tags, Time: now})
+		}
+		delete(current, line.Key)
+	}
+	if mode == importModeReplace {
+		for _, key := range slices.Sorted(maps.Keys(current)) {
+			events = append(events, Event{Type: EventTypeDelete, Namespace: ns, Key: key, Time: now})
+		}
+	}
+
+	applied, err := s.writeEvents(r, events)
+	for _, e := range applied {
+		resp.Sequence = e.Sequence
+		if e.Type == EventTypePut {
+			resp.Imported++
+		} else {
+			resp.Deleted++
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "import failed",
+			slog.String("error", err.Error()),
+			slog.Int("applied", len(applied)),
+			slog.Int("events", len(events)),
+		)
+		writeLogError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "import applied",
+		slog.String("namespace", ns),
+		slog.String("mode", mode),
+		slog.Int("imported", resp.Imported),
+		slog.Int("unchanged", resp.Unchanged),
+		slog.Int("deleted", resp.Deleted),
+	)
+
+	if resp.Sequence > 0 {
+		setSequenceHeader(w, resp.Sequence)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+var errInvalidImport = errors.New("invalid import")
+
+// readImport reads and checks the lines of an import body. A key that
+// appears more than once takes its last value.
+func (s *Server) readImport(body io.Reader) ([]ExportEntry, error) {
+	var lines []ExportEntry
+
+	dec := json.NewDecoder(bufio.NewReader(body))
+	for n := 1; ; n++ {
+		var line ExportEntry
+		err := dec.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: line %d: %w", errInvalidImport, n, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line.Key == "" {
+			return nil, fmt.Errorf("%w: line %d: key is empty", errInvalidImport, n)
+		}
+		if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(line.Key) > maxLength {
+			return nil, fmt.Errorf("%w: line %d: key is %d bytes long, more than the limit of %d", errInvalidImport, n, len(line.Key), maxLength)
+		}
+		if maxSize := s.config.MaxValueSize; maxSize > 0 && int64(len(line.value())) > maxSize {
+			return nil, fmt.Errorf("%w: line %d: value is larger than the limit of %d bytes", errInvalidImport, n, maxSize)
+		}
+		if line.ContentType != "" {
+			if _, _, err = mime.ParseMediaType(line.ContentType); err != nil {
+				return nil, fmt.Errorf("%w: line %d: invalid content_type: %w", errInvalidImport, n, err)
+			}
+		}
+		if line.Tags, err = parseTags(strings.Join(line.Tags, ",")); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", errInvalidImport, n, err)
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+// writeEvents logs events and applies them to the store in order. They are
+// queued a window at a time before waiting on the first, so that loggers can
+// commit them in batches without a large import overflowing the queue.
+// Events that fail to be logged are not applied; the ones applied are
+// returned along with the first error. The caller holds every key lock.
+func (s *Server) writeEvents(r *http.Request, events []Event) (applied []Event, err error) {
+	window := defaultQueueCapacity
+	if reporter, ok := s.transact.(LoggerStatsReporter); ok {
+		window = max(reporter.LoggerStats().Capacity, 1)
+	}
+
+	for i := range events {
+		events[i].Origin, events[i].Principal = s.config.NodeID, principal(r.Context())
+		if err = s.checkKeyLength(events[i]); err != nil {
+			return nil, err
+		}
+		if err = s.checkWriteOnce(events[i]); err != nil {
+			return nil, err
+		}
+		if err = s.transformEvent(r.Context(), &events[i]); err != nil {
+			return nil, err
+		}
+		if err = normalizeEvent(&events[i]); err != nil {
+			return nil, err
+		}
+		if err = s.checkSchema(r.Context(), events[i]); err != nil {
+			return nil, err
+		}
+		if s.values != nil {
+			if err = s.values.sealEvent(r.Context(), &events[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = s.checkQuota(events...); err != nil {
+		return nil, err
+	}
+
+	results := make([]<-chan WriteResult, len(events))
+	queued := 0
+
+	for i, e := range events {
+		for ; queued < len(events) && queued < i+window; queued++ {
+			results[queued] = s.transact.WriteEvent(events[queued])
+		}
+
+		result := <-results[i]
+		if result.Err != nil {
+			err = cmp.Or(err, result.Err)
+			continue
+		}
+		e.Sequence = result.Sequence
+		if s.changeCapture != nil {
+			s.changeCapture.capture(e)
+		}
+		s.recordHistory(e)
+		if s.leader != nil {
+			s.leader.notifyCommitted()
+		}
+
+		if e.Type == EventTypePut {
+			err = cmp.Or(err, s.store.Put(r.Context(), e))
+		} else {
+			err = cmp.Or(err, s.store.Delete(r.Context(), e))
+		}
+		s.notify(e)
+		applied = append(applied, e)
+	}
+
+	return applied, err
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cavee
+
+import "os"
+
+// lockFile only opens the lock file where flock is not available, so two
+// processes are not kept from sharing a log.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package cavee
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock on the file at path, creating it
+// if needed, and returns the file holding it. It fails at once with
+// ErrLogLocked if another process holds the lock. Closing the file releases
+// it, as does the process exiting.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLogLocked
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
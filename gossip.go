@@ -0,0 +1,363 @@
+package cavee
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Gossip finds the other nodes of the cluster and detects when they fail,
+// with the SWIM protocol of memberlist. Without a static -cluster-peers, the
+// hash ring is made of the members that are alive, and follows them as they
+// join, fail and leave. A replicated cluster has no ring, and gossip only
+// reports its membership.
+
+const (
+	// gossipRetryDelay and gossipMaxRetryDelay bound the backoff of a node
+	// joining the cluster through its seeds.
+	gossipRetryDelay    = time.Second
+	gossipMaxRetryDelay = 30 * time.Second
+	// gossipLeaveTimeout is how long a node closing waits for its leave to
+	// be gossiped to the other members.
+	gossipLeaveTimeout = 5 * time.Second
+)
+
+// Member states. Members that miss probes are suspected for a while before
+// they are declared dead, and stay alive, and on the hash ring, meanwhile.
+const (
+	MemberAlive = "alive"
+	MemberDead  = "dead"
+	MemberLeft  = "left"
+)
+
+// Member is a node of the cluster found through gossip.
+type Member struct {
+	ID string `json:"id"`
+	// Addr is the gossip address of the member.
+	Addr string `json:"addr"`
+	// URL is the base URL of the member's HTTP API, as set by its
+	// -advertise-url.
+	URL   string `json:"url,omitempty"`
+	Role  string `json:"role,omitempty"`
+	State string `json:"state"`
+	// Since is when the member was last seen to change state.
+	Since time.Time `json:"since"`
+}
+
+// memberMeta is what a node tells the other members about itself. Leaving
+// is set by a node about to leave, so that the others can tell it from one
+// that failed, which memberlist does not tell them.
+type memberMeta struct {
+	URL     string `json:"url,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Leaving bool   `json:"leaving,omitempty"`
+}
+
+// gossip keeps track of the members of the cluster. It is both the
+// memberlist delegate of the node and its event delegate.
+type gossip struct {
+	server *Server
+	list   *memberlist.Memberlist
+
+	mu      sync.Mutex
+	members map[string]*Member
+	joined  bool
+	leaving bool
+	// discovered are the addresses DNS discovery last joined through.
+	discovered []string
+}
+
+func newGossip(s *Server) *gossip {
+	return &gossip{server: s, members: make(map[string]*Member)}
+}
+
+// start binds the gossip address and creates the member list, with this
+// node as its only member until it joins the others.
+func (g *gossip) start() error {
+	config := memberlist.DefaultLANConfig()
+	config.Name = g.server.config.NodeID
+	config.Delegate = g
+	config.Events = g
+	config.Logger = slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug)
+
+	host, port, err := splitGossipAddr(g.server.config.GossipAddr)
+	if err != nil {
+		return fmt.Errorf("invalid gossip-addr: %w", err)
+	}
+	config.BindAddr, config.BindPort = cmp.Or(host, "0.0.0.0"), port
+	config.AdvertisePort = port
+	if g.server.config.GossipAdvertise != "" {
+		if config.AdvertiseAddr, config.AdvertisePort, err = splitGossipAddr(g.server.config.GossipAdvertise); err != nil {
+			return fmt.Errorf("invalid gossip-advertise: %w", err)
+		}
+	}
+
+	if g.list, err = memberlist.Create(config); err != nil {
+		return fmt.Errorf("failed to start gossip: %w", err)
+	}
+	slog.Info("gossip started", slog.String("addr", g.list.LocalNode().Address()))
+
+	return nil
+}
+
+func splitGossipAddr(addr string) (host string, port int, err error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	if port, err = strconv.Atoi(p); err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	return host, port, nil
+}
+
+// join joins the cluster through seeds, the gossip addresses of some of its
+// members, retrying with backoff until one of them answers or the server
+// closes. Once joined, failures and new members are found by gossip.
+func (g *gossip) join(seeds []string) {
+	defer g.server.background.Done()
+
+	delay := gossipRetryDelay
+	for {
+		n, err := g.list.Join(seeds)
+		if err == nil {
+			g.mu.Lock()
+			g.joined = true
+			g.mu.Unlock()
+			slog.Info("joined cluster", slog.Int("seeds", n), slog.Int("members", g.list.NumMembers()))
+			return
+		}
+		slog.Warn("failed to join cluster, retrying",
+			slog.String("seeds", strings.Join(seeds, ",")),
+			slog.String("error", err.Error()),
+			slog.String("retry_in", delay.String()),
+		)
+
+		select {
+		case <-time.After(delay):
+		case <-g.server.closing:
+			return
+		}
+		delay = min(delay*2, gossipMaxRetryDelay)
+	}
+}
+
+// joinNew joins the cluster through the addresses DNS discovery found that
+// it did not find before, as when the cluster scales up, or through all of
+// them until the node has joined. Addresses that go away are left to the
+// failure detection of gossip.
+func (g *gossip) joinNew(addrs []string) {
+	self := g.list.LocalNode().Address()
+
+	g.mu.Lock()
+	var seeds []string
+	for _, addr := range addrs {
+		if addr != self && (!g.joined || !slices.Contains(g.discovered, addr)) {
+			seeds = append(seeds, addr)
+		}
+	}
+	if len(seeds) == 0 {
+		// Either every address is known, or the node is alone in the
+		// cluster and has nobody to join.
+		g.joined = true
+		g.mu.Unlock()
+		return
+	}
+	g.mu.Unlock()
+
+	n, err := g.list.Join(seeds)
+	if err != nil {
+		slog.Warn("failed to join discovered peers", slog.String("peers", strings.Join(seeds, ",")), slog.String("error", err.Error()))
+		return
+	}
+
+	g.mu.Lock()
+	g.joined, g.discovered = true, addrs
+	g.mu.Unlock()
+	slog.Info("joined discovered peers", slog.Int("peers", n), slog.Int("members", g.list.NumMembers()))
+}
+
+// stop tells the other members that this node is leaving, so that they
+// take it off the ring at once rather than once it fails their probes.
+func (g *gossip) stop() {
+	g.mu.Lock()
+	g.leaving = true
+	g.mu.Unlock()
+	if err := g.list.UpdateNode(gossipLeaveTimeout); err != nil {
+		slog.Warn("failed to tell cluster of leaving", slog.String("error", err.Error()))
+	}
+	if err := g.list.Leave(gossipLeaveTimeout); err != nil {
+		slog.Warn("failed to leave cluster", slog.String("error", err.Error()))
+	}
+	if err := g.list.Shutdown(); err != nil {
+		slog.Warn("failed to stop gossip", slog.String("error", err.Error()))
+	}
+}
+
+// NodeMeta tells the other members where this node's HTTP API is and what
+// its replication role is.
+func (g *gossip) NodeMeta(limit int) []byte {
+	g.mu.Lock()
+	meta := memberMeta{URL: g.server.config.AdvertiseURL, Leaving: g.leaving}
+	g.mu.Unlock()
+	switch {
+	case g.server.leader != nil:
+		meta.Role = "leader"
+	case g.server.follower != nil:
+		meta.Role = "follower"
+	}
+
+	b, err := json.Marshal(meta)
+	if err != nil || len(b) > limit {
+		slog.Error("gossip node metadata too large", slog.Int("limit", limit))
+		return nil
+	}
+	return b
+}
+
+// The node gossips no messages or state of its own.
+func (g *gossip) NotifyMsg([]byte)                           {}
+func (g *gossip) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (g *gossip) LocalState(join bool) []byte                { return nil }
+func (g *gossip) MergeRemoteState(buf []byte, join bool)     {}
+
+func (g *gossip) NotifyJoin(node *memberlist.Node) {
+	g.update(node, MemberAlive)
+}
+
+func (g *gossip) NotifyUpdate(node *memberlist.Node) {
+	g.update(node, MemberAlive)
+}
+
+// NotifyLeave is called both for members that left and those that failed.
+func (g *gossip) NotifyLeave(node *memberlist.Node) {
+	g.update(node, MemberDead)
+}
+
+// update records a member changing state and rebuilds the ring from the
+// members that are alive. It is called by memberlist, which holds its own
+// locks, so it must not call back into it.
+func (g *gossip) update(node *memberlist.Node, state string) {
+	var meta memberMeta
+	if len(node.Meta) > 0 {
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			slog.Warn("invalid gossip node metadata", slog.String("node", node.Name), slog.String("error", err.Error()))
+		}
+	}
+	if state == MemberDead && meta.Leaving {
+		state = MemberLeft
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	since := time.Now().UTC()
+	switch m, ok := g.members[node.Name]; {
+	case !ok:
+		slog.Info("cluster member joined", slog.String("node", node.Name), slog.String("addr", node.Address()))
+	case m.State != state:
+		slog.Info("cluster member changed state",
+			slog.String("node", node.Name),
+			slog.String("from", m.State),
+			slog.String("to", state),
+		)
+	default:
+		since = m.Since
+	}
+	g.members[node.Name] = &Member{
+		ID:    node.Name,
+		Addr:  node.Address(),
+		URL:   meta.URL,
+		Role:  meta.Role,
+		State: state,
+		Since: since,
+	}
+
+	if g.server.ring == nil {
+		return
+	}
+	var nodes []RingNode
+	for _, m := range g.members {
+		if m.State == MemberAlive && m.URL != "" {
+			nodes = append(nodes, RingNode{ID: m.ID, URL: m.URL})
+		}
+	}
+	g.server.ring.SetNodes(nodes)
+}
+
+// Members returns the members of the cluster, sorted by ID. Members that
+// failed or left are kept until they rejoin.
+func (g *gossip) Members() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	slices.SortFunc(members, func(a, b Member) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return members
+}
+
+// healthCheck reports the node as degraded while it has not joined its
+// seeds, while memberlist's own health score shows it is slow to answer
+// probes, or while some members are failing.
+func (g *gossip) healthCheck() HealthCheck {
+	check := HealthCheck{Name: "gossip", Status: HealthOK}
+
+	g.mu.Lock()
+	joined := g.joined || len(g.server.config.GossipJoin) == 0 && g.server.config.ClusterDNS == ""
+	g.mu.Unlock()
+
+	var failing []string
+	for _, m := range g.Members() {
+		if m.State == MemberDead {
+			failing = append(failing, m.ID)
+		}
+	}
+
+	switch score := g.list.GetHealthScore(); {
+	case !joined:
+		check.Status, check.Detail = HealthDegraded, "not joined to the cluster yet"
+	case score > 0:
+		check.Status, check.Detail = HealthDegraded, fmt.Sprintf("health score %d: the node is slow to answer probes", score)
+	case len(failing) > 0:
+		check.Status, check.Detail = HealthDegraded, "members failing: "+strings.Join(failing, ", ")
+	}
+	return check
+}
+
+type clusterMembersResponse struct {
+	NodeID string `json:"node_id"`
+	// HealthScore is memberlist's awareness of this node's own health: 0
+	// when it answers probes in time, and higher the more it falls behind.
+	HealthScore int      `json:"health_score"`
+	Members     []Member `json:"members"`
+}
+
+// GetClusterMembersHandler lists the members of the cluster found through gossip,
+// with the state of each and the health of this node.
+func (s *Server) GetClusterMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if s.gossip == nil || s.gossip.list == nil {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotClustered, "the node does not gossip; start cavee with -gossip-addr")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, clusterMembersResponse{
+		NodeID:      s.config.NodeID,
+		HealthScore: s.gossip.list.GetHealthScore(),
+		Members:     s.gossip.Members(),
+	})
+}
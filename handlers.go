@@ -0,0 +1,588 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInternalServerError = errors.New("internal server error")
+)
+
+// The key handlers serve both /v1/key/{key}, in the default namespace, and
+// /v1/ns/{ns}/key/{key}.
+
+// PutHandler writes a key. With ?return=old it is a get-and-set: the value
+// it replaced is sent back with 200 as by GET, or 201 is sent without a body
+// if the key did not exist.
+func (s *Server) PutHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	returnOld := false
+	switch r.URL.Query().Get("return") {
+	case "":
+	case "old":
+		returnOld = true
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "return must be old")
+		return
+	}
+	// A get-and-set reads the key as a GET does.
+	if returnOld {
+		if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		if _, _, err = mime.ParseMediaType(contentType); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid Content-Type: "+err.Error())
+			return
+		}
+	}
+
+	tags, err := parseTags(r.Header.Get(tagsHeader))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	current, err := s.store.Get(r.Context(), ns, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrNoSuchKey) {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !(exists && matchesRevision(ifMatch, current.Version)) {
+		if exists {
+			w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+		}
+		writeError(w, r, http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "key does not match the revision in If-Match")
+		return
+	}
+
+	// If-None-Match: * makes the PUT a create that never overwrites.
+	if exists && strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+		writeError(w, r, http.StatusConflict, ErrorCodeKeyExists, "key already exists")
+		return
+	}
+
+	// The value replaced is read before the write, so that a read transform
+	// failing on it fails the request without writing.
+	var old string
+	if returnOld && exists {
+		if old, err = s.readValue(r.Context(), ns, current.Value); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePut, Namespace: ns, Key: key, Value: string(value), ContentType: contentType, Tags: tags, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Put(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	if !returnOld || !exists {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+	setTimestampHeaders(w.Header(), current)
+	writeValue(w, r, old, current.ContentType)
+}
+
+func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if r.URL.Query().Has("as_of") {
+		s.getAsOf(w, r, ns, key)
+		return
+	}
+
+	if clientID := r.Header.Get("X-Cavee-Client-ID"); clientID != "" {
+		if err := s.watchHub.Track(clientID, ns, key); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeUnknownClient, err.Error())
+			return
+		}
+	}
+
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if s.access != nil {
+		s.access.read(ns, key, time.Now())
+	}
+
+	if raw := r.URL.Query().Get("version"); raw != "" {
+		version, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "version must be a sequence number")
+			return
+		}
+
+		v, err := s.store.GetVersion(r.Context(), ns, key, version)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+
+		// Only the time a version was written is kept, so the headers
+		// describe the version rather than the key.
+		w.Header().Set("X-Cavee-Version", strconv.FormatUint(v.Version, 10))
+		setTimestampHeaders(w.Header(), Entry{Updated: v.Time})
+		if !notModified(w, r, v.Version, v.Time) {
+			s.writeReadValue(w, r, ns, v.Value, v.ContentType)
+		}
+		return
+	}
+
+	if entry.Sliding > 0 {
+		s.refreshExpiry(r, ns, key, entry)
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(entry.Version, 10))
+	if len(entry.Tags) > 0 {
+		w.Header().Set(tagsHeader, strings.Join(entry.Tags, ","))
+	}
+	setTimestampHeaders(w.Header(), entry)
+	if !notModified(w, r, entry.Version, entry.Updated) {
+		s.writeReadValue(w, r, ns, entry.Value, entry.ContentType)
+	}
+}
+
+// writeReadValue writes a value read with GET once it has been through the
+// read transforms of its namespace.
+func (s *Server) writeReadValue(w http.ResponseWriter, r *http.Request, ns, value, contentType string) {
+	transformed, err := s.readValue(r.Context(), ns, value)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeValue(w, r, transformed, contentType)
+}
+
+// notModified sets the ETag of a value, which is its quoted revision, and
+// answers with 304 when the conditional headers of a GET show the client
+// already has it. If-Modified-Since is only consulted without
+// If-None-Match, and only has the second precision of Last-Modified.
+func notModified(w http.ResponseWriter, r *http.Request, revision uint64, updated time.Time) bool {
+	w.Header().Set("ETag", `"`+strconv.FormatUint(revision, 10)+`"`)
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !matchesRevision(ifNoneMatch, revision) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || updated.IsZero() || updated.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeValue writes a value as the response body, with the content type it
+// was stored with or, failing that, a sniffed one. The router sends HEAD
+// requests to the GET handlers, which answer them with the same headers,
+// including the length of the value, but without the value itself.
+func writeValue(w http.ResponseWriter, r *http.Request, value, contentType string) {
+	h := w.Header()
+	if contentType == "" {
+		contentType = http.DetectContentType([]byte(value[:min(len(value), 512)]))
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	io.WriteString(w, value)
+}
+
+// KeyVersion describes one version in the response of the versions endpoint.
+type KeyVersion struct {
+	Version   uint64     `json:"version"`
+	Size      int        `json:"size"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type keyVersionsResponse struct {
+	Namespace string       `json:"namespace,omitempty"`
+	Key       string       `json:"key"`
+	Versions  []KeyVersion `json:"versions"`
+}
+
+// GetVersionsHandler lists the versions of a key still held by the store,
+// newest first. Each can be read with ?version= on the key.
+func (s *Server) GetVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	versions, err := s.store.Versions(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	resp := keyVersionsResponse{Namespace: ns, Key: key, Versions: make([]KeyVersion, 0, len(versions))}
+	for _, v := range versions {
+		kv := KeyVersion{Version: v.Version, Size: len(v.Value)}
+		if updated := v.Time.UTC(); !updated.IsZero() {
+			kv.UpdatedAt = &updated
+		}
+		resp.Versions = append(resp.Versions, kv)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// matchesRevision reports whether an If-Match or If-None-Match header lists
+// the revision, which is the version returned in X-Cavee-Version and, quoted,
+// in ETag. Revisions may be given bare or as entity tags, and "*" matches any
+// revision.
+func matchesRevision(header string, revision uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		tag = strings.Trim(tag, `"`)
+		if tag == "*" || tag == strconv.FormatUint(revision, 10) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeyMeta is the response of the meta endpoint.
+type KeyMeta struct {
+	Namespace   string     `json:"namespace,omitempty"`
+	Key         string     `json:"key"`
+	Version     uint64     `json:"version"`
+	Size        int        `json:"size"`
+	ContentType string     `json:"content_type,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Access      *KeyAccess `json:"access,omitempty"`
+	// KeyID is the data key the value is encrypted with at rest.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// GetMetaHandler describes a key without sending its value. Reading the
+// metadata does not count as a read of the key.
+func (s *Server) GetMetaHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	meta := KeyMeta{Namespace: ns, Key: key, Version: entry.Version, Size: len(entry.Value), ContentType: entry.ContentType, Tags: entry.Tags, KeyID: entry.KeyID}
+	if created := entry.Created.UTC(); !created.IsZero() {
+		meta.CreatedAt = &created
+	}
+	if updated := entry.Updated.UTC(); !updated.IsZero() {
+		meta.UpdatedAt = &updated
+	}
+	if s.access != nil {
+		access := s.access.get(ns, key)
+		meta.Access = &access
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(entry.Version, 10))
+	setTimestampHeaders(w.Header(), entry)
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// setTimestampHeaders sets Last-Modified, which only has second precision,
+// along with the exact creation and modification times of entry.
+func setTimestampHeaders(h http.Header, entry Entry) {
+	if !entry.Created.IsZero() {
+		h.Set("X-Cavee-Created-At", entry.Created.UTC().Format(time.RFC3339Nano))
+	}
+	if !entry.Updated.IsZero() {
+		h.Set("X-Cavee-Updated-At", entry.Updated.UTC().Format(time.RFC3339Nano))
+		h.Set("Last-Modified", entry.Updated.UTC().Format(http.TimeFormat))
+	}
+}
+
+// DeleteHandler deletes a key. With ?return=value it is a get-and-delete:
+// the key must exist, and its value is sent back as by GET.
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	returnValue := false
+	switch r.URL.Query().Get("return") {
+	case "":
+	case "value":
+		returnValue = true
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "return must be value")
+		return
+	}
+	if returnValue {
+		if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	var current Entry
+	if returnValue {
+		var err error
+		if current, err = s.store.Get(r.Context(), ns, key); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		if current.Value, err = s.readValue(r.Context(), ns, current.Value); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeDelete, Namespace: ns, Key: key, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Delete(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	if !returnValue {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+	setTimestampHeaders(w.Header(), current)
+	writeValue(w, r, current.Value, current.ContentType)
+}
+
+type deletePrefixResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// DeletePrefixHandler deletes every key starting with the prefix query
+// parameter at once. It is logged as a single event, however many keys
+// match, and watchers are told about each deleted key.
+func (s *Server) DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	ns, prefix := r.PathValue("ns"), r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "prefix is required")
+		return
+	}
+
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeDeletePrefix, Namespace: ns, Key: prefix, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	deleted, err := s.store.DeletePrefix(r.Context(), e)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	for _, key := range deleted {
+		s.notify(Event{Sequence: e.Sequence, Type: EventTypeDelete, Namespace: ns, Key: key, Time: e.Time})
+	}
+
+	slog.InfoContext(r.Context(), "deleted keys by prefix",
+		slog.String("namespace", ns),
+		slog.String("prefix", prefix),
+		slog.Int("deleted", len(deleted)),
+	)
+
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, deletePrefixResponse{Deleted: len(deleted)})
+}
+
+// writeEvent runs the pre-write hooks on e, appends it to the transaction
+// log with this node as its origin and the caller as its principal, and
+// returns it as logged, with the sequence number the log assigned.
+// The store is only updated afterwards, so callers hold the lock of the key
+// being written.
+func (s *Server) writeEvent(ctx context.Context, e Event) (Event, error) {
+	if err := s.runPreWriteHooks(ctx, &e); err != nil {
+		return Event{}, err
+	}
+	if err := s.checkKeyLength(e); err != nil {
+		return Event{}, err
+	}
+	if err := s.checkWriteOnce(e); err != nil {
+		return Event{}, err
+	}
+	if err := s.transformEvent(ctx, &e); err != nil {
+		return Event{}, err
+	}
+	if err := normalizeEvent(&e); err != nil {
+		return Event{}, err
+	}
+	if err := s.checkSchema(ctx, e); err != nil {
+		return Event{}, err
+	}
+	if s.values != nil {
+		if err := s.values.sealEvent(ctx, &e); err != nil {
+			return Event{}, err
+		}
+	}
+	if err := s.checkQuota(e); err != nil {
+		return Event{}, err
+	}
+
+	e.Origin, e.Principal = s.config.NodeID, principal(ctx)
+	result := <-s.transact.WriteEvent(e)
+	e.Sequence = result.Sequence
+
+	if result.Err == nil {
+		if s.changeCapture != nil {
+			s.changeCapture.capture(e)
+		}
+		s.recordHistory(e)
+		if s.leader != nil {
+			s.leader.notifyCommitted()
+		}
+	}
+
+	return e, result.Err
+}
+
+// setSequenceHeader sends the sequence number the transaction log assigned
+// to a write in X-Cavee-Sequence, so that clients can find the write in the
+// log or wait for a replica to catch up with it.
+func setSequenceHeader(w http.ResponseWriter, sequence uint64) {
+	w.Header().Set("X-Cavee-Sequence", strconv.FormatUint(sequence, 10))
+}
+
+// writeLogError reports a failure to append to the transaction log. A full
+// queue means the server is overloaded rather than broken, so the client is
+// asked to retry.
+func writeLogError(w http.ResponseWriter, r *http.Request, err error) {
+	if writeHookError(w, r, err) || writeSchemaError(w, r, err) || writeWriteOnceError(w, r, err) || writeQuotaError(w, r, err) || writeKeyTooLongError(w, r, err) || writeTransformError(w, r, err) || writeDataTypeError(w, r, err) {
+		return
+	}
+	if errors.Is(err, ErrEventUnsupported) {
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, err.Error())
+		return
+	}
+	if errors.Is(err, ErrLogQueueFull) {
+		slog.WarnContext(r.Context(), "rejected write", slog.String("error", err.Error()))
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeOverloaded, err.Error())
+		return
+	}
+
+	slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+	writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+}
+
+// writeStoreError maps an error returned by the store to an API error.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if writeHookError(w, r, err) || writeSchemaError(w, r, err) || writeWriteOnceError(w, r, err) || writeQuotaError(w, r, err) || writeKeyTooLongError(w, r, err) || writeTransformError(w, r, err) || writeDataTypeError(w, r, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, ErrNoSuchKey):
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchKey, err.Error())
+	case errors.Is(err, ErrNoSuchNamespace):
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchNamespace, err.Error())
+	case errors.Is(err, ErrNoSuchVersion):
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchVersion, err.Error())
+	case errors.Is(err, ErrSnapshotTooOld):
+		writeError(w, r, http.StatusGone, ErrorCodeSnapshotTooOld, err.Error())
+	case errors.Is(err, ErrWrongType):
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeWrongType, err.Error())
+	default:
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write response", slog.String("error", err.Error()))
+	}
+}
+
+func healthcheck(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK!"))
+}
@@ -0,0 +1,222 @@
+package cavee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// hashContentType is the content type of keys holding hashes, whose values
+// are JSON objects mapping each field to its value.
+const hashContentType = "application/vnd.cavee.hash+json"
+
+type hash map[string]string
+
+func decodeHash(entry Entry) (hash, error) {
+	var fields hash
+	if err := json.Unmarshal([]byte(entry.Value), &fields); err != nil {
+		return nil, fmt.Errorf("invalid hash: %w", err)
+	}
+	return fields, nil
+}
+
+// encode returns the value of a key holding the hash, or an empty one if the
+// hash has no fields, since an empty hash is kept as no key at all.
+func (h hash) encode() (string, error) {
+	if len(h) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(h)
+	return string(b), err
+}
+
+type hashResponse struct {
+	Fields hash `json:"fields"`
+	Count  int  `json:"count"`
+}
+
+type hashUpdateRequest struct {
+	Set    map[string]string `json:"set"`
+	Delete []string          `json:"delete"`
+}
+
+type hashUpdateResponse struct {
+	// Added counts the fields set that did not exist, and Updated those
+	// that did.
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Deleted int `json:"deleted"`
+	Count   int `json:"count"`
+}
+
+// getHash returns the hash a key holds, which has no fields if the key does
+// not exist, along with its entry.
+func (s *Server) getHash(r *http.Request, ns, key string) (hash, Entry, error) {
+	entry, exists, err := s.getTyped(r, ns, key, hashContentType)
+	if err != nil || !exists {
+		return hash{}, Entry{}, err
+	}
+
+	fields, err := decodeHash(entry)
+	return fields, entry, err
+}
+
+// GetFieldsHandler sends every field of the hash a key holds, along with
+// how many there are. A key that does not exist holds a hash without any.
+func (s *Server) GetFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	fields, _, err := s.getHash(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hashResponse{Fields: fields, Count: len(fields)})
+}
+
+// GetFieldHandler sends the value of a field of the hash a key holds.
+func (s *Server) GetFieldHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, field := r.PathValue("ns"), r.PathValue("key"), r.PathValue("field")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	fields, _, err := s.getHash(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	value, ok := fields[field]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchField, "hash has no field "+field)
+		return
+	}
+
+	writeValue(w, r, value, "")
+}
+
+// PutFieldHandler sets a field of the hash a key holds to the body, creating
+// the key if needed, without rewriting the other fields from the client. It
+// answers 201 if the field was added and 204 if it was replaced.
+func (s *Server) PutFieldHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, field := r.PathValue("ns"), r.PathValue("key"), r.PathValue("field")
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	resp, ok := s.updateHash(w, r, ns, key, hashUpdateRequest{Set: map[string]string{field: string(value)}})
+	if !ok {
+		return
+	}
+	if resp.Added == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DeleteFieldHandler deletes a field of the hash a key holds, deleting the
+// key once the hash has no fields left. It answers 404 if the hash has no
+// such field.
+func (s *Server) DeleteFieldHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, field := r.PathValue("ns"), r.PathValue("key"), r.PathValue("field")
+
+	resp, ok := s.updateHash(w, r, ns, key, hashUpdateRequest{Delete: []string{field}})
+	if !ok {
+		return
+	}
+	if resp.Deleted == 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchField, "hash has no field "+field)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateFieldsHandler sets and deletes fields of the hash a key holds in a
+// single write, taking {"set": {...}, "delete": [...]}. Fields are set
+// before others are deleted.
+func (s *Server) UpdateFieldsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req hashUpdateRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	resp, ok := s.updateHash(w, r, ns, key, req)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateHash sets and deletes fields of a hash, writing the hash back only
+// if it changed, and writing the error response if it fails.
+func (s *Server) updateHash(w http.ResponseWriter, r *http.Request, ns, key string, req hashUpdateRequest) (hashUpdateResponse, bool) {
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	fields, current, err := s.getHash(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return hashUpdateResponse{}, false
+	}
+
+	var resp hashUpdateResponse
+	changed := false
+	for field, value := range req.Set {
+		old, exists := fields[field]
+		if !exists {
+			resp.Added++
+		} else {
+			resp.Updated++
+		}
+		changed = changed || !exists || old != value
+		fields[field] = value
+	}
+	for _, field := range req.Delete {
+		if _, exists := fields[field]; exists {
+			delete(fields, field)
+			resp.Deleted++
+			changed = true
+		}
+	}
+	resp.Count = len(fields)
+
+	if !changed {
+		return resp, true
+	}
+
+	value, err := fields.encode()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return hashUpdateResponse{}, false
+	}
+	if _, ok := s.writeTyped(w, r, ns, key, current, value, hashContentType); !ok {
+		return hashUpdateResponse{}, false
+	}
+
+	return resp, true
+}
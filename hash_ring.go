@@ -0,0 +1,253 @@
+package cavee
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// forwardedByHeader is set on requests a node forwards to the owner of their
+// key, naming the node that forwarded them. A forwarded request is always
+// served where it lands, so that nodes disagreeing about the ring while it
+// changes cannot bounce a request between them.
+const forwardedByHeader = "X-Cavee-Forwarded-By"
+
+// Cluster routing modes: forward proxies requests for keys owned by another
+// node to it, while redirect sends the client there with 307.
+const (
+	clusterRoutingForward  = "forward"
+	clusterRoutingRedirect = "redirect"
+)
+
+// RingNode is a node of the hash ring, with the base URL its HTTP API is
+// served at.
+type RingNode struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// ParseRingNodes parses a comma-separated list of nodes given as id=url.
+func ParseRingNodes(s string) ([]RingNode, error) {
+	var nodes []RingNode
+	for _, peer := range strings.Split(s, ",") {
+		id, rawURL, ok := strings.Cut(strings.TrimSpace(peer), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid cluster peer %q: must be id=url", peer)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid cluster peer %q: url must be absolute", peer)
+		}
+		nodes = append(nodes, RingNode{ID: id, URL: strings.TrimSuffix(rawURL, "/")})
+	}
+	return nodes, nil
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// HashRing assigns every key to a node by consistent hashing. Each node is
+// placed on the ring at vnodes points, and a key belongs to the node of the
+// first point at or after the key's hash, so that adding or removing a node
+// only moves the keys of the slices next to its points. The nodes can be
+// replaced at any time, as when membership changes.
+type HashRing struct {
+	mu     sync.RWMutex
+	vnodes int
+	nodes  map[string]RingNode
+	points []ringPoint
+}
+
+func NewHashRing(vnodes int, nodes []RingNode) *HashRing {
+	r := &HashRing{vnodes: vnodes}
+	r.SetNodes(nodes)
+	return r
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// SetNodes replaces the nodes of the ring.
+func (r *HashRing) SetNodes(nodes []RingNode) {
+	byID := make(map[string]RingNode, len(nodes))
+	points := make([]ringPoint, 0, len(nodes)*r.vnodes)
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	for id := range byID {
+		for i := range r.vnodes {
+			points = append(points, ringPoint{hash: ringHash(id + "#" + strconv.Itoa(i)), node: id})
+		}
+	}
+	slices.SortFunc(points, func(a, b ringPoint) int {
+		if a.hash != b.hash {
+			return cmpUint64(a.hash, b.hash)
+		}
+		return strings.Compare(a.node, b.node)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nodes, r.points = byID, points
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Nodes returns the nodes of the ring, sorted by ID.
+func (r *HashRing) Nodes() []RingNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]RingNode, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.SortFunc(nodes, func(a, b RingNode) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return nodes
+}
+
+// Owner returns the node a key of a namespace belongs to, or false if the
+// ring has no nodes.
+func (r *HashRing) Owner(ns, key string) (RingNode, bool) {
+	h := ringHash(ns + "\x00" + key)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return RingNode{}, false
+	}
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		return cmpUint64(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i].node], true
+}
+
+// keyOfPath returns the namespace and key a request to the key API is about,
+// from /v1/key/{key} and /v1/ns/{ns}/key/{key} and the paths below them.
+func keyOfPath(u *url.URL) (ns, key string, ok bool) {
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	switch {
+	case len(segments) >= 3 && segments[0] == "v1" && segments[1] == "key":
+		key = segments[2]
+	case len(segments) >= 5 && segments[0] == "v1" && segments[1] == "ns" && segments[3] == "key":
+		ns, key = segments[2], segments[4]
+	default:
+		return "", "", false
+	}
+
+	var err error
+	if ns, err = url.PathUnescape(ns); err != nil {
+		return "", "", false
+	}
+	if key, err = url.PathUnescape(key); err != nil || key == "" {
+		return "", "", false
+	}
+	return ns, key, true
+}
+
+// routeToOwner sends the requests about a key owned by another node of the
+// ring there, by forwarding them or redirecting the client, according to
+// -cluster-routing. Requests that are not about a single key, such as scans,
+// transactions and the admin API, are served by the node that receives
+// them, from the keys it owns.
+func (s *Server) routeToOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ns, key, ok := keyOfPath(r.URL)
+		if !ok || r.Header.Get(forwardedByHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, ok := s.ring.Owner(ns, key)
+		if !ok || owner.ID == s.config.NodeID {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Cavee-Owner", owner.ID)
+		if s.config.ClusterRouting == clusterRoutingRedirect {
+			http.Redirect(w, r, owner.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		s.forward(w, r, owner)
+	})
+}
+
+// forward proxies a request to another node.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, node RingNode) {
+	target, err := url.Parse(node.URL)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "invalid node url", slog.String("node", node.ID), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusBadGateway, ErrorCodeNodeUnavailable, fmt.Sprintf("node %s has an invalid url", node.ID))
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(forwardedByHeader, s.config.NodeID)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.WarnContext(r.Context(), "failed to forward request",
+				slog.String("node", node.ID),
+				slog.String("error", err.Error()),
+			)
+			writeError(w, r, http.StatusBadGateway, ErrorCodeNodeUnavailable, fmt.Sprintf("node %s is unavailable", node.ID))
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+type ringResponse struct {
+	NodeID  string     `json:"node_id"`
+	Routing string     `json:"routing"`
+	Nodes   []RingNode `json:"nodes"`
+	// Owner is the node owning the key given as ?key=, and ?ns=.
+	Owner *RingNode `json:"owner,omitempty"`
+}
+
+// GetRingHandler describes the hash ring, and with ?key= which node owns
+// that key.
+func (s *Server) GetRingHandler(w http.ResponseWriter, r *http.Request) {
+	if s.ring == nil {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotClustered, "the node is not part of a hash ring")
+		return
+	}
+
+	resp := ringResponse{NodeID: s.config.NodeID, Routing: s.config.ClusterRouting, Nodes: s.ring.Nodes()}
+	if query := r.URL.Query(); query.Has("key") {
+		if owner, ok := s.ring.Owner(query.Get("ns"), query.Get("key")); ok {
+			resp.Owner = &owner
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
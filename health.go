@@ -0,0 +1,46 @@
+package cavee
+
+import (
+	"net/http"
+	"strings"
+)
+
+// LivezHandler reports that the process is up and serving HTTP. It does not
+// depend on the state of the store, so a restart is never triggered by a
+// long replay.
+func (s *Server) LivezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK!"))
+}
+
+// ReadyzHandler reports whether the server should receive traffic: only
+// once the transaction log has been replayed, and no longer once shutdown
+// has begun or the log has failed.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	failure := s.logFailure.Load()
+
+	switch {
+	case !s.started.Load():
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeNotReady, "server is starting up")
+	case s.draining.Load():
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeNotReady, "server is shutting down")
+	case failure != nil:
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeLogFailed, failure.String())
+	default:
+		w.Write([]byte("OK!"))
+	}
+}
+
+// readinessMiddleware turns away API and admin requests until the server has
+// started, since the store is incomplete and the logger not yet running
+// while the log is replayed.
+func (s *Server) readinessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.started.Load() && (strings.HasPrefix(r.URL.Path, "/v1/") || strings.HasPrefix(r.URL.Path, "/v3/") || strings.HasPrefix(r.URL.Path, "/admin/")) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeNotReady, "server is starting up")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
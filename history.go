@@ -0,0 +1,226 @@
+package cavee
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyHistoryEvent is an event of the transaction log that changed a key.
+type KeyHistoryEvent struct {
+	Sequence uint64 `json:"sequence"`
+	// Type is the kind of event: put, append, delete, delete_prefix,
+	// delete_tag, rename, expire or persist. The writes of a transaction
+	// are puts and deletes.
+	Type string `json:"type"`
+	// Time is left out for events logged before timestamps were recorded.
+	Time *time.Time `json:"time,omitempty"`
+	// Principal is the authenticated caller that made the change, if any.
+	Principal string `json:"principal,omitempty"`
+	// ValueHash is the hex SHA-256 of the value a put wrote, or of the part
+	// an append added.
+	ValueHash string `json:"value_hash,omitempty"`
+	// From and To name the other key of a rename.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// keyHistory indexes the events of the transaction log by the keys they
+// changed. It is built while the log is replayed and kept up to date as
+// events are logged, keeping the last limit events of each key. Keys keep
+// their history once deleted, except when their namespace is dropped.
+type keyHistory struct {
+	sync.Mutex
+	limit      int
+	namespaces map[string]map[string]*keyEvents
+}
+
+type keyEvents struct {
+	events []KeyHistoryEvent
+	// exists and tags describe the key as of its last event, so that the
+	// keys a prefix or tag delete removed can be told apart.
+	exists bool
+	tags   []string
+}
+
+func newKeyHistory(limit int) *keyHistory {
+	return &keyHistory{limit: limit, namespaces: make(map[string]map[string]*keyEvents)}
+}
+
+// add appends an event to the history of a key. The caller must hold the
+// lock.
+func (h *keyHistory) add(ns, key string, event KeyHistoryEvent) *keyEvents {
+	m, ok := h.namespaces[ns]
+	if !ok {
+		m = make(map[string]*keyEvents)
+		h.namespaces[ns] = m
+	}
+	k, ok := m[key]
+	if !ok {
+		k = &keyEvents{}
+		m[key] = k
+	}
+
+	if len(k.events) >= h.limit {
+		k.events = slices.Delete(k.events, 0, len(k.events)-h.limit+1)
+	}
+	k.events = append(k.events, event)
+
+	return k
+}
+
+// deleteAll records the deletion of the existing keys of a namespace that
+// match. The caller must hold the lock.
+func (h *keyHistory) deleteAll(ns string, event KeyHistoryEvent, matches func(key string, k *keyEvents) bool) {
+	for key, k := range h.namespaces[ns] {
+		if k.exists && matches(key, k) {
+			h.add(ns, key, event).exists = false
+		}
+	}
+}
+
+// record adds an event that has been logged to the history of the keys it
+// changed. hash returns the value hash of a value the event carries.
+func (h *keyHistory) record(e Event, hash func(value string) string) {
+	h.Lock()
+	defer h.Unlock()
+
+	event := KeyHistoryEvent{Sequence: e.Sequence, Type: e.Type.String(), Principal: e.Principal}
+	if !e.Time.IsZero() {
+		at := e.Time.UTC()
+		event.Time = &at
+	}
+
+	switch e.Type {
+	case EventTypePut:
+		event.ValueHash = hash(e.Value)
+		k := h.add(e.Namespace, e.Key, event)
+		k.exists, k.tags = true, e.Tags
+	case EventTypeAppend:
+		event.ValueHash = hash(e.Value)
+		k := h.add(e.Namespace, e.Key, event)
+		if !k.exists {
+			k.exists, k.tags = true, nil
+		}
+	case EventTypeDelete:
+		h.add(e.Namespace, e.Key, event).exists = false
+	case EventTypeExpire, EventTypePersist:
+		h.add(e.Namespace, e.Key, event)
+	case EventTypeRename:
+		var tags []string
+		if k, ok := h.namespaces[e.Namespace][e.Key]; ok {
+			tags = k.tags
+		}
+		from, to := event, event
+		from.To, to.From = e.Value, e.Key
+		h.add(e.Namespace, e.Key, from).exists = false
+		k := h.add(e.Namespace, e.Value, to)
+		k.exists, k.tags = true, tags
+	case EventTypeDeletePrefix:
+		h.deleteAll(e.Namespace, event, func(key string, _ *keyEvents) bool {
+			return strings.HasPrefix(key, e.Key)
+		})
+	case EventTypeDeleteTag:
+		h.deleteAll(e.Namespace, event, func(_ string, k *keyEvents) bool {
+			_, found := slices.BinarySearch(k.tags, e.Key)
+			return found
+		})
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			slog.Error("failed to index transaction for key history", slog.Uint64("sequence", e.Sequence), slog.String("error", err.Error()))
+			return
+		}
+		for _, op := range writes {
+			event := event
+			event.Type = op.Op
+			if op.Op == txnOpPut {
+				event.ValueHash = hash(op.Value)
+				k := h.add(e.Namespace, op.Key, event)
+				k.exists, k.tags = true, op.Tags
+			} else {
+				h.add(e.Namespace, op.Key, event).exists = false
+			}
+		}
+	case EventTypeNamespaceDrop:
+		delete(h.namespaces, e.Namespace)
+	}
+}
+
+// get returns a copy of the history of a key, oldest event first.
+func (h *keyHistory) get(ns, key string) []KeyHistoryEvent {
+	h.Lock()
+	defer h.Unlock()
+
+	if k, ok := h.namespaces[ns][key]; ok {
+		return slices.Clone(k.events)
+	}
+	return nil
+}
+
+// reset drops the history of every key, as when the log is restored from a
+// snapshot and the events before it are set aside.
+func (h *keyHistory) reset() {
+	h.Lock()
+	defer h.Unlock()
+
+	clear(h.namespaces)
+}
+
+// recordHistory adds an event that has been logged to the key history, if
+// it is kept. Values are hashed as they were written, before sealing.
+func (s *Server) recordHistory(e Event) {
+	if s.history == nil {
+		return
+	}
+
+	s.history.record(e, func(value string) string {
+		if s.values != nil {
+			plain, _, err := s.values.open(value)
+			if err != nil {
+				slog.Error("failed to open value for key history", slog.String("namespace", e.Namespace), slog.Uint64("sequence", e.Sequence), slog.String("error", err.Error()))
+				return ""
+			}
+			value = plain
+		}
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	})
+}
+
+type keyHistoryResponse struct {
+	Namespace string            `json:"namespace,omitempty"`
+	Key       string            `json:"key"`
+	Events    []KeyHistoryEvent `json:"events"`
+}
+
+// GetHistoryHandler sends the events of the transaction log that changed a
+// key, oldest first, as far back as -key-history events.
+func (s *Server) GetHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if s.history == nil {
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, "key history is not kept; start cavee with -key-history")
+		return
+	}
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	events := s.history.get(ns, key)
+	if events == nil {
+		events = []KeyHistoryEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, keyHistoryResponse{Namespace: ns, Key: key, Events: events})
+}
@@ -0,0 +1,155 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Applications embedding Cavee can add their own validation, enrichment or
+// authorization through hooks and middleware passed to NewServer, without
+// patching the handlers.
+
+// PreWriteHook is called with every event before it is logged, whether it
+// comes from a request or from the server itself, such as the deletion of
+// an expired key. It may change the event, which is logged and applied as
+// changed, or return an error to reject the write. Transactions are a single
+// event, as logged. The context carries the request's Identity, if any, and
+// the key of the event is locked while hooks run.
+type PreWriteHook func(ctx context.Context, e *Event) error
+
+// PostWriteHook is called with every change to a key once it has been logged
+// and applied to the store, as watchers see it: transactions and prefix
+// deletions are passed as the puts and deletes of each key, with the
+// sequence number of the event they were logged as. It runs on the write
+// path, so it should hand anything slow off to a goroutine of its own.
+type PostWriteHook func(e Event)
+
+// PreReadHook is called before a key is read through the API, and can
+// return an error to reject the read. Every route returning the value of a
+// key, or anything about it, calls it: a GET of the key or of its metadata,
+// versions, TTL, JSON paths or data type members, gets and compares in
+// transactions and sessions, ?return= on a PUT or DELETE, set queries,
+// scripts, exports and the etcd Range, Put and DeleteRange calls. Routes
+// reading many keys fail as a whole if any of them is rejected, except
+// watches and searches, which leave out the keys rejected. Scans only list
+// key names, and do not call it.
+type PreReadHook func(ctx context.Context, ns, key string) error
+
+// HookError rejects a request from a hook with a status, code and message
+// of its choosing. Hooks returning other errors reject requests with 403
+// and ErrorCodePermissionDenied.
+type HookError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// errRejectedByHook marks the errors returned by hooks, which are passed to
+// the client rather than logged as failures of the server.
+type errRejectedByHook struct {
+	err error
+}
+
+func (e *errRejectedByHook) Error() string {
+	return e.err.Error()
+}
+
+func (e *errRejectedByHook) Unwrap() error {
+	return e.err
+}
+
+type hooks struct {
+	preWrite   []PreWriteHook
+	postWrite  []PostWriteHook
+	preRead    []PreReadHook
+	middleware []func(http.Handler) http.Handler
+}
+
+// WithPreWriteHook adds a hook called before every write. Hooks are called
+// in the order they are added, and the first error stops the write.
+func WithPreWriteHook(hook PreWriteHook) ServerOption {
+	return func(s *Server) {
+		s.hooks.preWrite = append(s.hooks.preWrite, hook)
+	}
+}
+
+// WithPostWriteHook adds a hook called after every write.
+func WithPostWriteHook(hook PostWriteHook) ServerOption {
+	return func(s *Server) {
+		s.hooks.postWrite = append(s.hooks.postWrite, hook)
+	}
+}
+
+// WithPreReadHook adds a hook called before every read of a key. Hooks are
+// called in the order they are added, and the first error stops the read.
+func WithPreReadHook(hook PreReadHook) ServerOption {
+	return func(s *Server) {
+		s.hooks.preRead = append(s.hooks.preRead, hook)
+	}
+}
+
+// WithMiddleware wraps the routes of the API in mw. It runs inside
+// authentication, so it sees the request's Identity, and inside the
+// readiness and read-only checks. Middleware added first is outermost.
+func WithMiddleware(mw func(http.Handler) http.Handler) ServerOption {
+	return func(s *Server) {
+		s.hooks.middleware = append(s.hooks.middleware, mw)
+	}
+}
+
+func (s *Server) runPreWriteHooks(ctx context.Context, e *Event) error {
+	for _, hook := range s.hooks.preWrite {
+		if err := hook(ctx, e); err != nil {
+			return &errRejectedByHook{err: err}
+		}
+	}
+	return nil
+}
+
+func (s *Server) runPreReadHooks(ctx context.Context, ns, key string) error {
+	for _, hook := range s.hooks.preRead {
+		if err := hook(ctx, ns, key); err != nil {
+			return &errRejectedByHook{err: err}
+		}
+	}
+	return nil
+}
+
+// runPreReadHooksEach runs the pre-read hooks for each of keys, for the
+// routes returning the values of many keys at once, which fail as a whole
+// if any of them may not be read.
+func (s *Server) runPreReadHooksEach(ctx context.Context, ns string, keys []string) error {
+	for _, key := range keys {
+		if err := s.runPreReadHooks(ctx, ns, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHookError writes the response for a request rejected by a hook, and
+// reports whether err is such a rejection.
+func writeHookError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var rejected *errRejectedByHook
+	if !errors.As(err, &rejected) {
+		return false
+	}
+
+	var hookErr *HookError
+	if errors.As(rejected.err, &hookErr) && hookErr.Status != 0 {
+		code := hookErr.Code
+		if code == "" {
+			code = ErrorCodePermissionDenied
+		}
+		writeError(w, r, hookErr.Status, code, hookErr.Message)
+		return true
+	}
+
+	writeError(w, r, http.StatusForbidden, ErrorCodePermissionDenied, rejected.Error())
+	return true
+}
@@ -0,0 +1,74 @@
+package cavee_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// No route returning anything about a key may skip the pre-read hooks.
+func TestPreReadHookOnEveryRead(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"scripts/get.star": getScript})
+	deny := cavee.WithPreReadHook(func(ctx context.Context, ns, key string) error {
+		if strings.HasPrefix(key, "secret") {
+			return errors.New("secret keys may not be read")
+		}
+		return nil
+	})
+	inst := caveetest.StartWithOptions(t, []cavee.ServerOption{deny}, func(c *cavee.Config) {
+		c.ScriptsDir = filepath.Join(dir, "scripts")
+		c.SearchIndex = true
+	})
+
+	w := openWatch(t, inst, "prefix=")
+	mustRequest(t, inst, http.MethodPut, "/v1/key/secret", "word", http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/public", "word", http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/secret-set/members/a", "", http.StatusCreated)
+	if msg := w.next(t); msg.Key != "public" {
+		t.Errorf("watch sent %+v first, want the put of public", msg)
+	}
+
+	session := beginSession(t, inst)
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{name: "GET", method: "GET", path: "/v1/key/secret", status: http.StatusForbidden},
+		{name: "txn get", method: "POST", path: "/v1/txn", body: `{"then":[{"op":"get","key":"secret"}]}`, status: http.StatusForbidden},
+		{name: "txn compare", method: "POST", path: "/v1/txn", body: `{"compare":[{"key":"secret","value":"word"}],"then":[{"op":"put","key":"public","value":"x"}]}`, status: http.StatusForbidden},
+		{name: "session get", method: "GET", path: "/v1/sessions/" + session + "/key/secret", status: http.StatusForbidden},
+		{name: "PUT return=old", method: "PUT", path: "/v1/key/secret?return=old", body: "new", status: http.StatusForbidden},
+		{name: "DELETE return=value", method: "DELETE", path: "/v1/key/secret?return=value", status: http.StatusForbidden},
+		{name: "export", method: "GET", path: "/v1/export", status: http.StatusForbidden},
+		{name: "set query", method: "GET", path: "/v1/sets/union?key=secret-set", status: http.StatusForbidden},
+		{name: "script", method: "POST", path: "/v1/scripts/get", body: `{"keys":["secret"]}`, status: http.StatusForbidden},
+		{name: "etcd range", method: "POST", path: "/v3/kv/range", body: `{"key":"` + etcdBase64("secret") + `"}`, status: http.StatusForbidden},
+	} {
+		if resp, b := doRequest(t, inst, tc.method, tc.path, tc.body, nil); resp.StatusCode != tc.status {
+			t.Errorf("%s answered %d, want %d: %s", tc.name, resp.StatusCode, tc.status, b)
+		}
+	}
+
+	// Searches leave out the keys they may not read.
+	waitFor(t, 5*time.Second, "public to be indexed", func() bool {
+		return strings.Contains(string(mustRequest(t, inst, http.MethodGet, "/v1/search?q=word", "", http.StatusOK)), "public")
+	})
+	if b := mustRequest(t, inst, http.MethodGet, "/v1/search?q=word", "", http.StatusOK); !jsonEqual(b, `{"keys":["public"],"truncated":false}`) {
+		t.Errorf("search answered %s, want only public", b)
+	}
+
+	// None of the writes rejected for their reads happened.
+	if b := mustRequest(t, inst, http.MethodGet, "/v1/key/public", "", http.StatusOK); string(b) != "word" {
+		t.Errorf("public reads as %q, want word", b)
+	}
+	if b := mustRequest(t, inst, http.MethodGet, "/v1/keys", "", http.StatusOK); !strings.Contains(string(b), `"secret"`) {
+		t.Errorf("keys are %s, want secret still there", b)
+	}
+}
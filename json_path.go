@@ -0,0 +1,431 @@
+package cavee
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPath = errors.New("invalid path")
+	ErrNoSuchPath  = errors.New("no such path")
+	ErrNotJSON     = errors.New("value is not a JSON document")
+)
+
+// A jsonPath addresses a fragment of a JSON document. It is written in the
+// subset of JSONPath that names a single node: $ followed by any number of
+// .name, ['name'] and [index] segments, e.g. $.users[0]['display name'].
+type jsonPath []jsonPathSegment
+
+// jsonPathSegment is an object member name or, if isIndex is set, an array
+// index.
+type jsonPathSegment struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+func (seg jsonPathSegment) String() string {
+	if seg.isIndex {
+		return fmt.Sprintf("[%d]", seg.index)
+	}
+
+	return strconv.Quote(seg.name)
+}
+
+// parseJSONPath parses a path, treating an empty one as $.
+func parseJSONPath(raw string) (jsonPath, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(raw, "$") {
+		return nil, fmt.Errorf("%w: must start with $", ErrInvalidPath)
+	}
+
+	var path jsonPath
+	rest := raw[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("%w: empty member name", ErrInvalidPath)
+			}
+			path = append(path, jsonPathSegment{name: rest[1:end]})
+			rest = rest[end:]
+
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if len(rest) > 1 && (rest[1] == '\'' || rest[1] == '"') {
+				name, n, err := unquotePathName(rest[1:])
+				if err != nil {
+					return nil, err
+				}
+				if !strings.HasPrefix(rest[1+n:], "]") {
+					return nil, fmt.Errorf("%w: expected ] after member name", ErrInvalidPath)
+				}
+				path = append(path, jsonPathSegment{name: name})
+				rest = rest[2+n:]
+				continue
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("%w: missing ]", ErrInvalidPath)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("%w: %q is not an array index", ErrInvalidPath, rest[1:end])
+			}
+			path = append(path, jsonPathSegment{index: index, isIndex: true})
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidPath, rest[0])
+		}
+	}
+
+	return path, nil
+}
+
+// unquotePathName reads the quoted member name s starts with, in which the
+// quote and backslash may be escaped with a backslash. It returns the name
+// and the number of bytes it took up, quotes included.
+func unquotePathName(s string) (name string, n int, err error) {
+	quote := s[0]
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", 0, fmt.Errorf("%w: unterminated member name", ErrInvalidPath)
+}
+
+// jsonMember is an object member. Objects are decoded into their members,
+// rather than into a map, so that writing a fragment keeps the order of the
+// members around it.
+type jsonMember struct {
+	name  string
+	value json.RawMessage
+}
+
+func decodeJSONObject(doc json.RawMessage) (members []jsonMember, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		var m jsonMember
+		m.name = tok.(string)
+		if err = dec.Decode(&m.value); err != nil {
+			return nil, false
+		}
+		members = append(members, m)
+	}
+
+	return members, true
+}
+
+func encodeJSONObject(members []jsonMember) json.RawMessage {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(m.name)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(m.value)
+	}
+	b.WriteByte('}')
+
+	return b.Bytes()
+}
+
+func decodeJSONArray(doc json.RawMessage) (elems []json.RawMessage, ok bool) {
+	if err := json.Unmarshal(doc, &elems); err != nil {
+		return nil, false
+	}
+
+	return elems, true
+}
+
+func encodeJSONArray(elems []json.RawMessage) json.RawMessage {
+	var b bytes.Buffer
+	b.WriteByte('[')
+	for i, elem := range elems {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(elem)
+	}
+	b.WriteByte(']')
+
+	return b.Bytes()
+}
+
+// get returns the fragment of doc the path addresses.
+func (path jsonPath) get(doc json.RawMessage) (json.RawMessage, error) {
+	for i, seg := range path {
+		child, err := seg.child(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, path[:i+1])
+		}
+		doc = child
+	}
+
+	return doc, nil
+}
+
+// set returns doc with the fragment the path addresses replaced by value.
+// The last segment may name a member the object lacks, which is added, or
+// the index just past the end of an array, which appends to it; everything
+// before it must exist.
+func (path jsonPath) set(doc, value json.RawMessage) (json.RawMessage, error) {
+	return path.setFrom(0, doc, value)
+}
+
+// setFrom sets the fragment of doc, which is the node path[:i] addresses,
+// that path[i:] addresses.
+func (path jsonPath) setFrom(i int, doc, value json.RawMessage) (json.RawMessage, error) {
+	if i == len(path) {
+		return value, nil
+	}
+
+	seg, last := path[i], i == len(path)-1
+	if seg.isIndex {
+		elems, ok := decodeJSONArray(doc)
+		if !ok || seg.index > len(elems) || (seg.index == len(elems) && !last) {
+			return nil, fmt.Errorf("%w: %s", ErrNoSuchPath, path[:i+1])
+		}
+		if seg.index == len(elems) {
+			return encodeJSONArray(append(elems, value)), nil
+		}
+		child, err := path.setFrom(i+1, elems[seg.index], value)
+		if err != nil {
+			return nil, err
+		}
+		elems[seg.index] = child
+		return encodeJSONArray(elems), nil
+	}
+
+	members, ok := decodeJSONObject(doc)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchPath, path[:i+1])
+	}
+	for j, m := range members {
+		if m.name == seg.name {
+			child, err := path.setFrom(i+1, m.value, value)
+			if err != nil {
+				return nil, err
+			}
+			members[j].value = child
+			return encodeJSONObject(members), nil
+		}
+	}
+	if !last {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchPath, path[:i+1])
+	}
+
+	return encodeJSONObject(append(members, jsonMember{name: seg.name, value: value})), nil
+}
+
+func (seg jsonPathSegment) child(doc json.RawMessage) (json.RawMessage, error) {
+	if seg.isIndex {
+		if elems, ok := decodeJSONArray(doc); ok && seg.index < len(elems) {
+			return elems[seg.index], nil
+		}
+		return nil, ErrNoSuchPath
+	}
+
+	members, _ := decodeJSONObject(doc)
+	for _, m := range members {
+		if m.name == seg.name {
+			return m.value, nil
+		}
+	}
+
+	return nil, ErrNoSuchPath
+}
+
+func (path jsonPath) String() string {
+	var b strings.Builder
+	b.WriteByte('$')
+	for _, seg := range path {
+		if seg.isIndex {
+			b.WriteString(seg.String())
+		} else {
+			b.WriteString("[" + seg.String() + "]")
+		}
+	}
+
+	return b.String()
+}
+
+// writeJSONPathError answers with the error of a path that could not be
+// parsed or followed, or of a value that is not JSON.
+func writeJSONPathError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidPath):
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+	case errors.Is(err, ErrNoSuchPath):
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchPath, err.Error())
+	case errors.Is(err, ErrNotJSON):
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeNotJSON, err.Error())
+	default:
+		writeStoreError(w, r, err)
+	}
+}
+
+// GetJSONHandler parses the value of a key as a JSON document and sends only
+// the fragment addressed by ?path=, which defaults to the whole document.
+// The fragment is sent as it is stored, without being reformatted.
+func (s *Server) GetJSONHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	path, err := parseJSONPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeJSONPathError(w, r, err)
+		return
+	}
+
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	value, err := s.readValue(r.Context(), ns, entry.Value)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if !json.Valid([]byte(value)) {
+		writeJSONPathError(w, r, ErrNotJSON)
+		return
+	}
+
+	fragment, err := path.get(json.RawMessage(value))
+	if err != nil {
+		writeJSONPathError(w, r, err)
+		return
+	}
+
+	if s.access != nil {
+		s.access.read(ns, key, time.Now())
+	}
+	if entry.Sliding > 0 {
+		s.refreshExpiry(r, ns, key, entry)
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(entry.Version, 10))
+	setTimestampHeaders(w.Header(), entry)
+	writeValue(w, r, string(fragment), "application/json")
+}
+
+// PutJSONHandler replaces the fragment of a key's JSON document addressed
+// by ?path= with the JSON value in the body, adding it if the path names a
+// missing member of an object or the end of an array. The new document is
+// logged as an ordinary put that keeps the key's tags but, like any PUT,
+// clears its TTL. Writing to $, the default, replaces the whole document and
+// may create the key; other paths need the key to exist. If-Match is honored
+// as by PUT.
+func (s *Server) PutJSONHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	path, err := parseJSONPath(r.URL.Query().Get("path"))
+	if err != nil {
+		writeJSONPathError(w, r, err)
+		return
+	}
+
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	value := json.RawMessage(bytes.TrimSpace(body))
+	if !json.Valid(value) {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "body is not a JSON value")
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	current, err := s.store.Get(r.Context(), ns, key)
+	exists := err == nil
+	if err != nil && !(errors.Is(err, ErrNoSuchKey) && len(path) == 0) {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !(exists && matchesRevision(ifMatch, current.Version)) {
+		if exists {
+			w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+		}
+		writeError(w, r, http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "key does not match the revision in If-Match")
+		return
+	}
+
+	if len(path) > 0 && !json.Valid([]byte(current.Value)) {
+		writeJSONPathError(w, r, ErrNotJSON)
+		return
+	}
+	doc, err := path.set(json.RawMessage(current.Value), value)
+	if err != nil {
+		writeJSONPathError(w, r, err)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePut, Namespace: ns, Key: key, Value: string(doc), ContentType: "application/json", Tags: current.Tags, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Put(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,465 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers carried by the messages the Kafka logger publishes. The message
+// key and value are the store key and value, so downstream consumers can
+// read the topic without knowing about Cavee events. Keys outside the
+// default namespace are prefixed with the namespace and a NUL byte, so that
+// compaction keeps them apart.
+const (
+	kafkaHeaderSequence    = "cavee-sequence"
+	kafkaHeaderType        = "cavee-type"
+	kafkaHeaderNamespace   = "cavee-namespace"
+	kafkaHeaderContentType = "cavee-content-type"
+	kafkaHeaderTags        = "cavee-tags"
+	kafkaHeaderOrigin      = "cavee-origin"
+	kafkaHeaderPrincipal   = "cavee-principal"
+
+	kafkaClusterConfigPrefix = "cavee/cluster-config/"
+	kafkaNamespacePrefix     = "cavee/namespace/"
+	kafkaDeletePrefixPrefix  = "cavee/delete-prefix/"
+	kafkaExpiryPrefix        = "cavee/expiry/"
+	kafkaDeleteTagPrefix     = "cavee/delete-tag/"
+)
+
+type KafkaTransactionLoggerOptions struct {
+	Brokers []string
+	Topic   string
+
+	// ReplicationFactor is used when the logger has to create the topic.
+	ReplicationFactor int
+
+	Queue QueueOptions
+}
+
+// KafkaTransactionLogger publishes events to a single-partition Kafka topic,
+// keyed by store key, and replays the topic from the beginning on startup.
+// Deletes are written as tombstones, so the topic can be compacted down to
+// the latest value of every key.
+type KafkaTransactionLogger struct {
+	queue        eventQueue
+	errors       <-chan error
+	lastSequence uint64
+	opts         KafkaTransactionLoggerOptions
+	writer       *kafka.Writer
+}
+
+// NewKafkaTransactionLogger checks that the topic exists with exactly one
+// partition, creating it with compaction enabled if it does not, since events
+// are only ordered within a partition.
+func NewKafkaTransactionLogger(opts KafkaTransactionLoggerOptions) (logger TransactionLogger, err error) {
+	if len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("no kafka brokers configured")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("no kafka topic configured")
+	}
+
+	l := &KafkaTransactionLogger{queue: eventQueue{opts: opts.Queue}, opts: opts}
+
+	if err = l.ensureTopic(); err != nil {
+		return nil, err
+	}
+
+	l.writer = &kafka.Writer{
+		Addr:         kafka.TCP(opts.Brokers...),
+		Topic:        opts.Topic,
+		RequiredAcks: kafka.RequireAll,
+		// Run already batches whatever is queued, so the writer should not
+		// hold messages back waiting for more.
+		BatchTimeout: time.Millisecond,
+	}
+
+	return l, nil
+}
+
+// dial connects to the first reachable broker.
+func (l *KafkaTransactionLogger) dial() (conn *kafka.Conn, err error) {
+	for _, broker := range l.opts.Brokers {
+		if conn, err = kafka.Dial("tcp", broker); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to connect to kafka: %w", err)
+}
+
+func (l *KafkaTransactionLogger) ensureTopic() error {
+	conn, err := l.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(l.opts.Topic)
+	if err == nil {
+		if len(partitions) != 1 {
+			return fmt.Errorf("kafka topic %s has %d partitions, the transaction log needs exactly one", l.opts.Topic, len(partitions))
+		}
+		return nil
+	}
+	if !errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return fmt.Errorf("failed to read kafka topic metadata: %w", err)
+	}
+
+	// Topics can only be created through the controller.
+	controller, err := conn.Controller()
+	if err != nil {
+		return fmt.Errorf("failed to find kafka controller: %w", err)
+	}
+	controllerConn, err := kafka.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return fmt.Errorf("failed to connect to kafka controller: %w", err)
+	}
+	defer controllerConn.Close()
+
+	err = controllerConn.CreateTopics(kafka.TopicConfig{
+		Topic:             l.opts.Topic,
+		NumPartitions:     1,
+		ReplicationFactor: l.opts.ReplicationFactor,
+		ConfigEntries: []kafka.ConfigEntry{
+			{ConfigName: "cleanup.policy", ConfigValue: "compact"},
+		},
+	})
+	if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+		return fmt.Errorf("failed to create kafka topic %s: %w", l.opts.Topic, err)
+	}
+
+	return nil
+}
+
+func (l *KafkaTransactionLogger) WritePut(key, value string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypePut, Key: key, Value: value})
+}
+
+func (l *KafkaTransactionLogger) WriteDelete(key string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypeDelete, Key: key})
+}
+
+// WriteEvent rejects renames with ErrEventUnsupported: compaction could drop
+// the put of the source key a rename depends on, losing the value it moved.
+// Transactions are rejected too, since compaction cannot tell when a later
+// write has replaced the ones they hold, and once the tombstone of a later
+// delete is gone replaying them would bring the key back. Appends are
+// rejected as well, since compaction keeps only the last write to a key
+// and so would drop the value they append to.
+func (l *KafkaTransactionLogger) WriteEvent(e Event) <-chan WriteResult {
+	if e.Type == EventTypeRename || e.Type == EventTypeTxn || e.Type == EventTypeAppend {
+		result := make(chan WriteResult, 1)
+		result <- WriteResult{Err: ErrEventUnsupported}
+		return result
+	}
+
+	return l.queue.push(e)
+}
+
+func (l *KafkaTransactionLogger) Close(ctx context.Context) error {
+	started, err := l.queue.close(ctx)
+	if !started && err == nil {
+		return l.writer.Close()
+	}
+
+	return err
+}
+
+func (l *KafkaTransactionLogger) LoggerStats() LoggerStats {
+	return l.queue.stats()
+}
+
+func (l *KafkaTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *KafkaTransactionLogger) HealthChecks(ctx context.Context) []HealthCheck {
+	brokers := HealthCheck{Name: "brokers", Status: HealthFailing}
+	for _, broker := range l.opts.Brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			conn.Close()
+			brokers.Status, brokers.Detail = HealthOK, "reached "+broker
+			break
+		}
+		brokers.Detail = err.Error()
+	}
+
+	return append(l.queue.healthChecks(), brokers)
+}
+
+func (l *KafkaTransactionLogger) Run() {
+	events := l.queue.start()
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	go func() {
+		var failed error
+		batch := make([]pendingEvent, 0, cap(events))
+
+		for {
+			e, ok := <-events
+			if !ok {
+				l.queue.finish(l.writer.Close())
+				return
+			}
+
+			// Publish everything that queued up while the previous batch was
+			// being written in a single request.
+			batch = append(batch[:0], e)
+		drain:
+			for len(batch) < cap(batch) {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+
+			// Once a publish has failed the log can no longer be trusted, so
+			// every later write is rejected with the same error.
+			if failed == nil {
+				messages := make([]kafka.Message, len(batch))
+				for i := range batch {
+					l.lastSequence++
+					batch[i].Sequence = l.lastSequence
+					messages[i] = encodeKafkaMessage(batch[i].Event)
+				}
+
+				if err := l.writer.WriteMessages(context.Background(), messages...); err != nil {
+					failed = fmt.Errorf("failed to publish to kafka: %w", err)
+					errors <- failed
+				}
+			}
+
+			for _, e := range batch {
+				e.done(failed)
+			}
+		}
+	}()
+}
+
+func (l *KafkaTransactionLogger) ReadEvents() (eventsCh <-chan Event, errorsCh <-chan error) {
+	outEvents := make(chan Event)
+	outErrors := make(chan error, 1)
+
+	go func() {
+		defer close(outEvents)
+		defer close(outErrors)
+
+		if err := l.readTopic(outEvents); err != nil {
+			outErrors <- err
+		}
+	}()
+
+	return outEvents, outErrors
+}
+
+func (l *KafkaTransactionLogger) readTopic(outEvents chan<- Event) error {
+	ctx := context.Background()
+
+	var conn *kafka.Conn
+	var err error
+	for _, broker := range l.opts.Brokers {
+		if conn, err = kafka.DialLeader(ctx, "tcp", broker, l.opts.Topic, 0); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to kafka partition leader: %w", err)
+	}
+
+	// Only the messages present at startup are replayed; anything after
+	// them was written by this logger.
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read kafka offsets: %w", err)
+	}
+	if first >= last {
+		return nil
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   l.opts.Brokers,
+		Topic:     l.opts.Topic,
+		Partition: 0,
+		MaxBytes:  10 << 20,
+	})
+	defer r.Close()
+
+	if err = r.SetOffset(first); err != nil {
+		return fmt.Errorf("failed to seek kafka topic: %w", err)
+	}
+
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read kafka topic: %w", err)
+		}
+
+		e, err := decodeKafkaMessage(m)
+		if err != nil {
+			return &CorruptRecordError{Segment: l.opts.Topic, Offset: m.Offset, Sequence: l.lastSequence + 1, Reason: err.Error()}
+		}
+
+		// Compaction leaves gaps in the sequence, but never reorders it.
+		if l.lastSequence >= e.Sequence {
+			return fmt.Errorf("transaction number ouf of sequence in kafka topic %s at offset %d", l.opts.Topic, m.Offset)
+		}
+
+		l.lastSequence = e.Sequence
+		outEvents <- e
+
+		if m.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+func encodeKafkaMessage(e Event) kafka.Message {
+	m := kafka.Message{
+		Key:  []byte(e.Key),
+		Time: e.Time,
+		Headers: []kafka.Header{
+			{Key: kafkaHeaderSequence, Value: strconv.AppendUint(nil, e.Sequence, 10)},
+			{Key: kafkaHeaderType, Value: strconv.AppendInt(nil, int64(e.Type), 10)},
+		},
+	}
+
+	if e.Namespace != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: kafkaHeaderNamespace, Value: []byte(e.Namespace)})
+		m.Key = []byte(e.Namespace + "\x00" + e.Key)
+	}
+	if e.ContentType != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: kafkaHeaderContentType, Value: []byte(e.ContentType)})
+	}
+	if len(e.Tags) > 0 {
+		m.Headers = append(m.Headers, kafka.Header{Key: kafkaHeaderTags, Value: []byte(strings.Join(e.Tags, ","))})
+	}
+	if e.Origin != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: kafkaHeaderOrigin, Value: []byte(e.Origin)})
+	}
+	if e.Principal != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: kafkaHeaderPrincipal, Value: []byte(e.Principal)})
+	}
+
+	switch e.Type {
+	case EventTypeDelete:
+		// A nil value makes the message a tombstone.
+	case EventTypeNamespaceCreate, EventTypeNamespaceDrop:
+		m.Key = fmt.Appendf(nil, "%s%s/%d", kafkaNamespacePrefix, e.Namespace, e.Type)
+	case EventTypeExpire, EventTypePersist:
+		// Expiry changes are kept apart from the key's value, or compaction
+		// would take them for a new value. Only the latest change matters.
+		m.Key = fmt.Appendf(nil, "%s%s\x00%s", kafkaExpiryPrefix, e.Namespace, e.Key)
+		m.Value = []byte(e.Value)
+	case EventTypeDeletePrefix:
+		// A later delete of the same prefix covers everything an earlier one
+		// did, so compaction may keep only the latest.
+		m.Key = fmt.Appendf(nil, "%s%s\x00%s", kafkaDeletePrefixPrefix, e.Namespace, e.Key)
+	case EventTypeDeleteTag:
+		// As with prefixes, the latest delete of a tag covers every key an
+		// earlier one deleted that has not been written again since.
+		m.Key = fmt.Appendf(nil, "%s%s\x00%s", kafkaDeleteTagPrefix, e.Namespace, e.Key)
+	case EventTypeConfigPropose, EventTypeConfigCommit, EventTypeConfigAbort:
+		// Cluster config events are keyed by proposal ID. Each one gets a key
+		// of its own so compaction cannot drop a proposal its commit refers to.
+		m.Key = fmt.Appendf(nil, "%s%s/%d", kafkaClusterConfigPrefix, e.Key, e.Type)
+		m.Value = []byte(e.Value)
+	default:
+		m.Value = []byte(e.Value)
+	}
+
+	return m
+}
+
+func decodeKafkaMessage(m kafka.Message) (e Event, err error) {
+	var sequence, eventType string
+	for _, h := range m.Headers {
+		switch h.Key {
+		case kafkaHeaderSequence:
+			sequence = string(h.Value)
+		case kafkaHeaderType:
+			eventType = string(h.Value)
+		case kafkaHeaderNamespace:
+			e.Namespace = string(h.Value)
+		case kafkaHeaderContentType:
+			e.ContentType = string(h.Value)
+		case kafkaHeaderTags:
+			e.Tags = strings.Split(string(h.Value), ",")
+		case kafkaHeaderOrigin:
+			e.Origin = string(h.Value)
+		case kafkaHeaderPrincipal:
+			e.Principal = string(h.Value)
+		}
+	}
+
+	if e.Sequence, err = strconv.ParseUint(sequence, 10, 64); err != nil {
+		return Event{}, fmt.Errorf("invalid %s header %q", kafkaHeaderSequence, sequence)
+	}
+	t, err := strconv.Atoi(eventType)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid %s header %q", kafkaHeaderType, eventType)
+	}
+	e.Type = EventType(t)
+
+	e.Key = string(m.Key)
+	e.Value = string(m.Value)
+	e.Time = m.Time
+
+	switch e.Type {
+	case EventTypePut, EventTypeDelete:
+		if e.Namespace != "" {
+			key, ok := strings.CutPrefix(e.Key, e.Namespace+"\x00")
+			if !ok {
+				return Event{}, fmt.Errorf("message key %q does not match namespace %q", e.Key, e.Namespace)
+			}
+			e.Key = key
+		}
+	case EventTypeNamespaceCreate, EventTypeNamespaceDrop:
+		e.Key = ""
+	case EventTypeExpire, EventTypePersist:
+		key, ok := strings.CutPrefix(e.Key, kafkaExpiryPrefix+e.Namespace+"\x00")
+		if !ok {
+			return Event{}, fmt.Errorf("invalid expiry message key %q", e.Key)
+		}
+		e.Key = key
+	case EventTypeDeletePrefix:
+		prefix, ok := strings.CutPrefix(e.Key, kafkaDeletePrefixPrefix+e.Namespace+"\x00")
+		if !ok {
+			return Event{}, fmt.Errorf("invalid prefix delete message key %q", e.Key)
+		}
+		e.Key = prefix
+	case EventTypeDeleteTag:
+		tag, ok := strings.CutPrefix(e.Key, kafkaDeleteTagPrefix+e.Namespace+"\x00")
+		if !ok {
+			return Event{}, fmt.Errorf("invalid tag delete message key %q", e.Key)
+		}
+		e.Key = tag
+	case EventTypeConfigPropose, EventTypeConfigCommit, EventTypeConfigAbort:
+		rest, ok := strings.CutPrefix(e.Key, kafkaClusterConfigPrefix)
+		i := strings.LastIndexByte(rest, '/')
+		if !ok || i < 0 || rest[i+1:] != strconv.Itoa(int(e.Type)) {
+			return Event{}, fmt.Errorf("invalid cluster config message key %q", e.Key)
+		}
+		e.Key = rest[:i]
+	default:
+		return Event{}, fmt.Errorf("unknown event type %d", e.Type)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,125 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// LimitBodies caps every request body at maxSize bytes. It wraps the
+// middleware that buffers bodies as well as the handlers, so an oversized
+// PUT is cut off wherever it is first read instead of being held in memory.
+// Snapshot uploads and imports are exempt, since they hold many values;
+// their handlers check the values one by one.
+func LimitBodies(maxSize int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isBulkUpload(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > maxSize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge,
+				fmt.Sprintf("request body exceeds the limit of %d bytes", maxSize))
+			return
+		}
+
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBulkUpload reports whether path is the snapshot restore endpoint or one
+// of the import endpoints, telling the latter apart from keys named import.
+func isBulkUpload(path string) bool {
+	if path == "/admin/restore" || path == "/v1/import" {
+		return true
+	}
+
+	rest, ok := strings.CutPrefix(path, "/v1/ns/")
+	ns, found := strings.CutSuffix(rest, "/import")
+	return ok && found && ns != "" && !strings.Contains(ns, "/")
+}
+
+// writeBodyError reports a failure to read the request body, which is the
+// client's fault when the body went over the size limit.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge,
+			fmt.Sprintf("request body exceeds the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+
+	slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+	writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+}
+
+// ErrKeyTooLong is returned, wrapped in a KeyTooLongError, for writes that
+// would create a key longer than -max-key-length.
+var ErrKeyTooLong = errors.New("key too long")
+
+// KeyTooLongError names the key a write was rejected for.
+type KeyTooLongError struct {
+	Key   string
+	Limit int
+}
+
+func (e *KeyTooLongError) Error() string {
+	return fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(e.Key), e.Limit)
+}
+
+func (e *KeyTooLongError) Unwrap() error {
+	return ErrKeyTooLong
+}
+
+// checkKeyLength fails with a KeyTooLongError if an event would create a key
+// longer than -max-key-length: that of a put or append, the destination of a
+// rename, or that of a put in a transaction. Handlers check the keys they
+// are given up front too, to fail before doing any work; this check covers
+// every write, whichever handler makes it.
+func (s *Server) checkKeyLength(e Event) error {
+	limit := s.config.MaxKeyLength
+	if limit <= 0 {
+		return nil
+	}
+
+	check := func(key string) error {
+		if len(key) > limit {
+			return &KeyTooLongError{Key: key, Limit: limit}
+		}
+		return nil
+	}
+
+	switch e.Type {
+	case EventTypePut, EventTypeAppend:
+		return check(e.Key)
+	case EventTypeRename:
+		return check(e.Value)
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return err
+		}
+		for _, op := range writes {
+			if op.Op == txnOpPut {
+				if err = check(op.Key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeKeyTooLongError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, ErrKeyTooLong) {
+		return false
+	}
+	writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong, err.Error())
+	return true
+}
@@ -0,0 +1,289 @@
+package cavee
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// lockKeyPrefix is the prefix of the keys locks are kept in.
+	lockKeyPrefix = "_lock/"
+	maxLockTTL    = 24 * 60 * 60
+)
+
+var (
+	ErrLockHeld    = errors.New("lock is held")
+	ErrLockNotHeld = errors.New("lock is not held with that token")
+)
+
+// lockValue is the value of the key a held lock is kept in.
+type lockValue struct {
+	Holder string `json:"holder,omitempty"`
+	// TTL is the length of the lease in seconds, which each keepalive
+	// renews.
+	TTL int64 `json:"ttl"`
+}
+
+type lockRequest struct {
+	// TTL is the length of the lease in seconds.
+	TTL int64 `json:"ttl"`
+	// Holder names the client taking the lock, for others to see.
+	Holder string `json:"holder,omitempty"`
+}
+
+type lockResponse struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder,omitempty"`
+	// Token is the fencing token of the holder, which grows every time the
+	// lock is taken. Resources the lock guards should turn away requests
+	// carrying a smaller token than one they have already seen.
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// lockKey returns the key the lock name is kept in.
+func lockKey(name string) string {
+	return lockKeyPrefix + name
+}
+
+// getLock returns the current holder of a lock, along with the entry it is
+// kept in, or ErrNoSuchKey if nobody holds it. The caller holds the lock's
+// key lock if it is going to change it.
+func (s *Server) getLock(r *http.Request, ns, name string) (lockValue, Entry, error) {
+	entry, err := s.store.Get(r.Context(), ns, lockKey(name))
+	if err != nil {
+		return lockValue{}, Entry{}, err
+	}
+
+	var lock lockValue
+	if err = json.Unmarshal([]byte(entry.Value), &lock); err != nil {
+		return lockValue{}, Entry{}, fmt.Errorf("invalid lock %q: %w", name, err)
+	}
+
+	return lock, entry, nil
+}
+
+// checkLockName checks that the key a lock is kept in is not too long,
+// writing the error response if it is.
+func (s *Server) checkLockName(w http.ResponseWriter, r *http.Request, name string) bool {
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(lockKey(name)) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("lock name is %d bytes long, more than the limit of %d", len(name), maxLength-len(lockKeyPrefix)))
+		return false
+	}
+
+	return true
+}
+
+// readLockRequest decodes and checks the body of a request taking a lock,
+// writing the error response if it is invalid.
+func readLockRequest(w http.ResponseWriter, r *http.Request) (lockRequest, bool) {
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return lockRequest{}, false
+	}
+	if req.TTL <= 0 || req.TTL > maxLockTTL {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "ttl must be between 1 and "+strconv.Itoa(maxLockTTL)+" seconds")
+		return lockRequest{}, false
+	}
+
+	return req, true
+}
+
+// lockToken parses the ?token= of a request on a held lock, writing the
+// error response if it is missing or invalid.
+func lockToken(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "token must be the fencing token the lock was taken with")
+		return 0, false
+	}
+
+	return token, true
+}
+
+// AcquireLockHandler takes a lock for a lease of ttl seconds, failing with
+// 409 if somebody else holds it. Locks are kept as keys of the namespace,
+// named _lock/ followed by the lock's name, which are written and expire
+// like any other; the lease is the key's TTL, so a holder that stops
+// renewing it loses the lock once it runs out. The key is written with its
+// TTL as a single txn event, so a transaction log backend that cannot log
+// those cannot hold locks either.
+func (s *Server) AcquireLockHandler(w http.ResponseWriter, r *http.Request) {
+	ns, name := r.PathValue("ns"), r.PathValue("name")
+	if !s.checkLockName(w, r, name) {
+		return
+	}
+
+	req, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	lock, held, ok := s.takeLock(w, r, ns, name, req)
+	if !ok {
+		return
+	}
+	if held {
+		writeError(w, r, http.StatusConflict, ErrorCodeLockHeld, fmt.Sprintf("%s by %q until %s", ErrLockHeld, lock.Holder, lock.ExpiresAt.Format(time.RFC3339)))
+		return
+	}
+
+	setSequenceHeader(w, lock.Token)
+	writeJSON(w, http.StatusOK, lock)
+}
+
+// takeLock takes a lock if nobody holds it, returning the new holder. If
+// somebody does, it returns them instead, with held set. Other failures
+// are written as the response.
+func (s *Server) takeLock(w http.ResponseWriter, r *http.Request, ns, name string, req lockRequest) (lock lockResponse, held, ok bool) {
+	unlock := s.store.LockKey(ns, lockKey(name))
+	defer unlock()
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return lockResponse{}, false, false
+	}
+
+	if holder, entry, err := s.getLock(r, ns, name); err == nil {
+		return lockResponse{Name: name, Holder: holder.Holder, Token: entry.Version, ExpiresAt: entry.ExpiresAt.UTC()}, true, true
+	} else if !errors.Is(err, ErrNoSuchKey) {
+		writeStoreError(w, r, err)
+		return lockResponse{}, false, false
+	}
+
+	value, err := json.Marshal(lockValue{Holder: req.Holder, TTL: req.TTL})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return lockResponse{}, false, false
+	}
+	expiresAt := time.Now().Add(time.Duration(req.TTL) * time.Second).UTC()
+	e, ok := s.commitTxn(w, r, ns, []txnOp{{Op: txnOpPut, Key: lockKey(name), Value: string(value), ContentType: "application/json", ExpiresAt: &expiresAt}})
+	if !ok {
+		return lockResponse{}, false, false
+	}
+
+	slog.InfoContext(r.Context(), "lock acquired",
+		slog.String("namespace", ns),
+		slog.String("lock", name),
+		slog.String("holder", req.Holder),
+		slog.Uint64("token", e.Sequence),
+	)
+
+	return lockResponse{Name: name, Holder: req.Holder, Token: e.Sequence, ExpiresAt: expiresAt}, false, true
+}
+
+// GetLockHandler reports who holds a lock, with their fencing token and
+// when their lease runs out.
+func (s *Server) GetLockHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeLock(w, r, r.PathValue("ns"), r.PathValue("name"))
+}
+
+func (s *Server) writeLock(w http.ResponseWriter, r *http.Request, ns, name string) {
+	held, entry, err := s.getLock(r, ns, name)
+	if errors.Is(err, ErrNoSuchKey) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchLock, "lock is not held")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, lockResponse{Name: name, Holder: held.Holder, Token: entry.Version, ExpiresAt: entry.ExpiresAt.UTC()})
+}
+
+// KeepAliveLockHandler renews the lease of the holder whose fencing token
+// is in ?token=, for as long as the lease it took the lock with. It fails
+// with 409 if the lease has run out, even if nobody else has taken the lock
+// since.
+func (s *Server) KeepAliveLockHandler(w http.ResponseWriter, r *http.Request) {
+	s.keepAliveLock(w, r, r.PathValue("ns"), r.PathValue("name"))
+}
+
+func (s *Server) keepAliveLock(w http.ResponseWriter, r *http.Request, ns, name string) {
+	token, ok := lockToken(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := s.store.LockKey(ns, lockKey(name))
+	defer unlock()
+
+	held, entry, err := s.getLock(r, ns, name)
+	if (err == nil && entry.Version != token) || errors.Is(err, ErrNoSuchKey) {
+		writeError(w, r, http.StatusConflict, ErrorCodeLockNotHeld, ErrLockNotHeld.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(held.TTL) * time.Second).UTC()
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeExpire, Namespace: ns, Key: lockKey(name), Value: expiryValue(expiresAt, 0), Time: now})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.SetExpiry(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, lockResponse{Name: name, Holder: held.Holder, Token: token, ExpiresAt: expiresAt})
+}
+
+// ReleaseLockHandler lets go of a lock held with the fencing token in
+// ?token=, so that others can take it before the lease runs out.
+func (s *Server) ReleaseLockHandler(w http.ResponseWriter, r *http.Request) {
+	s.releaseLock(w, r, r.PathValue("ns"), r.PathValue("name"))
+}
+
+func (s *Server) releaseLock(w http.ResponseWriter, r *http.Request, ns, name string) {
+	token, ok := lockToken(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := s.store.LockKey(ns, lockKey(name))
+	defer unlock()
+
+	_, entry, err := s.getLock(r, ns, name)
+	if (err == nil && entry.Version != token) || errors.Is(err, ErrNoSuchKey) {
+		writeError(w, r, http.StatusConflict, ErrorCodeLockNotHeld, ErrLockNotHeld.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeDelete, Namespace: ns, Key: lockKey(name), Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Delete(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	slog.InfoContext(r.Context(), "lock released",
+		slog.String("namespace", ns),
+		slog.String("lock", name),
+		slog.Uint64("token", token),
+	)
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,313 @@
+package cavee
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// Every segment starts with a fixed header identifying the file and the
+// version of the record encoding used in it:
+//
+//	magic "CAVEELOG" (8 bytes) | version (uint32, little endian) | flags (uint32, little endian)
+//
+// Version 1 headers have no flags field. The header is followed by records of
+// the form
+//
+//	payload length (uvarint) | payload | CRC32 of payload (uint32, little endian)
+//
+// where the payload is
+//
+//	sequence (uvarint) | type (1 byte) | key length (uvarint) | key | value length (uvarint) | value | fields
+//
+// Since version 3, fields is a possibly empty list of optional event fields,
+// each encoded as
+//
+//	tag (uvarint) | length (uvarint) | data
+//
+// Fields whose tag is unknown are skipped, so new ones can be added without
+// another version bump.
+//
+// In segments with segmentFlagEncrypted set, the payload is instead an
+// AES-GCM nonce followed by the sealed plaintext payload.
+const (
+	segmentMagic = "CAVEELOG"
+
+	logFormatVersion uint32 = 3
+
+	segmentFlagEncrypted uint32 = 1 << 0
+
+	fieldTagNamespace   = 1
+	fieldTagTime        = 2 // Unix nanoseconds, as a uvarint
+	fieldTagContentType = 3
+	fieldTagTags        = 4 // comma-separated
+	fieldTagOrigin      = 5
+	fieldTagPrincipal   = 6
+
+	// maxRecordSize guards against allocating huge buffers when a corrupt
+	// length prefix is read.
+	maxRecordSize = 1 << 30
+)
+
+var (
+	// errTruncatedRecord is returned when the segment ends partway through
+	// a record.
+	errTruncatedRecord = errors.New("truncated record")
+	errChecksum        = errors.New("checksum mismatch")
+	// errMalformedPayload is returned for a record whose checksum matches
+	// but whose payload cannot be decoded.
+	errMalformedPayload = errors.New("malformed payload")
+	errFieldLength      = errors.New("field length exceeds payload")
+)
+
+type segmentHeader struct {
+	version uint32
+	flags   uint32
+}
+
+func (h segmentHeader) size() int64 {
+	if h.version == 1 {
+		return int64(len(segmentMagic) + 4)
+	}
+	return int64(len(segmentMagic) + 8)
+}
+
+func (h segmentHeader) encrypted() bool {
+	return h.flags&segmentFlagEncrypted != 0
+}
+
+func encodeSegmentHeader(flags uint32) []byte {
+	b := make([]byte, 0, len(segmentMagic)+8)
+	b = append(b, segmentMagic...)
+	b = binary.LittleEndian.AppendUint32(b, logFormatVersion)
+	b = binary.LittleEndian.AppendUint32(b, flags)
+
+	return b
+}
+
+func readSegmentHeader(r io.Reader) (h segmentHeader, err error) {
+	b := make([]byte, len(segmentMagic)+4)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return segmentHeader{}, fmt.Errorf("failed to read segment header: %w", err)
+	}
+
+	if string(b[:len(segmentMagic)]) != segmentMagic {
+		return segmentHeader{}, fmt.Errorf("not a transaction log segment")
+	}
+
+	h.version = binary.LittleEndian.Uint32(b[len(segmentMagic):])
+	if h.version == 0 || h.version > logFormatVersion {
+		return segmentHeader{}, fmt.Errorf("unsupported transaction log format version %d", h.version)
+	}
+
+	if h.version >= 2 {
+		b = b[:4]
+		if _, err = io.ReadFull(r, b); err != nil {
+			return segmentHeader{}, fmt.Errorf("failed to read segment header: %w", err)
+		}
+		h.flags = binary.LittleEndian.Uint32(b)
+	}
+
+	return h, nil
+}
+
+// encodeRecord encodes e for appending to a segment, sealing the payload with
+// aead when it is not nil.
+func encodeRecord(e Event, aead cipher.AEAD) ([]byte, error) {
+	payload := make([]byte, 0, 2*binary.MaxVarintLen64+1+len(e.Key)+len(e.Value))
+	payload = binary.AppendUvarint(payload, e.Sequence)
+	payload = append(payload, byte(e.Type))
+	payload = binary.AppendUvarint(payload, uint64(len(e.Key)))
+	payload = append(payload, e.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(e.Value)))
+	payload = append(payload, e.Value...)
+	if e.Namespace != "" {
+		payload = appendField(payload, fieldTagNamespace, e.Namespace)
+	}
+	if !e.Time.IsZero() {
+		payload = appendField(payload, fieldTagTime, string(binary.AppendUvarint(nil, uint64(e.Time.UnixNano()))))
+	}
+	if e.ContentType != "" {
+		payload = appendField(payload, fieldTagContentType, e.ContentType)
+	}
+	if len(e.Tags) > 0 {
+		payload = appendField(payload, fieldTagTags, strings.Join(e.Tags, ","))
+	}
+	if e.Origin != "" {
+		payload = appendField(payload, fieldTagOrigin, e.Origin)
+	}
+	if e.Principal != "" {
+		payload = appendField(payload, fieldTagPrincipal, e.Principal)
+	}
+
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		payload = aead.Seal(nonce, nonce, payload, nil)
+	}
+
+	b := make([]byte, 0, binary.MaxVarintLen64+len(payload)+4)
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	b = append(b, payload...)
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(payload))
+
+	return b, nil
+}
+
+// readRecord reads the next record and returns the number of bytes it took up
+// in the segment, opening the payload with aead when it is not nil. It returns
+// io.EOF only when the segment ends cleanly on a record boundary.
+func readRecord(r *bufio.Reader, aead cipher.AEAD) (e Event, n int64, err error) {
+	length, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return Event{}, 0, io.EOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return Event{}, 0, errTruncatedRecord
+	}
+	if err != nil {
+		return Event{}, 0, err
+	}
+	if length > maxRecordSize {
+		return Event{}, 0, fmt.Errorf("record length %d exceeds limit", length)
+	}
+
+	b := make([]byte, length+4)
+	if _, err = io.ReadFull(r, b); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Event{}, 0, errTruncatedRecord
+	} else if err != nil {
+		return Event{}, 0, err
+	}
+
+	if e, err = openRecord(b[:length], binary.LittleEndian.Uint32(b[length:]), aead); err != nil {
+		return Event{}, 0, err
+	}
+
+	return e, int64(uvarintLen(length)) + int64(len(b)), nil
+}
+
+// openRecord verifies the checksum of a record's payload, opens it with aead
+// when it is not nil, and decodes it.
+func openRecord(payload []byte, checksum uint32, aead cipher.AEAD) (e Event, err error) {
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return Event{}, errChecksum
+	}
+
+	if aead != nil {
+		if len(payload) < aead.NonceSize() {
+			return Event{}, fmt.Errorf("encrypted payload too short")
+		}
+		nonce, sealed := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+		if payload, err = aead.Open(nil, nonce, sealed, nil); err != nil {
+			return Event{}, fmt.Errorf("failed to decrypt record: %w", err)
+		}
+	}
+
+	if e, err = decodePayload(payload); err != nil {
+		return Event{}, fmt.Errorf("%w: %w", errMalformedPayload, err)
+	}
+	return e, nil
+}
+
+// findRecord looks for a complete record with a sequence number above after
+// anywhere in b, as a record following a corrupt length prefix would be. It
+// returns the sequence number of the first one found.
+func findRecord(b []byte, aead cipher.AEAD, after uint64) (sequence uint64, found bool) {
+	for i := range b {
+		length, n := binary.Uvarint(b[i:])
+		if n <= 0 || length > uint64(len(b)-i-n) || uint64(len(b)-i-n)-length < 4 {
+			continue
+		}
+		record := b[i+n:]
+		e, err := openRecord(record[:length], binary.LittleEndian.Uint32(record[length:]), aead)
+		if err == nil && e.Sequence > after {
+			return e.Sequence, true
+		}
+	}
+	return 0, false
+}
+
+func decodePayload(b []byte) (e Event, err error) {
+	var n int
+
+	if e.Sequence, n = binary.Uvarint(b); n <= 0 {
+		return Event{}, fmt.Errorf("malformed sequence")
+	}
+	b = b[n:]
+
+	if len(b) < 1 {
+		return Event{}, fmt.Errorf("malformed event type")
+	}
+	e.Type, b = EventType(b[0]), b[1:]
+
+	key, b, err := decodeBytes(b)
+	if err != nil {
+		return Event{}, fmt.Errorf("malformed key: %w", err)
+	}
+	value, b, err := decodeBytes(b)
+	if err != nil {
+		return Event{}, fmt.Errorf("malformed value: %w", err)
+	}
+	e.Key, e.Value = string(key), string(value)
+
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return Event{}, fmt.Errorf("malformed field tag")
+		}
+		data, rest, err := decodeBytes(b[n:])
+		if err != nil {
+			return Event{}, fmt.Errorf("malformed field %d: %w", tag, err)
+		}
+		b = rest
+
+		switch tag {
+		case fieldTagNamespace:
+			e.Namespace = string(data)
+		case fieldTagTime:
+			nanos, n := binary.Uvarint(data)
+			if n <= 0 {
+				return Event{}, fmt.Errorf("malformed time field")
+			}
+			e.Time = time.Unix(0, int64(nanos))
+		case fieldTagContentType:
+			e.ContentType = string(data)
+		case fieldTagTags:
+			e.Tags = strings.Split(string(data), ",")
+		case fieldTagOrigin:
+			e.Origin = string(data)
+		case fieldTagPrincipal:
+			e.Principal = string(data)
+		}
+	}
+
+	return e, nil
+}
+
+func appendField(b []byte, tag uint64, data string) []byte {
+	b = binary.AppendUvarint(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func decodeBytes(b []byte) (field, rest []byte, err error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < length {
+		return nil, nil, errFieldLength
+	}
+
+	return b[n : n+int(length)], b[n+int(length):], nil
+}
+
+func uvarintLen(x uint64) int {
+	return len(binary.AppendUvarint(nil, x))
+}
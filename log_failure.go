@@ -0,0 +1,72 @@
+package cavee
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logFailure is the error the transaction logger reported when an append
+// failed, and when it was reported.
+type logFailure struct {
+	err error
+	at  time.Time
+}
+
+func (f *logFailure) String() string {
+	return fmt.Sprintf("transaction log failed at %s: %v", f.at.UTC().Format(time.RFC3339), f.err)
+}
+
+// watchTransactionLog waits for the logger to report a failed append. The
+// logger rejects every write after one, so the server stops taking writes
+// and reports itself unhealthy until it is restarted.
+func (s *Server) watchTransactionLog(errors <-chan error) {
+	select {
+	case err := <-errors:
+		if err == nil {
+			return
+		}
+
+		s.logFailure.Store(&logFailure{err: err, at: time.Now()})
+		slog.Error("transaction log failed, rejecting writes until restarted", slog.String("error", err.Error()))
+	case <-s.closing:
+	}
+}
+
+// logFailureMiddleware turns away writes once the transaction log has
+// failed, since they could no longer be made durable. Reads are still
+// served from the store.
+func (s *Server) logFailureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failure := s.logFailure.Load()
+		if failure != nil && isLoggedWrite(r) {
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeLogFailed, failure.String())
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoggedWrite reports whether r is a request that appends to the
+// transaction log: an API write or a namespace change.
+func isLoggedWrite(r *http.Request) bool {
+	if isAPIWrite(r) {
+		return true
+	}
+
+	return !isReadMethod(r.Method) && strings.HasPrefix(r.URL.Path, "/admin/namespaces/")
+}
+
+// logFailureCheck reports whether the transaction log has failed since
+// startup. Unlike the logger's own checks, it stays failing until restart.
+func (s *Server) logFailureCheck() HealthCheck {
+	check := HealthCheck{Name: "transaction_log", Status: HealthOK}
+	if failure := s.logFailure.Load(); failure != nil {
+		check.Status, check.Detail = HealthFailing, failure.String()
+	}
+
+	return check
+}
@@ -0,0 +1,62 @@
+package cavee
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// logLevels are the levels the log level can be switched between, in the
+// order SIGUSR1 cycles through them.
+var logLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn}
+
+// ParseLogLevel parses one of debug, info or warn, in any case.
+func ParseLogLevel(s string) (slog.Level, error) {
+	for _, level := range logLevels {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid log level %q: must be debug, info or warn", s)
+}
+
+// NextLogLevel returns the level after level in the cycle debug, info, warn.
+func NextLogLevel(level slog.Level) slog.Level {
+	for i, l := range logLevels {
+		if l == level {
+			return logLevels[(i+1)%len(logLevels)]
+		}
+	}
+
+	return slog.LevelInfo
+}
+
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) GetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelResponse{Level: strings.ToLower(s.logLevel.Level().String())})
+}
+
+func (s *Server) SetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var req logLevelResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	level, err := ParseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	s.logLevel.Set(level)
+	slog.Warn("log level changed", slog.String("level", level.String()))
+
+	writeJSON(w, http.StatusOK, logLevelResponse{Level: strings.ToLower(level.String())})
+}
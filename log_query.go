@@ -0,0 +1,193 @@
+package cavee
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogEvent is one line of a transaction log query. Values are as logged, so
+// the values of encrypted namespaces are sealed, and values that are not
+// valid UTF-8 are carried base64 encoded in ValueBase64 instead of Value.
+type LogEvent struct {
+	Sequence    uint64     `json:"sequence"`
+	Type        string     `json:"type"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Value       string     `json:"value,omitempty"`
+	ValueBase64 []byte     `json:"value_base64,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Time        *time.Time `json:"time,omitempty"`
+	Origin      string     `json:"origin,omitempty"`
+	Principal   string     `json:"principal,omitempty"`
+}
+
+func logEvent(e Event) LogEvent {
+	line := LogEvent{Sequence: e.Sequence, Type: e.Type.String(), Namespace: e.Namespace, Key: e.Key, Value: e.Value, ContentType: e.ContentType, Tags: e.Tags, Origin: e.Origin, Principal: e.Principal}
+	if !utf8.ValidString(e.Value) {
+		line.Value, line.ValueBase64 = "", []byte(e.Value)
+	}
+	if !e.Time.IsZero() {
+		at := e.Time.UTC()
+		line.Time = &at
+	}
+	return line
+}
+
+// logQuery selects events of the transaction log. Every condition given
+// must hold.
+type logQuery struct {
+	// from and to bound the sequence numbers, both included.
+	from, to uint64
+	// since and until bound the event times, both included. Events logged
+	// before timestamps were recorded have none and never match.
+	since, until time.Time
+	namespace    *string
+	prefix       *string
+	limit        int
+}
+
+var errLogQueryLimit = errors.New("log query limit reached")
+
+func parseLogQuery(r *http.Request, last uint64) (q logQuery, err error) {
+	query := r.URL.Query()
+	q.from, q.to = 1, last
+
+	parseSequence := func(name string, v *uint64) {
+		if err == nil && query.Has(name) {
+			if *v, err = strconv.ParseUint(query.Get(name), 10, 64); err != nil {
+				err = errors.New(name + " must be a sequence number")
+			}
+		}
+	}
+	parseTime := func(name string, t *time.Time) {
+		if err == nil && query.Has(name) {
+			if *t, err = time.Parse(time.RFC3339Nano, query.Get(name)); err != nil {
+				err = errors.New(name + " must be an RFC 3339 time")
+			}
+		}
+	}
+	parseSequence("from", &q.from)
+	parseSequence("to", &q.to)
+	parseTime("since", &q.since)
+	parseTime("until", &q.until)
+	if err != nil {
+		return logQuery{}, err
+	}
+
+	if query.Has("ns") {
+		ns := query.Get("ns")
+		q.namespace = &ns
+	}
+	if query.Has("prefix") {
+		prefix := query.Get("prefix")
+		q.prefix = &prefix
+	}
+	if query.Has("limit") {
+		if q.limit, err = strconv.Atoi(query.Get("limit")); err != nil || q.limit < 1 {
+			return logQuery{}, errors.New("limit must be a positive number")
+		}
+	}
+
+	q.from = max(q.from, 1)
+	q.to = min(q.to, last)
+	return q, nil
+}
+
+// matches reports whether an event is selected by the query. A key prefix
+// matches the events that wrote a key starting with it, deletes by a prefix
+// that overlaps it, and transactions with such a write. Deletes by tag and
+// events that are not about keys never match a prefix.
+func (q logQuery) matches(e Event) bool {
+	if !q.since.IsZero() && (e.Time.IsZero() || e.Time.Before(q.since)) {
+		return false
+	}
+	if !q.until.IsZero() && (e.Time.IsZero() || e.Time.After(q.until)) {
+		return false
+	}
+	if q.namespace != nil && e.Namespace != *q.namespace {
+		return false
+	}
+	if q.prefix == nil {
+		return true
+	}
+
+	prefix := *q.prefix
+	switch e.Type {
+	case EventTypePut, EventTypeAppend, EventTypeDelete, EventTypeExpire, EventTypePersist:
+		return strings.HasPrefix(e.Key, prefix)
+	case EventTypeRename:
+		return strings.HasPrefix(e.Key, prefix) || strings.HasPrefix(e.Value, prefix)
+	case EventTypeDeletePrefix:
+		return strings.HasPrefix(e.Key, prefix) || strings.HasPrefix(prefix, e.Key)
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return false
+		}
+		for _, op := range writes {
+			if strings.HasPrefix(op.Key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LogQueryHandler streams the events of the transaction log selected by the
+// query as JSON lines, in order. ?from= and ?to= bound the sequence numbers
+// and ?since= and ?until= the times, all inclusive; ?ns= keeps one namespace,
+// ?prefix= the events about keys starting with it, and ?limit= stops after
+// that many events. Events the log no longer holds, such as those set aside
+// by a snapshot restore, are skipped.
+func (s *Server) LogQueryHandler(w http.ResponseWriter, r *http.Request) {
+	history, ok := s.transact.(HistoryReader)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, "the transaction log cannot be read back")
+		return
+	}
+
+	q, err := parseLogQuery(r, s.lastSequence())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if q.from > q.to {
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	sent := 0
+	err = history.ReadEventsBetween(r.Context(), q.from-1, q.to, func(e Event) error {
+		if !q.matches(e) {
+			return nil
+		}
+		if err := enc.Encode(logEvent(e)); err != nil {
+			return err
+		}
+		if sent++; q.limit > 0 && sent == q.limit {
+			return errLogQueryLimit
+		}
+		return nil
+	})
+	if errors.Is(err, errLogQueryLimit) {
+		err = nil
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil && r.Context().Err() == nil {
+		slog.ErrorContext(r.Context(), "failed to query transaction log", slog.String("error", err.Error()))
+	}
+}
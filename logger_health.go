@@ -0,0 +1,113 @@
+package cavee
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type HealthStatus string
+
+// Health statuses in increasing order of severity.
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded"
+	HealthFailing  HealthStatus = "failing"
+)
+
+func (s HealthStatus) worse(than HealthStatus) bool {
+	severity := map[HealthStatus]int{HealthOK: 0, HealthDegraded: 1, HealthFailing: 2}
+	return severity[s] > severity[than]
+}
+
+// HealthCheck is the outcome of one check of a component.
+type HealthCheck struct {
+	Name   string       `json:"name"`
+	Status HealthStatus `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+}
+
+// HealthChecker is implemented by transaction loggers that can check their
+// own health, such as whether their last write succeeded and whether their
+// storage is reachable. Checks should return promptly; ctx carries a
+// deadline.
+type HealthChecker interface {
+	HealthChecks(ctx context.Context) []HealthCheck
+}
+
+// healthCheckTimeout bounds the checks that reach out to a backend.
+const healthCheckTimeout = 2 * time.Second
+
+// queueFullThreshold is the share of the logger queue in use above which
+// writers are about to block.
+const queueFullThreshold = 0.9
+
+// healthChecks reports on the outcome of recent writes and on how full the
+// queue is.
+func (q *eventQueue) healthChecks() []HealthCheck {
+	q.mu.RLock()
+	closed, running, pending, capacity := q.closed, q.events != nil, len(q.events), cap(q.events)
+	q.mu.RUnlock()
+
+	q.statsMu.Lock()
+	lastWrite, lastErr, lastErrAt := q.lastWrite, q.lastErr, q.lastErrAt
+	q.statsMu.Unlock()
+
+	writes := HealthCheck{Name: "writes", Status: HealthOK}
+	switch {
+	case closed:
+		writes.Status, writes.Detail = HealthFailing, ErrLoggerClosed.Error()
+	case !running:
+		writes.Status, writes.Detail = HealthDegraded, ErrLoggerNotRunning.Error()
+	case lastErr != nil && !lastErrAt.Before(lastWrite):
+		writes.Status, writes.Detail = HealthFailing, fmt.Sprintf("last write failed at %s: %v", lastErrAt.UTC().Format(time.RFC3339), lastErr)
+	case !lastWrite.IsZero():
+		writes.Detail = "last write succeeded at " + lastWrite.UTC().Format(time.RFC3339)
+	default:
+		writes.Detail = "no writes yet"
+	}
+
+	queue := HealthCheck{Name: "queue", Status: HealthOK, Detail: fmt.Sprintf("%d of %d slots in use", pending, capacity)}
+	if capacity > 0 && float64(pending) >= queueFullThreshold*float64(capacity) {
+		queue.Status = HealthDegraded
+	}
+
+	return []HealthCheck{writes, queue}
+}
+
+type healthResponse struct {
+	Status HealthStatus  `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// HealthzHandler checks the transaction logger, and the node's membership
+// of the cluster when it gossips, and reports the worst status
+// of its checks, with 503 when it is failing or has failed since startup. A degraded logger still
+// accepts writes, so it is reported with 200.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{Status: HealthOK, Checks: []HealthCheck{}}
+
+	if checker, ok := s.transact.(HealthChecker); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		resp.Checks = checker.HealthChecks(ctx)
+		cancel()
+	}
+	resp.Checks = append(resp.Checks, s.logFailureCheck())
+	if s.gossip != nil && s.gossip.list != nil {
+		resp.Checks = append(resp.Checks, s.gossip.healthCheck())
+	}
+
+	for _, check := range resp.Checks {
+		if check.Status.worse(resp.Status) {
+			resp.Status = check.Status
+		}
+	}
+
+	status := http.StatusOK
+	if resp.Status == HealthFailing {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, resp)
+}
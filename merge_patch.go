@@ -0,0 +1,113 @@
+package cavee
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// mergePatch applies a JSON merge patch, as defined by RFC 7396, to target,
+// which is nil when there is no value to patch. Members keep their order,
+// with added ones going last.
+func mergePatch(target, patch json.RawMessage) json.RawMessage {
+	patchMembers, ok := decodeJSONObject(patch)
+	if !ok {
+		return patch
+	}
+
+	members, _ := decodeJSONObject(target)
+	for _, pm := range patchMembers {
+		i := -1
+		for j, m := range members {
+			if m.name == pm.name {
+				i = j
+				break
+			}
+		}
+
+		switch {
+		case bytes.Equal(pm.value, []byte("null")):
+			if i >= 0 {
+				members = append(members[:i], members[i+1:]...)
+			}
+		case i >= 0:
+			members[i].value = mergePatch(members[i].value, pm.value)
+		default:
+			members = append(members, jsonMember{name: pm.name, value: mergePatch(nil, pm.value)})
+		}
+	}
+
+	return encodeJSONObject(members)
+}
+
+// PatchHandler applies the JSON merge patch in the body to the JSON document
+// held by a key. The patched document is logged as an ordinary put that keeps
+// the key's tags but, like any PUT, clears its TTL. The key must exist, and If-Match is
+// honored as by PUT.
+func (s *Server) PatchHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != mergePatchContentType {
+		w.Header().Set("Accept-Patch", mergePatchContentType)
+		writeError(w, r, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedMediaType, "patches must be sent as "+mergePatchContentType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	patch := json.RawMessage(bytes.TrimSpace(body))
+	if !json.Valid(patch) {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "body is not a JSON value")
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	current, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchesRevision(ifMatch, current.Version) {
+		w.Header().Set("X-Cavee-Version", strconv.FormatUint(current.Version, 10))
+		writeError(w, r, http.StatusPreconditionFailed, ErrorCodePreconditionFailed, "key does not match the revision in If-Match")
+		return
+	}
+
+	if !json.Valid([]byte(current.Value)) {
+		writeJSONPathError(w, r, ErrNotJSON)
+		return
+	}
+
+	contentType := current.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	doc := mergePatch(json.RawMessage(current.Value), patch)
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePut, Namespace: ns, Key: key, Value: string(doc), ContentType: contentType, Tags: current.Tags, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Put(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(e)
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusNoContent)
+}
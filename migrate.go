@@ -0,0 +1,170 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+var (
+	ErrMigrationTargetNotEmpty = errors.New("destination transaction log is not empty")
+)
+
+// migrationWindow is how many events a migration has in flight at once, so
+// that the destination can commit them in batches.
+const migrationWindow = 1024
+
+// migratingEvent is an event written to the destination log whose result has
+// not been checked yet.
+type migratingEvent struct {
+	e      Event
+	result <-chan WriteResult
+}
+
+// MigrateTransactionLog copies every event of from into to, in order. Neither
+// logger may have been started, and to must be empty. If from starts from a
+// base snapshot, the snapshot is restored into to first.
+//
+// Events keep their sequence numbers unless from has gaps in them, as a
+// compacted Kafka topic does; to numbers events itself, so they are
+// renumbered from the gap on. It returns the number of events copied.
+func MigrateTransactionLog(ctx context.Context, from, to TransactionLogger) (migrated int, err error) {
+	if err = checkEmpty(to); err != nil {
+		return 0, err
+	}
+
+	if err = migrateBaseSnapshot(ctx, from, to); err != nil {
+		return 0, err
+	}
+
+	to.Run()
+
+	start := time.Now()
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+
+	var renumbered int
+	pending := make(chan migratingEvent, migrationWindow)
+
+	// confirm waits for the oldest event in flight to be written.
+	confirm := func() error {
+		p := <-pending
+		result := <-p.result
+		if result.Err != nil {
+			return fmt.Errorf("failed to write event %d: %w", p.e.Sequence, result.Err)
+		}
+		if result.Sequence != p.e.Sequence {
+			renumbered++
+		}
+		migrated++
+		return nil
+	}
+
+	events, errs := from.ReadEvents()
+	for e := range events {
+		if len(pending) == cap(pending) {
+			if err = confirm(); err != nil {
+				return migrated, err
+			}
+		}
+		pending <- migratingEvent{e, to.WriteEvent(e)}
+
+		select {
+		case <-progress.C:
+			slog.Info("migrating transaction log", slog.Int("events", migrated))
+		case <-ctx.Done():
+			return migrated, ctx.Err()
+		default:
+		}
+	}
+	if err = <-errs; err != nil {
+		return migrated, fmt.Errorf("failed to read source transaction log: %w", err)
+	}
+
+	for len(pending) > 0 {
+		if err = confirm(); err != nil {
+			return migrated, err
+		}
+	}
+
+	if renumbered > 0 {
+		slog.Warn("source transaction log has gaps in its sequence numbers, so events were renumbered",
+			slog.Int("renumbered", renumbered),
+		)
+	}
+	slog.Info("transaction log migrated",
+		slog.Int("events", migrated),
+		slog.String("duration", time.Since(start).String()),
+	)
+
+	return migrated, nil
+}
+
+// checkEmpty reads l to make sure it holds nothing, which also readies it to
+// be run.
+func checkEmpty(l TransactionLogger) error {
+	if restorer, ok := l.(SnapshotRestorer); ok {
+		file, err := restorer.OpenSnapshot()
+		if err == nil {
+			file.Close()
+			return ErrMigrationTargetNotEmpty
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	events, errs := l.ReadEvents()
+	empty := true
+	for range events {
+		empty = false
+	}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("failed to read destination transaction log: %w", err)
+	}
+	if !empty {
+		return ErrMigrationTargetNotEmpty
+	}
+
+	return nil
+}
+
+func migrateBaseSnapshot(ctx context.Context, from, to TransactionLogger) error {
+	source, ok := from.(SnapshotRestorer)
+	if !ok {
+		return nil
+	}
+
+	file, err := source.OpenSnapshot()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open base snapshot: %w", err)
+	}
+	header, _, err := readSnapshot(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read base snapshot: %w", err)
+	}
+
+	destination, ok := to.(SnapshotRestorer)
+	if !ok {
+		return fmt.Errorf("source transaction log starts from a snapshot: %w", ErrSnapshotsUnsupported)
+	}
+
+	if file, err = source.OpenSnapshot(); err != nil {
+		return fmt.Errorf("failed to open base snapshot: %w", err)
+	}
+	defer file.Close()
+
+	if err = destination.RestoreSnapshot(ctx, file, header.Sequence); err != nil {
+		return err
+	}
+	slog.Info("migrated base snapshot", slog.Uint64("sequence", header.Sequence))
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package cavee
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// exportChunk is the number of keys an export reads from the store at a
+// time, so that a long export only holds the store's read lock briefly.
+const exportChunk = 1000
+
+var (
+	ErrSnapshotTooOld = errors.New("snapshot too old")
+)
+
+// pastVersion is a value a key no longer has, together with the sequence
+// it stopped being current at. The entry was current from its Version up
+// to, but not including, until.
+type pastVersion struct {
+	entry Entry
+	until uint64
+}
+
+// pastRef names a past version in the order they are pruned in.
+type pastRef struct {
+	until   uint64
+	ns, key string
+}
+
+// retire keeps an entry that is overwritten or removed by the event with
+// sequence seq, for reads as of earlier sequences. It must be called with
+// the lock held.
+func (s *Store) retire(ns, key string, entry Entry, seq uint64) {
+	if s.retention == 0 || seq == 0 {
+		return
+	}
+
+	byKey := s.past[ns]
+	if byKey == nil {
+		byKey = make(map[string][]pastVersion)
+		s.past[ns] = byKey
+	}
+	entry.history = nil
+	byKey[key] = append(byKey[key], pastVersion{entry: entry, until: seq})
+	s.pastQueue = append(s.pastQueue, pastRef{until: seq, ns: ns, key: key})
+}
+
+// advance records that the event with sequence seq has been applied, and
+// drops the past versions that have fallen out of the retention window. It
+// must be called with the lock held.
+func (s *Store) advance(seq uint64) {
+	s.sequence = max(s.sequence, seq)
+	if s.retention == 0 {
+		return
+	}
+
+	floor := s.oldestReadable()
+	n := 0
+	for ; n < len(s.pastQueue) && s.pastQueue[n].until <= floor; n++ {
+		ref := s.pastQueue[n]
+		// Versions of a key are retired in sequence order, so the one
+		// that goes is always the oldest.
+		versions := s.past[ref.ns][ref.key][1:]
+		if len(versions) == 0 {
+			delete(s.past[ref.ns], ref.key)
+			if len(s.past[ref.ns]) == 0 {
+				delete(s.past, ref.ns)
+			}
+		} else {
+			s.past[ref.ns][ref.key] = versions
+		}
+	}
+	if n > 0 {
+		s.pastQueue = slices.Delete(s.pastQueue, 0, n)
+	}
+}
+
+// oldestReadable returns the oldest sequence the store can still be read
+// as of. It must be called with the lock held.
+func (s *Store) oldestReadable() uint64 {
+	if s.sequence > s.retention {
+		return max(s.readableFrom, s.sequence-s.retention)
+	}
+	return s.readableFrom
+}
+
+// forgetPast drops every past version, so that reads as of sequences
+// before seq fail. It is called once the store has been loaded from a
+// snapshot or a log, neither of which holds every value keys have had. It
+// must be called with the lock held.
+func (s *Store) forgetPast(seq uint64) {
+	s.sequence, s.readableFrom = seq, seq
+	s.past = make(map[string]map[string][]pastVersion)
+	s.pastQueue = nil
+}
+
+// StartHistory marks the store as loaded up to sequence seq, the point from
+// which reads as of a sequence can be served.
+func (s *Store) StartHistory(seq uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.forgetPast(seq)
+}
+
+// asOf returns the entry a key had as of sequence seq. It must be called
+// with the lock held.
+func (s *Store) asOf(ns, key string, seq uint64) (Entry, bool) {
+	if entry, exists := s.namespaces[ns][key]; exists && entry.Version <= seq {
+		return entry, true
+	}
+
+	for _, v := range s.past[ns][key] {
+		if v.entry.Version <= seq && seq < v.until {
+			return v.entry, true
+		}
+	}
+
+	return Entry{}, false
+}
+
+// checkAsOf checks that the store can be read as of sequence seq in
+// namespace ns. It must be called with the lock held.
+func (s *Store) checkAsOf(ns string, seq uint64) error {
+	if s.retention == 0 || seq < s.oldestReadable() {
+		return ErrSnapshotTooOld
+	}
+	if _, exists := s.namespaces[ns]; !exists && s.past[ns] == nil {
+		return ErrNoSuchNamespace
+	}
+
+	return nil
+}
+
+// GetAsOf returns the entry a key had once the event with sequence seq had
+// been applied. It fails with ErrSnapshotTooOld if the values the key had
+// then may no longer be held.
+func (s *Store) GetAsOf(ctx context.Context, ns, key string, seq uint64) (Entry, error) {
+	slog.DebugContext(ctx, "getting value as of sequence", slog.String("namespace", ns), slog.String("key", key), slog.Uint64("sequence", seq))
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := s.checkAsOf(ns, seq); err != nil {
+		return Entry{}, err
+	}
+
+	entry, exists := s.asOf(ns, key, seq)
+	if !exists || entry.expired(time.Now()) {
+		return Entry{}, ErrNoSuchKey
+	}
+
+	return s.open(entry)
+}
+
+// KeysAsOf returns, sorted, every key of a namespace that may have existed
+// as of sequence seq: the keys it has now and the ones with past versions.
+// EntriesAsOf tells which of them did.
+func (s *Store) KeysAsOf(ctx context.Context, ns string, seq uint64) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := s.checkAsOf(ns, seq); err != nil {
+		return nil, err
+	}
+
+	keys := slices.Collect(maps.Keys(s.namespaces[ns]))
+	for key := range s.past[ns] {
+		if _, exists := s.namespaces[ns][key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys, nil
+}
+
+// EntriesAsOf returns the entries the given keys of a namespace had as of
+// sequence seq, leaving out the keys that did not exist then and the ones
+// that have expired.
+func (s *Store) EntriesAsOf(ctx context.Context, ns string, keys []string, seq uint64) (map[string]Entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if err := s.checkAsOf(ns, seq); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := make(map[string]Entry, len(keys))
+	for _, key := range keys {
+		if entry, exists := s.asOf(ns, key, seq); exists && !entry.expired(now) {
+			entries[key] = entry
+		}
+	}
+	if s.values != nil {
+		if err := s.values.openEntries(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// parseAsOf parses the ?as_of= sequence of a read. It fails if the sequence
+// has not been reached yet, since its value could still change.
+func (s *Server) parseAsOf(w http.ResponseWriter, r *http.Request) (seq uint64, ok bool) {
+	if s.config.MVCCRetention == 0 {
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, "reads as of a sequence need -mvcc-retention")
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(r.URL.Query().Get("as_of"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "as_of must be a sequence number")
+		return 0, false
+	}
+	if last := s.lastSequence(); seq > last {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest,
+			"as_of is after the last sequence, "+strconv.FormatUint(last, 10))
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// getAsOf answers a GET with ?as_of=, with the value the key had once the
+// event with that sequence had been applied.
+func (s *Server) getAsOf(w http.ResponseWriter, r *http.Request, ns, key string) {
+	// Holding the key's lock means every event for it up to the last
+	// sequence has been applied.
+	unlock := s.store.LockKey(ns, key)
+	seq, ok := s.parseAsOf(w, r)
+	if !ok {
+		unlock()
+		return
+	}
+	entry, err := s.store.GetAsOf(r.Context(), ns, key, seq)
+	unlock()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSequenceHeader(w, seq)
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(entry.Version, 10))
+	setTimestampHeaders(w.Header(), entry)
+	if !notModified(w, r, entry.Version, entry.Updated) {
+		s.writeReadValue(w, r, ns, entry.Value, entry.ContentType)
+	}
+}
+
+// exportAsOf streams the keys of a namespace as they were at a single
+// sequence, reading them from the store a chunk at a time so that writes
+// carry on while the export runs. The sequence is sent in the
+// X-Cavee-Sequence header.
+//
+// Past values are only held for -mvcc-retention sequences, so an export
+// that is still running once that many writes have come in after its
+// sequence fails part way; the body then ends early, without the final
+// newline of a complete line if it was cut off mid-line.
+func (s *Server) exportAsOf(w http.ResponseWriter, r *http.Request, ns string) {
+	var seq uint64
+	if r.URL.Query().Has("as_of") {
+		var ok bool
+		if seq, ok = s.parseAsOf(w, r); !ok {
+			return
+		}
+	} else {
+		// Once every key is locked, every logged event has been applied.
+		unlock := s.store.LockAllKeys()
+		seq = s.lastSequence()
+		unlock()
+	}
+
+	keys, err := s.store.KeysAsOf(r.Context(), ns, seq)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err = s.runPreReadHooksEach(r.Context(), ns, keys); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSequenceHeader(w, seq)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for chunk := range slices.Chunk(keys, exportChunk) {
+		var entries map[string]Entry
+		if entries, err = s.store.EntriesAsOf(r.Context(), ns, chunk, seq); err != nil {
+			break
+		}
+		for _, key := range chunk {
+			entry, exists := entries[key]
+			if !exists {
+				continue
+			}
+			var line ExportEntry
+			if line, err = s.exportEntry(r.Context(), ns, key, entry); err != nil {
+				break
+			}
+			if err = enc.Encode(line); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to write export",
+			slog.Uint64("sequence", seq),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// exportEntry returns the export line of an entry, with its value as read
+// transforms leave it.
+func (s *Server) exportEntry(ctx context.Context, ns, key string, entry Entry) (ExportEntry, error) {
+	value, err := s.readValue(ctx, ns, entry.Value)
+	if err != nil {
+		return ExportEntry{}, err
+	}
+	line := ExportEntry{Key: key, Value: value, ContentType: entry.ContentType, Tags: entry.Tags}
+	if !utf8.ValidString(value) {
+		line.Value, line.ValueBase64 = "", []byte(value)
+	}
+	return line, nil
+}
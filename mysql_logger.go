@@ -0,0 +1,90 @@
+package cavee
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// Keys and values are stored as binary strings, since neither has to be
+// valid UTF-8. Tags are stored comma-separated.
+const mysqlSchema = "CREATE TABLE IF NOT EXISTS cavee_events (" +
+	"sequence BIGINT UNSIGNED NOT NULL PRIMARY KEY, " +
+	"type TINYINT UNSIGNED NOT NULL, " +
+	"namespace VARCHAR(64) NOT NULL DEFAULT '', " +
+	"`key` BLOB NOT NULL, " +
+	"value LONGBLOB NOT NULL, " +
+	"time BIGINT NOT NULL DEFAULT 0, " +
+	"content_type VARCHAR(255) NOT NULL DEFAULT '', " +
+	"tags " + mysqlTagsColumn + ", " +
+	"origin " + mysqlOriginColumn + ", " +
+	"principal " + mysqlPrincipalColumn + ", " +
+	"logged_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), " +
+	"INDEX cavee_events_key (namespace, `key`(255), sequence)" +
+	") ENGINE=InnoDB"
+
+const (
+	mysqlTagsColumn      = "VARCHAR(4200) NOT NULL DEFAULT ''"
+	mysqlOriginColumn    = "VARCHAR(255) NOT NULL DEFAULT ''"
+	mysqlPrincipalColumn = "VARCHAR(255) NOT NULL DEFAULT ''"
+)
+
+type MySQLTransactionLoggerOptions struct {
+	// DSN is a go-sql-driver/mysql data source name, e.g.
+	// "cavee:secret@tcp(db:3306)/cavee".
+	DSN string
+	// Connector, if set, opens the connections instead of DSN, as when the
+	// credentials are issued by Vault.
+	Connector driver.Connector
+	// ConnMaxLifetime is how long connections are kept, or 0 for as long
+	// as they work.
+	ConnMaxLifetime time.Duration
+
+	Queue QueueOptions
+}
+
+// NewMySQLTransactionLogger connects to a MySQL or MariaDB database and
+// creates the cavee_events table if it does not exist. The DSN defaults to
+// $CAVEE_MYSQL_DSN.
+func NewMySQLTransactionLogger(opts MySQLTransactionLoggerOptions) (logger TransactionLogger, err error) {
+	var db *sql.DB
+	if opts.Connector != nil {
+		db = sql.OpenDB(opts.Connector)
+	} else {
+		if opts.DSN == "" {
+			opts.DSN = os.Getenv("CAVEE_MYSQL_DSN")
+		}
+		if opts.DSN == "" {
+			return nil, fmt.Errorf("no mysql dsn configured")
+		}
+
+		if db, err = sql.Open("mysql", opts.DSN); err != nil {
+			return nil, fmt.Errorf("failed to open mysql transaction log: %w", err)
+		}
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	// Appends are serialized by Run, so one connection for writing and one
+	// for replay are all the logger ever uses.
+	db.SetMaxOpenConns(2)
+
+	if _, err = db.Exec(mysqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create mysql transaction log schema: %w", err)
+	}
+	for _, column := range []struct{ name, definition string }{
+		{"tags", mysqlTagsColumn},
+		{"origin", mysqlOriginColumn},
+		{"principal", mysqlPrincipalColumn},
+	} {
+		if err = addColumn(db, "mysql", "cavee_events", column.name, column.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate mysql transaction log schema: %w", err)
+		}
+	}
+
+	return &SQLTransactionLogger{queue: eventQueue{opts: opts.Queue}, db: db, driver: "mysql", table: "cavee_events"}, nil
+}
@@ -0,0 +1,77 @@
+package cavee
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func (s *Server) ListNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.store.Namespaces())
+}
+
+func (s *Server) CreateNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+	if !namespacePattern.MatchString(ns) {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest,
+			fmt.Sprintf("invalid namespace %q: must be 1 to 64 letters, digits, '_', '.' or '-'", ns))
+		return
+	}
+
+	// Namespace changes are rare, so they simply lock out every key write
+	// rather than racing with writes into the namespace.
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	if s.store.HasNamespace(ns) {
+		writeError(w, r, http.StatusConflict, ErrorCodeNamespaceExists, ErrNamespaceExists.Error())
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeNamespaceCreate, Namespace: ns, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.CreateNamespace(r.Context(), ns); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) DropNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	if ns == "" || !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeNamespaceDrop, Namespace: ns, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.DropNamespace(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if s.access != nil {
+		s.access.forgetNamespace(ns)
+	}
+	if s.search != nil {
+		s.search.reindex()
+	}
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusNoContent)
+}
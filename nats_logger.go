@@ -0,0 +1,343 @@
+package cavee
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Headers carrying the event fields that do not fit in a NATS subject.
+const (
+	natsHeaderKey         = "Cavee-Key"
+	natsHeaderType        = "Cavee-Type"
+	natsHeaderNamespace   = "Cavee-Namespace"
+	natsHeaderTime        = "Cavee-Time"
+	natsHeaderContentType = "Cavee-Content-Type"
+	natsHeaderTags        = "Cavee-Tags"
+	natsHeaderOrigin      = "Cavee-Origin"
+	natsHeaderPrincipal   = "Cavee-Principal"
+)
+
+type NATSTransactionLoggerOptions struct {
+	URL string
+
+	// Stream is the JetStream stream holding this instance's log. Each
+	// instance needs a stream of its own.
+	Stream string
+
+	// Replicas is used when the logger has to create the stream.
+	Replicas int
+
+	Queue QueueOptions
+}
+
+// NATSTransactionLogger appends events to a JetStream stream and replays it
+// from the first message on startup. Event sequence numbers are the stream
+// sequence numbers, and every publish expects the stream to end at the last
+// event this logger wrote, so a second writer on the same stream is detected
+// instead of interleaving with it.
+type NATSTransactionLogger struct {
+	queue        eventQueue
+	errors       <-chan error
+	lastSequence uint64
+	opts         NATSTransactionLoggerOptions
+	subject      string
+	conn         *nats.Conn
+	js           jetstream.JetStream
+	stream       jetstream.Stream
+}
+
+// NewNATSTransactionLogger connects to NATS and creates the stream if it
+// does not exist yet.
+func NewNATSTransactionLogger(opts NATSTransactionLoggerOptions) (logger TransactionLogger, err error) {
+	if opts.Stream == "" {
+		return nil, fmt.Errorf("no nats stream configured")
+	}
+
+	conn, err := nats.Connect(opts.URL, nats.Name("cavee"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+
+	l := &NATSTransactionLogger{queue: eventQueue{opts: opts.Queue}, opts: opts, subject: opts.Stream + ".events", conn: conn}
+
+	if l.js, err = jetstream.New(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open jetstream context: %w", err)
+	}
+
+	l.stream, err = l.js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:     opts.Stream,
+		Subjects: []string{l.subject},
+		Storage:  jetstream.FileStorage,
+		Replicas: opts.Replicas,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create jetstream stream %s: %w", opts.Stream, err)
+	}
+
+	return l, nil
+}
+
+func (l *NATSTransactionLogger) WritePut(key, value string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypePut, Key: key, Value: value})
+}
+
+func (l *NATSTransactionLogger) WriteDelete(key string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypeDelete, Key: key})
+}
+
+func (l *NATSTransactionLogger) WriteEvent(e Event) <-chan WriteResult {
+	return l.queue.push(e)
+}
+
+func (l *NATSTransactionLogger) Close(ctx context.Context) error {
+	started, err := l.queue.close(ctx)
+	if !started && err == nil {
+		l.conn.Close()
+	}
+
+	return err
+}
+
+func (l *NATSTransactionLogger) LoggerStats() LoggerStats {
+	return l.queue.stats()
+}
+
+func (l *NATSTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *NATSTransactionLogger) HealthChecks(ctx context.Context) []HealthCheck {
+	server := HealthCheck{Name: "server", Status: HealthOK, Detail: l.conn.Status().String()}
+	switch l.conn.Status() {
+	case nats.CONNECTED:
+	case nats.CLOSED:
+		server.Status = HealthFailing
+	default:
+		// The client buffers publishes while it reconnects.
+		server.Status = HealthDegraded
+	}
+
+	return append(l.queue.healthChecks(), server)
+}
+
+func (l *NATSTransactionLogger) Run() {
+	events := l.queue.start()
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	go func() {
+		var failed error
+		batch := make([]pendingEvent, 0, cap(events))
+
+		for {
+			e, ok := <-events
+			if !ok {
+				l.conn.Close()
+				l.queue.finish(nil)
+				return
+			}
+
+			// Publish everything that queued up while the previous batch was
+			// being acknowledged before waiting for any of the acks.
+			batch = append(batch[:0], e)
+		drain:
+			for len(batch) < cap(batch) {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+
+			// Once a publish has failed the log can no longer be trusted, so
+			// every later write is rejected with the same error.
+			if failed == nil {
+				if err := l.publish(batch); err != nil {
+					failed = err
+					errors <- failed
+				}
+			}
+
+			for _, e := range batch {
+				e.done(failed)
+			}
+		}
+	}()
+}
+
+func (l *NATSTransactionLogger) publish(batch []pendingEvent) error {
+	acks := make([]jetstream.PubAckFuture, 0, len(batch))
+
+	for i := range batch {
+		msg := encodeNATSMessage(l.subject, batch[i].Event)
+		ack, err := l.js.PublishMsgAsync(msg, jetstream.WithExpectLastSequence(l.lastSequence))
+		if err != nil {
+			return fmt.Errorf("failed to publish to jetstream: %w", err)
+		}
+		acks = append(acks, ack)
+
+		l.lastSequence++
+		batch[i].Sequence = l.lastSequence
+	}
+
+	for i, ack := range acks {
+		select {
+		case pubAck := <-ack.Ok():
+			if pubAck.Sequence != batch[i].Sequence {
+				return fmt.Errorf("jetstream stored event %d at sequence %d", batch[i].Sequence, pubAck.Sequence)
+			}
+		case err := <-ack.Err():
+			return fmt.Errorf("failed to publish to jetstream: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (l *NATSTransactionLogger) ReadEvents() (eventsCh <-chan Event, errorsCh <-chan error) {
+	outEvents := make(chan Event)
+	outErrors := make(chan error, 1)
+
+	go func() {
+		defer close(outEvents)
+		defer close(outErrors)
+
+		if err := l.readStream(outEvents); err != nil {
+			outErrors <- err
+		}
+	}()
+
+	return outEvents, outErrors
+}
+
+func (l *NATSTransactionLogger) readStream(outEvents chan<- Event) error {
+	ctx := context.Background()
+
+	info, err := l.stream.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read jetstream stream info: %w", err)
+	}
+
+	// Later publishes are checked against the end of the stream, even when
+	// the messages at its end have been removed.
+	defer func() { l.lastSequence = max(l.lastSequence, info.State.LastSeq) }()
+
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	consumer, err := l.stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create jetstream consumer: %w", err)
+	}
+
+	msgs, err := consumer.Messages()
+	if err != nil {
+		return fmt.Errorf("failed to consume jetstream stream: %w", err)
+	}
+	defer msgs.Stop()
+
+	for {
+		msg, err := msgs.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read jetstream stream: %w", err)
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return fmt.Errorf("failed to read jetstream message metadata: %w", err)
+		}
+
+		e, err := decodeNATSMessage(msg)
+		if err != nil {
+			return &CorruptRecordError{Segment: l.opts.Stream, Offset: int64(meta.Sequence.Stream), Sequence: l.lastSequence + 1, Reason: err.Error()}
+		}
+		e.Sequence = meta.Sequence.Stream
+
+		l.lastSequence = e.Sequence
+		outEvents <- e
+
+		// Only the messages present at startup are replayed; anything after
+		// them was written by this logger.
+		if meta.NumPending == 0 || e.Sequence >= info.State.LastSeq {
+			return nil
+		}
+	}
+}
+
+func encodeNATSMessage(subject string, e Event) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(natsHeaderKey, e.Key)
+	if e.Namespace != "" {
+		msg.Header.Set(natsHeaderNamespace, e.Namespace)
+	}
+	if !e.Time.IsZero() {
+		msg.Header.Set(natsHeaderTime, e.Time.UTC().Format(time.RFC3339Nano))
+	}
+	if e.ContentType != "" {
+		msg.Header.Set(natsHeaderContentType, e.ContentType)
+	}
+	if len(e.Tags) > 0 {
+		msg.Header.Set(natsHeaderTags, strings.Join(e.Tags, ","))
+	}
+	if e.Origin != "" {
+		msg.Header.Set(natsHeaderOrigin, e.Origin)
+	}
+	if e.Principal != "" {
+		msg.Header.Set(natsHeaderPrincipal, e.Principal)
+	}
+	msg.Header.Set(natsHeaderType, strconv.Itoa(int(e.Type)))
+	msg.Data = []byte(e.Value)
+
+	return msg
+}
+
+func decodeNATSMessage(msg jetstream.Msg) (e Event, err error) {
+	header := msg.Headers()
+
+	eventType := header.Get(natsHeaderType)
+	t, err := strconv.Atoi(eventType)
+	if err != nil {
+		return Event{}, fmt.Errorf("invalid %s header %q", natsHeaderType, eventType)
+	}
+
+	switch e.Type = EventType(t); e.Type {
+	case EventTypePut, EventTypeDelete, EventTypeConfigPropose, EventTypeConfigCommit, EventTypeConfigAbort,
+		EventTypeNamespaceCreate, EventTypeNamespaceDrop, EventTypeDeletePrefix, EventTypeRename,
+		EventTypeExpire, EventTypePersist, EventTypeDeleteTag, EventTypeTxn, EventTypeAppend:
+	default:
+		return Event{}, fmt.Errorf("unknown event type %d", e.Type)
+	}
+
+	e.Namespace = header.Get(natsHeaderNamespace)
+	if t := header.Get(natsHeaderTime); t != "" {
+		if e.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return Event{}, fmt.Errorf("invalid %s header %q", natsHeaderTime, t)
+		}
+	}
+	e.Key = header.Get(natsHeaderKey)
+	e.ContentType = header.Get(natsHeaderContentType)
+	e.Origin = header.Get(natsHeaderOrigin)
+	e.Principal = header.Get(natsHeaderPrincipal)
+	if tags := header.Get(natsHeaderTags); tags != "" {
+		e.Tags = strings.Split(tags, ",")
+	}
+	e.Value = string(msg.Data())
+
+	return e, nil
+}
@@ -0,0 +1,291 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+)
+
+const (
+	// logPluginEnv is set for plugins started by cavee, so that a plugin
+	// run by hand can tell it is not talking to cavee rather than hang.
+	logPluginEnv     = "CAVEE_LOG_PLUGIN"
+	logPluginVersion = "1"
+	// logPluginReadBatch is the number of events replay asks a plugin for
+	// at a time.
+	logPluginReadBatch = 1024
+)
+
+var ErrNotStartedByCavee = errors.New("transaction log plugins are started by cavee -tlog=plugin -tlog-plugin=<path>, not run directly")
+
+// LogPlugin is the storage behind a transaction log kept by a plugin: a
+// separate binary that calls ServeLogPlugin from its main function, so that
+// third parties can keep the log wherever they like without building their
+// own cavee. Cavee does the queueing, batching and numbering of events, so a
+// plugin only has to store them.
+type LogPlugin interface {
+	// Append stores a batch of events, numbered in order after those already
+	// stored. It should store all of them or none.
+	Append(events []Event) error
+	// Read returns up to limit events with a sequence number above after, in
+	// order, and none once there are no more.
+	Read(after uint64, limit int) ([]Event, error)
+	// Close is called once cavee has stopped writing, before the plugin's
+	// stdin is closed.
+	Close() error
+}
+
+// LogPluginReadArgs are the arguments of the Read call of a plugin.
+type LogPluginReadArgs struct {
+	After uint64
+	Limit int
+}
+
+// logPluginServer exposes a LogPlugin over net/rpc.
+type logPluginServer struct {
+	plugin LogPlugin
+}
+
+func (s *logPluginServer) Append(events []Event, _ *struct{}) error {
+	return s.plugin.Append(events)
+}
+
+func (s *logPluginServer) Read(args LogPluginReadArgs, events *[]Event) (err error) {
+	*events, err = s.plugin.Read(args.After, args.Limit)
+	return err
+}
+
+func (s *logPluginServer) Close(_ struct{}, _ *struct{}) error {
+	return s.plugin.Close()
+}
+
+// stdioConn is the connection between cavee and a plugin: the plugin's
+// stdin in one direction and its stdout in the other.
+type stdioConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (c stdioConn) Close() error {
+	return c.WriteCloser.Close()
+}
+
+// ServeLogPlugin serves p to the cavee that started the plugin, over the
+// plugin's stdin and stdout, until cavee closes it. Plugins must not write
+// anything else to stdout; stderr is passed through to cavee's.
+func ServeLogPlugin(p LogPlugin) error {
+	if os.Getenv(logPluginEnv) != logPluginVersion {
+		return ErrNotStartedByCavee
+	}
+
+	// An interrupt at a terminal reaches the plugin as well as cavee, which
+	// still has to close the log, so it is left to cavee to stop the plugin.
+	signal.Ignore(os.Interrupt)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &logPluginServer{plugin: p}); err != nil {
+		return err
+	}
+	server.ServeConn(stdioConn{Reader: os.Stdin, WriteCloser: os.Stdout})
+
+	return nil
+}
+
+type PluginTransactionLoggerOptions struct {
+	// Path is the plugin binary, which is run with Args.
+	Path string
+	Args []string
+
+	Queue QueueOptions
+}
+
+// PluginTransactionLogger keeps the transaction log in a LogPlugin, which it
+// runs as a child process and calls with net/rpc. If the plugin exits, every
+// later write fails as it would if a database went away.
+type PluginTransactionLogger struct {
+	queue        eventQueue
+	errors       <-chan error
+	lastSequence uint64
+	path         string
+	cmd          *exec.Cmd
+	client       *rpc.Client
+	// waitOnce and waitErr reap the plugin process once, however the logger
+	// is closed.
+	waitOnce sync.Once
+	waitErr  error
+}
+
+// NewPluginTransactionLogger starts the plugin.
+func NewPluginTransactionLogger(opts PluginTransactionLoggerOptions) (*PluginTransactionLogger, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("no transaction log plugin configured")
+	}
+
+	cmd := exec.Command(opts.Path, opts.Args...)
+	cmd.Env = append(os.Environ(), logPluginEnv+"="+logPluginVersion)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start transaction log plugin: %w", err)
+	}
+
+	return &PluginTransactionLogger{
+		queue:  eventQueue{opts: opts.Queue},
+		path:   opts.Path,
+		cmd:    cmd,
+		client: rpc.NewClient(stdioConn{Reader: stdout, WriteCloser: stdin}),
+	}, nil
+}
+
+func (l *PluginTransactionLogger) WritePut(key, value string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypePut, Key: key, Value: value})
+}
+
+func (l *PluginTransactionLogger) WriteDelete(key string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypeDelete, Key: key})
+}
+
+func (l *PluginTransactionLogger) WriteEvent(e Event) <-chan WriteResult {
+	return l.queue.push(e)
+}
+
+func (l *PluginTransactionLogger) Close(ctx context.Context) error {
+	started, err := l.queue.close(ctx)
+	if !started && err == nil {
+		return l.stop()
+	}
+
+	return err
+}
+
+// stop asks the plugin to close, closes its stdin and waits for it to exit.
+func (l *PluginTransactionLogger) stop() error {
+	l.waitOnce.Do(func() {
+		err := l.client.Call("Plugin.Close", struct{}{}, &struct{}{})
+		l.client.Close()
+		if waitErr := l.cmd.Wait(); err == nil && waitErr != nil {
+			err = fmt.Errorf("transaction log plugin %s exited: %w", l.path, waitErr)
+		}
+		l.waitErr = err
+	})
+
+	return l.waitErr
+}
+
+func (l *PluginTransactionLogger) LoggerStats() LoggerStats {
+	return l.queue.stats()
+}
+
+func (l *PluginTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *PluginTransactionLogger) HealthChecks(context.Context) []HealthCheck {
+	return l.queue.healthChecks()
+}
+
+func (l *PluginTransactionLogger) Run() {
+	events := l.queue.start()
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	go func() {
+		var failed error
+		batch := make([]pendingEvent, 0, cap(events))
+
+		for {
+			e, ok := <-events
+			if !ok {
+				l.queue.finish(l.stop())
+				return
+			}
+
+			batch = append(batch[:0], e)
+		drain:
+			for len(batch) < cap(batch) {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+
+			if failed == nil {
+				if err := l.append(batch); err != nil {
+					failed = fmt.Errorf("failed to append to plugin transaction log: %w", err)
+					errors <- failed
+				}
+			}
+
+			for _, e := range batch {
+				e.done(failed)
+			}
+		}
+	}()
+}
+
+func (l *PluginTransactionLogger) append(batch []pendingEvent) error {
+	events := make([]Event, len(batch))
+	for i := range batch {
+		batch[i].Sequence = l.lastSequence + uint64(i) + 1
+		events[i] = batch[i].Event
+	}
+
+	if err := l.client.Call("Plugin.Append", events, &struct{}{}); err != nil {
+		return err
+	}
+	l.lastSequence += uint64(len(batch))
+
+	return nil
+}
+
+func (l *PluginTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvents := make(chan Event)
+	outErrors := make(chan error, 1)
+
+	go func() {
+		defer close(outEvents)
+		defer close(outErrors)
+
+		for {
+			var events []Event
+			args := LogPluginReadArgs{After: l.lastSequence, Limit: logPluginReadBatch}
+			if err := l.client.Call("Plugin.Read", args, &events); err != nil {
+				outErrors <- fmt.Errorf("failed to read plugin transaction log: %w", err)
+				return
+			}
+			if len(events) == 0 {
+				return
+			}
+
+			for _, e := range events {
+				if e.Sequence <= l.lastSequence {
+					outErrors <- fmt.Errorf("plugin transaction log returned event %d after %d", e.Sequence, l.lastSequence)
+					return
+				}
+				l.lastSequence = e.Sequence
+				outEvents <- e
+			}
+		}
+	}()
+
+	return outEvents, outErrors
+}
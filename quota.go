@@ -0,0 +1,252 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Errors returned for writes that would take a namespace over its quota.
+var (
+	ErrKeyQuotaExceeded  = errors.New("namespace key quota exceeded")
+	ErrByteQuotaExceeded = errors.New("namespace storage quota exceeded")
+)
+
+// Quota limits the keys of a namespace and the bytes taken up by them and
+// their current values. A limit of 0 means none.
+type Quota struct {
+	MaxKeys  int   `yaml:"max_keys" json:"max_keys,omitempty"`
+	MaxBytes int64 `yaml:"max_bytes" json:"max_bytes,omitempty"`
+}
+
+// QuotaConfig is the quota of a namespace in a quotas file.
+type QuotaConfig struct {
+	Namespace string `yaml:"namespace"`
+	Quota     `yaml:",inline"`
+}
+
+type QuotasFile struct {
+	Quotas []QuotaConfig `yaml:"quotas"`
+}
+
+func LoadQuotasFile(filename string) (*QuotasFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quotas file: %w", err)
+	}
+
+	var f QuotasFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse quotas file: %w", err)
+	}
+
+	for _, q := range f.Quotas {
+		if q.MaxKeys < 0 || q.MaxBytes < 0 {
+			return nil, fmt.Errorf("quota of namespace %q must not be negative", q.Namespace)
+		}
+	}
+
+	return &f, nil
+}
+
+// Quotas holds the quota of each namespace, and the one of the namespaces
+// not given their own.
+type Quotas struct {
+	namespaces map[string]Quota
+	fallback   Quota
+}
+
+// NewQuotas returns the quotas of the namespaces in configs, with fallback
+// for the others.
+func NewQuotas(configs []QuotaConfig, fallback Quota) (*Quotas, error) {
+	q := &Quotas{namespaces: make(map[string]Quota, len(configs)), fallback: fallback}
+	for _, config := range configs {
+		if _, exists := q.namespaces[config.Namespace]; exists {
+			return nil, fmt.Errorf("namespace %q has more than one quota", config.Namespace)
+		}
+		q.namespaces[config.Namespace] = config.Quota
+	}
+	return q, nil
+}
+
+func (q *Quotas) of(ns string) Quota {
+	if quota, ok := q.namespaces[ns]; ok {
+		return quota
+	}
+	return q.fallback
+}
+
+// Usage returns the number of keys of a namespace and the bytes taken up by
+// them and their current values.
+func (s *Store) Usage(ns string) (keys int, bytes int64, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m, exists := s.namespaces[ns]
+	if !exists {
+		return 0, 0, ErrNoSuchNamespace
+	}
+	return len(m), s.namespaceBytes[ns], nil
+}
+
+// growth returns how much writing an event would grow the usage of its
+// namespace, which is negative for writes that free space.
+func (s *Store) growth(e Event) (keys int, bytes int64, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m := s.namespaces[e.Namespace]
+	del := func(key string) {
+		if entry, exists := m[key]; exists {
+			keys--
+			bytes -= int64(len(key) + len(entry.Value))
+		}
+	}
+	put := func(key, value string, appended bool) {
+		entry, exists := m[key]
+		switch {
+		case !exists:
+			keys++
+			bytes += int64(len(key) + len(value))
+		case appended:
+			bytes += int64(len(value))
+		default:
+			bytes += int64(len(value) - len(entry.Value))
+		}
+	}
+
+	switch e.Type {
+	case EventTypePut:
+		put(e.Key, e.Value, false)
+	case EventTypeAppend:
+		put(e.Key, e.Value, true)
+	case EventTypeDelete:
+		del(e.Key)
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, op := range writes {
+			if op.Op == txnOpPut {
+				put(op.Key, op.Value, false)
+			} else {
+				del(op.Key)
+			}
+		}
+	}
+
+	return keys, bytes, nil
+}
+
+// checkQuota fails if writing events would take their namespace over its
+// quota. Writes that do not grow it are always allowed, so that a namespace
+// over its quota can be cleaned up. Writes to different keys are checked
+// concurrently, so together they may go over a quota by the size of the
+// writes in flight.
+func (s *Server) checkQuota(events ...Event) error {
+	if s.quotas == nil || len(events) == 0 {
+		return nil
+	}
+
+	ns := events[0].Namespace
+	quota := s.quotas.of(ns)
+	if quota.MaxKeys == 0 && quota.MaxBytes == 0 {
+		return nil
+	}
+
+	var addedKeys int
+	var addedBytes int64
+	for _, e := range events {
+		keys, bytes, err := s.store.growth(e)
+		if err != nil {
+			return err
+		}
+		addedKeys, addedBytes = addedKeys+keys, addedBytes+bytes
+	}
+
+	keys, bytes, err := s.store.Usage(ns)
+	if err != nil {
+		return err
+	}
+	if quota.MaxKeys > 0 && addedKeys > 0 && keys+addedKeys > quota.MaxKeys {
+		return fmt.Errorf("%w: the namespace would have %d keys, more than its limit of %d", ErrKeyQuotaExceeded, keys+addedKeys, quota.MaxKeys)
+	}
+	if quota.MaxBytes > 0 && addedBytes > 0 && bytes+addedBytes > quota.MaxBytes {
+		return fmt.Errorf("%w: the namespace would take up %d bytes, more than its limit of %d", ErrByteQuotaExceeded, bytes+addedBytes, quota.MaxBytes)
+	}
+
+	return nil
+}
+
+// writeQuotaError reports a write rejected for going over the quota of its
+// namespace, if err is one, and reports whether it was. Going over the key
+// limit is like going over a rate limit, while going over the byte limit
+// means the namespace is out of storage.
+func writeQuotaError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, ErrKeyQuotaExceeded):
+		writeError(w, r, http.StatusTooManyRequests, ErrorCodeQuotaExceeded, err.Error())
+	case errors.Is(err, ErrByteQuotaExceeded):
+		writeError(w, r, http.StatusInsufficientStorage, ErrorCodeQuotaExceeded, err.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+// NamespaceUsage is the usage of a namespace next to its quota.
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	Keys      int    `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+	Quota     *Quota `json:"quota,omitempty"`
+}
+
+func (s *Server) namespaceUsage(ns string) (NamespaceUsage, error) {
+	keys, bytes, err := s.store.Usage(ns)
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+
+	usage := NamespaceUsage{Namespace: ns, Keys: keys, Bytes: bytes}
+	if s.quotas != nil {
+		if quota := s.quotas.of(ns); quota != (Quota{}) {
+			usage.Quota = &quota
+		}
+	}
+	return usage, nil
+}
+
+// GetUsageHandler sends the usage and quota of every namespace, the default
+// one included.
+func (s *Server) GetUsageHandler(w http.ResponseWriter, r *http.Request) {
+	names := []string{""}
+	for _, info := range s.store.Namespaces() {
+		names = append(names, info.Name)
+	}
+
+	usages := make([]NamespaceUsage, 0, len(names))
+	for _, ns := range names {
+		// Namespaces dropped since they were listed are left out.
+		if usage, err := s.namespaceUsage(ns); err == nil {
+			usages = append(usages, usage)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, usages)
+}
+
+// GetNamespaceUsageHandler sends the usage and quota of a namespace.
+func (s *Server) GetNamespaceUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := s.namespaceUsage(r.PathValue("ns"))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
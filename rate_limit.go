@@ -0,0 +1,148 @@
+package cavee
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idleBucketTimeout is how long a client's bucket is kept after it has
+// refilled, so that the limiter does not grow with every address it has
+// ever seen.
+const idleBucketTimeout = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	throttled uint64
+}
+
+// RateLimiter throttles each client with a token bucket that refills at rate
+// requests per second and holds up to burst requests. Clients are told apart
+// by the principal they authenticated as or, without authentication, by
+// their IP address.
+type RateLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	throttled uint64
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the client's bucket. When the bucket is empty it
+// returns false and how long the client should wait before retrying.
+func (l *RateLimiter) Allow(client string, now time.Time) (allowed bool, retryAfter time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	l.throttled++
+	b.throttled++
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets of clients that have been idle long enough to have
+// refilled. It must be called with the lock held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTimeout {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > refill+idleBucketTimeout {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter := l.Allow(rateLimitClient(r), time.Now())
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, ErrorCodeRateLimited, "rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitClient identifies the client a request counts against.
+func rateLimitClient(r *http.Request) string {
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		return "principal:" + id.Principal
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// rateLimitStats reports the throttled requests since startup, and per
+// client for the clients the limiter currently tracks.
+type rateLimitStats struct {
+	Rate              float64           `json:"rate"`
+	Burst             int               `json:"burst"`
+	Clients           int               `json:"clients"`
+	Throttled         uint64            `json:"throttled"`
+	ThrottledByClient map[string]uint64 `json:"throttled_by_client"`
+}
+
+func (s *Server) GetRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if s.rateLimiter == nil {
+		writeJSON(w, http.StatusOK, rateLimitStats{ThrottledByClient: map[string]uint64{}})
+		return
+	}
+
+	l := s.rateLimiter
+	l.Lock()
+	stats := rateLimitStats{
+		Rate:              l.rate,
+		Burst:             int(l.burst),
+		Clients:           len(l.buckets),
+		Throttled:         l.throttled,
+		ThrottledByClient: make(map[string]uint64),
+	}
+	for client, b := range l.buckets {
+		if b.throttled > 0 {
+			stats.ThrottledByClient[client] = b.throttled
+		}
+	}
+	l.Unlock()
+
+	writeJSON(w, http.StatusOK, stats)
+}
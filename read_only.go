@@ -0,0 +1,66 @@
+package cavee
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type readOnlyResponse struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// readOnlyMiddleware turns away API writes while the server is read-only.
+// Admin requests are still served, so that operators can work on a server
+// they have frozen.
+func (s *Server) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() && isAPIWrite(r) {
+			writeError(w, r, http.StatusServiceUnavailable, ErrorCodeReadOnly, "server is in read-only mode")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isAPIWrite reports whether r is a request of the API or the etcd gateway
+// that changes the store.
+func isAPIWrite(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		return !isEtcdRead(r.URL.Path)
+	}
+
+	return strings.HasPrefix(r.URL.Path, "/v1/") && !isReadMethod(r.Method)
+}
+
+// isAPIRead reports whether r is a request of the API or the etcd gateway
+// that only reads the store.
+func isAPIRead(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		return isEtcdRead(r.URL.Path)
+	}
+
+	return strings.HasPrefix(r.URL.Path, "/v1/") && isReadMethod(r.Method)
+}
+
+func (s *Server) GetReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, readOnlyResponse{ReadOnly: s.readOnly.Load()})
+}
+
+// SetReadOnlyHandler switches read-only mode on or off. Writes already being
+// served when it is switched on are allowed to finish.
+func (s *Server) SetReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var req readOnlyResponse
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if s.readOnly.Swap(req.ReadOnly) != req.ReadOnly {
+		slog.WarnContext(r.Context(), "read-only mode changed", slog.Bool("read_only", req.ReadOnly))
+	}
+
+	writeJSON(w, http.StatusOK, req)
+}
@@ -0,0 +1,81 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRecoveryTargetBeforeSnapshot = errors.New("recovery target is before the base snapshot of the transaction log")
+)
+
+// RecoveryTarget is the last point in the transaction log a point-in-time
+// recovery replays: either a sequence number or a time. The zero target
+// replays the whole log.
+type RecoveryTarget struct {
+	Sequence uint64
+	Time     time.Time
+}
+
+// ParseRecoveryTarget parses a sequence number or an RFC 3339 time.
+func ParseRecoveryTarget(s string) (RecoveryTarget, error) {
+	if sequence, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return RecoveryTarget{Sequence: sequence}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return RecoveryTarget{}, fmt.Errorf("invalid recovery target %q: must be a sequence number or an RFC 3339 time", s)
+	}
+
+	return RecoveryTarget{Time: t}, nil
+}
+
+func (t RecoveryTarget) IsZero() bool {
+	return t.Sequence == 0 && t.Time.IsZero()
+}
+
+// includes reports whether e is at or before the target. Events without a
+// time predate timestamps and so any time target.
+func (t RecoveryTarget) includes(e Event) bool {
+	switch {
+	case t.Sequence > 0:
+		return e.Sequence <= t.Sequence
+	case !t.Time.IsZero():
+		return e.Time.IsZero() || !e.Time.After(t.Time)
+	default:
+		return true
+	}
+}
+
+// includesSnapshot reports whether a base snapshot is at or before the
+// target, so that recovery can start from it.
+func (t RecoveryTarget) includesSnapshot(header SnapshotHeader) bool {
+	switch {
+	case t.Sequence > 0:
+		return header.Sequence <= t.Sequence
+	case !t.Time.IsZero():
+		return !header.CreatedAt.After(t.Time)
+	default:
+		return true
+	}
+}
+
+// RecoverTo replays the transaction log up to and including target and
+// writes a snapshot of the state it recovers to w, for restoring with
+// -restore. The log itself is left as it is, and the server must not be
+// started. It returns the sequence number of the last event replayed.
+func (s *Server) RecoverTo(target RecoveryTarget, w io.Writer) (sequence uint64, err error) {
+	if err = s.replay(target); err != nil {
+		return 0, err
+	}
+
+	if err = writeSnapshot(w, s.store.Snapshot(), s.replayedSequence); err != nil {
+		return 0, fmt.Errorf("failed to write recovered snapshot: %w", err)
+	}
+
+	return s.replayedSequence, nil
+}
@@ -0,0 +1,81 @@
+package cavee
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// keyDestination is the body of the requests that write one key to
+// another.
+type keyDestination struct {
+	Destination string `json:"destination"`
+	// Overwrite allows the destination to be replaced if it exists.
+	Overwrite bool `json:"overwrite"`
+}
+
+// readKeyDestination decodes and checks the destination of a rename or copy
+// of key, writing the error response if it is invalid.
+func (s *Server) readKeyDestination(w http.ResponseWriter, r *http.Request, key string) (keyDestination, bool) {
+	var req keyDestination
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return keyDestination{}, false
+	}
+
+	switch {
+	case req.Destination == "":
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "destination is required")
+	case req.Destination == key:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "destination is the key itself")
+	case s.config.MaxKeyLength > 0 && len(req.Destination) > s.config.MaxKeyLength:
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("destination is %d bytes long, more than the limit of %d", len(req.Destination), s.config.MaxKeyLength))
+	default:
+		return req, true
+	}
+
+	return keyDestination{}, false
+}
+
+// RenameHandler moves a key, with its value and content type, to the
+// destination key. Both keys are locked, so the move is seen by readers and
+// logged as a single step. The destination must not exist unless overwrite
+// is set.
+func (s *Server) RenameHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	req, ok := s.readKeyDestination(w, r, key)
+	if !ok {
+		return
+	}
+
+	unlock := s.store.LockKeys(ns, key, req.Destination)
+	defer unlock()
+
+	current, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if _, err = s.store.Get(r.Context(), ns, req.Destination); err == nil && !req.Overwrite {
+		writeError(w, r, http.StatusConflict, ErrorCodeKeyExists, "destination already exists")
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeRename, Namespace: ns, Key: key, Value: req.Destination, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.Rename(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	s.notify(Event{Sequence: e.Sequence, Type: EventTypeDelete, Namespace: ns, Key: key, Time: e.Time})
+	s.notify(Event{Sequence: e.Sequence, Type: EventTypePut, Namespace: ns, Key: req.Destination, Value: current.Value, ContentType: current.ContentType, Time: e.Time})
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,611 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// Replication ships the events a leader commits to followers over gRPC, and
+// followers log and apply them as they were logged by the leader, under the
+// same sequence numbers. It is asynchronous: the leader acknowledges writes
+// without waiting for followers, so followers lag behind by the events in
+// flight, and writes acknowledged just before the leader fails may never
+// reach them.
+
+const (
+	replicationStreamMethod = "/cavee.Replication/Stream"
+	// replicationBatch is the most events sent to a follower at once.
+	replicationBatch = 256
+	// replicationHeartbeat is how often the leader sends its last sequence
+	// to a follower that is caught up, so that the follower knows it still
+	// is.
+	replicationHeartbeat = time.Second
+	// replicationRetryDelay and replicationMaxRetryDelay bound the backoff
+	// of a follower reconnecting to the leader.
+	replicationRetryDelay    = 100 * time.Millisecond
+	replicationMaxRetryDelay = 10 * time.Second
+)
+
+// errReplicaDiverged is returned when a follower cannot log the events of
+// the leader under their sequence numbers, as when it was started with a
+// log of its own. Following stops until it is restored from a snapshot of
+// the leader.
+var errReplicaDiverged = errors.New("follower log has diverged from the leader's")
+
+// jsonCodec encodes replication messages as JSON, sparing the replication
+// protocol generated code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "cavee-json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// followerMessage is sent by a follower when it connects, with the last
+// sequence it has applied, from which the leader starts streaming, and then
+// again as it applies each batch of events.
+type followerMessage struct {
+	NodeID  string `json:"node_id,omitempty"`
+	Applied uint64 `json:"applied"`
+}
+
+// leaderMessage carries the next events of the log to a follower, in order,
+// along with the last sequence the leader has logged. Heartbeats carry no
+// events.
+type leaderMessage struct {
+	Events       []Event `json:"events,omitempty"`
+	LastSequence uint64  `json:"last_sequence"`
+}
+
+var replicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cavee.Replication",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "ReadIndex",
+		Handler:    readIndexHandler,
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Stream",
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			return srv.(*replicationLeader).stream(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// FollowerProgress is what a leader knows of a follower.
+type FollowerProgress struct {
+	// Applied is the last sequence the follower has applied.
+	Applied   uint64     `json:"applied"`
+	Lag       uint64     `json:"lag"`
+	Connected time.Time  `json:"connected"`
+	LastAck   *time.Time `json:"last_ack,omitempty"`
+}
+
+// replicationLeader serves the replication stream to followers.
+type replicationLeader struct {
+	server  *Server
+	history HistoryReader
+	grpc    *grpc.Server
+
+	mu        sync.Mutex
+	followers map[string]*FollowerProgress
+	// committed is closed, and replaced, whenever events are committed, to
+	// wake the streams waiting for them, and acked whenever a follower
+	// acknowledges events, to wake the writes waiting for replicas.
+	committed chan struct{}
+	acked     chan struct{}
+	// quorumSequence is the highest read index handed out.
+	quorumSequence uint64
+}
+
+func newReplicationLeader(s *Server) (*replicationLeader, error) {
+	history, ok := s.transact.(HistoryReader)
+	if !ok {
+		return nil, fmt.Errorf("replication-addr requires a transaction log that can be read back: file, sqlite or mysql")
+	}
+
+	l := &replicationLeader{
+		server:    s,
+		history:   history,
+		grpc:      grpc.NewServer(),
+		followers: make(map[string]*FollowerProgress),
+		committed: make(chan struct{}),
+		acked:     make(chan struct{}),
+	}
+	l.grpc.RegisterService(&replicationServiceDesc, l)
+
+	return l, nil
+}
+
+// serve listens for followers on addr until the leader is stopped.
+func (l *replicationLeader) serve(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for followers: %w", err)
+	}
+
+	slog.Info("serving replication", slog.String("addr", lis.Addr().String()))
+	go func() {
+		if err := l.grpc.Serve(lis); err != nil {
+			slog.Error("replication server stopped", slog.String("error", err.Error()))
+		}
+	}()
+
+	return nil
+}
+
+// notifyCommitted wakes the streams of followers that are caught up.
+func (l *replicationLeader) notifyCommitted() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.committed)
+	l.committed = make(chan struct{})
+}
+
+func (l *replicationLeader) acknowledge(nodeID string, applied uint64) {
+	_, quorum := l.server.replicas()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.followers[nodeID]; ok {
+		now := time.Now()
+		f.Applied, f.LastAck = applied, &now
+	}
+	// The read index moves on before the writes waiting for this
+	// acknowledgement are answered, so quorum reads see them.
+	l.quorumSequence = max(l.quorumSequence, l.replicatedBy(quorum))
+	close(l.acked)
+	l.acked = make(chan struct{})
+}
+
+// stream sends a follower the events of the log after the sequence it has
+// applied, and then the events committed from then on, until it goes away.
+func (l *replicationLeader) stream(stream grpc.ServerStream) error {
+	var hello followerMessage
+	if err := stream.RecvMsg(&hello); err != nil {
+		return err
+	}
+	if hello.NodeID == "" {
+		return status.Error(codes.InvalidArgument, "follower must give its node id")
+	}
+
+	l.mu.Lock()
+	if _, ok := l.followers[hello.NodeID]; ok {
+		l.mu.Unlock()
+		return status.Errorf(codes.AlreadyExists, "follower %s is already connected", hello.NodeID)
+	}
+	l.followers[hello.NodeID] = &FollowerProgress{Applied: hello.Applied, Connected: time.Now()}
+	l.mu.Unlock()
+
+	slog.Info("follower connected", slog.String("node", hello.NodeID), slog.Uint64("applied", hello.Applied))
+	defer func() {
+		l.mu.Lock()
+		delete(l.followers, hello.NodeID)
+		l.mu.Unlock()
+
+		slog.Info("follower disconnected", slog.String("node", hello.NodeID))
+	}()
+
+	// Acknowledgements are read on their own, so that a follower is never
+	// blocked sending one while the leader is blocked sending it events.
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			var ack followerMessage
+			if err := stream.RecvMsg(&ack); err != nil {
+				acks <- err
+				return
+			}
+			l.acknowledge(hello.NodeID, ack.Applied)
+		}
+	}()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	ctx, sent := stream.Context(), hello.Applied
+	for {
+		l.mu.Lock()
+		committed := l.committed
+		l.mu.Unlock()
+
+		last := l.server.lastSequence()
+		if sent > last {
+			return status.Errorf(codes.FailedPrecondition, "follower has applied up to sequence %d, past the leader's %d", sent, last)
+		}
+		if sent < last {
+			events, err := l.read(ctx, sent, min(last, sent+replicationBatch))
+			if err != nil {
+				return err
+			}
+			if err = stream.SendMsg(&leaderMessage{Events: events, LastSequence: last}); err != nil {
+				return err
+			}
+			sent = events[len(events)-1].Sequence
+			heartbeat.Reset(replicationHeartbeat)
+			continue
+		}
+
+		// Events the leader logs without a request, such as cluster config
+		// changes, are picked up by the next heartbeat.
+		select {
+		case <-committed:
+		case <-heartbeat.C:
+			if err := stream.SendMsg(&leaderMessage{LastSequence: last}); err != nil {
+				return err
+			}
+		case err := <-acks:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.server.closing:
+			return status.Error(codes.Unavailable, "leader is shutting down")
+		}
+	}
+}
+
+// read returns the events of the log after sequence from up to to, failing
+// if the log no longer holds some of them.
+func (l *replicationLeader) read(ctx context.Context, from, to uint64) ([]Event, error) {
+	events := make([]Event, 0, to-from)
+	next := from + 1
+	err := l.history.ReadEventsBetween(ctx, from, to, func(e Event) error {
+		if e.Sequence != next {
+			return nil
+		}
+		events = append(events, e)
+		next++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, status.Errorf(codes.OutOfRange, "the leader's log no longer holds sequence %d; restore the follower from a snapshot of the leader", next)
+	}
+
+	return events, nil
+}
+
+// progress returns what the leader knows of its followers, by node ID.
+func (l *replicationLeader) progress() map[string]FollowerProgress {
+	last := l.server.lastSequence()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	progress := make(map[string]FollowerProgress, len(l.followers))
+	for id, f := range l.followers {
+		p := *f
+		if last > p.Applied {
+			p.Lag = last - p.Applied
+		}
+		progress[id] = p
+	}
+	return progress
+}
+
+// LeaderProgress is what a follower knows of its leader.
+type LeaderProgress struct {
+	Addr      string `json:"addr"`
+	Connected bool   `json:"connected"`
+	// Applied is the last sequence the follower has applied, and
+	// LastSequence the last one the leader had logged when it last heard
+	// from it.
+	Applied      uint64     `json:"applied"`
+	LastSequence uint64     `json:"last_sequence"`
+	Lag          uint64     `json:"lag"`
+	LastContact  *time.Time `json:"last_contact,omitempty"`
+	// LagSeconds is how long ago the follower was last caught up with the
+	// leader. It is left out until the follower first catches up.
+	LagSeconds *float64 `json:"lag_seconds,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// replicationFollower streams the events of the leader into the server.
+type replicationFollower struct {
+	server *Server
+	conn   *grpc.ClientConn
+
+	mu       sync.Mutex
+	progress LeaderProgress
+	// caughtUp is when the follower last had every event the leader had
+	// logged.
+	caughtUp time.Time
+	// applied is closed, and replaced, whenever the follower applies
+	// events, to wake the reads waiting for them.
+	applied chan struct{}
+}
+
+func newReplicationFollower(s *Server) (*replicationFollower, error) {
+	conn, err := grpc.NewClient(s.config.ReplicateFrom,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replicate-from: %w", err)
+	}
+
+	return &replicationFollower{
+		server:   s,
+		conn:     conn,
+		progress: LeaderProgress{Addr: s.config.ReplicateFrom},
+		applied:  make(chan struct{}),
+	}, nil
+}
+
+// run follows the leader until the server closes, reconnecting whenever the
+// stream breaks, unless the follower has diverged from it.
+func (f *replicationFollower) run() {
+	defer f.server.background.Done()
+	defer f.conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-f.server.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delay := replicationRetryDelay
+	for {
+		applied := f.server.lastSequence()
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.progress.Connected, f.progress.Error = false, err.Error()
+		f.mu.Unlock()
+
+		if errors.Is(err, errReplicaDiverged) {
+			slog.Error("stopped following the leader", slog.String("error", err.Error()))
+			return
+		}
+		if f.server.lastSequence() > applied {
+			delay = replicationRetryDelay
+		}
+		slog.Warn("replication stream broke, reconnecting",
+			slog.String("leader", f.progress.Addr),
+			slog.String("delay", delay.String()),
+			slog.String("error", err.Error()),
+		)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay = min(delay*2, replicationMaxRetryDelay)
+	}
+}
+
+// follow streams the events of the leader from the last one applied, until
+// the stream breaks.
+func (f *replicationFollower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := f.conn.NewStream(ctx, &replicationServiceDesc.Streams[0], replicationStreamMethod)
+	if err != nil {
+		return err
+	}
+	applied := f.server.lastSequence()
+	if err = stream.SendMsg(&followerMessage{NodeID: f.server.config.NodeID, Applied: applied}); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.progress.Applied = applied
+	f.mu.Unlock()
+
+	for {
+		var m leaderMessage
+		if err = stream.RecvMsg(&m); err != nil {
+			return err
+		}
+
+		for _, e := range m.Events {
+			if e.Sequence != applied+1 {
+				return fmt.Errorf("leader sent sequence %d after %d", e.Sequence, applied)
+			}
+			if err = f.server.applyReplicated(e); err != nil {
+				return err
+			}
+			applied = e.Sequence
+		}
+
+		f.mu.Lock()
+		f.progress.Connected, f.progress.Error = true, ""
+		now := time.Now()
+		f.progress.Applied, f.progress.LastSequence, f.progress.LastContact = applied, m.LastSequence, &now
+		if applied >= m.LastSequence {
+			f.caughtUp = now
+		}
+		if len(m.Events) > 0 {
+			close(f.applied)
+			f.applied = make(chan struct{})
+		}
+		f.mu.Unlock()
+
+		if len(m.Events) > 0 {
+			if err = stream.SendMsg(&followerMessage{Applied: applied}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *replicationFollower) status() LeaderProgress {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := f.progress
+	if p.LastSequence > p.Applied {
+		p.Lag = p.LastSequence - p.Applied
+	}
+	if !f.caughtUp.IsZero() {
+		lag := time.Since(f.caughtUp).Seconds()
+		p.LagSeconds = &lag
+	}
+	return p
+}
+
+// lag returns how long ago the follower was last caught up with the leader,
+// or false if it has not caught up since it started. A follower keeping up
+// lags by up to the heartbeat interval.
+func (f *replicationFollower) lag() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.caughtUp.IsZero() {
+		return 0, false
+	}
+	return time.Since(f.caughtUp), true
+}
+
+// applyReplicated logs an event streamed from the leader, which must get
+// the sequence number the leader gave it, and applies it as replay would.
+// Watchers are told of the puts and deletes applied.
+func (s *Server) applyReplicated(e Event) error {
+	result := <-s.transact.WriteEvent(e)
+	if result.Err != nil {
+		return result.Err
+	}
+	if result.Sequence != e.Sequence {
+		return fmt.Errorf("%w: sequence %d was logged as %d", errReplicaDiverged, e.Sequence, result.Sequence)
+	}
+
+	switch e.Type {
+	case EventTypeConfigPropose, EventTypeConfigCommit, EventTypeConfigAbort:
+		if err := s.clusterConfig.Apply(e); err != nil {
+			return err
+		}
+	default:
+		s.store.Apply(e)
+	}
+	s.recordHistory(e)
+
+	if e.Type == EventTypePut || e.Type == EventTypeDelete {
+		s.notify(e)
+	}
+
+	return nil
+}
+
+// nodeLocalPaths are the admin endpoints acting on the node they are sent
+// to rather than on the data, which followers serve themselves.
+var nodeLocalPaths = []string{"/admin/drain", "/admin/readonly", "/admin/loglevel", "/admin/capture"}
+
+// isSessionPath reports whether a path is about transaction sessions, which
+// live on the leader.
+func isSessionPath(path string) bool {
+	segments := strings.Split(path, "/")
+	return len(segments) > 2 && segments[1] == "v1" &&
+		(segments[2] == "sessions" || len(segments) > 4 && segments[2] == "ns" && segments[4] == "sessions")
+}
+
+// forwardToLeader sends the writes a follower receives to the leader, since
+// only the leader's log takes them. Reads are served according to their
+// consistency, by the follower or by the leader.
+func (s *Server) forwardToLeader(next http.Handler) http.Handler {
+	leader := RingNode{ID: "leader", URL: s.config.LeaderURL}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case isSessionPath(r.URL.Path):
+			s.forward(w, r, leader)
+		case isAPIRead(r):
+			s.serveRead(w, r, next, leader)
+		case isReadMethod(r.Method) || slices.Contains(nodeLocalPaths, r.URL.Path):
+			next.ServeHTTP(w, r)
+		default:
+			s.forward(w, r, leader)
+		}
+	})
+}
+
+// checkReplicaLag turns a read away with 503 if the follower was last caught
+// up with the leader longer ago than -max-replication-lag, and reports
+// whether it may be served.
+func (s *Server) checkReplicaLag(w http.ResponseWriter, r *http.Request) bool {
+	lag, caughtUp := s.follower.lag()
+	if !caughtUp {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeReplicaLagging, "replica has not caught up with the leader yet")
+		return false
+	}
+	if maxLag := s.config.MaxReplicationLag; maxLag > 0 && lag > maxLag {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeReplicaLagging,
+			fmt.Sprintf("replica lags %s behind the leader, more than the %s allowed", lag.Round(time.Millisecond), maxLag))
+		return false
+	}
+	return true
+}
+
+type replicationResponse struct {
+	NodeID string `json:"node_id"`
+	// Role is leader or follower.
+	Role         string                      `json:"role"`
+	LastSequence uint64                      `json:"last_sequence"`
+	Followers    map[string]FollowerProgress `json:"followers,omitempty"`
+	Leader       *LeaderProgress             `json:"leader,omitempty"`
+}
+
+// GetReplicationHandler describes the replication of the node: the followers
+// connected to a leader and how far behind they are, or the leader a follower
+// streams from.
+func (s *Server) GetReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	resp := replicationResponse{NodeID: s.config.NodeID, LastSequence: s.lastSequence()}
+	switch {
+	case s.leader != nil:
+		resp.Role, resp.Followers = "leader", s.leader.progress()
+	case s.follower != nil:
+		leader := s.follower.status()
+		resp.Role, resp.Leader = "follower", &leader
+	default:
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotClustered, "the node neither leads nor follows")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
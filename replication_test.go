@@ -0,0 +1,147 @@
+package cavee_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// startReplicated starts a leader and a follower streaming from it, which
+// serves reads itself within the default -max-replication-lag.
+func startReplicated(t *testing.T, follower ...func(*cavee.Config)) (leaderInst, followerInst *caveetest.Instance) {
+	t.Helper()
+
+	addr := freeAddr(t)
+	leaderInst = caveetest.Start(t, func(c *cavee.Config) {
+		c.NodeID, c.ReplicationAddr = "leader", addr
+	})
+	followerInst = caveetest.Start(t, append([]func(*cavee.Config){func(c *cavee.Config) {
+		c.NodeID, c.ReplicateFrom, c.LeaderURL = "follower", addr, leaderInst.URL
+		c.ReadConsistency = cavee.ReadAny
+	}}, follower...)...)
+	return leaderInst, followerInst
+}
+
+// replicationStatus returns what a follower knows of its leader.
+func replicationStatus(t *testing.T, inst *caveetest.Instance) cavee.LeaderProgress {
+	t.Helper()
+
+	var resp struct {
+		Role   string                `json:"role"`
+		Leader *cavee.LeaderProgress `json:"leader"`
+	}
+	if err := json.Unmarshal(mustRequest(t, inst, http.MethodGet, "/admin/replication", "", http.StatusOK), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Role != "follower" || resp.Leader == nil {
+		t.Fatalf("node has role %q, want follower", resp.Role)
+	}
+	return *resp.Leader
+}
+
+// waitForValue waits until a key reads as value on inst.
+func waitForValue(t *testing.T, inst *caveetest.Instance, key, value string) {
+	t.Helper()
+
+	waitFor(t, 5*time.Second, key+" to read as "+value, func() bool {
+		resp, b := doRequest(t, inst, http.MethodGet, "/v1/key/"+key, "", nil)
+		return resp.StatusCode == http.StatusOK && string(b) == value
+	})
+}
+
+func TestReplication(t *testing.T) {
+	leader, follower := startReplicated(t)
+
+	mustRequest(t, leader, http.MethodPut, "/v1/key/a", "1", http.StatusCreated)
+	waitForValue(t, follower, "a", "1")
+
+	// Writes sent to the follower are forwarded to the leader, and come
+	// back through the stream.
+	mustRequest(t, follower, http.MethodPut, "/v1/key/b", "2", http.StatusCreated)
+	if b := mustRequest(t, leader, http.MethodGet, "/v1/key/b", "", http.StatusOK); string(b) != "2" {
+		t.Errorf("leader reads b as %q, want 2", b)
+	}
+	waitForValue(t, follower, "b", "2")
+
+	mustRequest(t, leader, http.MethodDelete, "/v1/key/a", "", http.StatusNoContent)
+	waitFor(t, 5*time.Second, "a to be deleted", func() bool {
+		resp, _ := doRequest(t, follower, http.MethodGet, "/v1/key/a", "", nil)
+		return resp.StatusCode == http.StatusNotFound
+	})
+
+	status := replicationStatus(t, follower)
+	if !status.Connected || status.Error != "" || status.Applied != 3 {
+		t.Errorf("follower status is %+v, want connected with 3 events applied", status)
+	}
+}
+
+// A follower serving a read of a key with sliding expiry must not log the
+// refreshed expiry itself: its log only takes the leader's events, with the
+// leader's sequence numbers.
+func TestReplicationSlidingExpiryOnFollower(t *testing.T) {
+	leader, follower := startReplicated(t)
+
+	mustRequest(t, leader, http.MethodPut, "/v1/key/session", "s", http.StatusCreated)
+	mustRequest(t, leader, http.MethodPut, "/v1/key/session/ttl", `{"ttl": 2, "sliding": true}`, http.StatusOK)
+	waitFor(t, 5*time.Second, "the expiry to replicate", func() bool {
+		return replicationStatus(t, follower).Applied == 2
+	})
+
+	// Reads only push back the expiry once less than half of the TTL is
+	// left.
+	time.Sleep(1100 * time.Millisecond)
+	mustRequest(t, follower, http.MethodGet, "/v1/key/session", "", http.StatusOK)
+
+	mustRequest(t, leader, http.MethodPut, "/v1/key/after", "x", http.StatusCreated)
+	waitForValue(t, follower, "after", "x")
+	if status := replicationStatus(t, follower); !status.Connected || status.Error != "" || status.Applied != 3 {
+		t.Errorf("follower status is %+v, want connected with 3 events applied", status)
+	}
+}
+
+// A follower whose log holds events the leader never logged has diverged
+// from it, and must neither take the leader's events nor serve reads.
+func TestReplicationDivergedFollower(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tlog")
+	logger, err := cavee.NewFileTransactionLogger(dir, cavee.FileTransactionLoggerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, errs := logger.ReadEvents()
+	for range events {
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	logger.Run()
+	if result := <-logger.WriteEvent(cavee.Event{Type: cavee.EventTypePut, Key: "stray", Value: "x"}); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if err = logger.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, follower := startReplicated(t, func(c *cavee.Config) {
+		c.TransactionLogDir = dir
+	})
+
+	waitFor(t, 5*time.Second, "the follower to report divergence", func() bool {
+		return strings.Contains(replicationStatus(t, follower).Error, "past the leader's")
+	})
+	if status := replicationStatus(t, follower); status.Connected {
+		t.Errorf("diverged follower reports %+v, want it disconnected", status)
+	}
+
+	resp, b := doRequest(t, follower, http.MethodGet, "/v1/key/stray", "", nil)
+	var e cavee.ErrorResponse
+	if resp.StatusCode != http.StatusServiceUnavailable || json.Unmarshal(b, &e) != nil || e.Code != cavee.ErrorCodeReplicaLagging {
+		t.Errorf("diverged follower answered a read with %d %s, want 503 %s", resp.StatusCode, b, cavee.ErrorCodeReplicaLagging)
+	}
+}
@@ -0,0 +1,113 @@
+package cavee
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits the request IDs accepted from clients to short
+// tokens that are safe to echo in headers and logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the ID of the request being served.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDContextKey{}).(string)
+	return id, ok
+}
+
+// RequestLogMiddleware gives every request an ID, reusing the X-Request-ID
+// the client sent if it is usable, and logs one access line per request once
+// it has been served. The ID is echoed in the response and carried in the
+// request context for ContextLogHandler.
+func RequestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(aw, r.WithContext(ctx))
+
+		slog.LogAttrs(ctx, slog.LevelInfo, "request served",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", aw.status),
+			slog.Int64("bytes", aw.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+		)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLogWriter counts what a handler sends for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ContextLogHandler adds the ID of the request being served to every record
+// logged with the request context.
+type ContextLogHandler struct {
+	slog.Handler
+}
+
+func NewContextLogHandler(h slog.Handler) *ContextLogHandler {
+	return &ContextLogHandler{Handler: h}
+}
+
+func (h *ContextLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *ContextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextLogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *ContextLogHandler) WithGroup(name string) slog.Handler {
+	return &ContextLogHandler{Handler: h.Handler.WithGroup(name)}
+}
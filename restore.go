@@ -0,0 +1,306 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrSnapshotsUnsupported = errors.New("transaction logger does not support restoring snapshots")
+)
+
+// baseSnapshotName is the file in the log directory holding the snapshot the
+// log starts from. It is kept as it was restored, so it is not encrypted
+// even when the segments are.
+const baseSnapshotName = "base.snapshot"
+
+// snapshotRestore asks the logger goroutine to restore a snapshot that has
+// been written to file in the log directory.
+type snapshotRestore struct {
+	file     string
+	sequence uint64
+	done     chan error
+}
+
+func (l *FileTransactionLogger) OpenSnapshot() (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.dir, baseSnapshotName))
+}
+
+func (l *FileTransactionLogger) readBaseSequence() (uint64, error) {
+	file, err := l.OpenSnapshot()
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open base snapshot: %w", err)
+	}
+	defer file.Close()
+
+	header, err := readSnapshotHeader(json.NewDecoder(file))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read base snapshot: %w", err)
+	}
+
+	return header.Sequence, nil
+}
+
+// RestoreSnapshot sets the segments and base snapshot the log had aside in a
+// pre-restore directory, rather than deleting them. With an archiver
+// configured, restoring to an earlier sequence number than the log had
+// reached reuses the names of archived segments, so the archive prefix should
+// be changed as well.
+func (l *FileTransactionLogger) RestoreSnapshot(ctx context.Context, r io.Reader, sequence uint64) error {
+	tmp, err := os.CreateTemp(l.dir, baseSnapshotName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write base snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write base snapshot: %w", err)
+	}
+
+	if l.restores == nil {
+		return l.resetToSnapshot(tmp.Name(), sequence)
+	}
+
+	req := snapshotRestore{file: tmp.Name(), sequence: sequence, done: make(chan error, 1)}
+	select {
+	case l.restores <- req:
+	case <-l.queue.stopped:
+		return ErrLoggerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Once the goroutine has the request it is carried through, so it is
+	// waited for regardless of ctx.
+	return <-req.done
+}
+
+// resetToSnapshot moves the current segments and base snapshot aside,
+// installs file as the base snapshot and starts a new segment after it. It
+// runs on the logger goroutine once the logger is running.
+func (l *FileTransactionLogger) resetToSnapshot(file string, sequence uint64) error {
+	if err := l.active.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction log segment: %w", err)
+	}
+
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+
+	aside := filepath.Join(l.dir, fmt.Sprintf("pre-restore-%d", time.Now().UnixNano()))
+	if err = os.Mkdir(aside, 0755); err != nil {
+		return fmt.Errorf("failed to set transaction log aside: %w", err)
+	}
+	for _, name := range append(segments, baseSnapshotName) {
+		err = os.Rename(filepath.Join(l.dir, name), filepath.Join(aside, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to set transaction log aside: %w", err)
+		}
+	}
+
+	if err = os.Rename(file, filepath.Join(l.dir, baseSnapshotName)); err != nil {
+		return fmt.Errorf("failed to install base snapshot: %w", err)
+	}
+
+	l.baseSequence, l.lastSequence = sequence, sequence
+	l.queue.resetSequence(sequence)
+
+	if err = l.openSegment(segmentName(sequence + 1)); err != nil {
+		return err
+	}
+
+	slog.Info("transaction log reset to snapshot",
+		slog.Uint64("sequence", sequence),
+		slog.String("previous_log", aside),
+	)
+
+	return nil
+}
+
+// loadBaseSnapshot loads the snapshot the transaction log starts from, if it
+// has one, and returns its header.
+func (s *Server) loadBaseSnapshot() (header SnapshotHeader, err error) {
+	restorer, ok := s.transact.(SnapshotRestorer)
+	if !ok {
+		return SnapshotHeader{}, nil
+	}
+
+	file, err := restorer.OpenSnapshot()
+	if errors.Is(err, fs.ErrNotExist) {
+		return SnapshotHeader{}, nil
+	}
+	if err != nil {
+		return SnapshotHeader{}, fmt.Errorf("failed to open base snapshot: %w", err)
+	}
+	defer file.Close()
+
+	header, namespaces, err := readSnapshot(file)
+	if err != nil {
+		return SnapshotHeader{}, fmt.Errorf("failed to load base snapshot: %w", err)
+	}
+	s.store.Restore(namespaces, header.Sequence)
+
+	slog.Info("loaded base snapshot",
+		slog.Uint64("sequence", header.Sequence),
+		slog.Int("keys", header.Keys),
+	)
+
+	return header, nil
+}
+
+// restoreSnapshot checks the snapshot in file and makes it the base of the
+// transaction log and the contents of the store. While the server is running
+// the caller must hold every key lock.
+func (s *Server) restoreSnapshot(ctx context.Context, file io.ReadSeeker) (header SnapshotHeader, err error) {
+	restorer, ok := s.transact.(SnapshotRestorer)
+	if !ok {
+		return SnapshotHeader{}, ErrSnapshotsUnsupported
+	}
+
+	header, namespaces, err := readSnapshot(file)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return SnapshotHeader{}, err
+	}
+	if err = restorer.RestoreSnapshot(ctx, file, header.Sequence); err != nil {
+		return SnapshotHeader{}, err
+	}
+	s.store.Restore(namespaces, header.Sequence)
+	if s.access != nil {
+		s.access.reset()
+	}
+	if s.search != nil {
+		s.search.reindex()
+	}
+	if s.history != nil {
+		s.history.reset()
+	}
+
+	return header, nil
+}
+
+// restoreFromFile restores the snapshot given by -restore before the log is
+// replayed. A snapshot that is already the base of the log is not restored
+// again, so the flag can be left in place across restarts without losing
+// the writes made since.
+func (s *Server) restoreFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	if restorer, ok := s.transact.(SnapshotRestorer); ok {
+		if base, err := restorer.OpenSnapshot(); err == nil {
+			current, currentErr := readSnapshotHeader(json.NewDecoder(base))
+			header, headerErr := readSnapshotHeader(json.NewDecoder(file))
+			base.Close()
+
+			if currentErr == nil && headerErr == nil &&
+				current.Sequence == header.Sequence && current.CreatedAt.Equal(header.CreatedAt) {
+				slog.Info("snapshot already restored", slog.String("file", filename))
+				return nil
+			}
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	header, err := s.restoreSnapshot(context.Background(), file)
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", filename, err)
+	}
+
+	slog.Info("restored snapshot",
+		slog.String("file", filename),
+		slog.Uint64("sequence", header.Sequence),
+		slog.Int("keys", header.Keys),
+	)
+
+	return nil
+}
+
+type restoreResponse struct {
+	Sequence   uint64   `json:"sequence"`
+	Keys       int      `json:"keys"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// RestoreHandler replaces the store with an uploaded snapshot, as written by
+// BackupHandler, and resets the transaction log to continue from it. Writes
+// wait until the restore is done. Watchers are not told about the keys that
+// change.
+func (s *Server) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	// The snapshot is checked in full before anything is replaced, so it is
+	// spooled to disk rather than held in memory twice.
+	tmp, err := os.CreateTemp("", "cavee-restore-*.snapshot")
+	if err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = io.Copy(tmp, r.Body); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	header, err := s.restoreSnapshot(r.Context(), tmp)
+	switch {
+	case errors.Is(err, ErrInvalidSnapshot):
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	case errors.Is(err, ErrSnapshotsUnsupported):
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, err.Error())
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+
+	slog.InfoContext(r.Context(), "restored snapshot",
+		slog.Uint64("sequence", header.Sequence),
+		slog.Int("keys", header.Keys),
+	)
+
+	writeJSON(w, http.StatusOK, restoreResponse{
+		Sequence:   header.Sequence,
+		Keys:       header.Keys,
+		Namespaces: header.Namespaces,
+	})
+}
@@ -0,0 +1,256 @@
+package cavee
+
+import (
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultScanCount = 100
+	maxScanCount     = 1000
+)
+
+var (
+	ErrInvalidPattern = errors.New("invalid pattern")
+	ErrInvalidCursor  = errors.New("invalid cursor")
+)
+
+// validateGlob checks that every character class in a glob pattern is
+// closed and that it does not end in an escape.
+func validateGlob(pattern string) error {
+	for p := 0; p < len(pattern); p++ {
+		switch pattern[p] {
+		case '\\':
+			if p++; p == len(pattern) {
+				return fmt.Errorf("%w: trailing backslash", ErrInvalidPattern)
+			}
+		case '[':
+			n, _ := matchClass(pattern[p:], 0)
+			if n == 0 {
+				return fmt.Errorf("%w: unterminated character class", ErrInvalidPattern)
+			}
+			p += n - 1
+		}
+	}
+
+	return nil
+}
+
+// matchGlob reports whether s matches a pattern checked by validateGlob, in
+// the glob syntax of Redis KEYS and SCAN MATCH: * matches any run of bytes,
+// ? any single byte, [abc], [a-z] and [^abc] a byte in or out of a class,
+// and \ makes the next byte stand for itself.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	// star is where the last * in the pattern was, and starMatched how much
+	// of s it has been tried against, so that a failed match can go back
+	// and let it take one more byte.
+	star, starMatched := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; c {
+			case '*':
+				star, starMatched = p, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if n, ok := matchClass(pattern[p:], s[i]); ok {
+					p += n
+					i++
+					continue
+				}
+			case '\\':
+				if pattern[p+1] == s[i] {
+					p += 2
+					i++
+					continue
+				}
+			default:
+				if c == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+
+		if star < 0 {
+			return false
+		}
+		starMatched++
+		p, i = star+1, starMatched
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matchClass reports whether c is in the character class class starts
+// with, along with the length of the class, which is 0 if it is not closed.
+// A ] right after the opening [ or [^ stands for itself.
+func matchClass(class string, c byte) (n int, matched bool) {
+	i, negated := 1, false
+	if i < len(class) && class[i] == '^' {
+		i, negated = i+1, true
+	}
+
+	for first := true; i < len(class); first = false {
+		lo := class[i]
+		switch {
+		case lo == ']' && !first:
+			return i + 1, matched != negated
+		case lo == '\\' && i+1 < len(class):
+			i++
+			lo = class[i]
+		}
+		i++
+
+		hi := lo
+		if i+1 < len(class) && class[i] == '-' && class[i+1] != ']' {
+			hi = class[i+1]
+			if hi == '\\' && i+2 < len(class) {
+				hi = class[i+2]
+				i++
+			}
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		matched = matched || (lo <= c && c <= hi)
+	}
+
+	return 0, false
+}
+
+// scanPage holds the smallest keys seen so far by a scan, as a max-heap so
+// that the largest of them can be replaced by a smaller one cheaply.
+type scanPage []string
+
+func (h scanPage) Len() int           { return len(h) }
+func (h scanPage) Less(i, j int) bool { return h[i] > h[j] }
+func (h scanPage) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scanPage) Push(x any)        { *h = append(*h, x.(string)) }
+
+func (h *scanPage) Pop() any {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// Scan returns, in order, up to count keys of a namespace that sort after
+// after and match the glob pattern, if one is given. Expired keys are left
+// out. The keys are read under the store's read lock, so each page is a
+// consistent view of the namespace. Only count keys are kept while going
+// over the namespace, rather than sorting every key for every page.
+func (s *Store) Scan(ctx context.Context, ns, after, pattern string, count int) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m, exists := s.namespaces[ns]
+	if !exists {
+		return nil, ErrNoSuchNamespace
+	}
+
+	now := time.Now()
+	page := make(scanPage, 0, min(count, len(m)))
+	for key, entry := range m {
+		if key <= after || (len(page) == count && key >= page[0]) {
+			continue
+		}
+		if (pattern != "" && !matchGlob(pattern, key)) || entry.expired(now) {
+			continue
+		}
+
+		if len(page) == count {
+			page[0] = key
+			heap.Fix(&page, 0)
+		} else {
+			heap.Push(&page, key)
+		}
+	}
+
+	keys := []string(page)
+	slices.Sort(keys)
+
+	return keys, nil
+}
+
+type scanResponse struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Keys      []string `json:"keys"`
+	// Cursor is passed back to get the next page. It is empty once the
+	// scan is over.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// ScanHandler lists the keys of a namespace in order, a page of ?count= at
+// a time, optionally only those matching the glob pattern in ?match=. The
+// cursor in the response is passed back in ?cursor= for the next page.
+//
+// The cursor is the last key returned, and each page starts after it, so a
+// scan holds no state on the server and tolerates concurrent writes:
+//
+//   - every key that exists for the whole scan is returned exactly once;
+//   - no key is returned more than once, even if it is deleted and written
+//     again during the scan;
+//   - keys created or deleted during the scan may or may not be returned,
+//     depending on whether the scan had already gone past them.
+//
+// Cursors stay valid across restarts, since they do not refer to anything
+// but the key.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	ns, query := r.PathValue("ns"), r.URL.Query()
+
+	pattern := query.Get("match")
+	if err := validateGlob(pattern); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	count := defaultScanCount
+	if raw := query.Get("count"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxScanCount {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "count must be between 1 and "+strconv.Itoa(maxScanCount))
+			return
+		}
+		count = n
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, ErrInvalidCursor.Error())
+		return
+	}
+
+	// One key more than asked for tells whether there is another page.
+	keys, err := s.store.Scan(r.Context(), ns, string(after), pattern, count+1)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	resp := scanResponse{Namespace: ns, Keys: append([]string{}, keys[:min(count, len(keys))]...)}
+	if len(keys) > count {
+		resp.Cursor = base64.RawURLEncoding.EncodeToString([]byte(keys[count-1]))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
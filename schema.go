@@ -0,0 +1,272 @@
+package cavee
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+)
+
+// maxSchemaViolations bounds the violations reported for a value.
+const maxSchemaViolations = 100
+
+// SchemaConfig attaches a JSON Schema to a namespace in a schemas file.
+type SchemaConfig struct {
+	Namespace string `yaml:"namespace"`
+	// Schema is the path of the schema, relative to the schemas file.
+	Schema string `yaml:"schema"`
+}
+
+type SchemasFile struct {
+	Schemas []SchemaConfig `yaml:"schemas"`
+}
+
+func LoadSchemasFile(filename string) (*SchemasFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas file: %w", err)
+	}
+
+	var f SchemasFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse schemas file: %w", err)
+	}
+
+	for i, s := range f.Schemas {
+		if !filepath.IsAbs(s.Schema) {
+			f.Schemas[i].Schema = filepath.Join(filepath.Dir(filename), s.Schema)
+		}
+	}
+
+	return &f, nil
+}
+
+// NewSchemas loads the schemas of a schemas file, by namespace.
+func NewSchemas(configs []SchemaConfig) (map[string]*JSONSchema, error) {
+	schemas := make(map[string]*JSONSchema, len(configs))
+	for _, config := range configs {
+		if _, exists := schemas[config.Namespace]; exists {
+			return nil, fmt.Errorf("namespace %q has more than one schema", config.Namespace)
+		}
+
+		b, err := os.ReadFile(config.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema: %w", err)
+		}
+		if schemas[config.Namespace], err = CompileJSONSchema(b); err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", config.Schema, err)
+		}
+	}
+
+	return schemas, nil
+}
+
+// SchemaViolation is a way a value does not match a schema. InstancePath is
+// the JSON Pointer to the part of the value that does not match, and Keyword
+// the schema keyword it fails.
+type SchemaViolation struct {
+	InstancePath string `json:"instance_path"`
+	Keyword      string `json:"keyword"`
+	Message      string `json:"message"`
+}
+
+// SchemaError is returned for writes of values that do not match the schema
+// of their namespace.
+type SchemaError struct {
+	Namespace  string
+	Key        string
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	msg := fmt.Sprintf("value of %q does not match the schema of the namespace", e.Key)
+	if len(e.Violations) > 0 {
+		v := e.Violations[0]
+		msg += ": " + cmp.Or(v.InstancePath, "/") + ": " + v.Message
+	}
+	return msg
+}
+
+// JSONSchema is a compiled JSON Schema. Schemas without $schema are taken as
+// draft 2020-12; $refs may only point into the schema itself, and format is
+// only an annotation.
+type JSONSchema struct {
+	root   any
+	schema *jsonschema.Schema
+}
+
+// schemaURL is the location a schema is compiled at, which its $refs are
+// resolved against unless it sets $id.
+const schemaURL = "cavee:///schema.json"
+
+// schemaLoader refuses to load the schemas $refs point at, so that
+// compiling a schema never reads files or the network.
+type schemaLoader struct{}
+
+func (schemaLoader) Load(url string) (any, error) {
+	return nil, errors.New("schemas may only refer to themselves")
+}
+
+// CompileJSONSchema parses a schema, checking it against its metaschema and
+// resolving its $refs.
+func CompileJSONSchema(b []byte) (*JSONSchema, error) {
+	root, err := jsonschema.UnmarshalJSON(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	c.UseLoader(schemaLoader{})
+	if err = c.AddResource(schemaURL, root); err != nil {
+		return nil, err
+	}
+	schema, err := c.Compile(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{root: root, schema: schema}, nil
+}
+
+var schemaPrinter = message.NewPrinter(language.English)
+
+// Validate checks a JSON value against the schema, returning the ways it
+// does not match it.
+func (s *JSONSchema) Validate(value []byte) []SchemaViolation {
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(value))
+	if err != nil {
+		return []SchemaViolation{{Keyword: "type", Message: "value is not JSON"}}
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err = s.schema.Validate(instance); !errors.As(err, &validationErr) {
+		return nil
+	}
+	var violations []SchemaViolation
+	addSchemaViolations(&violations, validationErr)
+	return violations
+}
+
+// addSchemaViolations appends the causes err comes down to, up to
+// maxSchemaViolations of them.
+func addSchemaViolations(violations *[]SchemaViolation, err *jsonschema.ValidationError) {
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			addSchemaViolations(violations, cause)
+		}
+		return
+	}
+	if len(*violations) == maxSchemaViolations {
+		return
+	}
+
+	var path strings.Builder
+	for _, token := range err.InstanceLocation {
+		path.WriteString("/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	var keyword string
+	switch err.ErrorKind.(type) {
+	case *kind.FalseSchema:
+		keyword = "false"
+	case *kind.Not:
+		keyword = "not"
+	default:
+		if keywordPath := err.ErrorKind.KeywordPath(); len(keywordPath) > 0 {
+			keyword = keywordPath[len(keywordPath)-1]
+		}
+	}
+	*violations = append(*violations, SchemaViolation{
+		InstancePath: path.String(),
+		Keyword:      keyword,
+		Message:      err.ErrorKind.LocalizedString(schemaPrinter),
+	})
+}
+
+// checkSchema validates the values an event writes against the schema of its
+// namespace. Appends are checked by the value they leave, which the caller
+// holds the lock of the key for.
+func (s *Server) checkSchema(ctx context.Context, e Event) error {
+	schema := s.schemas[e.Namespace]
+	if schema == nil {
+		return nil
+	}
+
+	check := func(key, value string) error {
+		if violations := schema.Validate([]byte(value)); len(violations) > 0 {
+			return &SchemaError{Namespace: e.Namespace, Key: key, Violations: violations}
+		}
+		return nil
+	}
+
+	switch e.Type {
+	case EventTypePut:
+		return check(e.Key, e.Value)
+	case EventTypeAppend:
+		current, err := s.store.Get(ctx, e.Namespace, e.Key)
+		if err != nil && !errors.Is(err, ErrNoSuchKey) {
+			return err
+		}
+		return check(e.Key, current.Value+e.Value)
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return err
+		}
+		for _, op := range writes {
+			if op.Op == txnOpPut {
+				if err = check(op.Key, op.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+type schemaErrorResponse struct {
+	ErrorResponse
+	Violations []SchemaViolation `json:"violations"`
+}
+
+// writeSchemaError reports a write rejected by the schema of its namespace,
+// if err is one, and reports whether it was.
+func writeSchemaError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		return false
+	}
+
+	writeJSON(w, http.StatusUnprocessableEntity, schemaErrorResponse{
+		ErrorResponse: ErrorResponse{
+			Code:      ErrorCodeSchemaViolation,
+			Message:   schemaErr.Error(),
+			Key:       schemaErr.Key,
+			RequestID: r.Header.Get(requestIDHeader),
+		},
+		Violations: schemaErr.Violations,
+	})
+	return true
+}
+
+// GetSchemaHandler sends the JSON Schema values of a namespace must match.
+func (s *Server) GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	schema := s.schemas[r.PathValue("ns")]
+	if schema == nil {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSchema, "the namespace has no schema")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schema.root)
+}
@@ -0,0 +1,73 @@
+package cavee_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// docSchema takes documents with a name and string tags, whose children are
+// documents too, and nothing else.
+const docSchema = `{
+	"$id": "https://example.com/doc",
+	"$dynamicAnchor": "doc",
+	"type": "object",
+	"allOf": [{"properties": {"name": {"type": "string"}}}],
+	"properties": {
+		"tags": {"$ref": "#tags"},
+		"children": {"type": "array", "items": {"$dynamicRef": "#doc"}}
+	},
+	"unevaluatedProperties": false,
+	"$defs": {
+		"tags": {"$anchor": "tags", "type": "array", "items": {"type": "string"}}
+	}
+}`
+
+func TestSchema(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"doc.json":     docSchema,
+		"schemas.yaml": "schemas:\n  - namespace: \"\"\n    schema: doc.json\n",
+	})
+	inst := caveetest.Start(t, func(c *cavee.Config) {
+		c.SchemasFile = filepath.Join(dir, "schemas.yaml")
+	})
+
+	mustRequest(t, inst, http.MethodPut, "/v1/key/ok", `{"name":"a","tags":["x"],"children":[{"name":"b"}]}`, http.StatusCreated)
+
+	for _, tc := range []struct {
+		name, value, path, keyword string
+	}{
+		{name: "unevaluated property", value: `{"name":"a","other":1}`, path: "/other", keyword: "false"},
+		{name: "anchored ref", value: `{"tags":[1]}`, path: "/tags/0", keyword: "type"},
+		{name: "dynamic ref", value: `{"children":[{"other":1}]}`, path: "/children/0/other", keyword: "false"},
+		{name: "not JSON", value: `{"name":`, path: "", keyword: "type"},
+	} {
+		resp, b := doRequest(t, inst, http.MethodPut, "/v1/key/bad", tc.value, nil)
+		var e struct {
+			cavee.ErrorResponse
+			Violations []cavee.SchemaViolation `json:"violations"`
+		}
+		if resp.StatusCode != http.StatusUnprocessableEntity || json.Unmarshal(b, &e) != nil || e.Code != cavee.ErrorCodeSchemaViolation {
+			t.Errorf("%s answered %d %s, want 422 %s", tc.name, resp.StatusCode, b, cavee.ErrorCodeSchemaViolation)
+			continue
+		}
+		if len(e.Violations) != 1 || e.Violations[0].InstancePath != tc.path || e.Violations[0].Keyword != tc.keyword {
+			t.Errorf("%s was rejected with %+v, want a violation of %s at %q", tc.name, e.Violations, tc.keyword, tc.path)
+		}
+	}
+	mustRequest(t, inst, http.MethodGet, "/v1/key/bad", "", http.StatusNotFound)
+}
+
+// Schemas may not refer to files or URLs, which the server would otherwise
+// read when it starts.
+func TestSchemaExternalRef(t *testing.T) {
+	for _, ref := range []string{"other.json", "https://example.com/other.json", "file:///etc/passwd"} {
+		if _, err := cavee.CompileJSONSchema([]byte(`{"$ref": "` + ref + `"}`)); err == nil {
+			t.Errorf("schema referring to %s compiled", ref)
+		}
+	}
+}
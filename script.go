@@ -0,0 +1,365 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// maxScriptSteps is how many computation steps, roughly bytecode
+// instructions, a script may execute before it is stopped, which bounds how
+// long it holds the locks of its keys.
+const maxScriptSteps = 10_000_000
+
+var ErrNoSuchScript = errors.New("no such script")
+
+// LoadScriptsDir compiles every *.star file in dir as a Starlark script,
+// registered under the file's name without the extension. Each script must
+// define run(keys, args), and may use the kv module besides the Starlark
+// builtins.
+func LoadScriptsDir(dir string) (map[string]*starlark.Program, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.star"))
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make(map[string]*starlark.Program, len(paths))
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read script: %w", err)
+		}
+		f, prog, err := starlark.SourceProgramOptions(&syntax.FileOptions{}, filepath.Base(path), src, func(name string) bool {
+			return name == "kv"
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile script %s: %w", path, err)
+		}
+		if !definesRun(f) {
+			return nil, fmt.Errorf("script %s does not define run(keys, args)", path)
+		}
+
+		scripts[strings.TrimSuffix(filepath.Base(path), ".star")] = prog
+	}
+
+	return scripts, nil
+}
+
+func definesRun(f *syntax.File) bool {
+	for _, stmt := range f.Stmts {
+		if def, ok := stmt.(*syntax.DefStmt); ok && def.Name.Name == "run" && len(def.Params) == 2 {
+			return true
+		}
+	}
+	return false
+}
+
+type scriptRequest struct {
+	// Keys are the keys the script may read and write, which are locked
+	// while it runs.
+	Keys []string `json:"keys"`
+	// Args is a JSON array, passed to the script as a list of the Starlark
+	// values it decodes to.
+	Args json.RawMessage `json:"args"`
+}
+
+type scriptResponse struct {
+	Result json.RawMessage `json:"result"`
+	// Sequence is that of the event the script's writes were logged as, if
+	// it wrote anything.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// scriptState is the view of its keys a script has: their values as they
+// were when it started, with its own writes applied on top.
+type scriptState struct {
+	s        *Server
+	r        *http.Request
+	ns       string
+	declared map[string]bool
+	// values holds the keys read or written so far, nil for those that do
+	// not exist, and existed whether they existed before the script ran.
+	values  map[string]*string
+	existed map[string]bool
+	written []string
+}
+
+func (st *scriptState) checkKey(fn string, key string) error {
+	if !st.declared[key] {
+		return fmt.Errorf("%s: key %q is not one of the script's keys", fn, key)
+	}
+	return nil
+}
+
+// get returns the value of a key as a client reading it would get it, once
+// the pre-read hooks have allowed it and it has been through the read
+// transforms of the namespace, since a script can send it back.
+func (st *scriptState) get(key string) (*string, error) {
+	if value, read := st.values[key]; read {
+		return value, nil
+	}
+
+	if err := st.s.runPreReadHooks(st.r.Context(), st.ns, key); err != nil {
+		return nil, err
+	}
+	entry, err := st.s.store.Get(st.r.Context(), st.ns, key)
+	if errors.Is(err, ErrNoSuchKey) {
+		st.values[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := st.s.readValue(st.r.Context(), st.ns, entry.Value)
+	if err != nil {
+		return nil, err
+	}
+	st.values[key], st.existed[key] = &value, true
+	return &value, nil
+}
+
+func (st *scriptState) set(key string, value *string) {
+	if _, read := st.values[key]; !read {
+		// A key put without being read may exist, so it is deleted if the
+		// script goes on to delete it.
+		st.existed[key] = true
+	}
+	if !slices.Contains(st.written, key) {
+		st.written = append(st.written, key)
+	}
+	st.values[key] = value
+}
+
+// module returns the kv module scripts use to read and write their keys.
+func (st *scriptState) module() *starlarkstruct.Module {
+	return &starlarkstruct.Module{Name: "kv", Members: starlark.StringDict{
+		"get": starlark.NewBuiltin("kv.get", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var key string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
+				return nil, err
+			}
+			if err := st.checkKey(b.Name(), key); err != nil {
+				return nil, err
+			}
+			value, err := st.get(key)
+			if err != nil || value == nil {
+				return starlark.None, err
+			}
+			return starlark.String(*value), nil
+		}),
+		"put": starlark.NewBuiltin("kv.put", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var key, value string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "value", &value); err != nil {
+				return nil, err
+			}
+			if err := st.checkKey(b.Name(), key); err != nil {
+				return nil, err
+			}
+			if maxSize := st.s.config.MaxValueSize; maxSize > 0 && int64(len(value)) > maxSize {
+				return nil, fmt.Errorf("%s: value is %d bytes, more than the limit of %d", b.Name(), len(value), maxSize)
+			}
+			st.set(key, &value)
+			return starlark.None, nil
+		}),
+		"delete": starlark.NewBuiltin("kv.delete", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var key string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key); err != nil {
+				return nil, err
+			}
+			if err := st.checkKey(b.Name(), key); err != nil {
+				return nil, err
+			}
+			value, err := st.get(key)
+			if err != nil {
+				return nil, err
+			}
+			st.set(key, nil)
+			return starlark.Bool(value != nil), nil
+		}),
+	}}
+}
+
+// writes returns the puts and deletes that leave the keys as the script
+// left them.
+func (st *scriptState) writes() []txnOp {
+	var writes []txnOp
+	for _, key := range st.written {
+		switch value := st.values[key]; {
+		case value != nil:
+			writes = append(writes, txnOp{Op: txnOpPut, Key: key, Value: *value})
+		case st.existed[key]:
+			writes = append(writes, txnOp{Op: txnOpDelete, Key: key})
+		}
+	}
+	return writes
+}
+
+// RunScriptHandler runs a script registered with -scripts-dir, taking
+// {"keys": [...], "args": [...]} and sending what its run function returns.
+// The keys are locked while it runs, and are the only ones it can read and
+// write, through kv.get, kv.put and kv.delete. Its writes are logged as a
+// single transaction once it returns, so other clients see all of them or
+// none, and a script that fails writes nothing. Keys are put without a
+// content type or tags, as by a plain PUT.
+func (s *Server) RunScriptHandler(w http.ResponseWriter, r *http.Request) {
+	ns, name := r.PathValue("ns"), r.PathValue("name")
+
+	prog, ok := s.scripts[name]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchScript, ErrNoSuchScript.Error())
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req scriptRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(req.Keys) > maxTxnOps {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Sprintf("a script may use at most %d keys", maxTxnOps))
+		return
+	}
+
+	keys := make([]starlark.Value, 0, len(req.Keys))
+	declared := make(map[string]bool, len(req.Keys))
+	for _, key := range req.Keys {
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "keys must not be empty")
+			return
+		}
+		if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+			writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+				fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+			return
+		}
+		keys = append(keys, starlark.String(key))
+		declared[key] = true
+	}
+	if len(req.Args) == 0 || string(req.Args) == "null" {
+		req.Args = json.RawMessage("[]")
+	}
+
+	if !s.store.HasNamespace(ns) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchNamespace, ErrNoSuchNamespace.Error())
+		return
+	}
+
+	unlock := s.store.LockKeys(ns, req.Keys...)
+	defer unlock()
+
+	st := &scriptState{s: s, r: r, ns: ns, declared: declared, values: make(map[string]*string), existed: make(map[string]bool)}
+	result, err := runScript(r.Context(), name, prog, st, starlark.NewList(keys), req.Args)
+	if errors.Is(err, errInvalidScriptArgs) {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if writeHookError(w, r, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeScriptFailed, fmt.Sprintf("script %s failed: %s", name, err))
+		return
+	}
+
+	resp := scriptResponse{Result: result}
+	if writes := st.writes(); len(writes) > 0 {
+		e, ok := s.commitTxn(w, r, ns, writes)
+		if !ok {
+			return
+		}
+		resp.Sequence = e.Sequence
+		setSequenceHeader(w, e.Sequence)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+var errInvalidScriptArgs = errors.New("invalid args")
+
+// runScript runs the top level of the script and then its run function,
+// returning what it returns as JSON. The script is stopped once it has run
+// for maxScriptSteps or ctx is done.
+func runScript(ctx context.Context, name string, prog *starlark.Program, st *scriptState, keys *starlark.List, rawArgs json.RawMessage) (json.RawMessage, error) {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.DebugContext(ctx, "script printed", slog.String("script", name), slog.String("message", msg))
+		},
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel(ctx.Err().Error())
+	})
+	defer stop()
+
+	args, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(rawArgs)}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidScriptArgs, scriptErrorMessage(err))
+	}
+	if _, ok := args.(*starlark.List); !ok {
+		return nil, fmt.Errorf("%w: args must be an array", errInvalidScriptArgs)
+	}
+
+	globals, err := prog.Init(thread, starlark.StringDict{"kv": st.module()})
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	run, ok := globals["run"].(*starlark.Function)
+	if !ok {
+		return nil, errors.New("run is not a function")
+	}
+	result, err := starlark.Call(thread, run, starlark.Tuple{keys, args}, nil)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{result}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("result cannot be converted to JSON: %s", scriptErrorMessage(err))
+	}
+	return json.RawMessage(encoded.(starlark.String)), nil
+}
+
+// scriptError returns the error a script failed with as the client is told
+// of it: a read rejected by a pre-read hook as the hook rejected it, and
+// anything else by its message.
+func scriptError(err error) error {
+	var rejected *errRejectedByHook
+	if errors.As(err, &rejected) {
+		return rejected
+	}
+	return errors.New(scriptErrorMessage(err))
+}
+
+// scriptErrorMessage returns the message of an error raised by a script,
+// prefixed with where in the script it was raised.
+func scriptErrorMessage(err error) string {
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		return err.Error()
+	}
+	for i := len(evalErr.CallStack) - 1; i >= 0; i-- {
+		if pos := evalErr.CallStack[i].Pos; pos.Filename() != "<builtin>" {
+			return fmt.Sprintf("%s: %s", pos, evalErr.Msg)
+		}
+	}
+	return evalErr.Msg
+}
@@ -0,0 +1,295 @@
+package cavee
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+	// maxSearchTermLength keeps long runs without separators, such as
+	// base64 data, out of the index.
+	maxSearchTermLength = 64
+)
+
+// searchIndex is an inverted index from the words in values to the keys
+// holding them. It is kept off the write path: writes only record the latest
+// value of each key they change, and a goroutine folds those into the index,
+// so searches may briefly miss recent writes. Matches are checked against
+// the store before being returned, so deleted and expired keys never are.
+type searchIndex struct {
+	store *Store
+
+	// pending holds the values of the keys changed since the index was
+	// last updated, nil for deleted keys. rebuild asks for the index to be
+	// built again from the store instead, for changes such as restores
+	// that are not made key by key.
+	mu      sync.Mutex
+	pending map[accessKey]*string
+	rebuild bool
+	wake    chan struct{}
+
+	// terms maps each term to the keys holding it, and keys each key to
+	// its terms so that they can be removed when it changes.
+	indexMu sync.RWMutex
+	terms   map[string]map[accessKey]struct{}
+	keys    map[accessKey][]string
+}
+
+func newSearchIndex(store *Store) *searchIndex {
+	return &searchIndex{
+		store:   store,
+		pending: make(map[accessKey]*string),
+		wake:    make(chan struct{}, 1),
+		terms:   make(map[string]map[accessKey]struct{}),
+		keys:    make(map[accessKey][]string),
+	}
+}
+
+// searchTerms splits text into lowercase words.
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return slices.DeleteFunc(words, func(word string) bool {
+		return len(word) > maxSearchTermLength
+	})
+}
+
+// valueTerms returns the distinct terms of a value. The strings of a JSON
+// document are indexed, leaving out member names and other values; values
+// that are not UTF-8 text are not indexed at all.
+func valueTerms(value string) []string {
+	var words []string
+
+	var doc any
+	if err := json.Unmarshal([]byte(value), &doc); err == nil {
+		var walk func(v any)
+		walk = func(v any) {
+			switch v := v.(type) {
+			case string:
+				words = append(words, searchTerms(v)...)
+			case []any:
+				for _, elem := range v {
+					walk(elem)
+				}
+			case map[string]any:
+				for _, member := range v {
+					walk(member)
+				}
+			}
+		}
+		walk(doc)
+	} else if utf8.ValidString(value) {
+		words = searchTerms(value)
+	}
+
+	slices.Sort(words)
+	return slices.Compact(words)
+}
+
+// update records a change to a key to be indexed.
+func (idx *searchIndex) update(ns, key string, value *string) {
+	idx.mu.Lock()
+	idx.pending[accessKey{namespace: ns, key: key}] = value
+	idx.mu.Unlock()
+
+	idx.signal()
+}
+
+// reindex asks for the whole index to be built again from the store.
+func (idx *searchIndex) reindex() {
+	idx.mu.Lock()
+	idx.rebuild = true
+	clear(idx.pending)
+	idx.mu.Unlock()
+
+	idx.signal()
+}
+
+func (idx *searchIndex) signal() {
+	select {
+	case idx.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run applies recorded changes to the index until stop is closed.
+func (idx *searchIndex) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-idx.wake:
+		}
+
+		idx.mu.Lock()
+		pending, rebuild := idx.pending, idx.rebuild
+		idx.pending, idx.rebuild = make(map[accessKey]*string), false
+		idx.mu.Unlock()
+
+		// The store already reflects every change recorded before the
+		// flags were taken, so a rebuild covers the pending changes too.
+		if rebuild {
+			idx.build()
+			continue
+		}
+
+		idx.indexMu.Lock()
+		for k, value := range pending {
+			idx.remove(k)
+			if value != nil {
+				idx.add(k, valueTerms(*value))
+			}
+		}
+		idx.indexMu.Unlock()
+	}
+}
+
+func (idx *searchIndex) build() {
+	terms := make(map[string]map[accessKey]struct{})
+	keys := make(map[accessKey][]string)
+	for ns, m := range idx.store.Snapshot() {
+		for key, entry := range m {
+			k := accessKey{namespace: ns, key: key}
+			entry, err := idx.store.open(entry)
+			if err != nil {
+				slog.Warn("not indexing key", slog.String("namespace", ns), slog.String("key", key), slog.String("error", err.Error()))
+				continue
+			}
+			words := valueTerms(entry.Value)
+			if len(words) == 0 {
+				continue
+			}
+			keys[k] = words
+			for _, term := range words {
+				if terms[term] == nil {
+					terms[term] = make(map[accessKey]struct{})
+				}
+				terms[term][k] = struct{}{}
+			}
+		}
+	}
+
+	idx.indexMu.Lock()
+	idx.terms, idx.keys = terms, keys
+	idx.indexMu.Unlock()
+}
+
+// add and remove must be called with indexMu held.
+func (idx *searchIndex) add(k accessKey, terms []string) {
+	if len(terms) == 0 {
+		return
+	}
+
+	idx.keys[k] = terms
+	for _, term := range terms {
+		if idx.terms[term] == nil {
+			idx.terms[term] = make(map[accessKey]struct{})
+		}
+		idx.terms[term][k] = struct{}{}
+	}
+}
+
+func (idx *searchIndex) remove(k accessKey) {
+	for _, term := range idx.keys[k] {
+		delete(idx.terms[term], k)
+		if len(idx.terms[term]) == 0 {
+			delete(idx.terms, term)
+		}
+	}
+	delete(idx.keys, k)
+}
+
+// search returns the keys of a namespace whose values hold every term of
+// the query, sorted.
+func (idx *searchIndex) search(ns string, query []string) []string {
+	idx.indexMu.RLock()
+	defer idx.indexMu.RUnlock()
+
+	// Starting from the rarest term keeps the intersection small.
+	slices.SortFunc(query, func(a, b string) int {
+		return len(idx.terms[a]) - len(idx.terms[b])
+	})
+
+	var keys []string
+	for k := range idx.terms[query[0]] {
+		if k.namespace != ns {
+			continue
+		}
+		if !slices.ContainsFunc(query[1:], func(term string) bool {
+			_, ok := idx.terms[term][k]
+			return !ok
+		}) {
+			keys = append(keys, k.key)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+type searchResponse struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Keys      []string `json:"keys"`
+	Truncated bool     `json:"truncated"`
+}
+
+// SearchHandler lists the keys, in order, whose values contain every word of
+// ?q=, matched case-insensitively. At most ?limit= keys are returned, with
+// truncated set when there were more.
+func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	if s.search == nil {
+		writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, "search is disabled; start the server with -search-index")
+		return
+	}
+
+	query := searchTerms(r.URL.Query().Get("q"))
+	slices.Sort(query)
+	if len(query) == 0 {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "q must contain at least one word")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxSearchLimit))
+			return
+		}
+		limit = n
+	}
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	resp := searchResponse{Namespace: ns, Keys: []string{}}
+	for _, key := range s.search.search(ns, slices.Compact(query)) {
+		// A match tells something of the key's value, so keys the pre-read
+		// hooks reject are left out.
+		if _, err := s.store.Get(r.Context(), ns, key); err != nil || s.runPreReadHooks(r.Context(), ns, key) != nil {
+			continue
+		}
+		if len(resp.Keys) == limit {
+			resp.Truncated = true
+			break
+		}
+		resp.Keys = append(resp.Keys, key)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,79 @@
+package cavee
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadSeedFile applies the keys and values in a JSON or YAML seed file to the
+// s.store. The file is a flat mapping of keys to values, and both may reference
+// environment variables as $VAR or ${VAR}. Keys that already hold the seeded
+// value are left untouched, so loading the same file on every start does not
+// grow the transaction log.
+func (s *Server) LoadSeedFile(filename string) (err error) {
+	slog.Info("loading seed file", slog.String("file", filename))
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read seed file: %w", err)
+	}
+
+	var seed map[string]string
+	if err = yaml.Unmarshal(b, &seed); err != nil {
+		return fmt.Errorf("failed to parse seed file: %w", err)
+	}
+
+	keys := make([]string, 0, len(seed))
+	for key := range seed {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	applied := 0
+	for _, rawKey := range keys {
+		key, value := os.ExpandEnv(rawKey), os.ExpandEnv(seed[rawKey])
+
+		changed, err := s.seedKey(context.Background(), key, value)
+		if err != nil {
+			return fmt.Errorf("failed to seed key %q: %w", key, err)
+		}
+		if changed {
+			applied++
+		}
+	}
+
+	slog.Info("loaded seed file",
+		slog.String("file", filename),
+		slog.Int("keys", len(keys)),
+		slog.Int("applied", applied),
+	)
+
+	return nil
+}
+
+// seedKey writes a seed value unless the key already holds it.
+func (s *Server) seedKey(ctx context.Context, key, value string) (changed bool, err error) {
+	unlock := s.store.LockKey("", key)
+	defer unlock()
+
+	if current, err := s.store.Get(ctx, "", key); err == nil && current.Value == value {
+		return false, nil
+	}
+
+	e, err := s.writeEvent(ctx, Event{Type: EventTypePut, Key: key, Value: value, Time: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	if err = s.store.Put(ctx, e); err != nil {
+		return false, err
+	}
+	s.notify(e)
+
+	return true, nil
+}
@@ -0,0 +1,791 @@
+package cavee
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.starlark.net/starlark"
+	"google.golang.org/grpc"
+)
+
+// Server is a Cavee instance: the store, its transaction log and the HTTP API
+// in front of them. It can be run standalone through ListenAndServe or
+// embedded by mounting Handler in another HTTP server.
+type Server struct {
+	config        *Config
+	store         *Store
+	transact      TransactionLogger
+	watchHub      *WatchHub
+	sessions      *txnSessions
+	clusterConfig *ClusterConfig
+	capturer      *Capturer
+	webhooks      *Webhooks
+	scripts       map[string]*starlark.Program
+	hooks         hooks
+	transforms    *Transforms
+	schemas       map[string]*JSONSchema
+	quotas        *Quotas
+	writeOnce     *WriteOnce
+	values        *ValueEncryption
+	changeCapture *changeCapture
+	access        *accessCounters
+	search        *searchIndex
+	history       *keyHistory
+	ring          *HashRing
+	leader        *replicationLeader
+	follower      *replicationFollower
+	gossip        *gossip
+	etcdGRPC      *grpc.Server
+	rateLimiter   *RateLimiter
+	requests      *requestCounter
+	logLevel      *slog.LevelVar
+	handler       http.Handler
+	httpServer    *http.Server
+
+	startedAt time.Time
+	// replayDuration and replayedSequence describe the replay done by
+	// Start. They are not modified afterwards.
+	replayDuration   time.Duration
+	replayedSequence uint64
+
+	// started is set once the transaction log has been replayed, and
+	// draining once shutdown has begun; the server is ready in between.
+	started  atomic.Bool
+	draining atomic.Bool
+	// readOnly turns away API writes.
+	readOnly atomic.Bool
+	// logFailure is set once the transaction logger reports a failed
+	// append, after which writes are turned away.
+	logFailure atomic.Pointer[logFailure]
+
+	// closing is closed when the server starts shutting down, ending
+	// long-lived requests such as watch streams.
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// exit is closed when a drain asks for the server to shut down.
+	exit     chan struct{}
+	exitOnce sync.Once
+
+	// background tracks the goroutines that write to the transaction log
+	// on their own, which Close waits for before closing it.
+	background sync.WaitGroup
+}
+
+type ServerOption func(*Server)
+
+// WithTransactionLogger makes the server use l instead of the logger
+// described by the config. l must not have been started yet.
+func WithTransactionLogger(l TransactionLogger) ServerOption {
+	return func(s *Server) {
+		s.transact = l
+	}
+}
+
+// WithLogLevel lets the admin API change the level of the logger that
+// level controls.
+func WithLogLevel(level *slog.LevelVar) ServerOption {
+	return func(s *Server) {
+		s.logLevel = level
+	}
+}
+
+// NewServer returns a server for config. Its handler can be served right
+// away, but answers API requests with 503 until Start has replayed the
+// transaction log.
+func NewServer(config *Config, opts ...ServerOption) (s *Server, err error) {
+	s = &Server{
+		config:    config,
+		store:     NewStore(config.MaxVersions, config.MVCCRetention),
+		watchHub:  NewWatchHub(),
+		sessions:  newTxnSessions(config.TxnSessionTimeout),
+		capturer:  NewCapturer(config.CaptureFile, config.CaptureMaxSize, config.CaptureBackups),
+		requests:  &requestCounter{counts: make(map[string]uint64)},
+		startedAt: time.Now(),
+		closing:   make(chan struct{}),
+		exit:      make(chan struct{}),
+	}
+
+	s.readOnly.Store(config.ReadOnly)
+	if config.AccessCounters {
+		s.access = newAccessCounters()
+	}
+	if config.SearchIndex {
+		s.search = newSearchIndex(s.store)
+	}
+	if config.KeyHistory > 0 {
+		s.history = newKeyHistory(config.KeyHistory)
+	}
+	if len(config.ClusterPeers) > 0 {
+		s.ring = NewHashRing(config.RingVnodes, config.ClusterPeers)
+	}
+	if config.GossipAddr != "" {
+		s.gossip = newGossip(s)
+		// Without replication, keys are sharded over the members gossip
+		// finds, starting with this node alone.
+		if config.ReplicationAddr == "" && config.ReplicateFrom == "" {
+			s.ring = NewHashRing(config.RingVnodes, []RingNode{{ID: config.NodeID, URL: config.AdvertiseURL}})
+		}
+	} else if config.ClusterDNS != "" {
+		// Without gossip, keys are sharded over the nodes found in DNS.
+		s.ring = NewHashRing(config.RingVnodes, []RingNode{{ID: config.NodeID, URL: config.AdvertiseURL}})
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.transact == nil {
+		if s.transact, err = NewTransactionLoggerFromConfig(config); err != nil {
+			return nil, err
+		}
+	}
+
+	s.clusterConfig = NewClusterConfig(s.transact, config.NodeID, ClusterSettings{
+		ReplicationFactor: 1,
+		Durability:        config.FsyncPolicy,
+	})
+
+	if config.ReplicationAddr != "" {
+		if s.leader, err = newReplicationLeader(s); err != nil {
+			return nil, err
+		}
+	}
+	if config.ReplicateFrom != "" {
+		if s.follower, err = newReplicationFollower(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.handler, err = s.buildHandler(); err != nil {
+		return nil, err
+	}
+	if config.EtcdGRPCAddr != "" {
+		s.etcdGRPC = newEtcdGRPC(s)
+	}
+
+	if config.WebhooksFile != "" {
+		f, err := LoadWebhooksFile(config.WebhooksFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.webhooks, err = NewWebhooks(f.Webhooks); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ScriptsDir != "" {
+		if s.scripts, err = LoadScriptsDir(config.ScriptsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.TransformsFile != "" {
+		f, err := LoadTransformsFile(config.TransformsFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.transforms, err = NewTransforms(f.Transforms); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SchemasFile != "" {
+		f, err := LoadSchemasFile(config.SchemasFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.schemas, err = NewSchemas(f.Schemas); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.WriteOnceFile != "" {
+		f, err := LoadWriteOnceFile(config.WriteOnceFile)
+		if err != nil {
+			return nil, err
+		}
+		s.writeOnce = NewWriteOnce(f.Rules)
+	}
+
+	if config.QuotasFile != "" || config.NamespaceQuota != (Quota{}) {
+		var configs []QuotaConfig
+		if config.QuotasFile != "" {
+			f, err := LoadQuotasFile(config.QuotasFile)
+			if err != nil {
+				return nil, err
+			}
+			configs = f.Quotas
+		}
+		if s.quotas, err = NewQuotas(configs, config.NamespaceQuota); err != nil {
+			return nil, err
+		}
+	}
+
+	wrapper, err := newKeyWrapper(config)
+	if err != nil {
+		return nil, err
+	}
+	if wrapper != nil {
+		if s.values, err = NewValueEncryption(context.Background(), wrapper, config.ValueKeyring, config.ValueEncryptionNamespaces); err != nil {
+			return nil, err
+		}
+		s.store.EncryptValues(s.values)
+	}
+
+	publisher, err := NewChangePublisherFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if publisher != nil {
+		s.changeCapture = newChangeCapture(publisher)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:    config.Addr,
+		Handler: s.handler,
+	}
+
+	return s, nil
+}
+
+// Start replays the transaction log into the store and applies the seed file
+// if one is configured, after which the server is ready. It may run while
+// the server is already listening. With a snapshot to restore configured, the
+// log is reset to it first.
+func (s *Server) Start() (err error) {
+	if s.config.RestoreFile != "" {
+		if err = s.restoreFromFile(s.config.RestoreFile); err != nil {
+			return err
+		}
+	}
+
+	if err = s.initializeTransactionLog(); err != nil {
+		return err
+	}
+
+	if s.config.SeedFile != "" {
+		if err = s.LoadSeedFile(s.config.SeedFile); err != nil {
+			return err
+		}
+	}
+
+	// Followers delete expired keys as the leader does, by applying its
+	// deletes.
+	if s.config.ExpireInterval > 0 && s.follower == nil {
+		s.background.Add(1)
+		go s.sweepExpired(s.config.ExpireInterval)
+	}
+	if s.search != nil {
+		s.search.reindex()
+		go s.search.run(s.closing)
+	}
+
+	if s.leader != nil {
+		if err = s.leader.serve(s.config.ReplicationAddr); err != nil {
+			return err
+		}
+	}
+	if s.follower != nil {
+		s.background.Add(1)
+		go s.follower.run()
+	}
+	if s.etcdGRPC != nil {
+		if err = s.serveEtcdGRPC(s.config.EtcdGRPCAddr); err != nil {
+			return err
+		}
+	}
+	if s.gossip != nil {
+		if err = s.gossip.start(); err != nil {
+			return err
+		}
+		if len(s.config.GossipJoin) > 0 {
+			s.background.Add(1)
+			go s.gossip.join(s.config.GossipJoin)
+		}
+	}
+	if s.config.ClusterDNS != "" {
+		s.background.Add(1)
+		go s.discoverPeers()
+	}
+
+	s.started.Store(true)
+	slog.Info("server ready")
+
+	return nil
+}
+
+func (s *Server) initializeTransactionLog() (err error) {
+	slog.Info("initializing transaction log")
+
+	if err = s.replay(RecoveryTarget{}); err != nil {
+		return err
+	}
+
+	s.transact.Run()
+	go s.watchTransactionLog(s.transact.Err())
+
+	return nil
+}
+
+// replay loads the transaction log into the store, leaving out the events
+// after target.
+func (s *Server) replay(target RecoveryTarget) (err error) {
+	start := time.Now()
+	progress := time.NewTicker(5 * time.Second)
+	defer progress.Stop()
+
+	var replayed, puts, deletes, skipped int
+
+	base, err := s.loadBaseSnapshot()
+	if err != nil {
+		return err
+	}
+	if !target.includesSnapshot(base) {
+		return ErrRecoveryTargetBeforeSnapshot
+	}
+	lastSequence, past := base.Sequence, false
+
+	events, errors := s.transact.ReadEvents()
+	event, channelOpen := Event{}, true
+
+	for channelOpen && err == nil {
+		select {
+		case err, channelOpen = <-errors:
+		case event, channelOpen = <-events:
+			if !channelOpen {
+				break
+			}
+
+			// The rest of the log is still read, so the reader is not left
+			// blocked, but no longer applied once the target has passed.
+			if past = past || !target.includes(event); past {
+				skipped++
+				break
+			}
+
+			switch event.Type {
+			case EventTypePut, EventTypeAppend:
+				s.store.Apply(event)
+				puts++
+			case EventTypeDelete, EventTypeDeletePrefix, EventTypeDeleteTag:
+				s.store.Apply(event)
+				deletes++
+			case EventTypeNamespaceCreate, EventTypeNamespaceDrop, EventTypeRename, EventTypeExpire, EventTypePersist, EventTypeTxn:
+				s.store.Apply(event)
+			case EventTypeConfigPropose, EventTypeConfigCommit, EventTypeConfigAbort:
+				err = s.clusterConfig.Apply(event)
+			}
+
+			s.recordHistory(event)
+			replayed++
+			lastSequence = event.Sequence
+		case <-progress.C:
+			s.logReplayProgress(start, replayed)
+		}
+	}
+
+	// The reader closes both channels when it stops, so an error can still be
+	// buffered when the closed events channel happens to be seen first.
+	if err == nil {
+		err = <-errors
+	}
+	if err != nil {
+		return err
+	}
+
+	s.replayDuration, s.replayedSequence = time.Since(start), lastSequence
+	s.store.StartHistory(lastSequence)
+
+	attrs := []any{
+		slog.String("duration", time.Since(start).String()),
+		slog.Int("events", replayed),
+		slog.Int("puts", puts),
+		slog.Int("deletes", deletes),
+		slog.Uint64("last_sequence", lastSequence),
+	}
+	if !target.IsZero() {
+		attrs = append(attrs, slog.Int("skipped", skipped))
+	}
+	slog.Info("transaction log replayed", attrs...)
+
+	return nil
+}
+
+func (s *Server) logReplayProgress(start time.Time, replayed int) {
+	attrs := []any{slog.Int("events", replayed)}
+
+	if reporter, ok := s.transact.(ReplayProgressReporter); ok {
+		read, total := reporter.ReplayProgress()
+		attrs = append(attrs, slog.Int64("bytes_read", read), slog.Int64("bytes_total", total))
+
+		if total > 0 && read > 0 {
+			elapsed := time.Since(start)
+			eta := time.Duration(float64(elapsed) * float64(total-read) / float64(read))
+			attrs = append(attrs,
+				slog.Float64("percent", math.Round(float64(read)/float64(total)*1000)/10),
+				slog.String("eta", eta.Round(time.Second).String()),
+			)
+		}
+	}
+
+	slog.Info("replaying transaction log", attrs...)
+}
+
+func (s *Server) buildHandler() (http.Handler, error) {
+	router := http.NewServeMux()
+	// streaming holds the patterns of the routes whose responses are
+	// streamed, which middlewares that buffer responses leave alone.
+	streaming := make(map[string]bool)
+	handleStream := func(pattern string, handler http.HandlerFunc) {
+		router.HandleFunc(pattern, handler)
+		streaming[pattern] = true
+	}
+	router.HandleFunc("/", healthcheck)
+	router.HandleFunc("GET /livez", s.LivezHandler)
+	router.HandleFunc("GET /readyz", s.ReadyzHandler)
+	router.HandleFunc("GET /healthz", s.HealthzHandler)
+
+	router.HandleFunc("PUT /v1/key/{key}", s.PutHandler)
+	router.HandleFunc("GET /v1/key/{key}", s.GetHandler)
+	router.HandleFunc("PATCH /v1/key/{key}", s.PatchHandler)
+	router.HandleFunc("DELETE /v1/key/{key}", s.DeleteHandler)
+	router.HandleFunc("GET /v1/keys", s.ScanHandler)
+	router.HandleFunc("DELETE /v1/keys", s.DeletePrefixHandler)
+	router.HandleFunc("GET /v1/stats", s.StoreStatsHandler)
+	router.HandleFunc("GET /v1/search", s.SearchHandler)
+	router.HandleFunc("GET /v1/tags/{tag}", s.GetTagHandler)
+	router.HandleFunc("DELETE /v1/tags/{tag}", s.DeleteTagHandler)
+	router.HandleFunc("GET /v1/key/{key}/meta", s.GetMetaHandler)
+	router.HandleFunc("GET /v1/key/{key}/json", s.GetJSONHandler)
+	router.HandleFunc("PUT /v1/key/{key}/json", s.PutJSONHandler)
+	router.HandleFunc("GET /v1/key/{key}/versions", s.GetVersionsHandler)
+	router.HandleFunc("GET /v1/key/{key}/history", s.GetHistoryHandler)
+	router.HandleFunc("POST /v1/key/{key}/rename", s.RenameHandler)
+	router.HandleFunc("POST /v1/key/{key}/copy", s.CopyHandler)
+	router.HandleFunc("GET /v1/key/{key}/ttl", s.GetTTLHandler)
+	router.HandleFunc("PUT /v1/key/{key}/ttl", s.ExpireHandler)
+	router.HandleFunc("DELETE /v1/key/{key}/ttl", s.PersistHandler)
+	router.HandleFunc("GET /v1/key/{key}/members", s.GetMembersHandler)
+	router.HandleFunc("POST /v1/key/{key}/members", s.UpdateMembersHandler)
+	router.HandleFunc("GET /v1/key/{key}/members/{member}", s.IsMemberHandler)
+	router.HandleFunc("PUT /v1/key/{key}/members/{member}", s.AddMemberHandler)
+	router.HandleFunc("DELETE /v1/key/{key}/members/{member}", s.RemoveMemberHandler)
+	router.HandleFunc("GET /v1/sets/{op}", s.SetQueryHandler)
+	router.HandleFunc("GET /v1/key/{key}/fields", s.GetFieldsHandler)
+	router.HandleFunc("POST /v1/key/{key}/fields", s.UpdateFieldsHandler)
+	router.HandleFunc("GET /v1/key/{key}/fields/{field}", s.GetFieldHandler)
+	router.HandleFunc("PUT /v1/key/{key}/fields/{field}", s.PutFieldHandler)
+	router.HandleFunc("DELETE /v1/key/{key}/fields/{field}", s.DeleteFieldHandler)
+	router.HandleFunc("POST /v1/key/{key}/append", s.AppendHandler)
+	router.HandleFunc("POST /v1/scripts/{name}", s.RunScriptHandler)
+	router.HandleFunc("GET /v1/key/{key}/bits/{offset}", s.GetBitHandler)
+	router.HandleFunc("PUT /v1/key/{key}/bits/{offset}", s.SetBitHandler)
+	router.HandleFunc("GET /v1/key/{key}/bitcount", s.BitCountHandler)
+	router.HandleFunc("GET /v1/key/{key}/scores", s.GetScoresHandler)
+	router.HandleFunc("POST /v1/key/{key}/scores", s.UpdateScoresHandler)
+	router.HandleFunc("POST /v1/key/{key}/scores/pop", s.PopScoresHandler)
+	router.HandleFunc("GET /v1/key/{key}/scores/{member}", s.GetScoreHandler)
+	router.HandleFunc("PUT /v1/key/{key}/scores/{member}", s.PutScoreHandler)
+	router.HandleFunc("DELETE /v1/key/{key}/scores/{member}", s.DeleteScoreHandler)
+	handleStream("GET /v1/watch", s.WatchHandler)
+	handleStream("GET /v1/export", s.ExportHandler)
+	router.HandleFunc("POST /v1/import", s.ImportHandler)
+	router.HandleFunc("POST /v1/txn", s.TxnHandler)
+	router.HandleFunc("POST /v1/sessions", s.BeginSessionHandler)
+	router.HandleFunc("GET /v1/sessions/{id}/key/{key}", s.SessionGetHandler)
+	router.HandleFunc("PUT /v1/sessions/{id}/key/{key}", s.SessionPutHandler)
+	router.HandleFunc("DELETE /v1/sessions/{id}/key/{key}", s.SessionDeleteHandler)
+	router.HandleFunc("POST /v1/sessions/{id}/commit", s.CommitSessionHandler)
+	router.HandleFunc("DELETE /v1/sessions/{id}", s.AbortSessionHandler)
+	router.HandleFunc("GET /v1/lock/{name}", s.GetLockHandler)
+	router.HandleFunc("POST /v1/lock/{name}", s.AcquireLockHandler)
+	router.HandleFunc("POST /v1/lock/{name}/keepalive", s.KeepAliveLockHandler)
+	router.HandleFunc("DELETE /v1/lock/{name}", s.ReleaseLockHandler)
+	router.HandleFunc("GET /v1/election/{name}", s.GetLeaderHandler)
+	handleStream("GET /v1/election/{name}/observe", s.ObserveHandler)
+	router.HandleFunc("POST /v1/election/{name}/campaign", s.CampaignHandler)
+	router.HandleFunc("POST /v1/election/{name}/keepalive", s.KeepAliveLeaderHandler)
+	router.HandleFunc("DELETE /v1/election/{name}", s.ResignHandler)
+
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}", s.PutHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}", s.GetHandler)
+	router.HandleFunc("PATCH /v1/ns/{ns}/key/{key}", s.PatchHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/key/{key}", s.DeleteHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/keys", s.ScanHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/keys", s.DeletePrefixHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/search", s.SearchHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/tags/{tag}", s.GetTagHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/tags/{tag}", s.DeleteTagHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/meta", s.GetMetaHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/json", s.GetJSONHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/json", s.PutJSONHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/versions", s.GetVersionsHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/history", s.GetHistoryHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/rename", s.RenameHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/copy", s.CopyHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/ttl", s.GetTTLHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/ttl", s.ExpireHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/key/{key}/ttl", s.PersistHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/members", s.GetMembersHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/members", s.UpdateMembersHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/members/{member}", s.IsMemberHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/members/{member}", s.AddMemberHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/key/{key}/members/{member}", s.RemoveMemberHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/sets/{op}", s.SetQueryHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/fields", s.GetFieldsHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/fields", s.UpdateFieldsHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/fields/{field}", s.GetFieldHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/fields/{field}", s.PutFieldHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/key/{key}/fields/{field}", s.DeleteFieldHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/append", s.AppendHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/scripts/{name}", s.RunScriptHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/bits/{offset}", s.GetBitHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/bits/{offset}", s.SetBitHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/bitcount", s.BitCountHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/scores", s.GetScoresHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/scores", s.UpdateScoresHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/key/{key}/scores/pop", s.PopScoresHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/key/{key}/scores/{member}", s.GetScoreHandler)
+	router.HandleFunc("PUT /v1/ns/{ns}/key/{key}/scores/{member}", s.PutScoreHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/key/{key}/scores/{member}", s.DeleteScoreHandler)
+	handleStream("GET /v1/ns/{ns}/watch", s.WatchHandler)
+	handleStream("GET /v1/ns/{ns}/export", s.ExportHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/import", s.ImportHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/txn", s.TxnHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/sessions", s.BeginSessionHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/lock/{name}", s.GetLockHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/lock/{name}", s.AcquireLockHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/lock/{name}/keepalive", s.KeepAliveLockHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/lock/{name}", s.ReleaseLockHandler)
+	router.HandleFunc("GET /v1/ns/{ns}/election/{name}", s.GetLeaderHandler)
+	handleStream("GET /v1/ns/{ns}/election/{name}/observe", s.ObserveHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/election/{name}/campaign", s.CampaignHandler)
+	router.HandleFunc("POST /v1/ns/{ns}/election/{name}/keepalive", s.KeepAliveLeaderHandler)
+	router.HandleFunc("DELETE /v1/ns/{ns}/election/{name}", s.ResignHandler)
+
+	router.HandleFunc("POST /v3/kv/range", s.EtcdRangeHandler)
+	router.HandleFunc("POST /v3/kv/put", s.EtcdPutHandler)
+	router.HandleFunc("POST /v3/kv/deleterange", s.EtcdDeleteRangeHandler)
+	router.HandleFunc("POST /v3/kv/txn", s.EtcdTxnHandler)
+	handleStream("POST /v3/watch", s.EtcdWatchHandler)
+
+	router.HandleFunc("GET /admin/cluster/config", s.GetClusterConfigHandler)
+	router.HandleFunc("POST /admin/cluster/config", s.ProposeClusterConfigHandler)
+	router.HandleFunc("POST /admin/cluster/config/{id}/commit", s.CommitClusterConfigHandler)
+	router.HandleFunc("POST /admin/cluster/config/{id}/abort", s.AbortClusterConfigHandler)
+	router.HandleFunc("GET /admin/cluster/ring", s.GetRingHandler)
+	router.HandleFunc("GET /admin/cluster/members", s.GetClusterMembersHandler)
+	router.HandleFunc("GET /admin/replication", s.GetReplicationHandler)
+
+	router.HandleFunc("GET /admin/namespaces", s.ListNamespacesHandler)
+	router.HandleFunc("PUT /admin/namespaces/{ns}", s.CreateNamespaceHandler)
+	router.HandleFunc("DELETE /admin/namespaces/{ns}", s.DropNamespaceHandler)
+	router.HandleFunc("GET /admin/namespaces/{ns}/keys", s.GetDataKeysHandler)
+	router.HandleFunc("GET /admin/namespaces/{ns}/schema", s.GetSchemaHandler)
+	router.HandleFunc("GET /admin/namespaces/{ns}/usage", s.GetNamespaceUsageHandler)
+	router.HandleFunc("POST /admin/namespaces/{ns}/rotate-key", s.RotateDataKeyHandler)
+
+	router.HandleFunc("GET /admin/stats", s.StatsHandler)
+	router.HandleFunc("GET /admin/usage", s.GetUsageHandler)
+	router.HandleFunc("GET /admin/backup", s.BackupHandler)
+	router.HandleFunc("GET /admin/log", s.LogQueryHandler)
+	router.HandleFunc("POST /admin/restore", s.RestoreHandler)
+	router.HandleFunc("GET /admin/ratelimit", s.GetRateLimitHandler)
+	router.HandleFunc("POST /admin/drain", s.DrainHandler)
+	router.HandleFunc("DELETE /admin/drain", s.UndrainHandler)
+	router.HandleFunc("GET /admin/readonly", s.GetReadOnlyHandler)
+	router.HandleFunc("PUT /admin/readonly", s.SetReadOnlyHandler)
+
+	if s.logLevel != nil {
+		router.HandleFunc("GET /admin/loglevel", s.GetLogLevelHandler)
+		router.HandleFunc("PUT /admin/loglevel", s.SetLogLevelHandler)
+	}
+
+	router.HandleFunc("GET /admin/capture", s.GetCaptureHandler)
+	router.HandleFunc("POST /admin/capture", s.EnableCaptureHandler)
+	router.HandleFunc("DELETE /admin/capture", s.DisableCaptureHandler)
+
+	authProvider, err := NewAuthProvider(s.config.Auth, s.config)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes http.Handler = router
+	for i := len(s.hooks.middleware) - 1; i >= 0; i-- {
+		routes = s.hooks.middleware[i](routes)
+	}
+	if s.ring != nil {
+		routes = s.routeToOwner(routes)
+	}
+	if s.config.ReplicationAddr != "" {
+		routes = s.replicateWrites(routes)
+	}
+	if s.config.ReplicateFrom != "" {
+		routes = s.forwardToLeader(routes)
+	}
+
+	var handler http.Handler = s.readinessMiddleware(s.readOnlyMiddleware(s.logFailureMiddleware(s.requests.Middleware(routes))))
+	// The rate limiter runs inside authentication so that authenticated
+	// clients are limited by principal rather than by address.
+	if s.config.RateLimit > 0 {
+		s.rateLimiter = NewRateLimiter(s.config.RateLimit, s.config.RateBurst)
+		handler = s.rateLimiter.Middleware(handler)
+		slog.Info("rate limiting enabled",
+			slog.Float64("rate", s.config.RateLimit),
+			slog.Int("burst", s.config.RateBurst),
+		)
+	}
+	if authProvider != nil {
+		handler = AuthMiddleware(authProvider, handler)
+		slog.Info("authentication enabled", slog.String("provider", s.config.Auth))
+	}
+	handler = s.capturer.Middleware(handler)
+	if s.config.ShadowURL != "" {
+		shadower, err := NewShadower(s.config.ShadowURL, s.config.ShadowPercent, s.config.ShadowWrites, s.config.ShadowTimeout)
+		if err != nil {
+			return nil, err
+		}
+		shadower.StreamingRoutes(func(r *http.Request) bool {
+			_, pattern := router.Handler(r)
+			return streaming[pattern]
+		})
+		handler = shadower.Middleware(handler)
+
+		slog.Info("shadowing traffic",
+			slog.String("target", s.config.ShadowURL),
+			slog.Float64("percent", s.config.ShadowPercent),
+			slog.Bool("writes", s.config.ShadowWrites),
+		)
+	}
+	if s.config.MaxValueSize > 0 {
+		handler = LimitBodies(s.config.MaxValueSize, handler)
+	}
+	// Compression goes outermost so that capture and shadowing see the
+	// plain response bodies.
+	if s.config.GzipMinSize >= 0 {
+		handler = NewCompressor(s.config.GzipMinSize).Middleware(handler)
+	}
+	handler = RequestLogMiddleware(handler)
+
+	return handler, nil
+}
+
+// Handler returns the HTTP API of the server with all middleware applied.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe serves the API on the configured address, over TLS when a
+// certificate is configured, either in files or in Vault.
+func (s *Server) ListenAndServe() error {
+	server := s.httpServer
+
+	if s.config.TLSCert == "" && s.config.VaultTLSPath == "" {
+		return server.ListenAndServe()
+	}
+
+	if s.config.TLSClientCA != "" {
+		pem, err := os.ReadFile(s.config.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA %s", s.config.TLSClientCA)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
+	if s.config.VaultTLSPath != "" {
+		cert, err := newVaultCertificate(s.config)
+		if err != nil {
+			return err
+		}
+		if server.TLSConfig == nil {
+			server.TLSConfig = &tls.Config{}
+		}
+		server.TLSConfig.GetCertificate = cert.getCertificate
+		go cert.renew(s.closing)
+
+		return server.ListenAndServeTLS("", "")
+	}
+
+	return server.ListenAndServeTLS(s.config.TLSCert, s.config.TLSKey)
+}
+
+// Shutdown gracefully stops a server started with ListenAndServe, waiting for
+// in-flight requests to finish, and then closes it. Readiness fails from the
+// start, and the server keeps serving for the configured shutdown delay so
+// that load balancers stop routing to it first, unless it has already been
+// drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.draining.Swap(true) && s.config.ShutdownDelay > 0 {
+		slog.Info("draining before shutdown", slog.Duration("delay", s.config.ShutdownDelay))
+
+		select {
+		case <-time.After(s.config.ShutdownDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	return s.Close(ctx)
+}
+
+// Close ends watch streams and closes the transaction logger, waiting for
+// queued writes to become durable. Webhook deliveries and change events
+// still queued get whatever time is left after that. Embedders that mount
+// Handler in their own HTTP server should call it once they have stopped
+// sending it requests.
+func (s *Server) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	if s.leader != nil {
+		s.leader.grpc.Stop()
+	}
+	if s.etcdGRPC != nil {
+		s.etcdGRPC.Stop()
+	}
+	if s.gossip != nil && s.gossip.list != nil {
+		s.gossip.stop()
+	}
+	s.background.Wait()
+
+	err := s.transact.Close(ctx)
+
+	if s.webhooks != nil {
+		if err := s.webhooks.Close(ctx); err != nil {
+			slog.Warn("webhook events left undelivered", slog.String("error", err.Error()))
+		}
+	}
+	if s.changeCapture != nil {
+		if err := s.changeCapture.close(ctx); err != nil {
+			slog.Warn("cdc events left unpublished", slog.String("error", err.Error()))
+		}
+	}
+	if s.transforms != nil {
+		if err := s.transforms.Close(ctx); err != nil {
+			slog.Warn("failed to release value transforms", slog.String("error", err.Error()))
+		}
+	}
+
+	return err
+}
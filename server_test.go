@@ -0,0 +1,197 @@
+package cavee_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// doRequest sends a request to a test server and returns the response with
+// its body read.
+func doRequest(t *testing.T, inst *caveetest.Instance, method, path, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, inst.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := inst.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp, b
+}
+
+// mustRequest sends a request and fails the test unless it is answered
+// with status.
+func mustRequest(t *testing.T, inst *caveetest.Instance, method, path, body string, status int) []byte {
+	t.Helper()
+
+	resp, b := doRequest(t, inst, method, path, body, nil)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s answered %d, want %d: %s", method, path, resp.StatusCode, status, b)
+	}
+	return b
+}
+
+// mustFail sends a request and fails the test unless it is answered with
+// status and an error with code.
+func mustFail(t *testing.T, inst *caveetest.Instance, method, path, body string, status int, code cavee.ErrorCode) {
+	t.Helper()
+
+	b := mustRequest(t, inst, method, path, body, status)
+	var e cavee.ErrorResponse
+	if err := json.Unmarshal(b, &e); err != nil || e.Code != code {
+		t.Fatalf("%s %s answered %s, want error code %s", method, path, b, code)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// freeAddr returns a local address nothing listens on, for the listeners a
+// test server opens itself.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// restarted runs before against a server, then stops it and returns a
+// server started again on the same transaction log, which it has to replay.
+func restarted(t *testing.T, before func(inst *caveetest.Instance)) *caveetest.Instance {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "tlog")
+	logDir := func(c *cavee.Config) {
+		c.TransactionLogDir = dir
+	}
+	t.Run("before restart", func(t *testing.T) {
+		before(caveetest.Start(t, logDir))
+	})
+	return caveetest.Start(t, logDir)
+}
+
+// getScript returns the value of its key.
+const getScript = "def run(keys, args):\n    return kv.get(keys[0])\n"
+
+// writeFiles writes files, by their paths, into a temporary directory and
+// returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// beginSession begins a session in the default namespace and returns its id.
+func beginSession(t *testing.T, inst *caveetest.Instance) string {
+	t.Helper()
+
+	var resp struct {
+		Session string `json:"session"`
+	}
+	if err := json.Unmarshal(mustRequest(t, inst, http.MethodPost, "/v1/sessions", "", http.StatusCreated), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Session
+}
+
+func etcdBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestRoutes(t *testing.T) {
+	inst := caveetest.Start(t)
+	mustRequest(t, inst, http.MethodPut, "/admin/namespaces/users", "", http.StatusCreated)
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		// want is the JSON the response body must hold, or the error code
+		// it must carry.
+		want string
+		code cavee.ErrorCode
+	}{
+		{method: "PUT", path: "/v1/key/k", body: "v", status: http.StatusCreated},
+		{method: "GET", path: "/v1/key/k", status: http.StatusOK},
+		{method: "PUT", path: "/v1/key/s/members/b", status: http.StatusCreated},
+		{method: "PUT", path: "/v1/key/s/members/a", status: http.StatusCreated},
+		{method: "PUT", path: "/v1/key/s/members/a", status: http.StatusNoContent},
+		{method: "GET", path: "/v1/key/s/members", status: http.StatusOK, want: `{"members":["a","b"],"cardinality":2}`},
+		{method: "GET", path: "/v1/key/s/members/a", status: http.StatusNoContent},
+		{method: "GET", path: "/v1/key/s/members/c", status: http.StatusNotFound, code: cavee.ErrorCodeNoSuchMember},
+		{method: "POST", path: "/v1/key/t/members", body: `{"add":["b","c"]}`, status: http.StatusOK, want: `{"added":2,"removed":0,"cardinality":2}`},
+		{method: "GET", path: "/v1/sets/intersection?key=s&key=t", status: http.StatusOK, want: `{"members":["b"],"cardinality":1}`},
+		{method: "DELETE", path: "/v1/key/s/members/a", status: http.StatusNoContent},
+		{method: "PUT", path: "/v1/ns/users/key/s/members/x", status: http.StatusCreated},
+		{method: "GET", path: "/v1/ns/users/key/s/members", status: http.StatusOK, want: `{"members":["x"],"cardinality":1}`},
+		{method: "GET", path: "/v1/key/s/members", status: http.StatusOK, want: `{"members":["b"],"cardinality":1}`},
+		{method: "GET", path: "/admin/cluster/members", status: http.StatusNotFound, code: cavee.ErrorCodeNotClustered},
+		{method: "GET", path: "/admin/replication", status: http.StatusNotFound, code: cavee.ErrorCodeNotClustered},
+	} {
+		resp, b := doRequest(t, inst, tc.method, tc.path, tc.body, nil)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s answered %d, want %d: %s", tc.method, tc.path, resp.StatusCode, tc.status, b)
+			continue
+		}
+
+		switch {
+		case tc.want != "":
+			var got, want any
+			json.Unmarshal([]byte(tc.want), &want)
+			if err := json.Unmarshal(b, &got); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s answered %s, want %s", tc.method, tc.path, b, tc.want)
+			}
+		case tc.code != "":
+			var e cavee.ErrorResponse
+			if err := json.Unmarshal(b, &e); err != nil || e.Code != tc.code {
+				t.Errorf("%s %s answered %s, want error code %s", tc.method, tc.path, b, tc.code)
+			}
+		}
+	}
+}
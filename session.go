@@ -0,0 +1,379 @@
+package cavee
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTxnSessions is the most transaction sessions that may be open at once.
+const maxTxnSessions = 1024
+
+var (
+	ErrNoSuchSession   = errors.New("no such session")
+	ErrTooManySessions = errors.New("too many open sessions")
+	ErrSessionConflict = errors.New("key changed since the session read it")
+	errSessionTooLarge = errors.New("session has too many operations")
+)
+
+// txnSession is a transaction that a client builds over several requests.
+// Reads go to the store and remember the version they saw; writes are kept
+// in the session until it is committed, when they are made at once if none
+// of the keys read has changed since.
+type txnSession struct {
+	sync.Mutex
+	id        string
+	namespace string
+
+	// reads holds the version of each key read, or 0 if it did not exist.
+	reads map[string]uint64
+	// writes holds the pending write of each key, in the order the keys
+	// were first written.
+	writes  []txnOp
+	written map[string]int
+
+	// lastUsed is guarded by the lock of the sessions, and ended by the
+	// session's own.
+	lastUsed time.Time
+	ended    bool
+}
+
+// ops counts the reads and writes of the session.
+func (ts *txnSession) ops() int {
+	return len(ts.reads) + len(ts.writes)
+}
+
+// write records a pending put or delete, replacing any earlier one of the
+// same key.
+func (ts *txnSession) write(op txnOp) error {
+	if i, ok := ts.written[op.Key]; ok {
+		ts.writes[i] = op
+		return nil
+	}
+	if ts.ops() >= maxTxnOps {
+		return errSessionTooLarge
+	}
+
+	ts.written[op.Key] = len(ts.writes)
+	ts.writes = append(ts.writes, op)
+	return nil
+}
+
+// txnSessions holds the open transaction sessions. Sessions not used for
+// timeout are dropped, along with their pending writes.
+type txnSessions struct {
+	sync.Mutex
+	sessions map[string]*txnSession
+	timeout  time.Duration
+}
+
+func newTxnSessions(timeout time.Duration) *txnSessions {
+	return &txnSessions{sessions: make(map[string]*txnSession), timeout: timeout}
+}
+
+// begin opens a session on a namespace.
+func (ss *txnSessions) begin(ns string, now time.Time) (*txnSession, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %w", err)
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	if len(ss.sessions) >= maxTxnSessions {
+		maps.DeleteFunc(ss.sessions, func(_ string, ts *txnSession) bool {
+			return now.Sub(ts.lastUsed) >= ss.timeout
+		})
+		if len(ss.sessions) >= maxTxnSessions {
+			return nil, ErrTooManySessions
+		}
+	}
+
+	ts := &txnSession{
+		id:        hex.EncodeToString(id),
+		namespace: ns,
+		reads:     make(map[string]uint64),
+		written:   make(map[string]int),
+		lastUsed:  now,
+	}
+	ss.sessions[ts.id] = ts
+
+	return ts, nil
+}
+
+// acquire returns a session locked for the caller to use, or
+// ErrNoSuchSession if it has ended or timed out.
+func (ss *txnSessions) acquire(id string, now time.Time) (*txnSession, error) {
+	ss.Lock()
+	ts, ok := ss.sessions[id]
+	if ok && now.Sub(ts.lastUsed) >= ss.timeout {
+		delete(ss.sessions, id)
+		ok = false
+	} else if ok {
+		ts.lastUsed = now
+	}
+	ss.Unlock()
+	if !ok {
+		return nil, ErrNoSuchSession
+	}
+
+	// The session may have been ended while its lock was awaited.
+	ts.Lock()
+	if ts.ended {
+		ts.Unlock()
+		return nil, ErrNoSuchSession
+	}
+
+	return ts, nil
+}
+
+// end closes a session. The caller holds its lock.
+func (ss *txnSessions) end(ts *txnSession) {
+	ts.ended = true
+
+	ss.Lock()
+	delete(ss.sessions, ts.id)
+	ss.Unlock()
+}
+
+type sessionResponse struct {
+	Session   string    `json:"session"`
+	Namespace string    `json:"namespace,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type sessionCommitResponse struct {
+	Writes int `json:"writes"`
+	// Sequence is that of the event the writes were logged as, if there
+	// were any.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// acquireSession returns the session named in the request path, locked,
+// writing the error response if there is none.
+func (s *Server) acquireSession(w http.ResponseWriter, r *http.Request) (*txnSession, bool) {
+	ts, err := s.sessions.acquire(r.PathValue("id"), time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchSession, err.Error())
+		return nil, false
+	}
+
+	return ts, true
+}
+
+// BeginSessionHandler opens a transaction session on a namespace. The
+// session is named by the returned token in the paths of the requests that
+// use it, and is dropped once it has not been used for
+// -txn-session-timeout.
+func (s *Server) BeginSessionHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	now := time.Now()
+	ts, err := s.sessions.begin(ns, now)
+	if errors.Is(err, ErrTooManySessions) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, ErrorCodeOverloaded, err.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, sessionResponse{Session: ts.id, Namespace: ns, ExpiresAt: now.Add(s.sessions.timeout)})
+}
+
+// SessionGetHandler reads a key within a session. A key the session has
+// written reads as the pending write; any other is read from the store and
+// the version seen is checked again at commit.
+func (s *Server) SessionGetHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	ts, ok := s.acquireSession(w, r)
+	if !ok {
+		return
+	}
+	defer ts.Unlock()
+
+	if err := s.runPreReadHooks(r.Context(), ts.namespace, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if i, ok := ts.written[key]; ok {
+		op := ts.writes[i]
+		if op.Op == txnOpDelete {
+			writeStoreError(w, r, ErrNoSuchKey)
+			return
+		}
+		s.writeReadValue(w, r, ts.namespace, op.Value, op.ContentType)
+		return
+	}
+
+	_, seen := ts.reads[key]
+	if !seen && ts.ops() >= maxTxnOps {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, errSessionTooLarge.Error())
+		return
+	}
+
+	entry, err := s.store.Get(r.Context(), ts.namespace, key)
+	if err != nil && !errors.Is(err, ErrNoSuchKey) {
+		writeStoreError(w, r, err)
+		return
+	}
+	// A key that has changed since the session first read it would fail
+	// the commit, so reading it again ends the session right away.
+	if version, seen := ts.reads[key]; !seen {
+		ts.reads[key] = entry.Version
+	} else if version != entry.Version {
+		s.sessions.end(ts)
+		writeError(w, r, http.StatusConflict, ErrorCodeSessionConflict, ErrSessionConflict.Error())
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Cavee-Version", strconv.FormatUint(entry.Version, 10))
+	s.writeReadValue(w, r, ts.namespace, entry.Value, entry.ContentType)
+}
+
+// SessionPutHandler adds a pending put of a key to a session. It takes the
+// same body and headers as a PUT of the key.
+func (s *Server) SessionPutHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	if maxLength := s.config.MaxKeyLength; maxLength > 0 && len(key) > maxLength {
+		writeError(w, r, http.StatusRequestURITooLong, ErrorCodeKeyTooLong,
+			fmt.Sprintf("key is %d bytes long, more than the limit of %d", len(key), maxLength))
+		return
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		if _, _, err = mime.ParseMediaType(contentType); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid Content-Type: "+err.Error())
+			return
+		}
+	}
+	tags, err := parseTags(r.Header.Get(tagsHeader))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	s.writeSession(w, r, txnOp{Op: txnOpPut, Key: key, Value: string(value), ContentType: contentType, Tags: tags})
+}
+
+// SessionDeleteHandler adds a pending delete of a key to a session.
+func (s *Server) SessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeSession(w, r, txnOp{Op: txnOpDelete, Key: r.PathValue("key")})
+}
+
+func (s *Server) writeSession(w http.ResponseWriter, r *http.Request, op txnOp) {
+	ts, ok := s.acquireSession(w, r)
+	if !ok {
+		return
+	}
+	defer ts.Unlock()
+
+	if err := ts.write(op); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CommitSessionHandler ends a session, making its pending writes at once if
+// none of the keys it read has changed since. Otherwise nothing is written
+// and it fails with 409, and the client has to start over in a new
+// session. The writes are logged as a single txn event, like those of
+// POST /v1/txn.
+func (s *Server) CommitSessionHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := s.acquireSession(w, r)
+	if !ok {
+		return
+	}
+	defer ts.Unlock()
+	s.sessions.end(ts)
+
+	keys := slices.Collect(maps.Keys(ts.reads))
+	for _, op := range ts.writes {
+		keys = append(keys, op.Key)
+	}
+
+	unlock := s.store.LockKeys(ts.namespace, keys...)
+	defer unlock()
+
+	// The namespace may have been dropped since the session began. As in
+	// TxnHandler, this is checked under the lock, before anything is
+	// logged, since replaying a txn event would create it again.
+	if !s.store.HasNamespace(ts.namespace) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	for key, version := range ts.reads {
+		entry, err := s.store.Get(r.Context(), ts.namespace, key)
+		if err != nil && !errors.Is(err, ErrNoSuchKey) {
+			writeStoreError(w, r, err)
+			return
+		}
+		if entry.Version != version {
+			slog.InfoContext(r.Context(), "session commit failed",
+				slog.String("namespace", ts.namespace),
+				slog.String("key", key),
+				slog.String("error", ErrSessionConflict.Error()),
+			)
+			writeError(w, r, http.StatusConflict, ErrorCodeSessionConflict, fmt.Sprintf("%s: %q", ErrSessionConflict, key))
+			return
+		}
+	}
+
+	resp := sessionCommitResponse{Writes: len(ts.writes)}
+	if len(ts.writes) > 0 {
+		e, ok := s.commitTxn(w, r, ts.namespace, ts.writes)
+		if !ok {
+			return
+		}
+		resp.Sequence = e.Sequence
+		setSequenceHeader(w, e.Sequence)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AbortSessionHandler ends a session without writing anything.
+func (s *Server) AbortSessionHandler(w http.ResponseWriter, r *http.Request) {
+	ts, ok := s.acquireSession(w, r)
+	if !ok {
+		return
+	}
+	defer ts.Unlock()
+	s.sessions.end(ts)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,30 @@
+package cavee_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// A session committed after its namespace was dropped must fail without
+// logging its writes, which would bring the namespace back on a restart.
+func TestSessionCommitAfterDrop(t *testing.T) {
+	inst := restarted(t, func(inst *caveetest.Instance) {
+		mustRequest(t, inst, http.MethodPut, "/admin/namespaces/a", "", http.StatusCreated)
+		var resp struct {
+			Session string `json:"session"`
+		}
+		if err := json.Unmarshal(mustRequest(t, inst, http.MethodPost, "/v1/ns/a/sessions", "", http.StatusCreated), &resp); err != nil {
+			t.Fatal(err)
+		}
+		mustRequest(t, inst, http.MethodPut, "/v1/sessions/"+resp.Session+"/key/k", "v", http.StatusNoContent)
+		mustRequest(t, inst, http.MethodDelete, "/admin/namespaces/a", "", http.StatusNoContent)
+
+		mustFail(t, inst, http.MethodPost, "/v1/sessions/"+resp.Session+"/commit", "", http.StatusNotFound, cavee.ErrorCodeNoSuchNamespace)
+	})
+
+	mustFail(t, inst, http.MethodGet, "/v1/ns/a/key/k", "", http.StatusNotFound, cavee.ErrorCodeNoSuchNamespace)
+}
@@ -0,0 +1,295 @@
+package cavee
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// setContentType is the content type of keys holding sets, whose values are
+// JSON arrays of their members, sorted.
+const setContentType = "application/vnd.cavee.set+json"
+
+// maxSetKeys is the most keys a set query may combine.
+const maxSetKeys = 128
+
+type set []string
+
+func decodeSet(entry Entry) (set, error) {
+	var members set
+	if err := json.Unmarshal([]byte(entry.Value), &members); err != nil {
+		return nil, fmt.Errorf("invalid set: %w", err)
+	}
+	return members, nil
+}
+
+// encode returns the value of a key holding the set, or an empty one if the
+// set is empty, since an empty set is kept as no key at all.
+func (st set) encode() (string, error) {
+	if len(st) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(st)
+	return string(b), err
+}
+
+func (st set) contains(member string) bool {
+	_, found := slices.BinarySearch(st, member)
+	return found
+}
+
+// add adds a member, reporting whether it was not there yet.
+func (st *set) add(member string) bool {
+	i, found := slices.BinarySearch(*st, member)
+	if !found {
+		*st = slices.Insert(*st, i, member)
+	}
+	return !found
+}
+
+// remove removes a member, reporting whether it was there.
+func (st *set) remove(member string) bool {
+	i, found := slices.BinarySearch(*st, member)
+	if found {
+		*st = slices.Delete(*st, i, i+1)
+	}
+	return found
+}
+
+type setResponse struct {
+	Members     set `json:"members"`
+	Cardinality int `json:"cardinality"`
+}
+
+type setUpdateRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+type setUpdateResponse struct {
+	Added       int `json:"added"`
+	Removed     int `json:"removed"`
+	Cardinality int `json:"cardinality"`
+}
+
+// getSet returns the set a key holds, which is empty if the key does not
+// exist, along with its entry.
+func (s *Server) getSet(r *http.Request, ns, key string) (set, Entry, error) {
+	entry, exists, err := s.getTyped(r, ns, key, setContentType)
+	if err != nil || !exists {
+		return set{}, Entry{}, err
+	}
+
+	members, err := decodeSet(entry)
+	return members, entry, err
+}
+
+// GetMembersHandler sends the members of the set a key holds, in order,
+// along with how many there are. A key that does not exist holds the empty
+// set.
+func (s *Server) GetMembersHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	members, _, err := s.getSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, setResponse{Members: members, Cardinality: len(members)})
+}
+
+// IsMemberHandler answers 204 if the set a key holds has a member, and 404
+// otherwise.
+func (s *Server) IsMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, member := r.PathValue("ns"), r.PathValue("key"), r.PathValue("member")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	members, _, err := s.getSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if !members.contains(member) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchMember, "set has no member "+member)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddMemberHandler adds a member to the set a key holds, creating the key if
+// needed. It answers 201 if the member was added and 204 if it was there
+// already, in which case nothing is written.
+func (s *Server) AddMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	resp, ok := s.updateSet(w, r, ns, key, setUpdateRequest{Add: []string{r.PathValue("member")}})
+	if !ok {
+		return
+	}
+	if resp.Added == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// RemoveMemberHandler removes a member from the set a key holds, deleting
+// the key once the set is empty. It answers 404 if the set has no such
+// member.
+func (s *Server) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, member := r.PathValue("ns"), r.PathValue("key"), r.PathValue("member")
+
+	resp, ok := s.updateSet(w, r, ns, key, setUpdateRequest{Remove: []string{member}})
+	if !ok {
+		return
+	}
+	if resp.Removed == 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchMember, "set has no member "+member)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateMembersHandler adds and removes members of the set a key holds in a
+// single write, taking {"add": [...], "remove": [...]}. Members are added
+// before others are removed.
+func (s *Server) UpdateMembersHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req setUpdateRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	resp, ok := s.updateSet(w, r, ns, key, req)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateSet adds and removes members of a set, writing the set back only if
+// it changed, and writing the error response if it fails.
+func (s *Server) updateSet(w http.ResponseWriter, r *http.Request, ns, key string, req setUpdateRequest) (setUpdateResponse, bool) {
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	members, current, err := s.getSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return setUpdateResponse{}, false
+	}
+
+	var resp setUpdateResponse
+	for _, member := range req.Add {
+		if members.add(member) {
+			resp.Added++
+		}
+	}
+	for _, member := range req.Remove {
+		if members.remove(member) {
+			resp.Removed++
+		}
+	}
+	resp.Cardinality = len(members)
+
+	if resp.Added == 0 && resp.Removed == 0 {
+		return resp, true
+	}
+
+	value, err := members.encode()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return setUpdateResponse{}, false
+	}
+	if _, ok := s.writeTyped(w, r, ns, key, current, value, setContentType); !ok {
+		return setUpdateResponse{}, false
+	}
+
+	return resp, true
+}
+
+// SetQueryHandler combines the sets held by the keys in ?key=, which is
+// repeated for each of them: /sets/intersection holds the members they all
+// have, /sets/union those any of them has, and /sets/difference those of
+// the first that none of the others has. Keys that do not exist hold the
+// empty set. The keys are locked while they are read, so the result is that
+// of the sets at a single point in time.
+func (s *Server) SetQueryHandler(w http.ResponseWriter, r *http.Request) {
+	ns, op := r.PathValue("ns"), r.PathValue("op")
+
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 || len(keys) > maxSetKeys {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Sprintf("key must be given between 1 and %d times", maxSetKeys))
+		return
+	}
+
+	var combine func(acc, next set) set
+	switch op {
+	case "intersection":
+		combine = func(acc, next set) set {
+			return slices.DeleteFunc(acc, func(member string) bool { return !next.contains(member) })
+		}
+	case "union":
+		combine = func(acc, next set) set {
+			for _, member := range next {
+				acc.add(member)
+			}
+			return acc
+		}
+	case "difference":
+		combine = func(acc, next set) set {
+			return slices.DeleteFunc(acc, next.contains)
+		}
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "set queries are intersection, union and difference")
+		return
+	}
+
+	if err := s.runPreReadHooksEach(r.Context(), ns, keys); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	unlock := s.store.LockKeys(ns, keys...)
+	defer unlock()
+
+	var result set
+	for i, key := range keys {
+		members, _, err := s.getSet(r, ns, key)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		if i == 0 {
+			result = members
+		} else {
+			result = combine(result, members)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, setResponse{Members: result, Cardinality: len(result)})
+}
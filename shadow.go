@@ -0,0 +1,154 @@
+package cavee
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxShadowInflight is the most shadow requests awaiting a response at once.
+// Requests that arrive while that many are outstanding are not shadowed, so
+// that a slow shadow instance cannot pile up goroutines and buffered
+// responses.
+const maxShadowInflight = 64
+
+// Shadower mirrors a share of incoming traffic to a second Cavee instance and
+// logs every response that differs from the one served by this instance.
+type Shadower struct {
+	target  *url.URL
+	percent float64
+	writes  bool
+	client  *http.Client
+	// inflight holds a slot for each shadow request awaiting a response.
+	inflight chan struct{}
+	// streaming reports whether a request is to a route whose response is
+	// streamed, as set by StreamingRoutes.
+	streaming func(r *http.Request) bool
+}
+
+func NewShadower(target string, percent float64, writes bool, timeout time.Duration) (*Shadower, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow url: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid shadow url: %q must be absolute", target)
+	}
+
+	return &Shadower{
+		target:   u,
+		percent:  percent,
+		writes:   writes,
+		client:   &http.Client{Timeout: timeout},
+		inflight: make(chan struct{}, maxShadowInflight),
+	}, nil
+}
+
+// StreamingRoutes sets how the shadower tells the routes whose responses are
+// streamed, which it leaves alone: watches and elections stream for as long
+// as the client stays, so there is no response to compare, and exports are
+// too large to buffer.
+func (s *Shadower) StreamingRoutes(streaming func(r *http.Request) bool) {
+	s.streaming = streaming
+}
+
+func (s *Shadower) shouldShadow(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/v1/") || (s.streaming != nil && s.streaming(r)) {
+		return false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodDelete:
+		if !s.writes {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return rand.Float64()*100 < s.percent
+}
+
+func (s *Shadower) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.shouldShadow(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case s.inflight <- struct{}{}:
+		default:
+			slog.DebugContext(r.Context(), "too many shadow requests in flight, not shadowing", slog.String("uri", r.URL.RequestURI()))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The body has to be read up front so that it can be replayed to
+		// both the primary handler and the shadow instance.
+		body, err := bufferBody(r)
+		if err != nil {
+			<-s.inflight
+			writeBodyError(w, r, err)
+			return
+		}
+
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		go s.compare(r.Method, r.URL.RequestURI(), r.Header.Clone(), body, rec.status, rec.body.Bytes())
+	})
+}
+
+func (s *Shadower) compare(method, uri string, header http.Header, body []byte, status int, primary []byte) {
+	defer func() { <-s.inflight }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.target.String(), "/")+uri, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("failed to build shadow request", slog.String("error", err.Error()))
+		return
+	}
+	req.Header = header
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		slog.Warn("shadow request failed",
+			slog.String("method", method),
+			slog.String("uri", uri),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+	defer resp.Body.Close()
+
+	shadow, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Warn("failed to read shadow response",
+			slog.String("method", method),
+			slog.String("uri", uri),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if resp.StatusCode != status || !bytes.Equal(shadow, primary) {
+		slog.Warn("shadow response mismatch",
+			slog.String("method", method),
+			slog.String("uri", uri),
+			slog.Int("primary_status", status),
+			slog.Int("shadow_status", resp.StatusCode),
+			slog.Int("primary_bytes", len(primary)),
+			slog.Int("shadow_bytes", len(shadow)),
+		)
+	}
+}
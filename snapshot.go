@@ -0,0 +1,239 @@
+package cavee
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// A snapshot is a stream of JSON lines: a SnapshotHeader followed by one
+// SnapshotEntry per key, ordered by namespace and key. Values are base64
+// encoded, since they need not be valid UTF-8. Only the current version of
+// each key is included.
+const (
+	snapshotFormat  = "cavee-snapshot"
+	snapshotVersion = 1
+)
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+)
+
+type SnapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Sequence is the sequence number of the last transaction log event
+	// reflected in the snapshot.
+	Sequence  uint64    `json:"sequence"`
+	CreatedAt time.Time `json:"created_at"`
+	// Namespaces lists the namespaces other than the default one, including
+	// empty ones.
+	Namespaces []string `json:"namespaces"`
+	Keys       int      `json:"keys"`
+}
+
+type SnapshotEntry struct {
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key"`
+	Value       []byte    `json:"value"`
+	Version     uint64    `json:"version"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	ContentType string    `json:"content_type,omitempty"`
+	// CreatedVersion and Writes are left out by snapshots taken before
+	// they were tracked.
+	CreatedVersion uint64 `json:"created_version,omitempty"`
+	Writes         uint64 `json:"writes,omitempty"`
+	// ExpiresAt is set for keys with a TTL. Keys that have expired are kept
+	// until their deletion is logged, as in the store.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// SlidingTTL is the TTL in nanoseconds reads refresh the key to, if
+	// it has sliding expiry.
+	SlidingTTL time.Duration `json:"sliding_ttl,omitempty"`
+	Tags       []string      `json:"tags,omitempty"`
+}
+
+// snapshot copies the store together with the sequence number of the last
+// event applied to it. Writers are only held off while the maps are copied;
+// the values themselves are shared with the store.
+func (s *Server) snapshot() (namespaces map[string]map[string]Entry, sequence uint64) {
+	// With every key locked no write is between being logged and being
+	// applied, so the store holds exactly the events logged so far.
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	return s.store.Snapshot(), s.lastSequence()
+}
+
+// lastSequence returns the sequence number of the last event replayed or
+// written since startup, or restored to.
+func (s *Server) lastSequence() uint64 {
+	if reporter, ok := s.transact.(LoggerStatsReporter); ok {
+		if sequence := reporter.LoggerStats().LastSequence; sequence > 0 {
+			return sequence
+		}
+	}
+
+	return s.replayedSequence
+}
+
+// WriteSnapshot writes a consistent point-in-time snapshot of the store to w
+// and returns the sequence number it was taken at.
+func (s *Server) WriteSnapshot(w io.Writer) (sequence uint64, err error) {
+	namespaces, sequence := s.snapshot()
+
+	return sequence, writeSnapshot(w, namespaces, sequence)
+}
+
+func writeSnapshot(w io.Writer, namespaces map[string]map[string]Entry, sequence uint64) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	header := SnapshotHeader{
+		Format:     snapshotFormat,
+		Version:    snapshotVersion,
+		Sequence:   sequence,
+		CreatedAt:  time.Now().UTC(),
+		Namespaces: []string{},
+	}
+	names := slices.Sorted(maps.Keys(namespaces))
+	for _, ns := range names {
+		if ns != "" {
+			header.Namespaces = append(header.Namespaces, ns)
+		}
+		header.Keys += len(namespaces[ns])
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	for _, ns := range names {
+		m := namespaces[ns]
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			entry := m[key]
+			e := SnapshotEntry{
+				Namespace:   ns,
+				Key:         key,
+				Value:       []byte(entry.Value),
+				Version:     entry.Version,
+				Created:     entry.Created,
+				Updated:     entry.Updated,
+				ContentType: entry.ContentType,
+				SlidingTTL:  entry.Sliding,
+				Tags:        entry.Tags,
+
+				CreatedVersion: entry.CreatedVersion,
+				Writes:         entry.Writes,
+			}
+			if !entry.ExpiresAt.IsZero() {
+				e.ExpiresAt = &entry.ExpiresAt
+			}
+
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// readSnapshotHeader reads the first line of a snapshot. dec must be reused
+// to read the entries that follow.
+func readSnapshotHeader(dec *json.Decoder) (header SnapshotHeader, err error) {
+	if err = dec.Decode(&header); err != nil {
+		return SnapshotHeader{}, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if header.Format != snapshotFormat {
+		return SnapshotHeader{}, fmt.Errorf("%w: not a cavee snapshot", ErrInvalidSnapshot)
+	}
+	if header.Version != snapshotVersion {
+		return SnapshotHeader{}, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, header.Version)
+	}
+
+	return header, nil
+}
+
+// readSnapshot reads a whole snapshot, checking that it holds as many keys as
+// its header says so that a truncated download is not mistaken for a
+// complete one.
+func readSnapshot(r io.Reader) (header SnapshotHeader, namespaces map[string]map[string]Entry, err error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	if header, err = readSnapshotHeader(dec); err != nil {
+		return SnapshotHeader{}, nil, err
+	}
+
+	namespaces = map[string]map[string]Entry{"": make(map[string]Entry)}
+	for _, ns := range header.Namespaces {
+		namespaces[ns] = make(map[string]Entry)
+	}
+
+	keys := 0
+	for {
+		var e SnapshotEntry
+		if err = dec.Decode(&e); errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return SnapshotHeader{}, nil, fmt.Errorf("%w: entry %d: %w", ErrInvalidSnapshot, keys+1, err)
+		}
+
+		m, exists := namespaces[e.Namespace]
+		if !exists {
+			return SnapshotHeader{}, nil, fmt.Errorf("%w: key %q is in undeclared namespace %q", ErrInvalidSnapshot, e.Key, e.Namespace)
+		}
+		entry := Entry{
+			Value:       string(e.Value),
+			Version:     e.Version,
+			Created:     e.Created,
+			Updated:     e.Updated,
+			ContentType: e.ContentType,
+			Sliding:     e.SlidingTTL,
+			Tags:        e.Tags,
+
+			CreatedVersion: e.CreatedVersion,
+			Writes:         e.Writes,
+		}
+		if e.ExpiresAt != nil {
+			entry.ExpiresAt = *e.ExpiresAt
+		}
+		m[e.Key] = entry
+		keys++
+	}
+
+	if keys != header.Keys {
+		return SnapshotHeader{}, nil, fmt.Errorf("%w: expected %d keys, found %d", ErrInvalidSnapshot, header.Keys, keys)
+	}
+
+	return header, namespaces, nil
+}
+
+// BackupHandler streams a snapshot of the store. The sequence number it was
+// taken at is sent in X-Cavee-Sequence as well as in the snapshot header.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	namespaces, sequence := s.snapshot()
+
+	h := w.Header()
+	h.Set("Content-Type", "application/x-ndjson")
+	h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="cavee-%d.snapshot"`, sequence))
+	h.Set("X-Cavee-Sequence", strconv.FormatUint(sequence, 10))
+	w.WriteHeader(http.StatusOK)
+
+	// Once the body has started the status can no longer change, so a
+	// failed backup only shows up as a truncated stream.
+	if err := writeSnapshot(w, namespaces, sequence); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write backup", slog.String("error", err.Error()))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "backup written", slog.Uint64("sequence", sequence))
+}
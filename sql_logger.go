@@ -0,0 +1,254 @@
+package cavee
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLTransactionLogger appends events to a table in a SQL database. Every
+// batch of queued events is inserted in a single transaction, and the table
+// can be queried with plain SQL for history, e.g.
+//
+//	SELECT sequence, type, value FROM events WHERE `key` = 'a';
+//
+// The table needs sequence, type, namespace, key, value, time, content_type,
+// tags, origin and principal columns, with time in Unix nanoseconds and tags
+// comma-separated;
+// the SQLite and MySQL constructors create it if it does not exist, and add
+// the columns that tables created by older versions lack.
+type SQLTransactionLogger struct {
+	queue        eventQueue
+	errors       <-chan error
+	lastSequence uint64
+	db           *sql.DB
+	driver       string
+	table        string
+}
+
+func (l *SQLTransactionLogger) WritePut(key, value string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypePut, Key: key, Value: value})
+}
+
+func (l *SQLTransactionLogger) WriteDelete(key string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypeDelete, Key: key})
+}
+
+func (l *SQLTransactionLogger) WriteEvent(e Event) <-chan WriteResult {
+	return l.queue.push(e)
+}
+
+func (l *SQLTransactionLogger) Close(ctx context.Context) error {
+	started, err := l.queue.close(ctx)
+	if !started && err == nil {
+		return l.db.Close()
+	}
+
+	return err
+}
+
+func (l *SQLTransactionLogger) LoggerStats() LoggerStats {
+	return l.queue.stats()
+}
+
+func (l *SQLTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *SQLTransactionLogger) HealthChecks(ctx context.Context) []HealthCheck {
+	database := HealthCheck{Name: "database", Status: HealthOK}
+	if err := l.db.PingContext(ctx); err != nil {
+		database.Status, database.Detail = HealthFailing, err.Error()
+	}
+
+	return append(l.queue.healthChecks(), database)
+}
+
+func (l *SQLTransactionLogger) Run() {
+	events := l.queue.start()
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	go func() {
+		var failed error
+		batch := make([]pendingEvent, 0, cap(events))
+
+		for {
+			e, ok := <-events
+			if !ok {
+				l.queue.finish(l.db.Close())
+				return
+			}
+
+			// Commit everything that queued up while the previous
+			// transaction was running together.
+			batch = append(batch[:0], e)
+		drain:
+			for len(batch) < cap(batch) {
+				select {
+				case e, ok := <-events:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+
+			// Once an append has failed the log can no longer be trusted, so
+			// every later write is rejected with the same error.
+			if failed == nil {
+				if err := l.insert(batch); err != nil {
+					failed = fmt.Errorf("failed to append to %s transaction log: %w", l.driver, err)
+					errors <- failed
+				}
+			}
+
+			for _, e := range batch {
+				e.done(failed)
+			}
+		}
+	}()
+}
+
+func (l *SQLTransactionLogger) insert(batch []pendingEvent) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO " + l.table + " (" + sqlEventColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	sequence := l.lastSequence
+	for i := range batch {
+		sequence++
+		batch[i].Sequence = sequence
+
+		if _, err = stmt.Exec(batch[i].Sequence, batch[i].Type, batch[i].Namespace, batch[i].Key, batch[i].Value, unixNanos(batch[i].Time), batch[i].ContentType, strings.Join(batch[i].Tags, ","), batch[i].Origin, batch[i].Principal); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	l.lastSequence = sequence
+
+	return nil
+}
+
+func (l *SQLTransactionLogger) ReadEvents() (eventsCh <-chan Event, errorsCh <-chan error) {
+	outEvents := make(chan Event)
+	outErrors := make(chan error, 1)
+
+	go func() {
+		defer close(outEvents)
+		defer close(outErrors)
+
+		rows, err := l.db.Query("SELECT " + sqlEventColumns + " FROM " + l.table + " ORDER BY sequence")
+		if err != nil {
+			outErrors <- fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			e, err := scanEvent(rows)
+			if err != nil {
+				outErrors <- fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+				return
+			}
+
+			l.lastSequence = e.Sequence
+			outEvents <- e
+		}
+
+		if err = rows.Err(); err != nil {
+			outErrors <- fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+		}
+	}()
+
+	return outEvents, outErrors
+}
+
+// ReadEventsBetween reads a range of the log with a query of its own, which
+// can run alongside the inserts of the logger.
+func (l *SQLTransactionLogger) ReadEventsBetween(ctx context.Context, from, to uint64, fn func(Event) error) error {
+	rows, err := l.db.QueryContext(ctx, "SELECT "+sqlEventColumns+" FROM "+l.table+" WHERE sequence > ? AND sequence <= ? ORDER BY sequence", from, to)
+	if err != nil {
+		return fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s transaction log: %w", l.driver, err)
+	}
+
+	return nil
+}
+
+// sqlEventColumns are the columns scanEvent reads, in order.
+const sqlEventColumns = "sequence, type, namespace, `key`, value, time, content_type, tags, origin, principal"
+
+func scanEvent(rows *sql.Rows) (e Event, err error) {
+	var nanos int64
+	var tags string
+	if err = rows.Scan(&e.Sequence, &e.Type, &e.Namespace, &e.Key, &e.Value, &nanos, &e.ContentType, &tags, &e.Origin, &e.Principal); err != nil {
+		return Event{}, err
+	}
+	if nanos != 0 {
+		e.Time = time.Unix(0, nanos)
+	}
+	if tags != "" {
+		e.Tags = strings.Split(tags, ",")
+	}
+
+	return e, nil
+}
+
+// addColumn adds a column to a table created before the column was, doing
+// nothing if the table already has it.
+func addColumn(db *sql.DB, driver, table, column, definition string) error {
+	query := "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	if driver == "sqlite" {
+		query = "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	}
+
+	var n int
+	if err := db.QueryRow(query, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// unixNanos returns t as Unix nanoseconds, or 0 for the zero time.
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
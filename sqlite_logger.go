@@ -0,0 +1,66 @@
+package cavee
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS events (
+	sequence  INTEGER PRIMARY KEY,
+	type      INTEGER NOT NULL,
+	namespace TEXT NOT NULL DEFAULT '',
+	key       TEXT NOT NULL,
+	value     TEXT NOT NULL,
+	time      INTEGER NOT NULL DEFAULT 0,
+	content_type TEXT NOT NULL DEFAULT '',
+	tags      TEXT NOT NULL DEFAULT '',
+	origin    TEXT NOT NULL DEFAULT '',
+	principal TEXT NOT NULL DEFAULT '',
+	logged_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+CREATE INDEX IF NOT EXISTS events_key ON events (namespace, key, sequence);
+`
+
+type SQLiteTransactionLoggerOptions struct {
+	Path string
+
+	// Sync set to SyncAlways makes every commit wait for an fsync. Otherwise
+	// commits survive a process crash but not a power failure.
+	Sync SyncPolicy
+
+	Queue QueueOptions
+}
+
+// NewSQLiteTransactionLogger opens, and creates if necessary, a single-file
+// SQLite database holding the log in its events table.
+func NewSQLiteTransactionLogger(opts SQLiteTransactionLoggerOptions) (logger TransactionLogger, err error) {
+	synchronous := "NORMAL"
+	if opts.Sync == SyncAlways {
+		synchronous = "FULL"
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=synchronous(%s)&_pragma=busy_timeout(5000)", opts.Path, synchronous)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite transaction log: %w", err)
+	}
+	// Appends are serialized by Run anyway, and a single connection keeps
+	// the pragmas above in effect for every statement.
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite transaction log schema: %w", err)
+	}
+	for _, column := range []string{"tags", "origin", "principal"} {
+		if err = addColumn(db, "sqlite", "events", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate sqlite transaction log schema: %w", err)
+		}
+	}
+
+	return &SQLTransactionLogger{queue: eventQueue{opts: opts.Queue}, db: db, driver: "sqlite", table: "events"}, nil
+}
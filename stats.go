@@ -0,0 +1,114 @@
+package cavee
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestCounter counts the requests served by each route pattern, and the
+// ones being served. Watch streams are left out of the latter, since they
+// only end when the client goes away.
+type requestCounter struct {
+	sync.Mutex
+	counts   map[string]uint64
+	inFlight atomic.Int64
+}
+
+// Middleware must wrap the router directly, since the router records the
+// pattern it matched on the request it is given.
+func (c *requestCounter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/watch") {
+			c.inFlight.Add(1)
+			defer c.inFlight.Add(-1)
+		}
+
+		next.ServeHTTP(w, r)
+
+		c.Lock()
+		c.counts[r.Pattern]++
+		c.Unlock()
+	})
+}
+
+func (c *requestCounter) snapshot() map[string]uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	counts := make(map[string]uint64, len(c.counts))
+	for pattern, n := range c.counts {
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		counts[pattern] += n
+	}
+
+	return counts
+}
+
+type statsResponse struct {
+	StartedAt        time.Time         `json:"started_at"`
+	UptimeSeconds    float64           `json:"uptime_seconds"`
+	Keys             int               `json:"keys"`
+	Bytes            int64             `json:"bytes"`
+	Namespaces       int               `json:"namespaces"`
+	LastSequence     uint64            `json:"last_sequence"`
+	PendingEvents    int               `json:"pending_events"`
+	QueueCapacity    int               `json:"queue_capacity"`
+	RejectedWrites   uint64            `json:"rejected_writes"`
+	LogError         string            `json:"log_error,omitempty"`
+	ReplayDurationMS float64           `json:"replay_duration_ms"`
+	Requests         map[string]uint64 `json:"requests"`
+}
+
+type storeStatsResponse struct {
+	Keys              int   `json:"keys"`
+	Bytes             int64 `json:"bytes"`
+	ValueBytes        int64 `json:"value_bytes"`
+	LargestValueBytes int   `json:"largest_value_bytes"`
+}
+
+// StoreStatsHandler reports the size of the data in the store to API
+// clients, without the details of the server /admin/stats has.
+func (s *Server) StoreStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.store.Stats()
+
+	writeJSON(w, http.StatusOK, storeStatsResponse{
+		Keys:              stats.Keys,
+		Bytes:             stats.Bytes,
+		ValueBytes:        stats.ValueBytes,
+		LargestValueBytes: stats.LargestValue,
+	})
+}
+
+// StatsHandler reports on the store, the transaction logger and the
+// requests served since startup. Requests are counted by route pattern.
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	keys, bytes := s.store.Size()
+
+	resp := statsResponse{
+		StartedAt:        s.startedAt.UTC(),
+		UptimeSeconds:    time.Since(s.startedAt).Seconds(),
+		Keys:             keys,
+		Bytes:            bytes,
+		Namespaces:       len(s.store.Namespaces()),
+		LastSequence:     s.lastSequence(),
+		ReplayDurationMS: float64(s.replayDuration.Microseconds()) / 1000,
+		Requests:         s.requests.snapshot(),
+	}
+
+	if reporter, ok := s.transact.(LoggerStatsReporter); ok {
+		stats := reporter.LoggerStats()
+		resp.PendingEvents, resp.QueueCapacity = stats.Pending, stats.Capacity
+		resp.RejectedWrites = stats.Rejected
+	}
+
+	if failure := s.logFailure.Load(); failure != nil {
+		resp.LogError = failure.String()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -1,56 +1,766 @@
-package main
+package cavee
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"hash/fnv"
 	"log/slog"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	ErrNoSuchKey = errors.New("no such key")
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrNoSuchNamespace = errors.New("no such namespace")
+	ErrNamespaceExists = errors.New("namespace already exists")
+	ErrNoSuchVersion   = errors.New("no such version")
 )
 
+// keyLockStripes is the number of mutexes the per-key locks are spread over.
+const keyLockStripes = 256
+
+// Entry is a value in the store together with its metadata.
+type Entry struct {
+	Value string
+	// Version is the sequence number of the transaction log event that last
+	// wrote the key.
+	Version uint64
+	// Created is when the key was last created, i.e. first written or
+	// written again after a delete. Updated is when it was last written.
+	// Both are zero for keys replayed from logs that predate timestamps.
+	Created time.Time
+	Updated time.Time
+	// CreatedVersion is the sequence number of the event that last created
+	// the key, and Writes counts the writes since, that one included. Both
+	// are zero for keys restored from snapshots that predate them.
+	CreatedVersion uint64
+	Writes         uint64
+	// ContentType is the media type the value was written with, or empty if
+	// the client did not send one.
+	ContentType string
+	// ExpiresAt is when the key expires, or zero if it does not.
+	ExpiresAt time.Time
+	// Sliding is set for keys whose TTL is refreshed when they are read:
+	// reads push ExpiresAt back to Sliding from the time of the read.
+	Sliding time.Duration
+	// Tags are the tags the value was written with, sorted.
+	Tags []string
+	// KeyID is the data key the value was encrypted with, if it was. It is
+	// only set on the entries reads return.
+	KeyID string
+
+	// history holds the values the key had before the current one, oldest
+	// first. It is never modified in place, so copies of an Entry stay valid.
+	history []Version
+}
+
+// expired reports whether the key has expired by now. Expired keys are
+// treated as missing, though they are only removed once their deletion is
+// logged.
+func (e Entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// Version is one value a key has held.
+type Version struct {
+	Version     uint64
+	Value       string
+	ContentType string
+	Time        time.Time
+}
+
+// Store holds the keys of every namespace. The default namespace, named "",
+// always exists; the others are created and dropped explicitly.
+//
+// Writes are logged before they are applied, so a handler holds the lock of
+// the key it writes, from checking the current value until the logged event
+// has been applied. That keeps the store in log order for every key.
 type Store struct {
 	sync.RWMutex
-	m map[string]string
+	namespaces map[string]map[string]Entry
+
+	// maxVersions is how many versions of each key are kept, including the
+	// current one.
+	maxVersions int
+	keyLocks    [keyLockStripes]sync.Mutex
+
+	// keys and bytes count the keys of every namespace and the bytes of
+	// those keys and their current values. namespaceBytes counts the bytes
+	// of each namespace alone.
+	keys           int
+	bytes          int64
+	namespaceBytes map[string]int64
+
+	// valueSizes counts the current values by size, so that the largest one
+	// can be found again once it is deleted without going over every key.
+	valueSizes   map[int]int
+	valueBytes   int64
+	largestValue int
+
+	// expiries indexes the keys with an expiry by time.
+	expiries expiryHeap
+	// tagged indexes the keys of each namespace by tag.
+	tagged map[string]map[string]map[string]struct{}
+
+	// retention is how many sequences back the store can be read as of, or
+	// 0 if values are dropped as soon as they are overwritten. sequence is
+	// that of the last event applied, and readableFrom the oldest sequence
+	// the store has been loaded from.
+	retention    uint64
+	sequence     uint64
+	readableFrom uint64
+	// past holds the values keys no longer have, oldest first, and
+	// pastQueue names them in the order they fall out of the window.
+	past      map[string]map[string][]pastVersion
+	pastQueue []pastRef
+
+	// values opens the values reads return, if they are encrypted.
+	values *ValueEncryption
 }
 
-func NewStore() *Store {
+// NewStore returns an empty store that keeps maxVersions versions of each
+// key, and the values keys had over the last retention sequences.
+func NewStore(maxVersions int, retention uint64) *Store {
 	return &Store{
-		m: make(map[string]string),
+		namespaces: map[string]map[string]Entry{
+			"": make(map[string]Entry),
+		},
+		maxVersions:    maxVersions,
+		namespaceBytes: make(map[string]int64),
+		valueSizes:     make(map[int]int),
+		tagged:         make(map[string]map[string]map[string]struct{}),
+		retention:      retention,
+		past:           make(map[string]map[string][]pastVersion),
 	}
 }
 
-func (s *Store) Put(key, value string) (err error) {
-	slog.Info("putting key to store", slog.String("key", key))
+// LockKey locks a key against other writers and returns the function that
+// unlocks it. Keys share a fixed number of locks, so unrelated keys may
+// occasionally wait for each other.
+func (s *Store) LockKey(ns, key string) (unlock func()) {
+	mu := &s.keyLocks[keyLockStripe(ns, key)]
+	mu.Lock()
+
+	return mu.Unlock
+}
+
+func keyLockStripe(ns, key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(ns))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	return h.Sum32() % keyLockStripes
+}
+
+// LockKeys locks several keys of a namespace at once, for writes such as
+// renames that touch more than one. The locks are taken in a fixed order so
+// that two such writers cannot deadlock.
+func (s *Store) LockKeys(ns string, keys ...string) (unlock func()) {
+	stripes := make([]uint32, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, keyLockStripe(ns, key))
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+
+	for _, i := range stripes {
+		s.keyLocks[i].Lock()
+	}
+
+	return func() {
+		for _, i := range stripes {
+			s.keyLocks[i].Unlock()
+		}
+	}
+}
+
+// LockAllKeys locks every key, for writes such as dropping a namespace that
+// affect keys no handler names.
+func (s *Store) LockAllKeys() (unlock func()) {
+	for i := range s.keyLocks {
+		s.keyLocks[i].Lock()
+	}
+
+	return func() {
+		for i := range s.keyLocks {
+			s.keyLocks[i].Unlock()
+		}
+	}
+}
+
+// Put applies a put event that has been written to the transaction log.
+func (s *Store) Put(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "putting key to store", slog.String("namespace", e.Namespace), slog.String("key", e.Key))
 
 	s.Lock()
-	s.m[key] = value
-	s.Unlock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return ErrNoSuchNamespace
+	}
+	s.put(m, e)
+	s.advance(e.Sequence)
 
 	return nil
 }
 
-func (s *Store) Get(key string) (value string, err error) {
-	slog.Info("getting value using key", slog.String("key", key))
+// put must be called with the lock held.
+func (s *Store) put(m map[string]Entry, e Event) {
+	entry, exists := m[e.Key]
+	if !exists {
+		entry.Created, entry.CreatedVersion = e.Time, e.Sequence
+		s.keys++
+		s.bytes += int64(len(e.Key))
+		s.namespaceBytes[e.Namespace] += int64(len(e.Key))
+	} else if s.maxVersions > 1 {
+		history := append(entry.history, Version{Version: entry.Version, Value: entry.Value, ContentType: entry.ContentType, Time: entry.Updated})
+		if n := len(history) - (s.maxVersions - 1); n > 0 {
+			history = slices.Clone(history[n:])
+		}
+		entry.history = history
+	}
+	if exists {
+		s.retire(e.Namespace, e.Key, entry, e.Sequence)
+		s.countValue(len(entry.Value), -1)
+		s.untag(e.Namespace, e.Key, entry.Tags)
+	}
+	s.countValue(len(e.Value), 1)
+	s.bytes += int64(len(e.Value) - len(entry.Value))
+	s.namespaceBytes[e.Namespace] += int64(len(e.Value) - len(entry.Value))
+	entry.Value, entry.Version, entry.Updated, entry.ContentType = e.Value, e.Sequence, e.Time, e.ContentType
+	entry.Writes++
+	entry.ExpiresAt, entry.Sliding = time.Time{}, 0
+	entry.Tags = e.Tags
+	s.tag(e.Namespace, e.Key, entry.Tags)
+	m[e.Key] = entry
+}
 
+// remove deletes a key of namespace ns if it exists, as the event with
+// sequence seq. It must be called with the lock held.
+func (s *Store) remove(m map[string]Entry, ns, key string, seq uint64) {
+	if entry, exists := m[key]; exists {
+		s.retire(ns, key, entry, seq)
+		s.keys--
+		s.bytes -= int64(len(key) + len(entry.Value))
+		s.namespaceBytes[ns] -= int64(len(key) + len(entry.Value))
+		s.countValue(len(entry.Value), -1)
+		s.untag(ns, key, entry.Tags)
+		delete(m, key)
+	}
+}
+
+// rename applies a rename event, and reports whether the source key
+// existed. It must be called with the lock held.
+func (s *Store) rename(m map[string]Entry, e Event) bool {
+	entry, exists := m[e.Key]
+	if !exists {
+		return false
+	}
+
+	s.remove(m, e.Namespace, e.Key, e.Sequence)
+	s.put(m, Event{Sequence: e.Sequence, Namespace: e.Namespace, Key: e.Value, Value: entry.Value, ContentType: entry.ContentType, Tags: entry.Tags, Time: e.Time})
+
+	moved := m[e.Value]
+	moved.ExpiresAt, moved.Sliding = entry.ExpiresAt, entry.Sliding
+	m[e.Value] = moved
+	s.trackExpiry(e.Namespace, e.Value, moved.ExpiresAt)
+
+	return true
+}
+
+// appendValue applies an append event and returns the entry it leaves. The
+// key keeps its content type, tags and expiry. It must be called with the
+// lock held.
+func (s *Store) appendValue(m map[string]Entry, e Event) Entry {
+	entry, exists := m[e.Key]
+	if !exists {
+		s.put(m, Event{Sequence: e.Sequence, Namespace: e.Namespace, Key: e.Key, Value: e.Value, ContentType: e.ContentType, Time: e.Time})
+		return m[e.Key]
+	}
+
+	s.put(m, Event{Sequence: e.Sequence, Namespace: e.Namespace, Key: e.Key, Value: entry.Value + e.Value, ContentType: entry.ContentType, Tags: entry.Tags, Time: e.Time})
+
+	appended := m[e.Key]
+	appended.ExpiresAt, appended.Sliding = entry.ExpiresAt, entry.Sliding
+	m[e.Key] = appended
+
+	return appended
+}
+
+// setExpiry applies an expire or persist event, and reports whether the
+// key existed. It must be called with the lock held.
+func (s *Store) setExpiry(m map[string]Entry, e Event) (bool, error) {
+	entry, exists := m[e.Key]
+	if !exists {
+		return false, nil
+	}
+
+	var expiresAt time.Time
+	var sliding time.Duration
+	if e.Type == EventTypeExpire {
+		var err error
+		if expiresAt, sliding, err = parseExpiry(e.Value); err != nil {
+			return true, err
+		}
+	}
+	entry.ExpiresAt, entry.Sliding = expiresAt, sliding
+	m[e.Key] = entry
+	s.trackExpiry(e.Namespace, e.Key, expiresAt)
+
+	return true, nil
+}
+
+// removePrefix deletes the keys starting with prefix, as the event with
+// sequence seq, and returns them. It must be called with the lock held.
+func (s *Store) removePrefix(m map[string]Entry, ns, prefix string, seq uint64) (removed []string) {
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(m, ns, key, seq)
+			removed = append(removed, key)
+		}
+	}
+
+	return removed
+}
+
+// countValue adds n current values of the given size to the value counts,
+// or removes them if n is negative. It must be called with the lock held.
+func (s *Store) countValue(size, n int) {
+	s.valueBytes += int64(size * n)
+
+	count := s.valueSizes[size] + n
+	if count > 0 {
+		s.valueSizes[size] = count
+		s.largestValue = max(s.largestValue, size)
+		return
+	}
+
+	delete(s.valueSizes, size)
+	if size == s.largestValue {
+		s.largestValue = 0
+		for size := range s.valueSizes {
+			s.largestValue = max(s.largestValue, size)
+		}
+	}
+}
+
+// dropNamespace must be called with the lock held.
+func (s *Store) dropNamespace(ns string, seq uint64) {
+	for key, entry := range s.namespaces[ns] {
+		s.retire(ns, key, entry, seq)
+		s.keys--
+		s.bytes -= int64(len(key) + len(entry.Value))
+		s.countValue(len(entry.Value), -1)
+	}
+	delete(s.namespaces, ns)
+	delete(s.namespaceBytes, ns)
+	delete(s.tagged, ns)
+}
+
+// Snapshot returns a copy of every namespace. Entries share their values
+// with the store, so the copy is cheap next to the data it describes.
+func (s *Store) Snapshot() map[string]map[string]Entry {
 	s.RLock()
-	value, exists := s.m[key]
-	s.RUnlock()
+	defer s.RUnlock()
 
+	namespaces := make(map[string]map[string]Entry, len(s.namespaces))
+	for ns, m := range s.namespaces {
+		namespaces[ns] = maps.Clone(m)
+	}
+
+	return namespaces
+}
+
+// Entries returns a copy of the keys of a namespace, leaving out the ones
+// that have expired.
+func (s *Store) Entries(ctx context.Context, ns string) (map[string]Entry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m, exists := s.namespaces[ns]
 	if !exists {
-		return "", ErrNoSuchKey
+		return nil, ErrNoSuchNamespace
 	}
 
-	return value, nil
+	now := time.Now()
+	entries := maps.Clone(m)
+	maps.DeleteFunc(entries, func(_ string, entry Entry) bool {
+		return entry.expired(now)
+	})
+	if s.values != nil {
+		if err := s.values.openEntries(entries); err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
 }
 
-func (s *Store) Delete(key string) (err error) {
-	slog.Info("deleting key from store", slog.String("key", key))
+// EncryptValues makes the store open the values it returns with v. The
+// values it holds, like those it is given to write, stay sealed.
+func (s *Store) EncryptValues(v *ValueEncryption) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.values = v
+}
 
+// open opens the value of an entry a read returns.
+func (s *Store) open(entry Entry) (Entry, error) {
+	if s.values == nil {
+		return entry, nil
+	}
+	return s.values.openEntry(entry)
+}
+
+// Restore replaces the contents of the store with namespaces, such as those
+// read from a snapshot taken at sequence. The store takes ownership of the
+// maps.
+func (s *Store) Restore(namespaces map[string]map[string]Entry, sequence uint64) {
 	s.Lock()
-	delete(s.m, key)
-	s.Unlock()
+	defer s.Unlock()
+
+	if namespaces[""] == nil {
+		namespaces[""] = make(map[string]Entry)
+	}
+	s.namespaces = namespaces
+
+	s.keys, s.bytes, s.namespaceBytes = 0, 0, make(map[string]int64)
+	s.valueSizes, s.valueBytes, s.largestValue = make(map[int]int), 0, 0
+	s.expiries = nil
+	s.tagged = make(map[string]map[string]map[string]struct{})
+	s.forgetPast(sequence)
+	for ns, m := range namespaces {
+		for key, entry := range m {
+			s.keys++
+			s.bytes += int64(len(key) + len(entry.Value))
+			s.namespaceBytes[ns] += int64(len(key) + len(entry.Value))
+			s.countValue(len(entry.Value), 1)
+			s.trackExpiry(ns, key, entry.ExpiresAt)
+			s.tag(ns, key, entry.Tags)
+		}
+	}
+}
+
+// StoreStats describes the contents of the store across namespaces.
+type StoreStats struct {
+	Keys int
+	// Bytes counts keys and their current values; ValueBytes only the
+	// values. Older versions are left out of both.
+	Bytes        int64
+	ValueBytes   int64
+	LargestValue int
+}
+
+// Stats returns the counts the store keeps up to date as it is written, so
+// it is cheap however many keys there are.
+func (s *Store) Stats() StoreStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	return StoreStats{Keys: s.keys, Bytes: s.bytes, ValueBytes: s.valueBytes, LargestValue: s.largestValue}
+}
+
+// Size returns the number of keys in the store, across namespaces, and the
+// bytes taken up by them and their current values.
+func (s *Store) Size() (keys int, bytes int64) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys, s.bytes
+}
+
+func (s *Store) Get(ctx context.Context, ns, key string) (entry Entry, err error) {
+	slog.DebugContext(ctx, "getting value using key", slog.String("namespace", ns), slog.String("key", key))
+
+	s.RLock()
+	defer s.RUnlock()
+
+	m, exists := s.namespaces[ns]
+	if !exists {
+		return Entry{}, ErrNoSuchNamespace
+	}
+
+	entry, exists = m[key]
+	if !exists || entry.expired(time.Now()) {
+		return Entry{}, ErrNoSuchKey
+	}
+
+	return s.open(entry)
+}
+
+// Versions returns the versions of a key the store still holds, newest
+// first.
+func (s *Store) Versions(ctx context.Context, ns, key string) (versions []Version, err error) {
+	entry, err := s.Get(ctx, ns, key)
+	if err != nil {
+		return nil, err
+	}
+
+	versions = make([]Version, 0, len(entry.history)+1)
+	versions = append(versions, Version{Version: entry.Version, Value: entry.Value, ContentType: entry.ContentType, Time: entry.Updated})
+	for i := len(entry.history) - 1; i >= 0; i-- {
+		v := entry.history[i]
+		if s.values != nil {
+			if v.Value, _, err = s.values.open(v.Value); err != nil {
+				return nil, err
+			}
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns the value a key had at the given version, which is the
+// sequence number of the event that wrote it.
+func (s *Store) GetVersion(ctx context.Context, ns, key string, version uint64) (Version, error) {
+	versions, err := s.Versions(ctx, ns, key)
+	if err != nil {
+		return Version{}, err
+	}
+
+	for _, v := range versions {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+
+	return Version{}, ErrNoSuchVersion
+}
+
+// Delete applies a delete event that has been written to the transaction
+// log.
+func (s *Store) Delete(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "deleting key from store", slog.String("namespace", e.Namespace), slog.String("key", e.Key))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return ErrNoSuchNamespace
+	}
+	s.remove(m, e.Namespace, e.Key, e.Sequence)
+	s.advance(e.Sequence)
+
+	return nil
+}
+
+// DeletePrefix applies a delete_prefix event, deleting every key of the
+// namespace starting with the prefix in its Key, and returns the keys it
+// deleted.
+func (s *Store) DeletePrefix(ctx context.Context, e Event) (deleted []string, err error) {
+	slog.DebugContext(ctx, "deleting keys by prefix from store", slog.String("namespace", e.Namespace), slog.String("prefix", e.Key))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return nil, ErrNoSuchNamespace
+	}
+	deleted = s.removePrefix(m, e.Namespace, e.Key, e.Sequence)
+	s.advance(e.Sequence)
+
+	return deleted, nil
+}
+
+// Rename applies a rename event that has been written to the transaction
+// log. The destination is written as by a put, so it keeps its own history
+// if it already existed.
+func (s *Store) Rename(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "renaming key in store", slog.String("namespace", e.Namespace), slog.String("key", e.Key), slog.String("destination", e.Value))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return ErrNoSuchNamespace
+	}
+	if !s.rename(m, e) {
+		return ErrNoSuchKey
+	}
+	s.advance(e.Sequence)
 
 	return nil
 }
+
+// Append applies an append event that has been written to the transaction
+// log, and returns the entry it leaves.
+func (s *Store) Append(ctx context.Context, e Event) (Entry, error) {
+	slog.DebugContext(ctx, "appending to key in store", slog.String("namespace", e.Namespace), slog.String("key", e.Key))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return Entry{}, ErrNoSuchNamespace
+	}
+	entry := s.appendValue(m, e)
+	s.advance(e.Sequence)
+
+	return s.open(entry)
+}
+
+// SetExpiry applies an expire or persist event that has been written to the
+// transaction log.
+func (s *Store) SetExpiry(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "setting key expiry in store", slog.String("namespace", e.Namespace), slog.String("key", e.Key))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return ErrNoSuchNamespace
+	}
+	if exists, err = s.setExpiry(m, e); !exists {
+		return ErrNoSuchKey
+	}
+	s.advance(e.Sequence)
+
+	return err
+}
+
+func (s *Store) CreateNamespace(ctx context.Context, ns string) (err error) {
+	slog.DebugContext(ctx, "creating namespace", slog.String("namespace", ns))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.namespaces[ns]; exists {
+		return ErrNamespaceExists
+	}
+	s.namespaces[ns] = make(map[string]Entry)
+
+	return nil
+}
+
+// DropNamespace applies a namespace_drop event, removing the namespace and
+// all of its keys. The default namespace cannot be dropped.
+func (s *Store) DropNamespace(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "dropping namespace", slog.String("namespace", e.Namespace))
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.namespaces[e.Namespace]; !exists || e.Namespace == "" {
+		return ErrNoSuchNamespace
+	}
+	s.dropNamespace(e.Namespace, e.Sequence)
+	s.advance(e.Sequence)
+
+	return nil
+}
+
+func (s *Store) HasNamespace(ns string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	_, exists := s.namespaces[ns]
+	return exists
+}
+
+type NamespaceInfo struct {
+	Name string `json:"name"`
+	Keys int    `json:"keys"`
+	// Bytes counts the keys and their current values.
+	Bytes int64 `json:"bytes"`
+}
+
+// Namespaces lists the namespaces other than the default one, sorted by
+// name.
+func (s *Store) Namespaces() []NamespaceInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	namespaces := make([]NamespaceInfo, 0, len(s.namespaces)-1)
+	for name, m := range s.namespaces {
+		if name != "" {
+			namespaces = append(namespaces, NamespaceInfo{Name: name, Keys: len(m), Bytes: s.namespaceBytes[name]})
+		}
+	}
+	slices.SortFunc(namespaces, func(a, b NamespaceInfo) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return namespaces
+}
+
+// Apply replays a store event from the transaction log. It is more lenient
+// than the methods used to serve requests: writes to a namespace that does
+// not exist create it, and dropping a missing namespace does nothing, because
+// a compacted log may no longer hold the events that created or dropped it.
+func (s *Store) Apply(e Event) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch e.Type {
+	case EventTypePut:
+		m, exists := s.namespaces[e.Namespace]
+		if !exists {
+			m = make(map[string]Entry)
+			s.namespaces[e.Namespace] = m
+		}
+		s.put(m, e)
+	case EventTypeDelete:
+		if m, exists := s.namespaces[e.Namespace]; exists {
+			s.remove(m, e.Namespace, e.Key, e.Sequence)
+		}
+	case EventTypeDeletePrefix:
+		if m, exists := s.namespaces[e.Namespace]; exists {
+			s.removePrefix(m, e.Namespace, e.Key, e.Sequence)
+		}
+	case EventTypeDeleteTag:
+		if m, exists := s.namespaces[e.Namespace]; exists {
+			s.removeTagged(m, e.Namespace, e.Key, e.Sequence)
+		}
+	case EventTypeRename:
+		if m, exists := s.namespaces[e.Namespace]; exists {
+			s.rename(m, e)
+		}
+	case EventTypeAppend:
+		m, exists := s.namespaces[e.Namespace]
+		if !exists {
+			m = make(map[string]Entry)
+			s.namespaces[e.Namespace] = m
+		}
+		s.appendValue(m, e)
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			slog.Warn("skipping invalid txn event", slog.Uint64("sequence", e.Sequence), slog.String("error", err.Error()))
+			break
+		}
+		m, exists := s.namespaces[e.Namespace]
+		if !exists {
+			m = make(map[string]Entry)
+			s.namespaces[e.Namespace] = m
+		}
+		s.applyTxn(m, e, writes)
+	case EventTypeExpire, EventTypePersist:
+		if m, exists := s.namespaces[e.Namespace]; exists {
+			if _, err := s.setExpiry(m, e); err != nil {
+				slog.Warn("skipping invalid expire event", slog.Uint64("sequence", e.Sequence), slog.String("error", err.Error()))
+			}
+		}
+	case EventTypeNamespaceCreate:
+		if _, exists := s.namespaces[e.Namespace]; !exists {
+			s.namespaces[e.Namespace] = make(map[string]Entry)
+		}
+	case EventTypeNamespaceDrop:
+		if e.Namespace != "" {
+			s.dropNamespace(e.Namespace, e.Sequence)
+		}
+	}
+	s.advance(e.Sequence)
+}
@@ -0,0 +1,191 @@
+package cavee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	maxTags      = 32
+	maxTagLength = 128
+	tagsHeader   = "X-Cavee-Tags"
+)
+
+var (
+	ErrInvalidTags = errors.New("invalid tags")
+)
+
+// parseTags parses the comma-separated tags of a write, sorting them and
+// dropping duplicates. Tags may not be empty or contain commas or control
+// characters.
+func parseTags(header string) ([]string, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("%w: empty tag", ErrInvalidTags)
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("%w: tag %.16q... is longer than %d bytes", ErrInvalidTags, tag, maxTagLength)
+		}
+		if strings.ContainsFunc(tag, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+			return nil, fmt.Errorf("%w: tag %q contains control characters", ErrInvalidTags, tag)
+		}
+		tags = append(tags, tag)
+	}
+
+	slices.Sort(tags)
+	tags = slices.Compact(tags)
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("%w: more than %d tags", ErrInvalidTags, maxTags)
+	}
+
+	return tags, nil
+}
+
+// tag adds a key to the index of each of its tags, and untag removes it.
+// Both must be called with the lock held.
+func (s *Store) tag(ns, key string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	byTag := s.tagged[ns]
+	if byTag == nil {
+		byTag = make(map[string]map[string]struct{})
+		s.tagged[ns] = byTag
+	}
+	for _, tag := range tags {
+		if byTag[tag] == nil {
+			byTag[tag] = make(map[string]struct{})
+		}
+		byTag[tag][key] = struct{}{}
+	}
+}
+
+func (s *Store) untag(ns, key string, tags []string) {
+	byTag := s.tagged[ns]
+	for _, tag := range tags {
+		delete(byTag[tag], key)
+		if len(byTag[tag]) == 0 {
+			delete(byTag, tag)
+		}
+	}
+}
+
+// KeysByTag returns the keys of a namespace that were written with tag,
+// sorted and leaving out the ones that have expired.
+func (s *Store) KeysByTag(ctx context.Context, ns, tag string) ([]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	m, exists := s.namespaces[ns]
+	if !exists {
+		return nil, ErrNoSuchNamespace
+	}
+
+	now := time.Now()
+	keys := slices.Sorted(maps.Keys(s.tagged[ns][tag]))
+
+	return slices.DeleteFunc(keys, func(key string) bool {
+		return m[key].expired(now)
+	}), nil
+}
+
+// DeleteTag applies a delete_tag event, deleting every key of the namespace
+// that was written with the tag in its Key, and returns them.
+func (s *Store) DeleteTag(ctx context.Context, e Event) (deleted []string, err error) {
+	slog.DebugContext(ctx, "deleting keys by tag from store", slog.String("namespace", e.Namespace), slog.String("tag", e.Key))
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return nil, ErrNoSuchNamespace
+	}
+	deleted = s.removeTagged(m, e.Namespace, e.Key, e.Sequence)
+	s.advance(e.Sequence)
+
+	return deleted, nil
+}
+
+// removeTagged deletes the keys written with tag, as the event with
+// sequence seq, and returns them. It must be called with the lock held.
+func (s *Store) removeTagged(m map[string]Entry, ns, tag string, seq uint64) (removed []string) {
+	removed = slices.Collect(maps.Keys(s.tagged[ns][tag]))
+	for _, key := range removed {
+		s.remove(m, ns, key, seq)
+	}
+
+	return removed
+}
+
+type tagKeysResponse struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Tag       string   `json:"tag"`
+	Keys      []string `json:"keys"`
+}
+
+// GetTagHandler lists the keys, in order, whose current value was written
+// with the tag.
+func (s *Server) GetTagHandler(w http.ResponseWriter, r *http.Request) {
+	ns, tag := r.PathValue("ns"), r.PathValue("tag")
+
+	keys, err := s.store.KeysByTag(r.Context(), ns, tag)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tagKeysResponse{Namespace: ns, Tag: tag, Keys: append([]string{}, keys...)})
+}
+
+// DeleteTagHandler deletes every key whose current value was written with
+// the tag. Like a prefix delete, it is logged as a single event and
+// watchers are told about each deleted key.
+func (s *Server) DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
+	ns, tag := r.PathValue("ns"), r.PathValue("tag")
+
+	unlock := s.store.LockAllKeys()
+	defer unlock()
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeDeleteTag, Namespace: ns, Key: tag, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	deleted, err := s.store.DeleteTag(r.Context(), e)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	for _, key := range deleted {
+		s.notify(Event{Sequence: e.Sequence, Type: EventTypeDelete, Namespace: ns, Key: key, Time: e.Time})
+	}
+
+	slog.InfoContext(r.Context(), "deleted keys by tag",
+		slog.String("namespace", ns),
+		slog.String("tag", tag),
+		slog.Int("deleted", len(deleted)),
+	)
+
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, deletePrefixResponse{Deleted: len(deleted)})
+}
@@ -1,11 +1,28 @@
-package main
+package cavee
 
 import (
 	"bufio"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrLoggerClosed     = errors.New("transaction logger is closed")
+	ErrLogLocked        = errors.New("transaction log is locked by another process")
+	ErrEventUnsupported = errors.New("transaction logger does not support this operation")
 )
 
 type EventType int
@@ -13,46 +30,543 @@ type EventType int
 const (
 	EventTypePut EventType = iota + 1
 	EventTypeDelete
+	EventTypeConfigPropose
+	EventTypeConfigCommit
+	EventTypeConfigAbort
+	EventTypeNamespaceCreate
+	EventTypeNamespaceDrop
+	// EventTypeDeletePrefix deletes every key of a namespace starting with
+	// the event's Key.
+	EventTypeDeletePrefix
+	// EventTypeRename moves the key named by the event's Key, with its value
+	// and content type, to the key named by its Value.
+	EventTypeRename
+	// EventTypeExpire sets the expiry of the key named by the event's Key
+	// to its Value, in Unix nanoseconds, followed for sliding expiry by a
+	// space and the sliding TTL in nanoseconds. EventTypePersist removes it.
+	EventTypeExpire
+	EventTypePersist
+	// EventTypeDeleteTag deletes every key of a namespace whose value was
+	// written with the tag in the event's Key.
+	EventTypeDeleteTag
+	// EventTypeTxn makes the writes of a transaction at once. Its Value is
+	// the JSON array of the puts and deletes, each naming its key.
+	EventTypeTxn
+	// EventTypeAppend appends its Value to the value of the key named by its
+	// Key, which is created with the event's content type if it does not
+	// exist.
+	EventTypeAppend
 )
 
+var eventTypeNames = map[EventType]string{
+	EventTypePut:             "put",
+	EventTypeDelete:          "delete",
+	EventTypeConfigPropose:   "config_propose",
+	EventTypeConfigCommit:    "config_commit",
+	EventTypeConfigAbort:     "config_abort",
+	EventTypeNamespaceCreate: "namespace_create",
+	EventTypeNamespaceDrop:   "namespace_drop",
+	EventTypeDeletePrefix:    "delete_prefix",
+	EventTypeRename:          "rename",
+	EventTypeExpire:          "expire",
+	EventTypePersist:         "persist",
+	EventTypeDeleteTag:       "delete_tag",
+	EventTypeTxn:             "txn",
+	EventTypeAppend:          "append",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
 type Event struct {
 	Sequence uint64
 	Type     EventType
-	Key      string
-	Value    string
+	// Namespace is empty for the default namespace.
+	Namespace string
+	Key       string
+	Value     string
+	// Time is when the event happened. It is zero for events written before
+	// timestamps were recorded.
+	Time time.Time
+	// ContentType is the media type a put value was written with, if any.
+	ContentType string
+	// Tags are the tags a put value was written with, sorted.
+	Tags []string
+	// Origin is the node ID of the server that logged the event. It is
+	// empty for events written before origins were recorded.
+	Origin string
+	// Principal is the authenticated caller whose request the event was
+	// logged for. It is empty when authentication is disabled and for
+	// writes the server makes on its own, such as deleting expired keys.
+	Principal string
+}
+
+// WriteResult is the outcome of appending an event to the transaction log.
+type WriteResult struct {
+	// Sequence is the sequence number assigned to the event. It is only set
+	// when Err is nil.
+	Sequence uint64
+	Err      error
 }
 
+// TransactionLogger persists store mutations. The write methods return a
+// channel that receives exactly one result once the event has been appended
+// to the log, or has failed to be.
 type TransactionLogger interface {
-	WritePut(key, value string)
-	WriteDelete(key string)
+	WritePut(key, value string) <-chan WriteResult
+	WriteDelete(key string) <-chan WriteResult
+	WriteEvent(e Event) <-chan WriteResult
 
 	Err() <-chan error
 	ReadEvents() (<-chan Event, <-chan error)
 	Run()
+
+	// Close stops accepting writes, waits for queued events to be written
+	// and made durable, and releases the logger's resources. Writes
+	// attempted after Close fail with ErrLoggerClosed.
+	Close(ctx context.Context) error
+}
+
+// ReplayProgressReporter is implemented by loggers that can tell how far
+// ReadEvents has got through the log, so startup can report progress.
+type ReplayProgressReporter interface {
+	ReplayProgress() (bytesRead, bytesTotal int64)
+}
+
+// LoggerStats describes the write queue of a transaction logger.
+type LoggerStats struct {
+	// LastSequence is the sequence number of the last event written since
+	// the logger started, or 0 if there has been none.
+	LastSequence uint64
+	// Pending is the number of events waiting in the queue, which holds
+	// up to Capacity events before writers block.
+	Pending  int
+	Capacity int
+	// Rejected counts the writes failed with ErrLogQueueFull since the
+	// logger started.
+	Rejected uint64
+}
+
+// LoggerStatsReporter is implemented by loggers that can report on their
+// write queue.
+type LoggerStatsReporter interface {
+	LoggerStats() LoggerStats
+}
+
+// Flusher is implemented by loggers that may acknowledge writes before they
+// are on stable storage, depending on their fsync policy. Flush forces every
+// event written so far there.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// SnapshotRestorer is implemented by loggers that can start over from a
+// snapshot of the store. The snapshot becomes the base of the log: the events
+// logged before it are set aside, replays load the snapshot before reading
+// any events, and new events are numbered on from the snapshot's sequence
+// number.
+type SnapshotRestorer interface {
+	// RestoreSnapshot makes the snapshot read from r, taken at sequence, the
+	// base of the log. It may be called before Run or while the logger is
+	// running, as long as no store writes are in flight.
+	RestoreSnapshot(ctx context.Context, r io.Reader, sequence uint64) error
+	// OpenSnapshot opens the base snapshot of the log. The error satisfies
+	// errors.Is(err, fs.ErrNotExist) if the log has none.
+	OpenSnapshot() (io.ReadCloser, error)
+}
+
+// HistoryReader is implemented by loggers that can read back part of the
+// log while running, for watches resuming from an earlier sequence number.
+type HistoryReader interface {
+	// ReadEventsBetween calls fn, in order, with each event logged after
+	// sequence from, up to and including sequence to, which is at most the
+	// last one acknowledged. Events the log no longer holds, such as those
+	// set aside by a snapshot restore, are skipped, so callers check that
+	// the sequence numbers follow on from from.
+	ReadEventsBetween(ctx context.Context, from, to uint64, fn func(Event) error) error
+}
+
+// SyncPolicy controls when the file logger forces appended events to stable
+// storage.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs after every event before acknowledging it.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs on a fixed interval and acknowledges all events
+	// written since the previous fsync at once (group commit).
+	SyncInterval SyncPolicy = "interval"
+	// SyncNone leaves flushing to the operating system. Acknowledged events
+	// survive a process crash but not a power failure.
+	SyncNone SyncPolicy = "none"
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNone:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+type FileTransactionLoggerOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// BatchDelay is how long the logger waits for more events to arrive
+	// before appending a batch. Events that queue up while a batch is being
+	// written are always appended together; waiting gathers larger batches
+	// at the cost of latency.
+	BatchDelay time.Duration
+
+	// MaxSegmentSize is the size in bytes after which the logger rolls over
+	// to a new segment file. Zero disables rolling.
+	MaxSegmentSize int64
+
+	// EncryptionKey is a 16, 24 or 32 byte AES key. When set, new segments
+	// are written with every record sealed using AES-GCM.
+	EncryptionKey []byte
+
+	Queue QueueOptions
+
+	// Archiver, if set, receives every segment once it has been closed, and
+	// segments missing locally are restored from it on startup.
+	Archiver SegmentArchiver
 }
 
+// CorruptRecordError reports a log record that failed verification. Sequence
+// is the sequence number the record was expected to carry, since the one
+// stored in a corrupt record cannot be trusted.
+type CorruptRecordError struct {
+	Segment  string
+	Offset   int64
+	Sequence uint64
+	Reason   string
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt transaction log record in segment %s at offset %d (sequence %d): %s",
+		e.Segment, e.Offset, e.Sequence, e.Reason)
+}
+
+// FileTransactionLoggerOptionsFromConfig builds the file logger options
+// described by the server configuration.
+func FileTransactionLoggerOptionsFromConfig(config *Config) (opts FileTransactionLoggerOptions, err error) {
+	key, err := LoadEncryptionKey(config)
+	if err != nil {
+		return FileTransactionLoggerOptions{}, err
+	}
+
+	opts = FileTransactionLoggerOptions{
+		Sync:           config.FsyncPolicy,
+		SyncInterval:   config.FsyncInterval,
+		BatchDelay:     config.BatchDelay,
+		Queue:          config.QueueOptions(),
+		MaxSegmentSize: config.MaxSegmentSize,
+		EncryptionKey:  key,
+	}
+
+	if config.ArchiveBucket != "" {
+		if opts.Archiver, err = NewS3Archiver(S3ArchiverOptions{
+			Endpoint: config.ArchiveEndpoint,
+			Region:   config.ArchiveRegion,
+			Bucket:   config.ArchiveBucket,
+			Prefix:   config.ArchivePrefix,
+		}); err != nil {
+			return FileTransactionLoggerOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// NewTransactionLoggerFromConfig creates the transaction logger selected by
+// the -tlog flag.
+func NewTransactionLoggerFromConfig(config *Config) (logger TransactionLogger, err error) {
+	switch config.TransactionLog {
+	case "sqlite":
+		logger, err = NewSQLiteTransactionLogger(SQLiteTransactionLoggerOptions{
+			Path:  config.SQLitePath,
+			Sync:  config.FsyncPolicy,
+			Queue: config.QueueOptions(),
+		})
+	case "mysql":
+		opts := MySQLTransactionLoggerOptions{Queue: config.QueueOptions()}
+		if opts.DSN, err = resolveSecret(config, cmp.Or(config.MySQLDSN, os.Getenv("CAVEE_MYSQL_DSN"))); err != nil {
+			break
+		}
+		if config.VaultMySQLCreds != "" {
+			var connector *vaultMySQLConnector
+			if connector, err = newVaultMySQLConnector(config.Vault, config.VaultMySQLCreds, opts.DSN); err != nil {
+				break
+			}
+			opts.Connector, opts.ConnMaxLifetime = connector, connector.maxLifetime()
+		}
+		logger, err = NewMySQLTransactionLogger(opts)
+	case "kafka":
+		logger, err = NewKafkaTransactionLogger(KafkaTransactionLoggerOptions{
+			Brokers:           config.KafkaBrokers,
+			Topic:             config.KafkaTopic,
+			ReplicationFactor: config.KafkaReplicationFactor,
+			Queue:             config.QueueOptions(),
+		})
+	case "nats":
+		logger, err = NewNATSTransactionLogger(NATSTransactionLoggerOptions{
+			URL:      config.NATSURL,
+			Stream:   config.NATSStream,
+			Replicas: config.NATSReplicas,
+			Queue:    config.QueueOptions(),
+		})
+	case "plugin":
+		logger, err = NewPluginTransactionLogger(PluginTransactionLoggerOptions{
+			Path:  config.LogPlugin,
+			Queue: config.QueueOptions(),
+		})
+	default:
+		var opts FileTransactionLoggerOptions
+		if opts, err = FileTransactionLoggerOptionsFromConfig(config); err != nil {
+			return nil, err
+		}
+		logger, err = NewFileTransactionLogger(config.TransactionLogDir, opts)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction logger: %w", err)
+	}
+
+	return logger, nil
+}
+
+// FileTransactionLogger appends events to numbered segment files in a
+// directory. Each segment is named after the sequence number of its first
+// event, and only the last one, the active segment, is ever written to.
 type FileTransactionLogger struct {
-	events       chan<- Event
+	queue        eventQueue
 	errors       <-chan error
 	lastSequence uint64
-	file         *os.File
+	// baseSequence is the sequence number of the base snapshot, if the log
+	// has been restored from one.
+	baseSequence uint64
+	// restores hands snapshots to the logger goroutine once it is running,
+	// and flushes asks it to fsync.
+	restores chan snapshotRestore
+	flushes  chan chan error
+	dir      string
+	// lock holds the lock on the log directory for as long as the logger is
+	// open.
+	lock         *os.File
+	active       *os.File
+	activeHeader segmentHeader
+	activeSize   int64
+	aead         cipher.AEAD
+	opts         FileTransactionLoggerOptions
+
+	replayRead  atomic.Int64
+	replayTotal atomic.Int64
+
+	// archive feeds closed segments to the archiver goroutine, starting
+	// with unarchived, the ones left over from earlier runs.
+	archive    chan string
+	unarchived []string
+}
+
+func NewFileTransactionLogger(dir string, opts FileTransactionLoggerOptions) (logger TransactionLogger, err error) {
+	if opts.Sync == SyncInterval && opts.SyncInterval <= 0 {
+		return nil, fmt.Errorf("fsync interval must be positive, got %v", opts.SyncInterval)
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create transaction log directory: %w", err)
+	}
+
+	// Two processes appending to the same segments would interleave their
+	// sequence numbers, so only one may have the log open.
+	lock, err := lockFile(filepath.Join(dir, lockFileName))
+	if errors.Is(err, ErrLogLocked) {
+		return nil, fmt.Errorf("%w: is another cavee using %s?", err, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock transaction log: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &FileTransactionLogger{queue: eventQueue{opts: opts.Queue}, dir: dir, lock: lock, opts: opts}
+
+	if opts.EncryptionKey != nil {
+		block, err := aes.NewCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transaction log encryption key: %w", err)
+		}
+		if l.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("invalid transaction log encryption key: %w", err)
+		}
+	}
+
+	if l.baseSequence, err = l.readBaseSequence(); err != nil {
+		return nil, err
+	}
+	l.lastSequence = l.baseSequence
+
+	var archived []string
+	if opts.Archiver != nil {
+		if archived, err = l.restoreSegments(segments); err != nil {
+			return nil, err
+		}
+		if segments, err = listSegments(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	name := segmentName(l.baseSequence + 1)
+	if len(segments) > 0 {
+		name = segments[len(segments)-1]
+	}
+	if err = l.openSegment(name); err != nil {
+		return nil, err
+	}
+
+	if opts.Archiver != nil {
+		if l.unarchived, err = l.unarchivedSegments(archived); err != nil {
+			l.active.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+const lockFileName = "LOCK"
+
+func segmentName(firstSequence uint64) string {
+	return fmt.Sprintf("%020d%s", firstSequence, segmentExt)
+}
+
+const segmentExt = ".log"
+
+// listSegments returns the segment file names in dir in log order.
+func listSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list transaction log segments: %w", err)
+	}
+
+	var segments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != segmentExt {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64); err != nil {
+			continue
+		}
+		segments = append(segments, name)
+	}
+
+	// Names are zero padded, so lexical order is sequence order.
+	slices.Sort(segments)
+
+	return segments, nil
 }
 
-func NewFileTransactionLogger(filename string) (logger TransactionLogger, err error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+func (l *FileTransactionLogger) openSegment(name string) error {
+	file, err := os.OpenFile(filepath.Join(l.dir, name), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open transaction log file: %w", err)
+		return fmt.Errorf("failed to open transaction log segment: %w", err)
 	}
 
-	return &FileTransactionLogger{file: file}, nil
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat transaction log segment: %w", err)
+	}
+	size := info.Size()
+
+	header, err := readSegmentHeader(io.NewSectionReader(file, 0, size))
+	if err != nil && size >= int64(len(encodeSegmentHeader(0))) {
+		file.Close()
+		return fmt.Errorf("invalid transaction log segment %s: %w", name, err)
+	}
+
+	// A segment holding no records yet, including one whose header was cut
+	// short by a crash, is rewritten so it matches the current settings.
+	if err != nil || size <= header.size() {
+		var flags uint32
+		if l.aead != nil {
+			flags |= segmentFlagEncrypted
+		}
+
+		b := encodeSegmentHeader(flags)
+		if err = file.Truncate(0); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to reset transaction log segment: %w", err)
+		}
+		if _, err = file.Write(b); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write transaction log segment header: %w", err)
+		}
+
+		header = segmentHeader{version: logFormatVersion, flags: flags}
+		size = int64(len(b))
+	}
+
+	l.active = file
+	l.activeHeader = header
+	l.activeSize = size
+
+	return nil
 }
 
-func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{Type: EventTypePut, Key: key, Value: value}
+// roll syncs and closes the active segment and starts a new one beginning at
+// the given sequence number.
+func (l *FileTransactionLogger) roll(firstSequence uint64) error {
+	if err := l.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync transaction log segment: %w", err)
+	}
+	if err := l.active.Close(); err != nil {
+		return fmt.Errorf("failed to close transaction log segment: %w", err)
+	}
+
+	return l.openSegment(segmentName(firstSequence))
+}
+
+func (l *FileTransactionLogger) WritePut(key, value string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypePut, Key: key, Value: value})
 }
 
-func (l *FileTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{Type: EventTypeDelete, Key: key}
+func (l *FileTransactionLogger) WriteDelete(key string) <-chan WriteResult {
+	return l.WriteEvent(Event{Type: EventTypeDelete, Key: key})
+}
+
+func (l *FileTransactionLogger) WriteEvent(e Event) <-chan WriteResult {
+	return l.queue.push(e)
+}
+
+func (l *FileTransactionLogger) Close(ctx context.Context) error {
+	started, err := l.queue.close(ctx)
+	if !started && err == nil {
+		err = l.active.Close()
+		l.lock.Close()
+	}
+
+	return err
+}
+
+func (l *FileTransactionLogger) LoggerStats() LoggerStats {
+	return l.queue.stats()
 }
 
 func (l *FileTransactionLogger) Err() <-chan error {
@@ -60,61 +574,536 @@ func (l *FileTransactionLogger) Err() <-chan error {
 }
 
 func (l *FileTransactionLogger) Run() {
-	events := make(chan Event, 16)
-	l.events = events
+	events := l.queue.start()
+	l.restores = make(chan snapshotRestore)
+	l.flushes = make(chan chan error)
 
 	errors := make(chan error, 1)
 	l.errors = errors
 
+	if l.opts.Archiver != nil {
+		l.archive = make(chan string, 64)
+		go l.archiveSegments(l.archive)
+
+		for _, name := range l.unarchived {
+			l.archiveSegment(name)
+		}
+		l.unarchived = nil
+	}
+
 	go func() {
-		for e := range events {
-			l.lastSequence++
+		var failed error
 
-			if _, err := fmt.Fprintf(l.file, "%d\t%d\t%s\t\"%s\"\n", l.lastSequence, e.Type, e.Key, e.Value); err != nil {
-				errors <- err
-				return
+		batch := make([]pendingEvent, 0, cap(events))
+
+		// unsynced holds the writers waiting for the next interval fsync.
+		var unsynced []pendingEvent
+
+		var tick <-chan time.Time
+		if l.opts.Sync == SyncInterval {
+			ticker := time.NewTicker(l.opts.SyncInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		fail := func(err error) {
+			failed = err
+			errors <- failed
+		}
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					l.queue.finish(l.stop(failed, unsynced))
+					return
+				}
+
+				// Append everything that queued up while the previous batch
+				// was being written with a single write, and fsync.
+				batch = append(batch[:0], e)
+				open := l.collectBatch(events, &batch)
+
+				// Once an append has failed the log can no longer be trusted, so
+				// every later write is rejected with the same error.
+				if failed != nil {
+					for _, p := range batch {
+						p.done(failed)
+					}
+				} else {
+					var err error
+					if unsynced, err = l.appendBatch(batch, unsynced); err != nil {
+						fail(err)
+					}
+				}
+
+				if !open {
+					l.queue.finish(l.stop(failed, unsynced))
+					return
+				}
+
+			case done := <-l.flushes:
+				if failed == nil {
+					if err := l.active.Sync(); err != nil {
+						fail(fmt.Errorf("failed to sync transaction log: %w", err))
+					}
+				}
+				for _, p := range unsynced {
+					p.done(failed)
+				}
+				unsynced = unsynced[:0]
+				done <- failed
+
+			case req := <-l.restores:
+				if failed != nil {
+					req.done <- failed
+					continue
+				}
+
+				// The events before the snapshot are about to be set aside, so
+				// the ones still waiting for an fsync are synced first.
+				err := l.active.Sync()
+				if err != nil {
+					fail(fmt.Errorf("failed to sync transaction log: %w", err))
+				}
+				for _, p := range unsynced {
+					p.done(failed)
+				}
+				unsynced = unsynced[:0]
+
+				if err == nil {
+					if err = l.resetToSnapshot(req.file, req.sequence); err != nil {
+						// The active segment may already be closed, so nothing
+						// more can be appended.
+						fail(err)
+					}
+				}
+				req.done <- err
+
+			case <-tick:
+				if len(unsynced) == 0 {
+					continue
+				}
+
+				if err := l.active.Sync(); err != nil && failed == nil {
+					fail(fmt.Errorf("failed to sync transaction log: %w", err))
+				}
+				for _, p := range unsynced {
+					p.done(failed)
+				}
+				unsynced = unsynced[:0]
 			}
 		}
 	}()
 }
 
+// collectBatch adds the events queued behind the first one of a batch, up to
+// the capacity of the queue, waiting up to the batch delay for more to
+// arrive. It reports whether the events channel is still open.
+func (l *FileTransactionLogger) collectBatch(events <-chan pendingEvent, batch *[]pendingEvent) (open bool) {
+	var timeout <-chan time.Time
+	if l.opts.BatchDelay > 0 {
+		timer := time.NewTimer(l.opts.BatchDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for len(*batch) < cap(events) {
+		if timeout == nil {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return false
+				}
+				*batch = append(*batch, e)
+			default:
+				return true
+			}
+			continue
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			*batch = append(*batch, e)
+		case <-timeout:
+			return true
+		}
+	}
+
+	return true
+}
+
+// appendBatch writes a batch of events to the log, rolling over to new
+// segments as needed, and completes them as the fsync policy says. It
+// returns the events left waiting for an interval fsync. If it fails, every
+// event of the batch and every unsynced one has been completed with the
+// error.
+func (l *FileTransactionLogger) appendBatch(batch, unsynced []pendingEvent) ([]pendingEvent, error) {
+	var buf []byte
+	// written holds the events of the batch that are in buf or have been
+	// written out without being completed.
+	var written []pendingEvent
+
+	fail := func(rest []pendingEvent, err error) ([]pendingEvent, error) {
+		for _, group := range [][]pendingEvent{unsynced, written, rest} {
+			for _, p := range group {
+				p.done(err)
+			}
+		}
+		return nil, err
+	}
+	write := func() error {
+		n, err := l.active.Write(buf)
+		l.activeSize += int64(n)
+		buf = buf[:0]
+		if err != nil {
+			return fmt.Errorf("failed to append to transaction log: %w", err)
+		}
+		return nil
+	}
+
+	for i, p := range batch {
+		l.lastSequence++
+
+		size := l.activeSize + int64(len(buf))
+		full := l.opts.MaxSegmentSize > 0 && size >= l.opts.MaxSegmentSize
+		// Encryption and the record format are per segment, so turning
+		// encryption on or off, or upgrading, starts a new one.
+		mismatched := l.activeHeader.encrypted() != (l.aead != nil) || l.activeHeader.version != logFormatVersion
+
+		if (full || mismatched) && size > l.activeHeader.size() {
+			if err := write(); err != nil {
+				return fail(batch[i:], err)
+			}
+
+			// Rolling syncs the old segment, which makes every event written
+			// to it durable.
+			closed := filepath.Base(l.active.Name())
+			if err := l.roll(l.lastSequence); err != nil {
+				return fail(batch[i:], err)
+			}
+			l.archiveSegment(closed)
+
+			for _, group := range [][]pendingEvent{unsynced, written} {
+				for _, q := range group {
+					q.done(nil)
+				}
+			}
+			unsynced, written = unsynced[:0], written[:0]
+		}
+
+		p.Sequence = l.lastSequence
+
+		record, err := encodeRecord(p.Event, l.aead)
+		if err != nil {
+			return fail(batch[i:], fmt.Errorf("failed to encode transaction log record: %w", err))
+		}
+		buf = append(buf, record...)
+		written = append(written, p)
+	}
+
+	if err := write(); err != nil {
+		return fail(nil, err)
+	}
+
+	switch l.opts.Sync {
+	case SyncAlways:
+		if err := l.active.Sync(); err != nil {
+			return fail(nil, fmt.Errorf("failed to sync transaction log: %w", err))
+		}
+		for _, p := range written {
+			p.done(nil)
+		}
+	case SyncInterval:
+		unsynced = append(unsynced, written...)
+	default:
+		for _, p := range written {
+			p.done(nil)
+		}
+	}
+
+	return unsynced, nil
+}
+
+// Flush fsyncs the active segment, making every event written so far durable
+// whatever the fsync policy.
+func (l *FileTransactionLogger) Flush(ctx context.Context) error {
+	if l.flushes == nil {
+		return ErrLoggerNotRunning
+	}
+
+	done := make(chan error, 1)
+	select {
+	case l.flushes <- done:
+	case <-l.queue.stopped:
+		return ErrLoggerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// archiveSegment queues a closed segment for upload. Segments that do not fit
+// in the queue are picked up again on the next start.
+func (l *FileTransactionLogger) archiveSegment(name string) {
+	if l.archive == nil {
+		return
+	}
+
+	select {
+	case l.archive <- name:
+	default:
+		slog.Warn("archive queue full, deferring segment to next start", slog.String("segment", name))
+	}
+}
+
+// stop syncs and closes the active segment once the events channel has been
+// drained, releasing any writers still waiting for an interval fsync.
+func (l *FileTransactionLogger) stop(failed error, unsynced []pendingEvent) error {
+	if l.archive != nil {
+		close(l.archive)
+	}
+
+	err := l.active.Sync()
+	if err != nil {
+		err = fmt.Errorf("failed to sync transaction log: %w", err)
+	}
+
+	for _, p := range unsynced {
+		if failed != nil {
+			p.done(failed)
+		} else {
+			p.done(err)
+		}
+	}
+
+	if closeErr := l.active.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close transaction log segment: %w", closeErr)
+	}
+	l.lock.Close()
+
+	return err
+}
+
 func (l *FileTransactionLogger) ReadEvents() (eventsCh <-chan Event, errorsCh <-chan error) {
-	scanner := bufio.NewScanner(l.file)
 	outEvents := make(chan Event)
 	outErrors := make(chan error, 1)
 
 	go func() {
-		var e Event
-
 		defer close(outEvents)
 		defer close(outErrors)
 
-		for scanner.Scan() {
-			line := scanner.Text()
+		segments, err := listSegments(l.dir)
+		if err != nil {
+			outErrors <- err
+			return
+		}
+
+		var total int64
+		for _, name := range segments {
+			if info, err := os.Stat(filepath.Join(l.dir, name)); err == nil {
+				total += info.Size()
+			}
+		}
+		l.replayTotal.Store(total)
 
-			if _, err := fmt.Sscanf(line, "%d\t%d\t%s\t%s",
-				&e.Sequence, &e.Type, &e.Key, &e.Value); err != nil {
-				outErrors <- fmt.Errorf("transaction log line parse error: %w", err)
+		for _, name := range segments {
+			if err := l.readSegment(name, outEvents); err != nil {
+				outErrors <- err
 				return
 			}
+		}
+	}()
 
-			// Remove quotes from parsing
-			e.Value = e.Value[1 : len(e.Value)-1]
+	return outEvents, outErrors
+}
 
-			if l.lastSequence >= e.Sequence {
-				outErrors <- fmt.Errorf("transaction number ouf of sequence")
-				return
+func (l *FileTransactionLogger) ReplayProgress() (bytesRead, bytesTotal int64) {
+	return l.replayRead.Load(), l.replayTotal.Load()
+}
+
+// minFreeLogDiskSpace is the free space on the log volume below which the
+// file logger reports itself degraded, as is less than 5% free.
+const minFreeLogDiskSpace = 512 << 20
+
+func (l *FileTransactionLogger) HealthChecks(ctx context.Context) []HealthCheck {
+	checks := l.queue.healthChecks()
+
+	free, total, err := diskSpace(l.dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return checks
+	}
+
+	disk := HealthCheck{Name: "disk", Status: HealthOK}
+	if err != nil {
+		disk.Status, disk.Detail = HealthFailing, err.Error()
+	} else {
+		disk.Detail = fmt.Sprintf("%d of %d bytes free", free, total)
+		if free < minFreeLogDiskSpace || free < total/20 {
+			disk.Status = HealthDegraded
+		}
+	}
+
+	return append(checks, disk)
+}
+
+// openSegmentReader opens a segment for reading and reads its header,
+// returning the cipher its records are sealed with, if any.
+func (l *FileTransactionLogger) openSegmentReader(name string) (file *os.File, r *bufio.Reader, header segmentHeader, aead cipher.AEAD, err error) {
+	file, err = os.Open(filepath.Join(l.dir, name))
+	if err != nil {
+		return nil, nil, segmentHeader{}, nil, fmt.Errorf("failed to open transaction log segment: %w", err)
+	}
+
+	r = bufio.NewReader(file)
+
+	header, err = readSegmentHeader(r)
+	if err != nil {
+		file.Close()
+		return nil, nil, segmentHeader{}, nil, fmt.Errorf("invalid transaction log segment %s: %w", name, err)
+	}
+
+	if header.encrypted() {
+		if l.aead == nil {
+			file.Close()
+			return nil, nil, segmentHeader{}, nil, fmt.Errorf("transaction log segment %s is encrypted but no encryption key is configured", name)
+		}
+		aead = l.aead
+	}
+
+	return file, r, header, aead, nil
+}
+
+func (l *FileTransactionLogger) readSegment(name string, outEvents chan<- Event) error {
+	file, r, header, aead, err := l.openSegmentReader(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := header.size()
+	l.replayRead.Add(offset)
+	for {
+		e, n, err := readRecord(r, aead)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		// A record cut short at the very end of the active segment is an
+		// append that was interrupted by a crash and never acknowledged, so
+		// it is dropped rather than failing the replay. A corrupt length
+		// prefix runs past the end of the segment too, but complete records
+		// follow it.
+		if errors.Is(err, errTruncatedRecord) && name == filepath.Base(l.active.Name()) {
+			data, rerr := os.ReadFile(filepath.Join(l.dir, name))
+			if rerr != nil {
+				return fmt.Errorf("failed to read transaction log segment %s: %w", name, rerr)
+			}
+			if sequence, found := findRecord(data[offset+1:], aead, l.lastSequence); found {
+				return &CorruptRecordError{Segment: name, Offset: offset, Sequence: l.lastSequence + 1,
+					Reason: fmt.Sprintf("record runs past the end of the segment, but record %d follows it", sequence)}
 			}
 
-			l.lastSequence = e.Sequence
-			outEvents <- e
+			slog.Warn("truncating incomplete record at end of transaction log",
+				slog.String("segment", name),
+				slog.Int64("offset", offset),
+			)
+			if err := l.active.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate transaction log segment %s: %w", name, err)
+			}
+			l.activeSize = offset
+			return nil
 		}
 
-		if err := scanner.Err(); !errors.Is(err, io.EOF) && err != nil {
-			outErrors <- fmt.Errorf("transaction log read failure: %w", err)
-			return
+		if err != nil {
+			return &CorruptRecordError{Segment: name, Offset: offset, Sequence: l.lastSequence + 1, Reason: err.Error()}
 		}
-	}()
 
-	return outEvents, outErrors
+		if l.lastSequence >= e.Sequence {
+			return fmt.Errorf("transaction number ouf of sequence in segment %s at offset %d", name, offset)
+		}
+
+		l.lastSequence = e.Sequence
+		outEvents <- e
+
+		offset += n
+		l.replayRead.Add(n)
+	}
+}
+
+// ReadEventsBetween reads events from the segments on disk while the logger
+// runs. Appends never rewrite what an acknowledged event was written to, so
+// only the end of the active segment can be in flux, and that is past the
+// last acknowledged event.
+func (l *FileTransactionLogger) ReadEventsBetween(ctx context.Context, from, to uint64, fn func(Event) error) error {
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+
+	// Segments are named after their first sequence number, so reading
+	// starts at the last one beginning at or before the first event wanted.
+	start := 0
+	for i, name := range segments {
+		first, _ := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if first > from+1 {
+			break
+		}
+		start = i
+	}
+
+	for _, name := range segments[start:] {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		done, err := l.readSegmentBetween(name, from, to, fn)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSegmentBetween calls fn with the events of a segment after from, up to
+// and including to, reporting whether it got past to.
+func (l *FileTransactionLogger) readSegmentBetween(name string, from, to uint64, fn func(Event) error) (done bool, err error) {
+	file, r, _, aead, err := l.openSegmentReader(name)
+	// A segment set aside by a restore since it was listed, or one just
+	// started whose header is still being written, holds nothing to read.
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	for {
+		e, _, err := readRecord(r, aead)
+		if errors.Is(err, io.EOF) || errors.Is(err, errTruncatedRecord) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid record in transaction log segment %s: %w", name, err)
+		}
+
+		if e.Sequence > to {
+			return true, nil
+		}
+		if e.Sequence > from {
+			if err = fn(e); err != nil {
+				return true, err
+			}
+		}
+	}
 }
@@ -0,0 +1,237 @@
+package cavee
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, dir string, opts FileTransactionLoggerOptions) TransactionLogger {
+	t.Helper()
+
+	logger, err := NewFileTransactionLogger(dir, opts)
+	if err != nil {
+		t.Fatalf("failed to open transaction log: %v", err)
+	}
+	return logger
+}
+
+// replayTestLog reads every event of a log, returning the error replay
+// stopped with, if any.
+func replayTestLog(logger TransactionLogger) (events []Event, err error) {
+	eventsCh, errorsCh := logger.ReadEvents()
+	for e := range eventsCh {
+		events = append(events, e)
+	}
+	return events, <-errorsCh
+}
+
+// writeTestLog writes events to a new log in dir and closes it.
+func writeTestLog(t *testing.T, dir string, opts FileTransactionLoggerOptions, events ...Event) {
+	t.Helper()
+
+	logger := openTestLog(t, dir, opts)
+	if _, err := replayTestLog(logger); err != nil {
+		t.Fatalf("failed to replay empty log: %v", err)
+	}
+	logger.Run()
+	for _, e := range events {
+		if result := <-logger.WriteEvent(e); result.Err != nil {
+			t.Fatalf("failed to write event: %v", result.Err)
+		}
+	}
+	if err := logger.Close(context.Background()); err != nil {
+		t.Fatalf("failed to close log: %v", err)
+	}
+}
+
+func testSegment(t *testing.T, dir string) string {
+	t.Helper()
+
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("expected one segment, got %v (%v)", segments, err)
+	}
+	return filepath.Join(dir, segments[0])
+}
+
+func TestFileTransactionLoggerRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	written := []Event{
+		{Type: EventTypePut, Namespace: "users", Key: "alice", Value: "v1", ContentType: "text/plain", Tags: []string{"a", "b"}, Time: at, Origin: "node-1", Principal: "admin"},
+		{Type: EventTypePut, Key: "bin", Value: "\x00\xff\x01"},
+		{Type: EventTypeDelete, Namespace: "users", Key: "alice", Time: at},
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts FileTransactionLoggerOptions
+	}{
+		{name: "plain"},
+		{name: "encrypted", opts: FileTransactionLoggerOptions{EncryptionKey: bytes.Repeat([]byte{7}, 32)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestLog(t, dir, tc.opts, written...)
+
+			if tc.opts.EncryptionKey != nil {
+				data, err := os.ReadFile(testSegment(t, dir))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(data, []byte("alice")) {
+					t.Error("encrypted segment holds a key in the clear")
+				}
+			}
+
+			logger := openTestLog(t, dir, tc.opts)
+			defer logger.Close(context.Background())
+			events, err := replayTestLog(logger)
+			if err != nil {
+				t.Fatalf("replay failed: %v", err)
+			}
+			if len(events) != len(written) {
+				t.Fatalf("replayed %d events, want %d", len(events), len(written))
+			}
+			for i, e := range events {
+				want := written[i]
+				want.Sequence = uint64(i + 1)
+				if e.Sequence != want.Sequence || e.Type != want.Type || e.Namespace != want.Namespace || e.Key != want.Key ||
+					e.Value != want.Value || e.ContentType != want.ContentType || !slices.Equal(e.Tags, want.Tags) ||
+					!e.Time.Equal(want.Time) || e.Origin != want.Origin || e.Principal != want.Principal {
+					t.Errorf("event %d = %+v, want %+v", i, e, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileTransactionLoggerTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	writeTestLog(t, dir, FileTransactionLoggerOptions{},
+		Event{Type: EventTypePut, Key: "a", Value: "1"},
+		Event{Type: EventTypePut, Key: "b", Value: "2"},
+	)
+	segment := testSegment(t, dir)
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An append interrupted by a crash leaves part of a record behind.
+	record, err := encodeRecord(Event{Sequence: 3, Type: EventTypePut, Key: "c", Value: "3"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(record[:len(record)/2])
+	f.Close()
+
+	logger := openTestLog(t, dir, FileTransactionLoggerOptions{})
+	defer logger.Close(context.Background())
+	events, err := replayTestLog(logger)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("replayed %d events, want 2", len(events))
+	}
+	if after, _ := os.Stat(segment); after.Size() != info.Size() {
+		t.Errorf("segment is %d bytes after replay, want %d", after.Size(), info.Size())
+	}
+}
+
+func TestFileTransactionLoggerReportsCorruption(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// corrupt damages the second of three records, which starts at
+		// offset in data.
+		corrupt func(data []byte, offset int)
+	}{
+		{
+			name: "checksum",
+			corrupt: func(data []byte, offset int) {
+				data[offset+3] ^= 0xff
+			},
+		},
+		{
+			// A length prefix that runs past the end of the segment looks
+			// like a torn tail, but the third record follows it.
+			name: "length prefix",
+			corrupt: func(data []byte, offset int) {
+				data[offset] = 0x7f
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestLog(t, dir, FileTransactionLoggerOptions{},
+				Event{Type: EventTypePut, Key: "a", Value: "1"},
+				Event{Type: EventTypePut, Key: "b", Value: "2"},
+				Event{Type: EventTypePut, Key: "c", Value: "3"},
+			)
+			segment := testSegment(t, dir)
+			data, err := os.ReadFile(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := encodeRecord(Event{Sequence: 1, Type: EventTypePut, Key: "a", Value: "1"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := len(encodeSegmentHeader(0)) + len(first)
+			tc.corrupt(data, offset)
+			if err = os.WriteFile(segment, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			logger := openTestLog(t, dir, FileTransactionLoggerOptions{})
+			defer logger.Close(context.Background())
+			events, err := replayTestLog(logger)
+
+			var corrupt *CorruptRecordError
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("replay returned %v, want a CorruptRecordError", err)
+			}
+			if corrupt.Offset != int64(offset) || corrupt.Sequence != 2 {
+				t.Errorf("corruption reported at offset %d, sequence %d; want %d, 2", corrupt.Offset, corrupt.Sequence, offset)
+			}
+			if len(events) != 1 {
+				t.Errorf("replayed %d events before the corrupt record, want 1", len(events))
+			}
+			if after, _ := os.ReadFile(segment); !bytes.Equal(after, data) {
+				t.Error("corrupt segment was modified")
+			}
+		})
+	}
+}
+
+func TestReadRecordMalformedPayload(t *testing.T) {
+	record, err := encodeRecord(Event{Sequence: 1, Type: EventTypePut, Key: "key", Value: "value"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key claims more bytes than the payload holds, under a valid
+	// checksum.
+	payload := bytes.Clone(record[1 : len(record)-4])
+	payload[2] = 0x7f
+	if _, err = openRecord(payload, crc32.ChecksumIEEE(payload), nil); !errors.Is(err, errMalformedPayload) || errors.Is(err, errTruncatedRecord) {
+		t.Errorf("openRecord returned %v, want errMalformedPayload", err)
+	}
+
+	if _, _, err = readRecord(bufio.NewReader(bytes.NewReader(record[:len(record)-1])), nil); !errors.Is(err, errTruncatedRecord) {
+		t.Errorf("readRecord of a cut record returned %v, want errTruncatedRecord", err)
+	}
+}
@@ -0,0 +1,364 @@
+package cavee
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultTransformTimeout = 100 * time.Millisecond
+	// defaultTransformMemory is the memory a transform may grow to, in
+	// 64 KiB pages, which is 16 MiB.
+	defaultTransformMemory = 256
+	// wasmMaxPages is the most memory a WebAssembly module can address.
+	wasmMaxPages = 65536
+)
+
+var ErrValueRejected = errors.New("value rejected")
+
+// errTransformFailed is returned when a transform fails other than by
+// rejecting the value, and errTransformedTooLarge when a write transform
+// leaves a value larger than -max-value-size.
+var (
+	errTransformFailed     = errors.New("value transform failed")
+	errTransformedTooLarge = errors.New("transformed value too large")
+)
+
+// TransformConfig is a transform in a transforms file: a WebAssembly module
+// that values of keys in the namespace are passed through, on write or on
+// read. Timeout bounds how long a call may run, as "50ms", and MaxMemory
+// the number of 64 KiB pages its memory may grow to.
+type TransformConfig struct {
+	Namespace string `yaml:"namespace"`
+	// Module is the path of the .wasm file, relative to the transforms file.
+	Module    string        `yaml:"module"`
+	On        string        `yaml:"on"`
+	Timeout   time.Duration `yaml:"timeout"`
+	MaxMemory uint32        `yaml:"max_memory"`
+}
+
+type TransformsFile struct {
+	Transforms []TransformConfig `yaml:"transforms"`
+}
+
+func LoadTransformsFile(filename string) (*TransformsFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transforms file: %w", err)
+	}
+
+	var f TransformsFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse transforms file: %w", err)
+	}
+
+	for i, t := range f.Transforms {
+		if !filepath.IsAbs(t.Module) {
+			f.Transforms[i].Module = filepath.Join(filepath.Dir(filename), t.Module)
+		}
+	}
+
+	return &f, nil
+}
+
+// transform is a loaded transform, compiled by wazero in a runtime of its
+// own that bounds the memory of its instances. A module gets a fresh
+// instance for every value, so nothing carries over from one value to the
+// next, and a call that runs past its timeout, or whose request goes away,
+// is stopped.
+//
+// A module exports its memory, alloc(size i32) i32, which returns where the
+// host can write a value of that size, and transform(ptr i32, len i32) i64,
+// which returns where the transformed value is, in the high 32 bits, and its
+// length, in the low 32. It can import cavee.reject(ptr i32, len i32) to
+// reject the value with the message at ptr, and nothing else.
+type transform struct {
+	config  TransformConfig
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+}
+
+// Transforms holds the transforms of each namespace, in the order they are
+// applied.
+type Transforms struct {
+	write, read map[string][]*transform
+}
+
+func NewTransforms(configs []TransformConfig) (*Transforms, error) {
+	t := &Transforms{write: make(map[string][]*transform), read: make(map[string][]*transform)}
+
+	for _, config := range configs {
+		if config.Timeout <= 0 {
+			config.Timeout = defaultTransformTimeout
+		}
+		if config.MaxMemory == 0 {
+			config.MaxMemory = defaultTransformMemory
+		}
+
+		var transforms map[string][]*transform
+		switch config.On {
+		case "write":
+			transforms = t.write
+		case "read":
+			transforms = t.read
+		default:
+			t.Close(context.Background())
+			return nil, fmt.Errorf("transform %s: on must be write or read, not %q", config.Module, config.On)
+		}
+
+		tr, err := loadTransform(config)
+		if err != nil {
+			t.Close(context.Background())
+			return nil, err
+		}
+		transforms[config.Namespace] = append(transforms[config.Namespace], tr)
+	}
+
+	return t, nil
+}
+
+func loadTransform(config TransformConfig) (*transform, error) {
+	if config.MaxMemory > wasmMaxPages {
+		return nil, fmt.Errorf("transform %s: max_memory must be at most %d pages", config.Module, wasmMaxPages)
+	}
+	b, err := os.ReadFile(config.Module)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transform module: %w", err)
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(config.MaxMemory).
+		WithCloseOnContextDone(true))
+	tr := &transform{config: config, runtime: runtime}
+	if err = tr.compile(ctx, b); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to load transform module %s: %w", config.Module, err)
+	}
+	return tr, nil
+}
+
+// compile compiles the module and checks that it has the exports and
+// imports of a transform.
+func (tr *transform) compile(ctx context.Context, b []byte) error {
+	_, err := tr.runtime.NewHostModuleBuilder("cavee").
+		NewFunctionBuilder().WithFunc(rejectValue).Export("reject").
+		Instantiate(ctx)
+	if err != nil {
+		return err
+	}
+	if tr.module, err = tr.runtime.CompileModule(ctx, b); err != nil {
+		return err
+	}
+
+	for _, f := range tr.module.ImportedFunctions() {
+		if module, name, _ := f.Import(); module != "cavee" || name != "reject" {
+			return fmt.Errorf("unknown import %s.%s", module, name)
+		}
+	}
+	if _, ok := tr.module.ExportedMemories()["memory"]; !ok {
+		return errors.New("module does not export memory")
+	}
+	exports := tr.module.ExportedFunctions()
+	for name, signature := range map[string][2][]api.ValueType{
+		"alloc":     {{api.ValueTypeI32}, {api.ValueTypeI32}},
+		"transform": {{api.ValueTypeI32, api.ValueTypeI32}, {api.ValueTypeI64}},
+	} {
+		f, ok := exports[name]
+		if !ok {
+			return fmt.Errorf("module does not export %s", name)
+		}
+		if !slices.Equal(f.ParamTypes(), signature[0]) || !slices.Equal(f.ResultTypes(), signature[1]) {
+			return fmt.Errorf("%s must take %s and return %s", name, wasmTypes(signature[0]), wasmTypes(signature[1]))
+		}
+	}
+	return nil
+}
+
+func wasmTypes(types []api.ValueType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = api.ValueTypeName(t)
+	}
+	return "(" + strings.Join(names, ", ") + ")"
+}
+
+// transformRejectKey is the context key of where cavee.reject records the
+// rejection of the value being transformed.
+type transformRejectKey struct{}
+
+// rejectValue is cavee.reject. It ends the call by panicking, which wazero
+// turns into the error of the call.
+func rejectValue(ctx context.Context, m api.Module, ptr, n uint32) {
+	msg, ok := m.Memory().Read(ptr, n)
+	if !ok {
+		panic(errors.New("cavee.reject: out of bounds memory access"))
+	}
+	rejected := ctx.Value(transformRejectKey{}).(*error)
+	*rejected = fmt.Errorf("%w: %s", ErrValueRejected, msg)
+	panic(*rejected)
+}
+
+// run passes value through the transform, stopping it when ctx is done.
+func (tr *transform) run(ctx context.Context, value []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, tr.config.Timeout)
+	defer cancel()
+	var rejected error
+	ctx = context.WithValue(ctx, transformRejectKey{}, &rejected)
+
+	// Instances are anonymous, so that values can be transformed
+	// concurrently, and only the module's start section runs.
+	in, err := tr.runtime.InstantiateModule(ctx, tr.module, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close(context.Background())
+
+	results, err := in.ExportedFunction("alloc").Call(ctx, uint64(len(value)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if !in.Memory().Write(ptr, value) {
+		return nil, errors.New("alloc returned memory out of bounds")
+	}
+
+	results, err = in.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(value)))
+	if rejected != nil {
+		return nil, rejected
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, ok := in.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, errors.New("transform returned memory out of bounds")
+	}
+	return bytes.Clone(out), nil
+}
+
+// Close releases the compiled modules of the transforms.
+func (t *Transforms) Close(ctx context.Context) error {
+	var errs []error
+	for _, transforms := range []map[string][]*transform{t.write, t.read} {
+		for _, trs := range transforms {
+			for _, tr := range trs {
+				errs = append(errs, tr.runtime.Close(ctx))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyTransforms passes value through the transforms of ns for a write or a
+// read, in turn.
+func (s *Server) applyTransforms(ctx context.Context, ns string, write bool, value string) (string, error) {
+	if s.transforms == nil {
+		return value, nil
+	}
+
+	transforms := s.transforms.read[ns]
+	if write {
+		transforms = s.transforms.write[ns]
+	}
+	for _, tr := range transforms {
+		out, err := tr.run(ctx, []byte(value))
+		if errors.Is(err, ErrValueRejected) {
+			return "", err
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "value transform failed",
+				slog.String("module", tr.config.Module),
+				slog.String("namespace", ns),
+				slog.String("error", err.Error()),
+			)
+			return "", fmt.Errorf("%w: %s: %w", errTransformFailed, tr.config.Module, err)
+		}
+		value = string(out)
+	}
+
+	return value, nil
+}
+
+// transformEvent passes the values an event writes through the write
+// transforms of its namespace: that of a put, the part an append adds, and
+// those of the puts of a transaction. Every logged write goes through it,
+// so no route can skip a module rejecting values.
+func (s *Server) transformEvent(ctx context.Context, e *Event) error {
+	if s.transforms == nil || len(s.transforms.write[e.Namespace]) == 0 {
+		return nil
+	}
+
+	transform := func(value string) (string, error) {
+		value, err := s.applyTransforms(ctx, e.Namespace, true, value)
+		if err != nil {
+			return "", err
+		}
+		if maxSize := s.config.MaxValueSize; maxSize > 0 && int64(len(value)) > maxSize {
+			return "", fmt.Errorf("%w: %d bytes, more than the limit of %d", errTransformedTooLarge, len(value), maxSize)
+		}
+		return value, nil
+	}
+
+	var err error
+	switch e.Type {
+	case EventTypePut, EventTypeAppend:
+		e.Value, err = transform(e.Value)
+	case EventTypeTxn:
+		var writes []txnOp
+		if writes, err = decodeTxnWrites(e.Value); err != nil {
+			return err
+		}
+		for i := range writes {
+			if writes[i].Op == txnOpPut {
+				if writes[i].Value, err = transform(writes[i].Value); err != nil {
+					return err
+				}
+			}
+		}
+		var value []byte
+		if value, err = json.Marshal(writes); err == nil {
+			e.Value = string(value)
+		}
+	}
+
+	return err
+}
+
+// readValue passes a value on its way to a client through the read
+// transforms of its namespace. Every response carrying a stored value goes
+// through it, so no route can skip a module redacting values; reads made to
+// change a value work on the value as stored.
+func (s *Server) readValue(ctx context.Context, ns, value string) (string, error) {
+	return s.applyTransforms(ctx, ns, false, value)
+}
+
+// writeTransformError reports a value a transform rejected or failed on, if
+// err is one, and reports whether it was.
+func writeTransformError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, ErrValueRejected):
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeValueRejected, err.Error())
+	case errors.Is(err, errTransformedTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge, err.Error())
+	case errors.Is(err, errTransformFailed):
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, errTransformFailed.Error())
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package cavee_test
+
+import (
+	"encoding/binary"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// transformModule assembles a WebAssembly module of the form transforms
+// take. Its alloc always returns address 1024, its transform has the body
+// code, locals first, and data is placed at address 0.
+func transformModule(code, data []byte) []byte {
+	section := func(id byte, content ...[]byte) []byte {
+		b := []byte{id}
+		body := []byte{}
+		for _, c := range content {
+			body = append(body, c...)
+		}
+		return append(binary.AppendUvarint(b, uint64(len(body))), body...)
+	}
+	name := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	body := func(code []byte) []byte {
+		return append(binary.AppendUvarint(nil, uint64(len(code))), code...)
+	}
+
+	module := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(0x01, []byte{
+		0x03,
+		0x60, 0x02, 0x7f, 0x7f, 0x00, // reject(ptr, len)
+		0x60, 0x01, 0x7f, 0x01, 0x7f, // alloc(size) ptr
+		0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, // transform(ptr, len) result
+	})...)
+	module = append(module, section(0x02, []byte{0x01}, name("cavee"), name("reject"), []byte{0x00, 0x00})...)
+	module = append(module, section(0x03, []byte{0x02, 0x01, 0x02})...)
+	module = append(module, section(0x05, []byte{0x01, 0x00, 0x01})...)
+	module = append(module, section(0x07, []byte{0x03},
+		name("memory"), []byte{0x02, 0x00},
+		name("alloc"), []byte{0x00, 0x01},
+		name("transform"), []byte{0x00, 0x02},
+	)...)
+	module = append(module, section(0x0a, []byte{0x02},
+		body([]byte{0x00, 0x41, 0x80, 0x08, 0x0b}),
+		body(code),
+	)...)
+	module = append(module, section(0x0b, []byte{0x01, 0x00, 0x41, 0x00, 0x0b}, body(data))...)
+	return module
+}
+
+// rejectBang rejects values holding a "!", and passes the others through.
+var rejectBang = []byte{
+	0x01, 0x01, 0x7f, // i, an i32
+	0x02, 0x40, 0x03, 0x40, // block, loop
+	0x20, 0x02, 0x20, 0x01, 0x4f, 0x0d, 0x01, // break out once i >= len
+	0x20, 0x00, 0x20, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, '!', 0x46, // value[i] == '!'
+	0x04, 0x40, 0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x0c, 0x02, 0x0b, // reject the value
+	0x20, 0x02, 0x41, 0x01, 0x6a, 0x21, 0x02, 0x0c, 0x00, // i++
+	0x0b, 0x0b,
+	0x20, 0x00, 0xad, 0x42, 0x20, 0x86, 0x20, 0x01, 0xad, 0x84, // ptr<<32 | len
+	0x0b,
+}
+
+// redactedValue is what the read transform of startTransformed turns every
+// value into.
+const redactedValue = `"redacted"`
+
+// redact returns redactedValue, placed at address 0.
+var redact = []byte{0x00, 0x42, byte(len(redactedValue)), 0x0b}
+
+// startTransformed starts a server rejecting written values holding a "!"
+// and redacting every value read in the default namespace, with the scripts
+// get, which returns the value of its key, and put, which writes the value
+// it is given.
+func startTransformed(t *testing.T) *caveetest.Instance {
+	t.Helper()
+
+	dir := writeFiles(t, map[string]string{
+		"write.wasm": string(transformModule(rejectBang, []byte("rejected"))),
+		"read.wasm":  string(transformModule(redact, []byte(redactedValue))),
+		"transforms.yaml": `transforms:
+  - namespace: ""
+    module: write.wasm
+    on: write
+  - namespace: ""
+    module: read.wasm
+    on: read
+`,
+		"scripts/get.star": getScript,
+		"scripts/put.star": "def run(keys, args):\n    kv.put(keys[0], args[0])\n",
+	})
+
+	return caveetest.Start(t, func(c *cavee.Config) {
+		c.TransformsFile = filepath.Join(dir, "transforms.yaml")
+		c.ScriptsDir = filepath.Join(dir, "scripts")
+		c.MVCCRetention = 100
+	})
+}
+
+// No route writing a value may skip the write transforms.
+func TestTransformsOnEveryWrite(t *testing.T) {
+	inst := startTransformed(t)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/doc", `{"a":1}`, http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/text", "a", http.StatusCreated)
+
+	session := beginSession(t, inst)
+	mustRequest(t, inst, http.MethodPut, "/v1/sessions/"+session+"/key/s", "!", http.StatusNoContent)
+
+	for _, tc := range []struct {
+		name, method, path, body, contentType string
+		status                                int
+	}{
+		{name: "PUT", method: "PUT", path: "/v1/key/k", body: "!", status: http.StatusUnprocessableEntity},
+		{name: "PATCH", method: "PATCH", path: "/v1/key/doc", body: `{"a":"!"}`, contentType: "application/merge-patch+json", status: http.StatusUnprocessableEntity},
+		{name: "PUT json", method: "PUT", path: "/v1/key/doc/json?path=$.a", body: `"!"`, status: http.StatusUnprocessableEntity},
+		{name: "append", method: "POST", path: "/v1/key/text/append", body: "!", status: http.StatusUnprocessableEntity},
+		{name: "import", method: "POST", path: "/v1/import", body: `{"key":"i","value":"!"}`, status: http.StatusUnprocessableEntity},
+		{name: "txn", method: "POST", path: "/v1/txn", body: `{"then":[{"op":"put","key":"t","value":"!"}]}`, status: http.StatusUnprocessableEntity},
+		{name: "session commit", method: "POST", path: "/v1/sessions/" + session + "/commit", status: http.StatusUnprocessableEntity},
+		{name: "script", method: "POST", path: "/v1/scripts/put", body: `{"keys":["p"],"args":["!"]}`, status: http.StatusUnprocessableEntity},
+		{name: "etcd put", method: "POST", path: "/v3/kv/put", body: `{"key":"` + etcdBase64("e") + `","value":"` + etcdBase64("!") + `"}`, status: http.StatusBadRequest},
+	} {
+		header := http.Header{}
+		if tc.contentType != "" {
+			header.Set("Content-Type", tc.contentType)
+		}
+		if resp, b := doRequest(t, inst, tc.method, tc.path, tc.body, header); resp.StatusCode != tc.status {
+			t.Errorf("%s answered %d, want %d: %s", tc.name, resp.StatusCode, tc.status, b)
+		}
+	}
+
+	for _, key := range []string{"k", "i", "t", "s", "p", "e"} {
+		mustRequest(t, inst, http.MethodGet, "/v1/key/"+key, "", http.StatusNotFound)
+	}
+}
+
+// No route returning a value may skip the read transforms.
+func TestTransformsOnEveryRead(t *testing.T) {
+	inst := startTransformed(t)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/k", "secret", http.StatusCreated)
+	session := beginSession(t, inst)
+
+	w := openWatch(t, inst, "prefix=w")
+	mustRequest(t, inst, http.MethodPut, "/v1/key/w", "secret", http.StatusCreated)
+	if msg := w.next(t); msg.Value != redactedValue {
+		t.Errorf("watch sent %q, want it redacted", msg.Value)
+	}
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+	}{
+		{name: "GET", method: "GET", path: "/v1/key/k", status: http.StatusOK},
+		{name: "GET json", method: "GET", path: "/v1/key/k/json", status: http.StatusOK},
+		{name: "as_of", method: "GET", path: "/v1/key/k?as_of=1", status: http.StatusOK},
+		{name: "export", method: "GET", path: "/v1/export", status: http.StatusOK},
+		{name: "txn", method: "POST", path: "/v1/txn", body: `{"then":[{"op":"get","key":"k"}]}`, status: http.StatusOK},
+		{name: "session get", method: "GET", path: "/v1/sessions/" + session + "/key/k", status: http.StatusOK},
+		{name: "script", method: "POST", path: "/v1/scripts/get", body: `{"keys":["k"],"args":[]}`, status: http.StatusOK},
+		{name: "etcd range", method: "POST", path: "/v3/kv/range", body: `{"key":"` + etcdBase64("k") + `"}`, status: http.StatusOK},
+		{name: "PUT return=old", method: "PUT", path: "/v1/key/k?return=old", body: "secret", status: http.StatusOK},
+		{name: "DELETE return=value", method: "DELETE", path: "/v1/key/k?return=value", status: http.StatusOK},
+	} {
+		resp, b := doRequest(t, inst, tc.method, tc.path, tc.body, nil)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s answered %d, want %d: %s", tc.name, resp.StatusCode, tc.status, b)
+			continue
+		}
+		body := string(b)
+		if strings.Contains(body, "secret") || strings.Contains(body, etcdBase64("secret")) ||
+			!strings.Contains(body, "redacted") && !strings.Contains(body, etcdBase64(redactedValue)) {
+			t.Errorf("%s answered %s, want the value redacted", tc.name, b)
+		}
+	}
+}
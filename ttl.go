@@ -0,0 +1,191 @@
+package cavee
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ttlResponse struct {
+	// TTL is the time left before the key expires in seconds, rounded as
+	// Redis does, or -1 if the key does not expire.
+	TTL       int64      `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Sliding   bool       `json:"sliding,omitempty"`
+}
+
+// GetTTLHandler reports how long a key has left to live, with the same
+// values as the Redis TTL command, except that a missing key is a 404
+// rather than -2.
+func (s *Server) GetTTLHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	resp := ttlResponse{TTL: -1, Sliding: entry.Sliding > 0}
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt := entry.ExpiresAt.UTC()
+		resp.TTL, resp.ExpiresAt = (time.Until(expiresAt).Milliseconds()+500)/1000, &expiresAt
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// expiryValue encodes an expiry time, and the TTL of a key with sliding
+// expiry, as the Value of an expire event. Events hold the time rather than
+// the TTL, so that replaying them later does not extend it.
+func expiryValue(t time.Time, sliding time.Duration) string {
+	value := strconv.FormatInt(t.UnixNano(), 10)
+	if sliding > 0 {
+		value += " " + strconv.FormatInt(int64(sliding), 10)
+	}
+
+	return value
+}
+
+func parseExpiry(value string) (t time.Time, sliding time.Duration, err error) {
+	expiresAt, slidingTTL, hasSliding := strings.Cut(value, " ")
+
+	nanos, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if hasSliding {
+		n, err := strconv.ParseInt(slidingTTL, 10, 64)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		sliding = time.Duration(n)
+	}
+
+	return time.Unix(0, nanos), sliding, nil
+}
+
+type expireRequest struct {
+	// TTL is the time to live in seconds.
+	TTL int64 `json:"ttl"`
+	// Sliding makes reads of the key refresh the TTL.
+	Sliding bool `json:"sliding"`
+}
+
+// ExpireHandler sets a TTL on an existing key, replacing any it had, without
+// rewriting its value. Writing the key again clears the TTL.
+func (s *Server) ExpireHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	var req expireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.TTL <= 0 {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "ttl must be a positive number of seconds")
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	if _, err := s.store.Get(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	ttl := time.Duration(req.TTL) * time.Second
+	var sliding time.Duration
+	if req.Sliding {
+		sliding = ttl
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeExpire, Namespace: ns, Key: key, Value: expiryValue(expiresAt, sliding), Time: now})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.SetExpiry(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	expiresAt = expiresAt.UTC()
+	setSequenceHeader(w, e.Sequence)
+	writeJSON(w, http.StatusOK, ttlResponse{TTL: req.TTL, ExpiresAt: &expiresAt, Sliding: req.Sliding})
+}
+
+// refreshExpiry pushes back the expiry of a key with sliding expiry that has
+// just been read. To keep reads from logging an event each, the expiry is
+// only logged again once less than half of the TTL is left, so a key lives
+// for between half and all of its TTL after it was last read. Failures are
+// logged and otherwise ignored, since the read itself succeeded.
+//
+// Followers only log the leader's events, so that they keep its sequence
+// numbers, and reads they serve do not push back the expiry.
+func (s *Server) refreshExpiry(r *http.Request, ns, key string, entry Entry) {
+	if time.Until(entry.ExpiresAt) >= entry.Sliding/2 || s.readOnly.Load() || s.logFailure.Load() != nil || s.follower != nil {
+		return
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	// The key may have been written or refreshed since it was read.
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil || entry.Sliding == 0 || time.Until(entry.ExpiresAt) >= entry.Sliding/2 {
+		return
+	}
+
+	now := time.Now()
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypeExpire, Namespace: ns, Key: key, Value: expiryValue(now.Add(entry.Sliding), entry.Sliding), Time: now})
+	if err == nil {
+		err = s.store.SetExpiry(r.Context(), e)
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "failed to refresh key expiry", slog.String("key", key), slog.String("error", err.Error()))
+	}
+}
+
+// PersistHandler removes the TTL of a key, so that it no longer expires.
+// Nothing is logged for a key without one.
+func (s *Server) PersistHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	entry, err := s.store.Get(r.Context(), ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if entry.ExpiresAt.IsZero() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	e, err := s.writeEvent(r.Context(), Event{Type: EventTypePersist, Namespace: ns, Key: key, Time: time.Now()})
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+	if err = s.store.SetExpiry(r.Context(), e); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSequenceHeader(w, e.Sequence)
+	w.WriteHeader(http.StatusNoContent)
+}
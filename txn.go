@@ -0,0 +1,390 @@
+package cavee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxTxnOps is the most conditions and operations, together, a transaction
+// may have.
+const maxTxnOps = 128
+
+// Transaction operations.
+const (
+	txnOpGet    = "get"
+	txnOpPut    = "put"
+	txnOpDelete = "delete"
+)
+
+// txnCompare is a condition a transaction checks against a key. Exactly one
+// of Version and Value is set. A Version of 0 holds when the key does not
+// exist; a Value only holds when it does.
+type txnCompare struct {
+	Key     string  `json:"key"`
+	Version *uint64 `json:"version,omitempty"`
+	Value   *string `json:"value,omitempty"`
+}
+
+// txnOp is an operation of a transaction. The puts and deletes of the
+// branch a transaction takes are also what its log event holds. ExpiresAt,
+// for puts, gives the key an expiry in the same step as its value.
+type txnOp struct {
+	Op          string     `json:"op"`
+	Key         string     `json:"key"`
+	Value       string     `json:"value,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []txnCompare `json:"compare"`
+	Then    []txnOp      `json:"then"`
+	Else    []txnOp      `json:"else"`
+}
+
+// txnResult is the outcome of an operation. Gets report whether the key was
+// found and, if so, its value; puts and deletes only their key.
+type txnResult struct {
+	Op          string   `json:"op"`
+	Key         string   `json:"key"`
+	Found       *bool    `json:"found,omitempty"`
+	Value       string   `json:"value,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Version     uint64   `json:"version,omitempty"`
+}
+
+type txnResponse struct {
+	Namespace string `json:"namespace,omitempty"`
+	// Succeeded tells whether every condition held, and so whether the then
+	// or the else branch was taken.
+	Succeeded bool        `json:"succeeded"`
+	Results   []txnResult `json:"results"`
+	// Sequence is that of the event the transaction was logged as, if it
+	// wrote anything.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+var errInvalidTxn = errors.New("invalid transaction")
+
+// check checks the conditions and operations of a transaction, sorting the
+// tags of its puts, and returns every key it names.
+func (req *txnRequest) check(maxKeyLength int) (keys []string, err error) {
+	if n := len(req.Compare) + len(req.Then) + len(req.Else); n > maxTxnOps {
+		return nil, fmt.Errorf("%w: %d conditions and operations, more than the limit of %d", errInvalidTxn, n, maxTxnOps)
+	}
+
+	checkKey := func(key string) error {
+		if key == "" {
+			return fmt.Errorf("%w: key is empty", errInvalidTxn)
+		}
+		if maxKeyLength > 0 && len(key) > maxKeyLength {
+			return fmt.Errorf("%w: key is %d bytes long, more than the limit of %d", errInvalidTxn, len(key), maxKeyLength)
+		}
+		keys = append(keys, key)
+		return nil
+	}
+
+	for _, c := range req.Compare {
+		if err = checkKey(c.Key); err != nil {
+			return nil, err
+		}
+		if (c.Version == nil) == (c.Value == nil) {
+			return nil, fmt.Errorf("%w: condition on %q must have exactly one of version and value", errInvalidTxn, c.Key)
+		}
+	}
+
+	for _, branch := range [][]txnOp{req.Then, req.Else} {
+		written := make(map[string]bool)
+		for i := range branch {
+			op := &branch[i]
+			if err = checkKey(op.Key); err != nil {
+				return nil, err
+			}
+
+			switch op.Op {
+			case txnOpGet:
+				continue
+			case txnOpPut:
+				if op.ContentType != "" {
+					if _, _, err = mime.ParseMediaType(op.ContentType); err != nil {
+						return nil, fmt.Errorf("%w: put of %q: invalid content_type: %w", errInvalidTxn, op.Key, err)
+					}
+				}
+				if op.Tags, err = parseTags(strings.Join(op.Tags, ",")); err != nil {
+					return nil, fmt.Errorf("%w: put of %q: %w", errInvalidTxn, op.Key, err)
+				}
+			case txnOpDelete:
+			default:
+				return nil, fmt.Errorf("%w: invalid op %q: must be get, put or delete", errInvalidTxn, op.Op)
+			}
+
+			// A key is written at most once, so the event holds one change
+			// per key, as the other log events do.
+			if written[op.Key] {
+				return nil, fmt.Errorf("%w: %q is written more than once", errInvalidTxn, op.Key)
+			}
+			written[op.Key] = true
+		}
+	}
+
+	return keys, nil
+}
+
+// holds reports whether a condition holds for a key, given its entry if it
+// exists.
+func (c txnCompare) holds(entry Entry, exists bool) bool {
+	if c.Version != nil {
+		return (!exists && *c.Version == 0) || (exists && entry.Version == *c.Version)
+	}
+	return exists && entry.Value == *c.Value
+}
+
+// decodeTxnWrites decodes the writes held by a txn event.
+func decodeTxnWrites(value string) (writes []txnOp, err error) {
+	if err = json.Unmarshal([]byte(value), &writes); err != nil {
+		return nil, fmt.Errorf("invalid txn event: %w", err)
+	}
+	return writes, nil
+}
+
+// Txn applies a txn event that has been written to the transaction log,
+// making every write it holds at once.
+func (s *Store) Txn(ctx context.Context, e Event) (err error) {
+	slog.DebugContext(ctx, "applying transaction to store", slog.String("namespace", e.Namespace))
+
+	writes, err := decodeTxnWrites(e.Value)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	m, exists := s.namespaces[e.Namespace]
+	if !exists {
+		return ErrNoSuchNamespace
+	}
+	s.applyTxn(m, e, writes)
+	s.advance(e.Sequence)
+
+	return nil
+}
+
+// applyTxn must be called with the lock held.
+func (s *Store) applyTxn(m map[string]Entry, e Event, writes []txnOp) {
+	for _, op := range writes {
+		switch op.Op {
+		case txnOpPut:
+			s.put(m, Event{Sequence: e.Sequence, Type: EventTypePut, Namespace: e.Namespace, Key: op.Key, Value: op.Value, ContentType: op.ContentType, Tags: op.Tags, Time: e.Time})
+			if op.ExpiresAt != nil {
+				entry := m[op.Key]
+				entry.ExpiresAt = *op.ExpiresAt
+				m[op.Key] = entry
+				s.trackExpiry(e.Namespace, op.Key, entry.ExpiresAt)
+			}
+		case txnOpDelete:
+			s.remove(m, e.Namespace, op.Key, e.Sequence)
+		}
+	}
+}
+
+// TxnHandler runs a transaction on the keys of a namespace: if every
+// condition in compare holds, the operations in then are carried out, and
+// otherwise those in else. Every key it names is locked while it runs, so
+// the conditions cannot change before the writes are made, and the writes
+// are logged as a single event and seen by readers all at once. Gets see
+// the writes that come before them in the branch.
+func (s *Server) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req txnRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	keys, err := req.check(s.config.MaxKeyLength)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	unlock := s.store.LockKeys(ns, keys...)
+	defer unlock()
+
+	if !s.store.HasNamespace(ns) {
+		writeStoreError(w, r, ErrNoSuchNamespace)
+		return
+	}
+
+	// current holds the entries of the keys as the transaction goes, so
+	// that gets see the writes before them.
+	type state struct {
+		entry  Entry
+		exists bool
+	}
+	current := make(map[string]state, len(keys))
+	for _, key := range keys {
+		entry, err := s.store.Get(r.Context(), ns, key)
+		if err != nil && !errors.Is(err, ErrNoSuchKey) {
+			writeStoreError(w, r, err)
+			return
+		}
+		current[key] = state{entry, err == nil}
+	}
+
+	// A compare reads its key as surely as a get, so the pre-read hooks
+	// are run for both.
+	for _, c := range req.Compare {
+		if err = s.runPreReadHooks(r.Context(), ns, c.Key); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+
+	resp := txnResponse{Namespace: ns, Succeeded: true, Results: []txnResult{}}
+	for _, c := range req.Compare {
+		if !c.holds(current[c.Key].entry, current[c.Key].exists) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops, ok := req.Then, true
+	if !resp.Succeeded {
+		ops = req.Else
+	}
+
+	var writes []txnOp
+	for _, op := range ops {
+		if op.Op != txnOpGet {
+			writes = append(writes, op)
+		}
+	}
+
+	// The results are worked out before the writes are committed, so that
+	// a read transform failing on a value fails the transaction without
+	// writing. Gets of keys the transaction puts get its sequence once it
+	// has one.
+	now := time.Now()
+	var written []int
+	for _, op := range ops {
+		result := txnResult{Op: op.Op, Key: op.Key}
+
+		switch op.Op {
+		case txnOpGet:
+			if err = s.runPreReadHooks(r.Context(), ns, op.Key); err != nil {
+				writeStoreError(w, r, err)
+				return
+			}
+			st := current[op.Key]
+			result.Found = &st.exists
+			if st.exists {
+				if result.Value, err = s.readValue(r.Context(), ns, st.entry.Value); err != nil {
+					writeStoreError(w, r, err)
+					return
+				}
+				result.ContentType, result.Tags, result.Version = st.entry.ContentType, st.entry.Tags, st.entry.Version
+				if st.entry.Version == 0 {
+					written = append(written, len(resp.Results))
+				}
+			}
+		case txnOpPut:
+			current[op.Key] = state{Entry{Value: op.Value, ContentType: op.ContentType, Tags: op.Tags}, true}
+		case txnOpDelete:
+			current[op.Key] = state{}
+		}
+
+		resp.Results = append(resp.Results, result)
+	}
+
+	if len(writes) > 0 {
+		var e Event
+		if e, ok = s.commitTxn(w, r, ns, writes); !ok {
+			return
+		}
+		resp.Sequence, now = e.Sequence, e.Time
+		for _, i := range written {
+			resp.Results[i].Version = e.Sequence
+		}
+	}
+	if s.access != nil {
+		for _, result := range resp.Results {
+			if result.Op == txnOpGet && *result.Found {
+				s.access.read(ns, result.Key, now)
+			}
+		}
+	}
+
+	slog.InfoContext(r.Context(), "transaction applied",
+		slog.String("namespace", ns),
+		slog.Bool("succeeded", resp.Succeeded),
+		slog.Int("writes", len(writes)),
+	)
+
+	if resp.Sequence > 0 {
+		setSequenceHeader(w, resp.Sequence)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// commitTxn logs the writes of a transaction as a single event, applies it
+// and tells watchers about each write, writing the error response if it
+// fails. The caller holds the locks of the keys written.
+func (s *Server) commitTxn(w http.ResponseWriter, r *http.Request, ns string, writes []txnOp) (Event, bool) {
+	e, err := s.applyWrites(r.Context(), ns, writes)
+	if errors.Is(err, ErrEventUnsupported) || errors.Is(err, ErrLogQueueFull) {
+		writeLogError(w, r, err)
+		return Event{}, false
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return Event{}, false
+	}
+
+	return e, true
+}
+
+// applyWrites is commitTxn for callers that report errors their own way.
+func (s *Server) applyWrites(ctx context.Context, ns string, writes []txnOp) (Event, error) {
+	value, err := json.Marshal(writes)
+	if err != nil {
+		return Event{}, err
+	}
+
+	e, err := s.writeEvent(ctx, Event{Type: EventTypeTxn, Namespace: ns, Value: string(value), Time: time.Now()})
+	if err != nil {
+		return Event{}, err
+	}
+	if err = s.store.Txn(ctx, e); err != nil {
+		return Event{}, err
+	}
+
+	// Watchers are told of the values as logged, once transforms have been
+	// through them.
+	if writes, err = decodeTxnWrites(e.Value); err != nil {
+		return Event{}, err
+	}
+	for _, op := range writes {
+		if op.Op == txnOpPut {
+			s.notify(Event{Sequence: e.Sequence, Type: EventTypePut, Namespace: ns, Key: op.Key, Value: op.Value, ContentType: op.ContentType, Tags: op.Tags, Time: e.Time})
+		} else {
+			s.notify(Event{Sequence: e.Sequence, Type: EventTypeDelete, Namespace: ns, Key: op.Key, Time: e.Time})
+		}
+	}
+
+	return e, nil
+}
@@ -0,0 +1,631 @@
+package cavee
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values are encrypted with envelope encryption: every namespace has data
+// keys of its own, which encrypt its values, and which are only kept
+// wrapped by a key encryption key held outside cavee, in a KMS or behind a
+// command. Values are sealed before they are logged, so the transaction
+// log, snapshots and the store only hold ciphertext, and opened when they
+// are read.
+//
+// A sealed value is a sequence of frames, each naming the data key it was
+// sealed with, so that appends can add frames of their own and values
+// sealed with keys since rotated can still be read. Frames are text,
+//
+//	\x00cv1<key ID>:<base64 nonce and ciphertext>.
+//
+// since transaction events carry values in JSON, which only holds UTF-8.
+
+const (
+	// valueFrameMagic starts every frame of a sealed value. Values that do
+	// not start with it were written before encryption was turned on, and
+	// are read as they are.
+	valueFrameMagic = "\x00cv1"
+	valueKeySize    = 32
+	valueKMSTimeout = 10 * time.Second
+)
+
+var (
+	ErrValueDecrypt  = errors.New("failed to decrypt value")
+	ErrNoSuchDataKey = errors.New("no such data key")
+)
+
+// keyWrapper wraps and unwraps data keys with a key encryption key.
+type keyWrapper interface {
+	wrap(ctx context.Context, key []byte) ([]byte, error)
+	unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+	// name identifies the key encryption key, and is recorded with the data
+	// keys it wraps.
+	name() string
+}
+
+// localKeyWrapper wraps data keys with an AES key given to cavee itself,
+// which is as safe as the flag or environment holding it.
+type localKeyWrapper struct {
+	aead cipher.AEAD
+	id   string
+}
+
+func (w *localKeyWrapper) wrap(_ context.Context, key []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (w *localKeyWrapper) unwrap(_ context.Context, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < w.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:w.aead.NonceSize()], wrapped[w.aead.NonceSize():]
+	return w.aead.Open(nil, nonce, sealed, nil)
+}
+
+func (w *localKeyWrapper) name() string {
+	return w.id
+}
+
+// commandKeyWrapper wraps data keys by running shell commands that read a
+// key on stdin and print it wrapped or unwrapped, which is how cavee uses
+// GCP KMS (gcloud kms encrypt), age and the like, e.g.
+//
+//	age -e -r age1...        age -d -i key.txt
+type commandKeyWrapper struct {
+	wrapCommand, unwrapCommand string
+}
+
+func (w *commandKeyWrapper) run(ctx context.Context, command string, in []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+func (w *commandKeyWrapper) wrap(ctx context.Context, key []byte) ([]byte, error) {
+	out, err := w.run(ctx, w.wrapCommand, key)
+	if err != nil {
+		return nil, fmt.Errorf("key wrap command failed: %w", err)
+	}
+	return out, nil
+}
+
+func (w *commandKeyWrapper) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := w.run(ctx, w.unwrapCommand, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("key unwrap command failed: %w", err)
+	}
+	return out, nil
+}
+
+func (w *commandKeyWrapper) name() string {
+	return "command:" + w.wrapCommand
+}
+
+// awsKMSKeyWrapper wraps data keys with the Encrypt and Decrypt calls of AWS
+// KMS, made directly against its JSON API and signed like the S3 archiver's
+// requests.
+type awsKMSKeyWrapper struct {
+	keyID    string
+	region   string
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+func (w *awsKMSKeyWrapper) call(ctx context.Context, action string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	hash := sha256.Sum256(body)
+	signAWSRequest(req, "kms", w.region, w.creds, hex.EncodeToString(hash[:]), time.Now().UTC())
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &kmsErr) == nil && kmsErr.Type != "" {
+			return fmt.Errorf("kms %s: %s: %s", action, kmsErr.Type, kmsErr.Message)
+		}
+		return fmt.Errorf("kms %s: unexpected status %s", action, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (w *awsKMSKeyWrapper) wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var out struct {
+		CiphertextBlob []byte
+	}
+	err := w.call(ctx, "Encrypt", map[string]any{"KeyId": w.keyID, "Plaintext": key}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (w *awsKMSKeyWrapper) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext []byte
+	}
+	err := w.call(ctx, "Decrypt", map[string]any{"KeyId": w.keyID, "CiphertextBlob": wrapped}, &out)
+	return out.Plaintext, err
+}
+
+func (w *awsKMSKeyWrapper) name() string {
+	return "aws-kms:" + w.keyID
+}
+
+// newKeyWrapper creates the key wrapper selected by -value-encryption, or
+// returns nil if values are not encrypted.
+func newKeyWrapper(config *Config) (keyWrapper, error) {
+	switch config.ValueEncryption {
+	case "", "none":
+		return nil, nil
+	case "local":
+		encoded := config.ValueKEK
+		if encoded == "" {
+			encoded = os.Getenv("CAVEE_VALUE_KEK")
+		}
+		encoded, err := resolveSecret(config, encoded)
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeAESKey(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value key encryption key: %w", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// The key is named by a hash of it, so that data keys wrapped with
+		// another one are told apart without recording the key itself.
+		sum := sha256.Sum256(key)
+		return &localKeyWrapper{aead: aead, id: "local:" + hex.EncodeToString(sum[:4])}, nil
+	case "command":
+		if config.ValueKEKWrapCommand == "" || config.ValueKEKUnwrapCommand == "" {
+			return nil, fmt.Errorf("value-encryption=command requires value-kek-wrap-command and value-kek-unwrap-command")
+		}
+		return &commandKeyWrapper{wrapCommand: config.ValueKEKWrapCommand, unwrapCommand: config.ValueKEKUnwrapCommand}, nil
+	case "aws-kms":
+		if config.ValueKEK == "" {
+			return nil, fmt.Errorf("value-encryption=aws-kms requires value-kek, the KMS key ID or ARN")
+		}
+		endpoint := config.ValueKMSEndpoint
+		if endpoint == "" {
+			endpoint = "https://kms." + config.ValueKMSRegion + ".amazonaws.com/"
+		}
+		creds := awsCredentialsFromEnv()
+		if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return nil, fmt.Errorf("no kms credentials configured")
+		}
+		return &awsKMSKeyWrapper{
+			keyID:    config.ValueKEK,
+			region:   config.ValueKMSRegion,
+			endpoint: endpoint,
+			creds:    creds,
+			client:   &http.Client{Timeout: valueKMSTimeout},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown value encryption %q", config.ValueEncryption)
+	}
+}
+
+// DataKeyInfo describes a data key of a namespace, without the key itself.
+type DataKeyInfo struct {
+	ID string `json:"id"`
+	// KEK names the key encryption key the data key is wrapped with.
+	KEK     string    `json:"kek"`
+	Created time.Time `json:"created"`
+	// Current is set for the key new values are sealed with.
+	Current bool `json:"current"`
+}
+
+type dataKeyRecord struct {
+	ID      string    `json:"id"`
+	KEK     string    `json:"kek"`
+	Wrapped []byte    `json:"wrapped"`
+	Created time.Time `json:"created"`
+}
+
+// valueKeyringFile is the keyring as it is kept on disk: the wrapped data
+// keys of each namespace, oldest first.
+type valueKeyringFile struct {
+	Namespaces map[string][]dataKeyRecord `json:"namespaces"`
+}
+
+// ValueEncryption seals and opens values with the data keys of their
+// namespaces. A namespace gets its first data key when a value is first
+// written to it, and new ones when its key is rotated; the keys it had are
+// kept for the values they sealed.
+type ValueEncryption struct {
+	wrapper keyWrapper
+	path    string
+	// namespaces holds the namespaces whose values are encrypted, or is nil
+	// if all of them are.
+	namespaces map[string]bool
+
+	mu      sync.RWMutex
+	file    valueKeyringFile
+	keys    map[string]cipher.AEAD
+	current map[string]string
+}
+
+// NewValueEncryption loads the keyring at path, unwrapping every data key it
+// holds, which fails if the key encryption key cannot unwrap them.
+func NewValueEncryption(ctx context.Context, wrapper keyWrapper, path string, namespaces []string) (*ValueEncryption, error) {
+	v := &ValueEncryption{
+		wrapper: wrapper,
+		path:    path,
+		file:    valueKeyringFile{Namespaces: make(map[string][]dataKeyRecord)},
+		keys:    make(map[string]cipher.AEAD),
+		current: make(map[string]string),
+	}
+	if len(namespaces) > 0 {
+		v.namespaces = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			v.namespaces[ns] = true
+		}
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+	if err = json.Unmarshal(b, &v.file); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %w", err)
+	}
+	if v.file.Namespaces == nil {
+		v.file.Namespaces = make(map[string][]dataKeyRecord)
+	}
+
+	for ns, records := range v.file.Namespaces {
+		for _, record := range records {
+			key, err := wrapper.unwrap(ctx, record.Wrapped)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unwrap data key %s, wrapped with %s: %w", record.ID, record.KEK, err)
+			}
+			if v.keys[record.ID], err = newValueAEAD(key); err != nil {
+				return nil, fmt.Errorf("invalid data key %s: %w", record.ID, err)
+			}
+			v.current[ns] = record.ID
+		}
+	}
+
+	return v, nil
+}
+
+func newValueAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != valueKeySize {
+		return nil, fmt.Errorf("data key is %d bytes, not %d", len(key), valueKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts reports whether the values of namespace ns are encrypted.
+func (v *ValueEncryption) Encrypts(ns string) bool {
+	return v.namespaces == nil || v.namespaces[ns]
+}
+
+// newKey creates, wraps and saves a new data key for ns, which becomes the
+// one new values are sealed with. It must be called with mu held.
+func (v *ValueEncryption) newKey(ctx context.Context, ns string) (string, error) {
+	key := make([]byte, valueKeySize)
+	id := make([]byte, 8)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	wrapped, err := v.wrapper.wrap(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	aead, err := newValueAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	record := dataKeyRecord{ID: hex.EncodeToString(id), KEK: v.wrapper.name(), Wrapped: wrapped, Created: time.Now().UTC()}
+	v.file.Namespaces[ns] = append(v.file.Namespaces[ns], record)
+	if err = v.save(); err != nil {
+		v.file.Namespaces[ns] = v.file.Namespaces[ns][:len(v.file.Namespaces[ns])-1]
+		return "", err
+	}
+	v.keys[record.ID] = aead
+	v.current[ns] = record.ID
+
+	slog.Info("created data key", slog.String("namespace", ns), slog.String("key_id", record.ID), slog.String("kek", record.KEK))
+	return record.ID, nil
+}
+
+// save writes the keyring next to where it is kept and renames it into
+// place, so that a crash never leaves a keyring missing keys.
+func (v *ValueEncryption) save() error {
+	b, err := json.MarshalIndent(v.file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), filepath.Base(v.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), v.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save keyring: %w", err)
+	}
+
+	return nil
+}
+
+// Rotate gives ns a new data key, which seals the values written from then
+// on, and returns its ID.
+func (v *ValueEncryption) Rotate(ctx context.Context, ns string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.newKey(ctx, ns)
+}
+
+// Keys describes the data keys of ns, oldest first.
+func (v *ValueEncryption) Keys(ns string) []DataKeyInfo {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	infos := make([]DataKeyInfo, 0, len(v.file.Namespaces[ns]))
+	for _, record := range v.file.Namespaces[ns] {
+		infos = append(infos, DataKeyInfo{ID: record.ID, KEK: record.KEK, Created: record.Created, Current: record.ID == v.current[ns]})
+	}
+	return infos
+}
+
+// seal encrypts value with the current data key of ns, creating it if ns
+// has none yet.
+func (v *ValueEncryption) seal(ctx context.Context, ns, value string) (string, error) {
+	if !v.Encrypts(ns) {
+		return value, nil
+	}
+
+	v.mu.RLock()
+	id, ok := v.current[ns]
+	aead := v.keys[id]
+	v.mu.RUnlock()
+
+	if !ok {
+		v.mu.Lock()
+		var err error
+		if id, ok = v.current[ns]; !ok {
+			id, err = v.newKey(ctx, ns)
+		}
+		aead = v.keys[id]
+		v.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+
+	return valueFrameMagic + id + ":" + base64.StdEncoding.EncodeToString(sealed) + ".", nil
+}
+
+// open decrypts a value, returning it with the ID of the data key it was
+// sealed with, or of the last one for values appended to since a rotation.
+// Values that are not sealed are returned as they are, with no key ID.
+func (v *ValueEncryption) open(value string) (plain, keyID string, err error) {
+	if !strings.HasPrefix(value, valueFrameMagic) {
+		return value, "", nil
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	var b strings.Builder
+	for rest := value; rest != ""; {
+		if !strings.HasPrefix(rest, valueFrameMagic) {
+			return "", "", fmt.Errorf("%w: malformed frame", ErrValueDecrypt)
+		}
+		var encoded string
+		var ok bool
+		if keyID, rest, ok = strings.Cut(rest[len(valueFrameMagic):], ":"); !ok {
+			return "", "", fmt.Errorf("%w: truncated frame", ErrValueDecrypt)
+		}
+		if encoded, rest, ok = strings.Cut(rest, "."); !ok {
+			return "", "", fmt.Errorf("%w: truncated frame", ErrValueDecrypt)
+		}
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: malformed frame", ErrValueDecrypt)
+		}
+
+		aead, ok := v.keys[keyID]
+		if !ok {
+			return "", "", fmt.Errorf("%w: %w %s", ErrValueDecrypt, ErrNoSuchDataKey, keyID)
+		}
+		if len(sealed) < aead.NonceSize() {
+			return "", "", fmt.Errorf("%w: truncated frame", ErrValueDecrypt)
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %w", ErrValueDecrypt, err)
+		}
+		b.Write(plain)
+	}
+
+	return b.String(), keyID, nil
+}
+
+// sealEvent seals the values an event carries, if its namespace is
+// encrypted.
+func (v *ValueEncryption) sealEvent(ctx context.Context, e *Event) error {
+	if !v.Encrypts(e.Namespace) {
+		return nil
+	}
+
+	var err error
+	switch e.Type {
+	case EventTypePut, EventTypeAppend:
+		e.Value, err = v.seal(ctx, e.Namespace, e.Value)
+	case EventTypeTxn:
+		var writes []txnOp
+		if writes, err = decodeTxnWrites(e.Value); err != nil {
+			return err
+		}
+		for i := range writes {
+			if writes[i].Op == txnOpPut {
+				if writes[i].Value, err = v.seal(ctx, e.Namespace, writes[i].Value); err != nil {
+					return err
+				}
+			}
+		}
+		var value []byte
+		if value, err = json.Marshal(writes); err == nil {
+			e.Value = string(value)
+		}
+	}
+
+	return err
+}
+
+// openEntry opens the value of an entry, recording the data key it was
+// sealed with.
+func (v *ValueEncryption) openEntry(entry Entry) (Entry, error) {
+	var err error
+	entry.Value, entry.KeyID, err = v.open(entry.Value)
+	return entry, err
+}
+
+// openMessages opens the values of watch messages replayed from the
+// transaction log, which holds them sealed.
+func (s *Server) openMessages(msgs []WatchMessage) error {
+	if s.values == nil {
+		return nil
+	}
+
+	for i := range msgs {
+		var err error
+		if msgs[i].Value, _, err = s.values.open(msgs[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dataKeysResponse struct {
+	Keys []DataKeyInfo `json:"keys"`
+}
+
+// GetDataKeysHandler lists the data keys of a namespace.
+func (s *Server) GetDataKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	if s.values == nil || !s.values.Encrypts(ns) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotEncrypted, "values of the namespace are not encrypted")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dataKeysResponse{Keys: s.values.Keys(ns)})
+}
+
+// RotateDataKeyHandler gives a namespace a new data key. Values already
+// written stay sealed with the keys they were written with, which are kept,
+// until they are written again.
+func (s *Server) RotateDataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ns := r.PathValue("ns")
+
+	if s.values == nil || !s.values.Encrypts(ns) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNotEncrypted, "values of the namespace are not encrypted")
+		return
+	}
+	if !s.store.HasNamespace(ns) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchNamespace, ErrNoSuchNamespace.Error())
+		return
+	}
+
+	id, err := s.values.Rotate(r.Context(), ns)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to rotate data key", slog.String("namespace", ns), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, "failed to rotate data key")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "rotated data key", slog.String("namespace", ns), slog.String("key_id", id))
+	writeJSON(w, http.StatusOK, dataKeysResponse{Keys: s.values.Keys(ns)})
+}
+
+// openEntries opens the values of entries in place.
+func (v *ValueEncryption) openEntries(entries map[string]Entry) error {
+	for key, entry := range entries {
+		opened, err := v.openEntry(entry)
+		if err != nil {
+			return err
+		}
+		entries[key] = opened
+	}
+	return nil
+}
@@ -0,0 +1,520 @@
+package cavee
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// vaultSecretPrefix marks flag values that name a Vault secret rather than
+// holding the secret itself, as in
+//
+//	-tlog-key vault:secret/data/cavee#tlog_key
+//
+// where the path is the API path of the secret, so for the KV version 2
+// engine it includes data/, and the field follows the #.
+const vaultSecretPrefix = "vault:"
+
+const (
+	vaultTimeout = 10 * time.Second
+	// vaultRetryInterval is how long a failed renewal waits before it is
+	// tried again.
+	vaultRetryInterval = time.Minute
+)
+
+var ErrNoVault = errors.New("no vault configured")
+
+// VaultClient reads secrets from HashiCorp Vault through its HTTP API, and
+// keeps its token alive while it is used.
+type VaultClient struct {
+	addr string
+	// token is the Vault token, or empty if it is read from tokenFile, as
+	// written by Vault Agent, before every request. Agent renews the tokens
+	// it writes, so only tokens given directly are renewed here.
+	token     string
+	tokenFile string
+	client    *http.Client
+
+	renewToken sync.Once
+}
+
+// NewVaultClient returns a client for the Vault server at addr that
+// authenticates with token, or with the token read from tokenFile.
+func NewVaultClient(addr, token, tokenFile string) (*VaultClient, error) {
+	if token == "" && tokenFile == "" {
+		return nil, fmt.Errorf("no vault token configured")
+	}
+
+	return &VaultClient{
+		addr:      strings.TrimSuffix(addr, "/"),
+		token:     token,
+		tokenFile: tokenFile,
+		client:    &http.Client{Timeout: vaultTimeout},
+	}, nil
+}
+
+// vaultSecret is the response Vault sends for a secret.
+type vaultSecret struct {
+	LeaseID       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+}
+
+func (s *vaultSecret) lease() time.Duration {
+	return time.Duration(s.LeaseDuration) * time.Second
+}
+
+func (c *VaultClient) do(ctx context.Context, method, path string, body any) (*vaultSecret, error) {
+	c.renewToken.Do(func() {
+		if c.token != "" {
+			go c.renewTokenPeriodically()
+		}
+	})
+
+	token := c.token
+	if c.tokenFile != "" {
+		b, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+strings.TrimPrefix(path, "/"), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return nil, fmt.Errorf("vault %s %s: %s", method, path, strings.Join(vaultErr.Errors, "; "))
+		}
+		return nil, fmt.Errorf("vault %s %s: unexpected status %s", method, path, resp.Status)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return &vaultSecret{}, nil
+	}
+
+	var secret vaultSecret
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("vault %s %s: %w", method, path, err)
+	}
+	return &secret, nil
+}
+
+// Read returns the data of the secret at path. The data of KV version 2
+// secrets is returned without the metadata wrapped around it.
+func (c *VaultClient) Read(ctx context.Context, path string) (map[string]any, error) {
+	secret, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return secretData(secret), nil
+}
+
+func secretData(secret *vaultSecret) map[string]any {
+	if data, ok := secret.Data["data"].(map[string]any); ok {
+		if _, ok = secret.Data["metadata"]; ok {
+			return data
+		}
+	}
+	return secret.Data
+}
+
+// vaultField returns a string field of the data of a secret.
+func vaultField(data map[string]any, path, name string) (string, error) {
+	value, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, name)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of vault secret %s is not a string", name, path)
+	}
+	return s, nil
+}
+
+// renewTokenPeriodically renews the client's token at two thirds of its
+// TTL, for as long as the process runs. Tokens that are not renewable, such
+// as root tokens, which do not expire, are left alone.
+func (c *VaultClient) renewTokenPeriodically() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+		secret, err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", nil)
+		cancel()
+		if err != nil {
+			slog.Error("failed to look up vault token", slog.String("error", err.Error()))
+			time.Sleep(vaultRetryInterval)
+			continue
+		}
+
+		renewable, _ := secret.Data["renewable"].(bool)
+		ttl, _ := secret.Data["ttl"].(float64)
+		if !renewable || ttl == 0 {
+			return
+		}
+		time.Sleep(time.Duration(ttl) * time.Second * 2 / 3)
+
+		ctx, cancel = context.WithTimeout(context.Background(), vaultTimeout)
+		_, err = c.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]any{})
+		cancel()
+		if err != nil {
+			slog.Error("failed to renew vault token", slog.String("error", err.Error()))
+			time.Sleep(vaultRetryInterval)
+			continue
+		}
+		slog.Debug("renewed vault token")
+	}
+}
+
+// resolveSecret returns value, unless it names a Vault secret with
+// vaultSecretPrefix, in which case the secret is read from Vault.
+func resolveSecret(config *Config, value string) (string, error) {
+	ref, ok := strings.CutPrefix(value, vaultSecretPrefix)
+	if !ok {
+		return value, nil
+	}
+	if config.Vault == nil {
+		return "", fmt.Errorf("%w for secret %s", ErrNoVault, value)
+	}
+
+	path, name, ok := strings.Cut(ref, "#")
+	if !ok {
+		return "", fmt.Errorf("vault secret %s does not name a field after #", value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	data, err := config.Vault.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return vaultField(data, path, name)
+}
+
+// vaultCertificate is the TLS certificate the server is served with, as
+// issued by the Vault PKI engine or kept in a KV secret. It is fetched again
+// before it expires.
+type vaultCertificate struct {
+	vault *VaultClient
+	path  string
+	// commonName is the name certificates are issued for by the PKI
+	// engine, or empty if the certificate is read from a KV secret.
+	commonName string
+	// refresh is how often a certificate kept in a KV secret is read again.
+	refresh time.Duration
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newVaultCertificate(config *Config) (*vaultCertificate, error) {
+	if config.Vault == nil {
+		return nil, fmt.Errorf("%w for vault-tls-path", ErrNoVault)
+	}
+
+	c := &vaultCertificate{vault: config.Vault, path: config.VaultTLSPath, commonName: config.VaultTLSCommonName, refresh: config.VaultRefresh}
+	if err := c.fetch(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *vaultCertificate) fetch() error {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	var data map[string]any
+	if c.commonName != "" {
+		secret, err := c.vault.do(ctx, http.MethodPost, c.path, map[string]any{"common_name": c.commonName})
+		if err != nil {
+			return err
+		}
+		data = secret.Data
+	} else {
+		var err error
+		if data, err = c.vault.Read(ctx, c.path); err != nil {
+			return err
+		}
+	}
+
+	certPEM, err := vaultField(data, c.path, "certificate")
+	if err != nil {
+		return err
+	}
+	keyPEM, err := vaultField(data, c.path, "private_key")
+	if err != nil {
+		return err
+	}
+	// The PKI engine sends the certificates it was issued by apart from
+	// the one it issued.
+	if chain, ok := data["ca_chain"].([]any); ok {
+		for _, ca := range chain {
+			if pem, ok := ca.(string); ok {
+				certPEM += "\n" + pem
+			}
+		}
+	} else if ca, ok := data["issuing_ca"].(string); ok {
+		certPEM += "\n" + ca
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return fmt.Errorf("invalid certificate in vault secret %s: %w", c.path, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	slog.Info("loaded tls certificate from vault",
+		slog.String("path", c.path),
+		slog.String("subject", cert.Leaf.Subject.String()),
+		slog.Time("not_after", cert.Leaf.NotAfter),
+	)
+	return nil
+}
+
+func (c *vaultCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// next returns how long to wait before fetching the certificate again: two
+// thirds of the way through its validity, and for certificates in KV
+// secrets, no later than the refresh interval.
+func (c *vaultCertificate) next() time.Duration {
+	c.mu.RLock()
+	leaf := c.cert.Leaf
+	c.mu.RUnlock()
+
+	d := time.Until(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3))
+	if c.commonName == "" && c.refresh > 0 {
+		d = min(d, c.refresh)
+	}
+	return max(d, vaultRetryInterval)
+}
+
+// renew fetches the certificate again whenever it is due, until closing is
+// closed.
+func (c *vaultCertificate) renew(closing <-chan struct{}) {
+	timer := time.NewTimer(c.next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-timer.C:
+		}
+
+		if err := c.fetch(); err != nil {
+			slog.Error("failed to renew tls certificate from vault", slog.String("path", c.path), slog.String("error", err.Error()))
+			timer.Reset(vaultRetryInterval)
+			continue
+		}
+		timer.Reset(c.next())
+	}
+}
+
+// vaultMySQLConnector connects to MySQL with credentials issued by the
+// Vault database secrets engine. It renews their lease, and once Vault
+// will not renew it any further, has new credentials issued, which the
+// connections opened from then on use.
+type vaultMySQLConnector struct {
+	vault *VaultClient
+	path  string
+	cfg   *mysql.Config
+
+	mu         sync.Mutex
+	connector  driver.Connector
+	leaseID    string
+	leaseTotal time.Duration
+	lease      time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newVaultMySQLConnector has credentials issued from path, e.g.
+// database/creds/cavee, for the database dsn points to.
+func newVaultMySQLConnector(vault *VaultClient, path, dsn string) (*vaultMySQLConnector, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mysql dsn: %w", err)
+	}
+
+	c := &vaultMySQLConnector{vault: vault, path: path, cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+	if err = c.issue(); err != nil {
+		return nil, err
+	}
+	go c.renew()
+
+	return c, nil
+}
+
+// issue has new credentials issued.
+func (c *vaultMySQLConnector) issue() error {
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	secret, err := c.vault.do(ctx, http.MethodGet, c.path, nil)
+	if err != nil {
+		return err
+	}
+	username, err := vaultField(secret.Data, c.path, "username")
+	if err != nil {
+		return err
+	}
+	password, err := vaultField(secret.Data, c.path, "password")
+	if err != nil {
+		return err
+	}
+
+	cfg := c.cfg.Clone()
+	cfg.User, cfg.Passwd = username, password
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.connector, c.leaseID = connector, secret.LeaseID
+	c.leaseTotal, c.lease = secret.lease(), secret.lease()
+	c.mu.Unlock()
+
+	slog.Info("issued mysql credentials from vault", slog.String("path", c.path), slog.String("username", username), slog.Duration("lease", secret.lease()))
+	return nil
+}
+
+func (c *vaultMySQLConnector) renew() {
+	defer close(c.done)
+
+	for {
+		c.mu.Lock()
+		leaseID, lease, total := c.leaseID, c.lease, c.leaseTotal
+		c.mu.Unlock()
+		if lease == 0 {
+			// Static credentials do not expire.
+			return
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(lease * 2 / 3):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+		secret, err := c.vault.do(ctx, http.MethodPut, "sys/leases/renew", map[string]any{"lease_id": leaseID, "increment": int(total.Seconds())})
+		cancel()
+
+		// A lease close to its maximum TTL is only extended up to it, so
+		// once less than half of it is granted, credentials are issued
+		// anew while the current ones still work.
+		if err == nil && secret.lease() >= total/2 {
+			c.mu.Lock()
+			c.lease = secret.lease()
+			c.mu.Unlock()
+			slog.Debug("renewed mysql credentials lease", slog.String("lease_id", leaseID), slog.Duration("lease", secret.lease()))
+			continue
+		}
+		if err != nil {
+			slog.Warn("failed to renew mysql credentials lease", slog.String("lease_id", leaseID), slog.String("error", err.Error()))
+		}
+
+		if err = c.issue(); err != nil {
+			slog.Error("failed to issue mysql credentials from vault", slog.String("path", c.path), slog.String("error", err.Error()))
+			c.mu.Lock()
+			c.lease = vaultRetryInterval * 3 / 2
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *vaultMySQLConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	connector := c.connector
+	c.mu.Unlock()
+
+	return connector.Connect(ctx)
+}
+
+func (c *vaultMySQLConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
+// maxLifetime is how long connections are kept, so that they are reopened
+// with new credentials before the ones they were opened with are revoked.
+func (c *vaultMySQLConnector) maxLifetime() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.leaseTotal / 2
+}
+
+// Close stops renewing the credentials and revokes them. It is called when
+// the database is closed.
+func (c *vaultMySQLConnector) Close() error {
+	close(c.stop)
+	<-c.done
+
+	c.mu.Lock()
+	leaseID := c.leaseID
+	c.mu.Unlock()
+	if leaseID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	_, err := c.vault.do(ctx, http.MethodPut, "sys/leases/revoke", map[string]any{"lease_id": leaseID})
+	return err
+}
@@ -0,0 +1,437 @@
+package cavee
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownClient = errors.New("unknown tracking client")
+)
+
+const (
+	WatchMessagePut    = "put"
+	WatchMessageDelete = "delete"
+	// WatchMessageExpire is sent instead of a delete when a key is deleted
+	// because its TTL ran out.
+	WatchMessageExpire     = "expire"
+	WatchMessageInvalidate = "invalidate"
+	// WatchMessageDeletePrefix and WatchMessageDeleteTag are only sent when
+	// a watch resumes, for logged deletes of every key under the prefix, or
+	// with the tag, in Key: the log does not say which keys those were.
+	WatchMessageDeletePrefix = "delete_prefix"
+	WatchMessageDeleteTag    = "delete_tag"
+)
+
+type WatchMessage struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// Revision is the sequence number of the event the change was logged
+	// as, which a client passes as ?since= to resume watching after it.
+	// Invalidations have none.
+	Revision uint64 `json:"revision,omitempty"`
+}
+
+// readMessage prepares a watch message for a client as any other read of
+// its key. It reports false for a change to a key the pre-read hooks reject,
+// which the watch leaves out, and passes the value of a put through the
+// read transforms of ns.
+func (s *Server) readMessage(ctx context.Context, ns string, msg WatchMessage) (WatchMessage, bool, error) {
+	switch msg.Type {
+	case WatchMessagePut, WatchMessageDelete, WatchMessageExpire:
+		if s.runPreReadHooks(ctx, ns, msg.Key) != nil {
+			return msg, false, nil
+		}
+	}
+	if msg.Type != WatchMessagePut {
+		return msg, true, nil
+	}
+
+	var err error
+	msg.Value, err = s.readValue(ctx, ns, msg.Value)
+	return msg, true, err
+}
+
+type watchSubscriber struct {
+	id        string
+	namespace string
+	prefix    string
+	tracking  bool
+	messages  chan WatchMessage
+
+	// keys holds the keys this client has read while tracking is enabled, so
+	// they can be forgotten when the client goes away.
+	keys map[string]struct{}
+}
+
+// trackingKey identifies a key across namespaces in the tracking tables.
+func trackingKey(ns, key string) string {
+	return ns + "\x00" + key
+}
+
+// WatchHub fans out store changes to connected watch clients. Clients that
+// opt into tracking are not sent changes directly; instead the hub remembers
+// which keys each of them has read and pushes a single invalidation message
+// the next time one of those keys changes, after which the key has to be read
+// again to be tracked again.
+type WatchHub struct {
+	sync.Mutex
+	subscribers map[string]*watchSubscriber
+	tracking    map[string]map[string]struct{}
+}
+
+func NewWatchHub() *WatchHub {
+	return &WatchHub{
+		subscribers: make(map[string]*watchSubscriber),
+		tracking:    make(map[string]map[string]struct{}),
+	}
+}
+
+func (h *WatchHub) subscribe(ns, prefix string, tracking bool) (*watchSubscriber, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate client id: %w", err)
+	}
+
+	sub := &watchSubscriber{
+		id:        hex.EncodeToString(id),
+		namespace: ns,
+		prefix:    prefix,
+		tracking:  tracking,
+		messages:  make(chan WatchMessage, 64),
+		keys:      make(map[string]struct{}),
+	}
+
+	h.Lock()
+	h.subscribers[sub.id] = sub
+	h.Unlock()
+
+	return sub, nil
+}
+
+func (h *WatchHub) unsubscribe(sub *watchSubscriber) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.remove(sub)
+}
+
+// remove must be called with the lock held.
+func (h *WatchHub) remove(sub *watchSubscriber) {
+	if _, ok := h.subscribers[sub.id]; !ok {
+		return
+	}
+
+	for key := range sub.keys {
+		delete(h.tracking[key], sub.id)
+		if len(h.tracking[key]) == 0 {
+			delete(h.tracking, key)
+		}
+	}
+
+	delete(h.subscribers, sub.id)
+	close(sub.messages)
+}
+
+// Track records that the client has read key in namespace ns and should be
+// told when it changes. It must be called before the key is read from the
+// store so that a concurrent write can never slip in between the read and
+// the registration.
+func (h *WatchHub) Track(clientID, ns, key string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	sub, ok := h.subscribers[clientID]
+	if !ok || !sub.tracking || sub.namespace != ns {
+		return ErrUnknownClient
+	}
+	key = trackingKey(ns, key)
+
+	if h.tracking[key] == nil {
+		h.tracking[key] = make(map[string]struct{})
+	}
+	h.tracking[key][clientID] = struct{}{}
+	sub.keys[key] = struct{}{}
+
+	return nil
+}
+
+// Notify publishes a change to key to every interested client.
+func (h *WatchHub) Notify(e Event) {
+	msg := WatchMessage{Key: e.Key, Value: e.Value, Revision: e.Sequence}
+	switch e.Type {
+	case EventTypePut:
+		msg.Type = WatchMessagePut
+	case EventTypeDelete:
+		msg.Type = WatchMessageDelete
+	}
+
+	h.notify(e.Namespace, msg)
+}
+
+// NotifyExpired publishes the deletion of an expired key. Keys are only
+// deleted, and so only reported, once the expiry sweeper gets to them.
+func (h *WatchHub) NotifyExpired(e Event) {
+	h.notify(e.Namespace, WatchMessage{Type: WatchMessageExpire, Key: e.Key, Revision: e.Sequence})
+}
+
+func (h *WatchHub) notify(ns string, msg WatchMessage) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := trackingKey(ns, msg.Key)
+
+	for id := range h.tracking[key] {
+		sub := h.subscribers[id]
+		delete(sub.keys, key)
+		h.send(sub, WatchMessage{Type: WatchMessageInvalidate, Key: msg.Key})
+	}
+	delete(h.tracking, key)
+
+	for _, sub := range h.subscribers {
+		if sub.tracking || sub.namespace != ns || !strings.HasPrefix(msg.Key, sub.prefix) {
+			continue
+		}
+		h.send(sub, msg)
+	}
+}
+
+// send must be called with the lock held. A client that cannot keep up is
+// disconnected rather than silently missing messages, since a missed
+// invalidation would leave it serving stale data.
+func (h *WatchHub) send(sub *watchSubscriber, msg WatchMessage) {
+	select {
+	case sub.messages <- msg:
+	default:
+		slog.Warn("disconnecting slow watch client", slog.String("client_id", sub.id))
+		h.remove(sub)
+	}
+}
+
+// replayMessages turns a logged event into the messages a watcher of prefix
+// in the event's namespace is sent when resuming. Deletes of expired keys
+// are logged as plain deletes, and so replayed as such, and the value a
+// renamed key took to its new name is not logged, so its new key is
+// replayed as an invalidation, as is a key appended to, whose whole value is
+// not logged either.
+func replayMessages(e Event, prefix string) ([]WatchMessage, error) {
+	var msgs []WatchMessage
+	add := func(typ, key, value string) {
+		if strings.HasPrefix(key, prefix) {
+			msgs = append(msgs, WatchMessage{Type: typ, Key: key, Value: value, Revision: e.Sequence})
+		}
+	}
+
+	switch e.Type {
+	case EventTypePut:
+		add(WatchMessagePut, e.Key, e.Value)
+	case EventTypeDelete:
+		add(WatchMessageDelete, e.Key, "")
+	case EventTypeRename:
+		add(WatchMessageDelete, e.Key, "")
+		add(WatchMessageInvalidate, e.Value, "")
+	case EventTypeAppend:
+		add(WatchMessageInvalidate, e.Key, "")
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range writes {
+			if op.Op == txnOpPut {
+				add(WatchMessagePut, op.Key, op.Value)
+			} else {
+				add(WatchMessageDelete, op.Key, "")
+			}
+		}
+	case EventTypeDeletePrefix:
+		if strings.HasPrefix(e.Key, prefix) || strings.HasPrefix(prefix, e.Key) {
+			msgs = append(msgs, WatchMessage{Type: WatchMessageDeletePrefix, Key: e.Key, Revision: e.Sequence})
+		}
+	case EventTypeDeleteTag:
+		msgs = append(msgs, WatchMessage{Type: WatchMessageDeleteTag, Key: e.Key, Revision: e.Sequence})
+	}
+
+	return msgs, nil
+}
+
+// WatchHandler streams the changes to the keys of a namespace under
+// ?prefix= as server-sent events. With ?since= set to the revision of the
+// last change a client saw, the changes logged after it are replayed from
+// the transaction log first, so a client that reconnects misses nothing.
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	tracking := r.URL.Query().Get("tracking") == "true"
+
+	ns := r.PathValue("ns")
+	if !s.store.HasNamespace(ns) {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchNamespace, ErrNoSuchNamespace.Error())
+		return
+	}
+
+	var since uint64
+	var history HistoryReader
+	resume := r.URL.Query().Has("since")
+	if resume {
+		var err error
+		if since, err = strconv.ParseUint(r.URL.Query().Get("since"), 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "since must be a revision")
+			return
+		}
+		if tracking {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "since cannot be used with tracking")
+			return
+		}
+		var ok bool
+		if history, ok = s.transact.(HistoryReader); !ok {
+			writeError(w, r, http.StatusNotImplemented, ErrorCodeNotSupported, "the transaction log cannot be read back to resume watches")
+			return
+		}
+	}
+
+	sub, err := s.watchHub.subscribe(ns, prefix, tracking)
+	if err != nil {
+		slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+		writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+		return
+	}
+	defer s.watchHub.unsubscribe(sub)
+
+	// Every change sent to the watchers before they subscribed was logged by
+	// now, so replaying up to here and skipping the live messages up to here
+	// sends each change once.
+	until := s.lastSequence()
+	if resume && since < until {
+		found := false
+		err = history.ReadEventsBetween(r.Context(), since, since+1, func(e Event) error {
+			found = e.Sequence == since+1
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), ErrInternalServerError.Error(), slog.String("error", err.Error()))
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, ErrInternalServerError.Error())
+			return
+		}
+		if !found {
+			writeError(w, r, http.StatusGone, ErrorCodeHistoryUnavailable, fmt.Sprintf("the transaction log no longer holds the events after %d", since))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Cavee-Client-ID", sub.id)
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeSSE(w, "hello", map[string]any{"client_id": sub.id, "tracking": tracking}); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "watch stream does not support flushing", slog.String("error", err.Error()))
+		return
+	}
+
+	if resume && since < until {
+		next := since + 1
+		err = history.ReadEventsBetween(r.Context(), since, until, func(e Event) error {
+			if e.Sequence != next {
+				return fmt.Errorf("transaction log skips from %d to %d", next-1, e.Sequence)
+			}
+			next++
+
+			if e.Namespace != ns {
+				return nil
+			}
+			msgs, err := replayMessages(e, prefix)
+			if err == nil {
+				err = s.openMessages(msgs)
+			}
+			if err != nil {
+				return err
+			}
+			for _, msg := range msgs {
+				var ok bool
+				if msg, ok, err = s.readMessage(r.Context(), ns, msg); err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if err = writeSSE(w, msg.Type, msg); err != nil {
+					return err
+				}
+			}
+			return rc.Flush()
+		})
+		if err == nil && next <= until {
+			err = fmt.Errorf("transaction log ends at %d", next-1)
+		}
+		if err != nil {
+			if r.Context().Err() == nil {
+				slog.WarnContext(r.Context(), "failed to replay watch", slog.Uint64("since", since), slog.String("error", err.Error()))
+			}
+			return
+		}
+	}
+	skip := max(since, until)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case msg, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			if resume && msg.Revision <= skip {
+				continue
+			}
+			msg, ok, err := s.readMessage(r.Context(), ns, msg)
+			if err != nil {
+				return
+			}
+			if !ok {
+				continue
+			}
+			if err = writeSSE(w, msg.Type, msg); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
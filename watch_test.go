@@ -0,0 +1,106 @@
+package cavee_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// watchStream reads the messages of a watch, skipping its hello.
+type watchStream struct {
+	scanner *bufio.Scanner
+}
+
+func openWatch(t *testing.T, inst *caveetest.Instance, query string) *watchStream {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, inst.URL+"/v1/watch?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := inst.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch answered %d, want 200", resp.StatusCode)
+	}
+
+	w := &watchStream{scanner: bufio.NewScanner(resp.Body)}
+	if msg := w.next(t); msg.Type != "hello" {
+		t.Fatalf("watch started with %+v, want hello", msg)
+	}
+	return w
+}
+
+// next returns the next message of the watch. The hello has only its type
+// set.
+func (w *watchStream) next(t *testing.T) cavee.WatchMessage {
+	t.Helper()
+
+	var event string
+	for w.scanner.Scan() {
+		line := w.scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "hello":
+			return cavee.WatchMessage{Type: event}
+		case strings.HasPrefix(line, "data: "):
+			var msg cavee.WatchMessage
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatalf("invalid watch message %q: %v", line, err)
+			}
+			return msg
+		}
+	}
+	t.Fatalf("watch ended: %v", w.scanner.Err())
+	return cavee.WatchMessage{}
+}
+
+func TestWatchResume(t *testing.T) {
+	inst := caveetest.Start(t)
+
+	mustRequest(t, inst, http.MethodPut, "/v1/key/app-a", "1", http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/other", "x", http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/app-b", "2", http.StatusCreated)
+	mustRequest(t, inst, http.MethodDelete, "/v1/key/app-a", "", http.StatusNoContent)
+
+	// Resuming after the first change replays the later changes under the
+	// prefix, then carries on with live ones, sending each once.
+	w := openWatch(t, inst, "prefix=app-&since=1")
+	mustRequest(t, inst, http.MethodPut, "/v1/key/app-c", "3", http.StatusCreated)
+
+	for _, want := range []cavee.WatchMessage{
+		{Type: cavee.WatchMessagePut, Key: "app-b", Value: "2", Revision: 3},
+		{Type: cavee.WatchMessageDelete, Key: "app-a", Revision: 4},
+		{Type: cavee.WatchMessagePut, Key: "app-c", Value: "3", Revision: 5},
+	} {
+		if msg := w.next(t); msg != want {
+			t.Errorf("watch sent %+v, want %+v", msg, want)
+		}
+	}
+
+	// A watch resuming from the last revision only gets live changes.
+	w = openWatch(t, inst, "prefix=app-&since=5")
+	mustRequest(t, inst, http.MethodPut, "/v1/key/app-d", "4", http.StatusCreated)
+	if msg, want := w.next(t), (cavee.WatchMessage{Type: cavee.WatchMessagePut, Key: "app-d", Value: "4", Revision: 6}); msg != want {
+		t.Errorf("watch sent %+v, want %+v", msg, want)
+	}
+
+	resp, b := doRequest(t, inst, http.MethodGet, "/v1/watch?since=latest", "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("watch with an invalid since answered %d, want 400: %s", resp.StatusCode, b)
+	}
+}
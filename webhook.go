@@ -0,0 +1,294 @@
+package cavee
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// webhookQueueSize is the number of events a webhook can fall behind by
+	// before further events are dropped.
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+	webhookAttempts  = 6
+	// Failed deliveries are retried after webhookMinBackoff, doubling up to
+	// webhookMaxBackoff.
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 30 * time.Second
+)
+
+// WebhookConfig is a webhook in a webhooks file. Changes to keys in the
+// namespace that start with the prefix are POSTed to the URL.
+type WebhookConfig struct {
+	URL       string `yaml:"url"`
+	Namespace string `yaml:"namespace"`
+	Prefix    string `yaml:"prefix"`
+	// Secret, if set, is used to sign deliveries with HMAC-SHA256. It may
+	// reference environment variables as $VAR or ${VAR}.
+	Secret string `yaml:"secret"`
+}
+
+type WebhooksFile struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+}
+
+func LoadWebhooksFile(filename string) (*WebhooksFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhooks file: %w", err)
+	}
+
+	var f WebhooksFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse webhooks file: %w", err)
+	}
+
+	return &f, nil
+}
+
+// WebhookEvent is the body of a webhook delivery.
+type WebhookEvent struct {
+	Sequence    uint64    `json:"sequence"`
+	Type        string    `json:"type"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key"`
+	Value       string    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Webhooks delivers key changes to the configured webhooks. Each webhook
+// has a queue and a goroutine of its own, so a slow or failing endpoint
+// holds up neither writes nor the other webhooks. Deliveries to a webhook
+// are made in order, and each is retried with backoff before it is given
+// up on.
+type Webhooks struct {
+	hooks []*webhook
+	wg    sync.WaitGroup
+	// stop is closed to cut retries short on shutdown.
+	stop chan struct{}
+}
+
+type webhook struct {
+	config WebhookConfig
+	secret []byte
+	events chan WebhookEvent
+	client *http.Client
+}
+
+func NewWebhooks(configs []WebhookConfig) (*Webhooks, error) {
+	w := &Webhooks{stop: make(chan struct{})}
+
+	for _, config := range configs {
+		u, err := url.Parse(config.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url: %q must be an absolute http or https url", config.URL)
+		}
+
+		w.hooks = append(w.hooks, &webhook{
+			config: config,
+			secret: []byte(os.ExpandEnv(config.Secret)),
+			events: make(chan WebhookEvent, webhookQueueSize),
+			client: &http.Client{Timeout: webhookTimeout},
+		})
+	}
+
+	for _, hook := range w.hooks {
+		w.wg.Add(1)
+		go w.deliver(hook)
+	}
+
+	return w, nil
+}
+
+// Notify queues an event for the webhooks it matches. Events are dropped,
+// with a warning, for webhooks that have fallen too far behind.
+func (w *Webhooks) Notify(e WebhookEvent) {
+	for _, hook := range w.hooks {
+		if hook.config.Namespace != e.Namespace || !strings.HasPrefix(e.Key, hook.config.Prefix) {
+			continue
+		}
+
+		select {
+		case hook.events <- e:
+		default:
+			slog.Warn("dropping webhook event, delivery is falling behind",
+				slog.String("url", hook.config.URL),
+				slog.Uint64("sequence", e.Sequence),
+			)
+		}
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be
+// delivered, until ctx is done.
+func (w *Webhooks) Close(ctx context.Context) error {
+	for _, hook := range w.hooks {
+		close(hook.events)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(w.stop)
+		return fmt.Errorf("failed to deliver queued webhook events: %w", ctx.Err())
+	}
+}
+
+func (w *Webhooks) deliver(hook *webhook) {
+	defer w.wg.Done()
+
+	for e := range hook.events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			slog.Error("failed to encode webhook event", slog.String("error", err.Error()))
+			continue
+		}
+
+		backoff := webhookMinBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := hook.post(e.Type, body)
+			if err == nil {
+				break
+			}
+
+			if !retry || attempt == webhookAttempts {
+				slog.Error("failed to deliver webhook event",
+					slog.String("url", hook.config.URL),
+					slog.Uint64("sequence", e.Sequence),
+					slog.Int("attempts", attempt),
+					slog.String("error", err.Error()),
+				)
+				break
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-w.stop:
+				return
+			}
+			backoff = min(2*backoff, webhookMaxBackoff)
+		}
+	}
+}
+
+// post makes one delivery attempt, and reports whether it is worth retrying
+// if it fails.
+func (hook *webhook) post(eventType string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, hook.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cavee-Event", eventType)
+	if len(hook.secret) > 0 {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(body)
+		req.Header.Set("X-Cavee-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("webhook responded with %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+}
+
+// notify publishes a change to a key that has been logged and applied to
+// the watch stream, the post-write hooks and the webhooks.
+func (s *Server) notify(e Event) {
+	if s.values != nil && e.Type == EventTypePut {
+		// Values are logged sealed, and only watchers and the like are
+		// handed them opened.
+		var err error
+		if e.Value, _, err = s.values.open(e.Value); err != nil {
+			slog.Error("failed to open value of written key", slog.String("namespace", e.Namespace), slog.String("key", e.Key), slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	s.watchHub.Notify(e)
+	for _, hook := range s.hooks.postWrite {
+		hook(e)
+	}
+
+	if s.access != nil {
+		switch e.Type {
+		case EventTypePut:
+			s.access.write(e.Namespace, e.Key, e.Time)
+		case EventTypeDelete:
+			s.access.forget(e.Namespace, e.Key)
+		}
+	}
+	if s.search != nil {
+		switch e.Type {
+		case EventTypePut:
+			s.search.update(e.Namespace, e.Key, &e.Value)
+		case EventTypeDelete:
+			s.search.update(e.Namespace, e.Key, nil)
+		}
+	}
+
+	if s.webhooks != nil {
+		event := WebhookEvent{Sequence: e.Sequence, Namespace: e.Namespace, Key: e.Key, Value: e.Value, ContentType: e.ContentType, Time: e.Time}
+		switch e.Type {
+		case EventTypePut:
+			event.Type = WatchMessagePut
+		case EventTypeDelete:
+			event.Type = WatchMessageDelete
+		}
+		s.webhooks.Notify(event)
+	}
+}
+
+// notifyExpired publishes the deletion of an expired key.
+func (s *Server) notifyExpired(e Event) {
+	s.watchHub.NotifyExpired(e)
+	for _, hook := range s.hooks.postWrite {
+		hook(e)
+	}
+
+	if s.access != nil {
+		s.access.forget(e.Namespace, e.Key)
+	}
+	if s.search != nil {
+		s.search.update(e.Namespace, e.Key, nil)
+	}
+
+	if s.webhooks != nil {
+		s.webhooks.Notify(WebhookEvent{Sequence: e.Sequence, Type: WatchMessageExpire, Namespace: e.Namespace, Key: e.Key, Time: e.Time})
+	}
+}
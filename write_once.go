@@ -0,0 +1,221 @@
+package cavee
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WriteOnceConfig makes keys of a namespace write-once in a write-once file:
+// the key named by Key, or every key starting with Prefix if Key is empty.
+// Once such a key is written, it can be neither written again nor deleted
+// until Retention has passed since it was created, or ever if Retention is 0.
+type WriteOnceConfig struct {
+	Namespace string        `yaml:"namespace"`
+	Key       string        `yaml:"key"`
+	Prefix    string        `yaml:"prefix"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type WriteOnceFile struct {
+	Rules []WriteOnceConfig `yaml:"write_once"`
+}
+
+func LoadWriteOnceFile(filename string) (*WriteOnceFile, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-once file: %w", err)
+	}
+
+	var f WriteOnceFile
+	if err = yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse write-once file: %w", err)
+	}
+
+	for _, rule := range f.Rules {
+		if rule.Key != "" && rule.Prefix != "" {
+			return nil, fmt.Errorf("write-once rule of namespace %q must have a key or a prefix, not both", rule.Namespace)
+		}
+		if rule.Retention < 0 {
+			return nil, fmt.Errorf("write-once rule of namespace %q must not have a negative retention", rule.Namespace)
+		}
+	}
+
+	return &f, nil
+}
+
+// WriteOnce holds the write-once rules of each namespace.
+type WriteOnce struct {
+	namespaces map[string][]WriteOnceConfig
+}
+
+// NewWriteOnce returns the write-once rules of a write-once file, by
+// namespace.
+func NewWriteOnce(rules []WriteOnceConfig) *WriteOnce {
+	w := &WriteOnce{namespaces: make(map[string][]WriteOnceConfig)}
+	for _, rule := range rules {
+		w.namespaces[rule.Namespace] = append(w.namespaces[rule.Namespace], rule)
+	}
+	return w
+}
+
+// lockedUntil reports whether a key created at the given time is still
+// kept from changing at now, and until when, which is zero for keys kept
+// forever. The longest retention of the rules matching the key wins. Keys
+// replayed from logs that predate timestamps count as created at the zero
+// time, so only rules without a retention keep them.
+func (w *WriteOnce) lockedUntil(ns, key string, created, now time.Time) (until time.Time, locked bool) {
+	for _, rule := range w.namespaces[ns] {
+		if rule.Key != "" && key != rule.Key || rule.Key == "" && !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		if rule.Retention == 0 {
+			return time.Time{}, true
+		}
+		if end := created.Add(rule.Retention); now.Before(end) && end.After(until) {
+			until, locked = end, true
+		}
+	}
+	return until, locked
+}
+
+// ErrWriteOnce is returned, wrapped in a WriteOnceError, for writes that
+// would change or delete a write-once key.
+var ErrWriteOnce = errors.New("key is write-once")
+
+// WriteOnceError names the write-once key a write was rejected for.
+type WriteOnceError struct {
+	Namespace string
+	Key       string
+	// Until is when the key can be changed, or zero if it never can.
+	Until time.Time
+}
+
+func (e *WriteOnceError) Error() string {
+	if e.Until.IsZero() {
+		return fmt.Sprintf("key %q is write-once", e.Key)
+	}
+	return fmt.Sprintf("key %q is write-once until %s", e.Key, e.Until.UTC().Format(time.RFC3339))
+}
+
+func (e *WriteOnceError) Unwrap() error {
+	return ErrWriteOnce
+}
+
+// checkLocked fails with a WriteOnceError if an event would change or
+// delete an existing key that w keeps from changing. Keys that have expired
+// are left out, since they are already treated as deleted. Persisting a key
+// leaves it as it is, so it is allowed, unlike giving it an expiry, which
+// renames and txn puts creating a locked key cannot do either.
+func (s *Store) checkLocked(w *WriteOnce, e Event) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	m := s.namespaces[e.Namespace]
+	now := time.Now()
+	check := func(key string) error {
+		entry, exists := m[key]
+		if !exists || entry.expired(now) {
+			return nil
+		}
+		if until, locked := w.lockedUntil(e.Namespace, key, entry.Created, now); locked {
+			return &WriteOnceError{Namespace: e.Namespace, Key: key, Until: until}
+		}
+		return nil
+	}
+	// A key created with an expiry would be deleted by the sweeper before
+	// its retention passes, so one cannot be created where keys are locked.
+	checkExpiry := func(key string) error {
+		if until, locked := w.lockedUntil(e.Namespace, key, now, now); locked {
+			return &WriteOnceError{Namespace: e.Namespace, Key: key, Until: until}
+		}
+		return nil
+	}
+	checkAll := func(matches func(key string, entry Entry) bool) error {
+		for key, entry := range m {
+			if matches(key, entry) {
+				if err := check(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	switch e.Type {
+	case EventTypePut, EventTypeAppend, EventTypeDelete, EventTypeExpire:
+		return check(e.Key)
+	case EventTypeRename:
+		if err := check(e.Key); err != nil {
+			return err
+		}
+		if err := check(e.Value); err != nil {
+			return err
+		}
+		if entry, exists := m[e.Key]; exists && !entry.ExpiresAt.IsZero() && !entry.expired(now) {
+			return checkExpiry(e.Value)
+		}
+	case EventTypeDeletePrefix:
+		return checkAll(func(key string, _ Entry) bool {
+			return strings.HasPrefix(key, e.Key)
+		})
+	case EventTypeDeleteTag:
+		return checkAll(func(_ string, entry Entry) bool {
+			_, found := slices.BinarySearch(entry.Tags, e.Key)
+			return found
+		})
+	case EventTypeNamespaceDrop:
+		return checkAll(func(string, Entry) bool { return true })
+	case EventTypeTxn:
+		writes, err := decodeTxnWrites(e.Value)
+		if err != nil {
+			return err
+		}
+		for _, op := range writes {
+			if err = check(op.Key); err != nil {
+				return err
+			}
+			if op.Op == txnOpPut && op.ExpiresAt != nil {
+				if err = checkExpiry(op.Key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkWriteOnce fails if an event would change or delete a write-once key.
+// Creating a key is allowed, unless it would be created with an expiry. The
+// caller holds the locks of the keys written, so that a key checked cannot
+// be created before the event is logged.
+func (s *Server) checkWriteOnce(e Event) error {
+	if s.writeOnce == nil || len(s.writeOnce.namespaces[e.Namespace]) == 0 {
+		return nil
+	}
+	return s.store.checkLocked(s.writeOnce, e)
+}
+
+// writeWriteOnceError reports a write rejected for changing a write-once
+// key, if err is one, and reports whether it was.
+func writeWriteOnceError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var writeOnceErr *WriteOnceError
+	if !errors.As(err, &writeOnceErr) {
+		return false
+	}
+
+	writeJSON(w, http.StatusConflict, ErrorResponse{
+		Code:      ErrorCodeWriteOnce,
+		Message:   writeOnceErr.Error(),
+		Key:       writeOnceErr.Key,
+		RequestID: r.Header.Get(requestIDHeader),
+	})
+	return true
+}
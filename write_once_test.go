@@ -0,0 +1,38 @@
+package cavee_test
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nayyara-airlangga/cavee"
+	"github.com/nayyara-airlangga/cavee/caveetest"
+)
+
+// A key cannot be created with an expiry where keys are write-once, since
+// the expiry would delete it before its retention passes.
+func TestWriteOnceExpiry(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"write_once.yaml": "write_once:\n  - namespace: \"\"\n    prefix: audit-\n    retention: 1h\n",
+	})
+	inst := caveetest.Start(t, func(c *cavee.Config) {
+		c.WriteOnceFile = filepath.Join(dir, "write_once.yaml")
+	})
+
+	mustRequest(t, inst, http.MethodPut, "/v1/key/temp", "v", http.StatusCreated)
+	mustRequest(t, inst, http.MethodPut, "/v1/key/temp/ttl", `{"ttl": 60}`, http.StatusOK)
+	mustFail(t, inst, http.MethodPost, "/v1/key/temp/rename", `{"destination":"audit-renamed"}`, http.StatusConflict, cavee.ErrorCodeWriteOnce)
+
+	expiresAt := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	mustFail(t, inst, http.MethodPost, "/v1/txn", `{"then":[{"op":"put","key":"audit-txn","value":"v","expires_at":"`+expiresAt+`"}]}`, http.StatusConflict, cavee.ErrorCodeWriteOnce)
+
+	for _, key := range []string{"audit-renamed", "audit-txn"} {
+		mustRequest(t, inst, http.MethodGet, "/v1/key/"+key, "", http.StatusNotFound)
+	}
+
+	// Keys without an expiry can still be moved and written there.
+	mustRequest(t, inst, http.MethodDelete, "/v1/key/temp/ttl", "", http.StatusNoContent)
+	mustRequest(t, inst, http.MethodPost, "/v1/key/temp/rename", `{"destination":"audit-renamed"}`, http.StatusNoContent)
+	mustRequest(t, inst, http.MethodPost, "/v1/txn", `{"then":[{"op":"put","key":"audit-txn","value":"v"}]}`, http.StatusOK)
+}
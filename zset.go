@@ -0,0 +1,436 @@
+package cavee
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sortedSetContentType is the content type of keys holding sorted sets,
+// whose values are JSON arrays of their members with their scores, in
+// order of score and, for equal scores, of member.
+const sortedSetContentType = "application/vnd.cavee.sorted-set+json"
+
+type scoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func compareScored(a, b scoredMember) int {
+	return cmp.Or(cmp.Compare(a.Score, b.Score), strings.Compare(a.Member, b.Member))
+}
+
+type sortedSet []scoredMember
+
+func decodeSortedSet(entry Entry) (sortedSet, error) {
+	var members sortedSet
+	if err := json.Unmarshal([]byte(entry.Value), &members); err != nil {
+		return nil, fmt.Errorf("invalid sorted set: %w", err)
+	}
+	return members, nil
+}
+
+// encode returns the value of a key holding the sorted set, or an empty one
+// if it is empty, since an empty sorted set is kept as no key at all.
+func (zs sortedSet) encode() (string, error) {
+	if len(zs) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(zs)
+	return string(b), err
+}
+
+// rank returns the position of a member in score order, or -1 if the set
+// does not hold it.
+func (zs sortedSet) rank(member string) int {
+	return slices.IndexFunc(zs, func(m scoredMember) bool { return m.Member == member })
+}
+
+// add sets the score of a member, reporting whether it was not there yet.
+func (zs *sortedSet) add(member string, score float64) bool {
+	i := zs.rank(member)
+	if i >= 0 {
+		*zs = slices.Delete(*zs, i, i+1)
+	}
+
+	m := scoredMember{Member: member, Score: score}
+	j, _ := slices.BinarySearchFunc(*zs, m, compareScored)
+	*zs = slices.Insert(*zs, j, m)
+
+	return i < 0
+}
+
+// remove removes a member, reporting whether it was there.
+func (zs *sortedSet) remove(member string) bool {
+	i := zs.rank(member)
+	if i >= 0 {
+		*zs = slices.Delete(*zs, i, i+1)
+	}
+	return i >= 0
+}
+
+// scoreBound is an end of a range of scores. As in Redis, a bound starting
+// with ( leaves out the score itself, and -inf and +inf are unbounded.
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string, unbounded float64) (scoreBound, error) {
+	if s == "" {
+		return scoreBound{score: unbounded}, nil
+	}
+
+	raw, exclusive := strings.CutPrefix(s, "(")
+	score, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(score) {
+		return scoreBound{}, fmt.Errorf("invalid score bound %q", s)
+	}
+
+	return scoreBound{score: score, exclusive: exclusive}, nil
+}
+
+func (b scoreBound) above(score float64) bool {
+	return score > b.score || (!b.exclusive && score == b.score)
+}
+
+func (b scoreBound) below(score float64) bool {
+	return score < b.score || (!b.exclusive && score == b.score)
+}
+
+type sortedSetRangeResponse struct {
+	Members     sortedSet `json:"members"`
+	Cardinality int       `json:"cardinality"`
+}
+
+type scoreResponse struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	// Rank is the position of the member counting from the lowest score,
+	// or from the highest with ?reverse=true, from 0.
+	Rank int `json:"rank"`
+}
+
+type sortedSetUpdateRequest struct {
+	Add    map[string]float64 `json:"add"`
+	Remove []string           `json:"remove"`
+}
+
+type sortedSetUpdateResponse struct {
+	Added       int `json:"added"`
+	Updated     int `json:"updated"`
+	Removed     int `json:"removed"`
+	Cardinality int `json:"cardinality"`
+}
+
+type popResponse struct {
+	Members sortedSet `json:"members"`
+}
+
+// getSortedSet returns the sorted set a key holds, which is empty if the key
+// does not exist, along with its entry.
+func (s *Server) getSortedSet(r *http.Request, ns, key string) (sortedSet, Entry, error) {
+	entry, exists, err := s.getTyped(r, ns, key, sortedSetContentType)
+	if err != nil || !exists {
+		return sortedSet{}, Entry{}, err
+	}
+
+	members, err := decodeSortedSet(entry)
+	return members, entry, err
+}
+
+// parseReverse parses ?reverse=, writing the error response if it is
+// invalid.
+func parseReverse(w http.ResponseWriter, r *http.Request) (reverse, ok bool) {
+	switch r.URL.Query().Get("reverse") {
+	case "", "false":
+		return false, true
+	case "true":
+		return true, true
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "reverse must be true or false")
+		return false, false
+	}
+}
+
+// GetScoresHandler sends the members of the sorted set a key holds whose
+// scores are within ?min= and ?max=, lowest score first or, with
+// ?reverse=true, highest first, up to ?limit= of them. Bounds starting with
+// ( are exclusive. Cardinality counts every member of the set.
+func (s *Server) GetScoresHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	lower, err := parseScoreBound(r.URL.Query().Get("min"), math.Inf(-1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	upper, err := parseScoreBound(r.URL.Query().Get("max"), math.Inf(1))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	limit := -1
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "limit must be a non-negative number")
+			return
+		}
+	}
+	reverse, ok := parseReverse(w, r)
+	if !ok {
+		return
+	}
+
+	members, _, err := s.getSortedSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	resp := sortedSetRangeResponse{Members: sortedSet{}, Cardinality: len(members)}
+	if reverse {
+		members = slices.Clone(members)
+		slices.Reverse(members)
+	}
+	for _, m := range members {
+		if limit >= 0 && len(resp.Members) == limit {
+			break
+		}
+		if lower.above(m.Score) && upper.below(m.Score) {
+			resp.Members = append(resp.Members, m)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetScoreHandler sends the score and rank of a member of the sorted set a
+// key holds.
+func (s *Server) GetScoreHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, member := r.PathValue("ns"), r.PathValue("key"), r.PathValue("member")
+
+	if err := s.runPreReadHooks(r.Context(), ns, key); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	reverse, ok := parseReverse(w, r)
+	if !ok {
+		return
+	}
+
+	members, _, err := s.getSortedSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	rank := members.rank(member)
+	if rank < 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchMember, "sorted set has no member "+member)
+		return
+	}
+
+	resp := scoreResponse{Member: member, Score: members[rank].Score, Rank: rank}
+	if reverse {
+		resp.Rank = len(members) - 1 - rank
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// PutScoreHandler sets the score of a member of the sorted set a key holds
+// to the number in the body, adding the member, and creating the key, if
+// needed. It answers 201 if the member was added and 204 if its score was
+// replaced.
+func (s *Server) PutScoreHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, member := r.PathValue("ns"), r.PathValue("key"), r.PathValue("member")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	score, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "body must be a score")
+		return
+	}
+
+	resp, ok := s.updateSortedSet(w, r, ns, key, sortedSetUpdateRequest{Add: map[string]float64{member: score}})
+	if !ok {
+		return
+	}
+	if resp.Added == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DeleteScoreHandler removes a member from the sorted set a key holds,
+// deleting the key once the set is empty. It answers 404 if the set has no
+// such member.
+func (s *Server) DeleteScoreHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key, member := r.PathValue("ns"), r.PathValue("key"), r.PathValue("member")
+
+	resp, ok := s.updateSortedSet(w, r, ns, key, sortedSetUpdateRequest{Remove: []string{member}})
+	if !ok {
+		return
+	}
+	if resp.Removed == 0 {
+		writeError(w, r, http.StatusNotFound, ErrorCodeNoSuchMember, "sorted set has no member "+member)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateScoresHandler adds members to, or sets the scores of members of,
+// and removes members from the sorted set a key holds in a single write,
+// taking {"add": {"member": score, ...}, "remove": [...]}. Members are
+// added before others are removed.
+func (s *Server) UpdateScoresHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req sortedSetUpdateRequest
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	resp, ok := s.updateSortedSet(w, r, ns, key, req)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateSortedSet adds and removes members of a sorted set, writing it back
+// only if it changed, and writing the error response if it fails.
+func (s *Server) updateSortedSet(w http.ResponseWriter, r *http.Request, ns, key string, req sortedSetUpdateRequest) (sortedSetUpdateResponse, bool) {
+	for member, score := range req.Add {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "score of "+member+" must be a finite number")
+			return sortedSetUpdateResponse{}, false
+		}
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	members, current, err := s.getSortedSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return sortedSetUpdateResponse{}, false
+	}
+
+	var resp sortedSetUpdateResponse
+	changed := false
+	for member, score := range req.Add {
+		if i := members.rank(member); i >= 0 && members[i].Score == score {
+			resp.Updated++
+			continue
+		}
+		if members.add(member, score) {
+			resp.Added++
+		} else {
+			resp.Updated++
+		}
+		changed = true
+	}
+	for _, member := range req.Remove {
+		if members.remove(member) {
+			resp.Removed++
+			changed = true
+		}
+	}
+	resp.Cardinality = len(members)
+
+	if changed && !s.writeSortedSet(w, r, ns, key, current, members) {
+		return sortedSetUpdateResponse{}, false
+	}
+
+	return resp, true
+}
+
+func (s *Server) writeSortedSet(w http.ResponseWriter, r *http.Request, ns, key string, current Entry, members sortedSet) bool {
+	value, err := members.encode()
+	if err != nil {
+		writeStoreError(w, r, err)
+		return false
+	}
+
+	_, ok := s.writeTyped(w, r, ns, key, current, value, sortedSetContentType)
+	return ok
+}
+
+// PopScoresHandler removes and sends the ?count= members, 1 by default, with
+// the lowest scores of the sorted set a key holds or, with ?from=max, the
+// highest, in the order they were popped. A set with fewer members gives up
+// all it has.
+func (s *Server) PopScoresHandler(w http.ResponseWriter, r *http.Request) {
+	ns, key := r.PathValue("ns"), r.PathValue("key")
+
+	fromMax := false
+	switch r.URL.Query().Get("from") {
+	case "", "min":
+	case "max":
+		fromMax = true
+	default:
+		writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "from must be min or max")
+		return
+	}
+	count := 1
+	if raw := r.URL.Query().Get("count"); raw != "" {
+		var err error
+		if count, err = strconv.Atoi(raw); err != nil || count < 1 {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeInvalidRequest, "count must be a positive number")
+			return
+		}
+	}
+
+	unlock := s.store.LockKey(ns, key)
+	defer unlock()
+
+	members, current, err := s.getSortedSet(r, ns, key)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	count = min(count, len(members))
+	var popped sortedSet
+	if fromMax {
+		popped = slices.Clone(members[len(members)-count:])
+		slices.Reverse(popped)
+		members = members[:len(members)-count]
+	} else {
+		popped = slices.Clone(members[:count])
+		members = members[count:]
+	}
+
+	if len(popped) > 0 && !s.writeSortedSet(w, r, ns, key, current, members) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, popResponse{Members: append(sortedSet{}, popped...)})
+}